@@ -0,0 +1,85 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ByteSize is a number of bytes written with a unit, like 10MB. The units go
+// in powers of 1024, as in Prometheus, KB and KiB are the same.
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	name string
+	n    int64
+}{
+	{"B", 1},
+	{"KB", 1 << 10},
+	{"KiB", 1 << 10},
+	{"MB", 1 << 20},
+	{"MiB", 1 << 20},
+	{"GB", 1 << 30},
+	{"GiB", 1 << 30},
+	{"TB", 1 << 40},
+	{"TiB", 1 << 40},
+}
+
+func ParseByteSize(s string) (ByteSize, error) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i == 0 {
+		return 0, fmt.Errorf("not a valid byte size: %q", s)
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("not a valid byte size: %q", s)
+	}
+
+	unit := strings.TrimSpace(s[i:])
+	if unit == "" {
+		return ByteSize(n), nil
+	}
+	for _, u := range byteSizeUnits {
+		if u.name == unit {
+			if n > (1<<63-1)/u.n {
+				return 0, fmt.Errorf("byte size out of range: %q", s)
+			}
+			return ByteSize(n * u.n), nil
+		}
+	}
+	return 0, fmt.Errorf("not a valid byte size: %q", s)
+}
+
+// String uses the biggest unit the size is a whole number of.
+func (b ByteSize) String() string {
+	for i := len(byteSizeUnits) - 2; i > 0; i -= 2 {
+		if u := byteSizeUnits[i]; b != 0 && int64(b)%u.n == 0 {
+			return strconv.FormatInt(int64(b)/u.n, 10) + u.name
+		}
+	}
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+
+	parsed, err := ParseByteSize(s)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+
+	*b = parsed
+	return nil
+}
+
+func (b ByteSize) MarshalYAML() (any, error) {
+	return b.String(), nil
+}
@@ -0,0 +1,47 @@
+package config
+
+import "testing"
+
+func Test_parseByteSize(t *testing.T) {
+	for s, want := range map[string]ByteSize{
+		"0":      0,
+		"512":    512,
+		"512B":   512,
+		"10KB":   10 << 10,
+		"10KiB":  10 << 10,
+		"100MB":  100 << 20,
+		"1GB":    1 << 30,
+		"2 TiB":  2 << 40,
+		"1536KB": 1536 << 10,
+	} {
+		b, err := ParseByteSize(s)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", s, err)
+			continue
+		}
+		if b != want {
+			t.Errorf("Expected %q to be %d, got %d", s, want, b)
+		}
+	}
+
+	for _, s := range []string{"", "MB", "10XB", "-1MB", "1.5MB", "99999999999TB"} {
+		if _, err := ParseByteSize(s); err == nil {
+			t.Errorf("Invalid byte size %q was accepted", s)
+		}
+	}
+}
+
+func Test_byteSize_string(t *testing.T) {
+	for b, want := range map[ByteSize]string{
+		0:          "0B",
+		512:        "512B",
+		10 << 10:   "10KB",
+		1536 << 10: "1536KB",
+		100 << 20:  "100MB",
+		1 << 40:    "1TB",
+	} {
+		if got := b.String(); got != want {
+			t.Errorf("Expected %d to be %q, got %q", b, want, got)
+		}
+	}
+}
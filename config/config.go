@@ -0,0 +1,510 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+	"github.com/pomyslowynick/scratcheus/relabel"
+)
+
+var (
+	DefaultGlobalConfig = GlobalConfig{
+		ScrapeInterval: Duration(time.Minute),
+		ScrapeTimeout:  Duration(10 * time.Second),
+	}
+
+	DefaultScrapeConfig = ScrapeConfig{
+		MetricsPath:      "/metrics",
+		Scheme:           "http",
+		HonorTimestamps:  true,
+		HTTPClientConfig: DefaultHTTPClientConfig,
+	}
+
+	// DefaultScrapeProtocols leave protobuf out, there's no parser for it.
+	DefaultScrapeProtocols = []ScrapeProtocol{
+		OpenMetricsText1_0_0,
+		OpenMetricsText0_0_1,
+		PrometheusText0_0_4,
+	}
+
+	DefaultFileSDConfig = FileSDConfig{
+		RefreshInterval: Duration(5 * time.Minute),
+	}
+
+	DefaultHTTPSDConfig = HTTPSDConfig{
+		RefreshInterval: Duration(time.Minute),
+	}
+
+	DefaultDNSSDConfig = DNSSDConfig{
+		Type:            "SRV",
+		RefreshInterval: Duration(30 * time.Second),
+	}
+)
+
+// Config is the configuration file, it follows the Prometheus one, with the
+// parts implemented so far.
+type Config struct {
+	GlobalConfig  GlobalConfig    `yaml:"global"`
+	ScrapeConfigs []*ScrapeConfig `yaml:"scrape_configs,omitempty"`
+}
+
+type GlobalConfig struct {
+	// ScrapeInterval and ScrapeTimeout are the defaults of the scrape configs.
+	ScrapeInterval Duration `yaml:"scrape_interval,omitempty"`
+	ScrapeTimeout  Duration `yaml:"scrape_timeout,omitempty"`
+	// ExternalLabels are for identifying this server to others.
+	ExternalLabels labels.Labels `yaml:"external_labels,omitempty"`
+}
+
+// ScrapeConfig is a job, the targets scraped the same way.
+type ScrapeConfig struct {
+	JobName        string     `yaml:"job_name"`
+	ScrapeInterval Duration   `yaml:"scrape_interval,omitempty"`
+	ScrapeTimeout  Duration   `yaml:"scrape_timeout,omitempty"`
+	MetricsPath    string     `yaml:"metrics_path,omitempty"`
+	Scheme         string     `yaml:"scheme,omitempty"`
+	Params         url.Values `yaml:"params,omitempty"`
+
+	HTTPClientConfig HTTPClientConfig `yaml:",inline"`
+	// ScrapeProtocols are the formats asked for, in order of preference.
+	ScrapeProtocols []ScrapeProtocol `yaml:"scrape_protocols,omitempty"`
+
+	// HonorLabels keeps the scraped labels clashing with the target labels,
+	// otherwise they're kept as exported_<name>. HonorTimestamps uses the
+	// timestamps of the scraped samples, rather than the time of the scrape.
+	HonorLabels     bool `yaml:"honor_labels,omitempty"`
+	HonorTimestamps bool `yaml:"honor_timestamps"`
+
+	// The limits fail the whole scrape when they're exceeded, 0 is no limit.
+	// SampleLimit counts the samples left after metric relabeling, the label
+	// limits apply to the series as they'd be appended.
+	SampleLimit           int      `yaml:"sample_limit,omitempty"`
+	LabelLimit            int      `yaml:"label_limit,omitempty"`
+	LabelNameLengthLimit  int      `yaml:"label_name_length_limit,omitempty"`
+	LabelValueLengthLimit int      `yaml:"label_value_length_limit,omitempty"`
+	BodySizeLimit         ByteSize `yaml:"body_size_limit,omitempty"`
+
+	StaticConfigs []*StaticConfig `yaml:"static_configs,omitempty"`
+	FileSDConfigs []*FileSDConfig `yaml:"file_sd_configs,omitempty"`
+	DNSSDConfigs  []*DNSSDConfig  `yaml:"dns_sd_configs,omitempty"`
+	HTTPSDConfigs []*HTTPSDConfig `yaml:"http_sd_configs,omitempty"`
+
+	KubernetesSDConfigs []*KubernetesSDConfig `yaml:"kubernetes_sd_configs,omitempty"`
+
+	// RelabelConfigs are applied to the targets before they're scraped,
+	// MetricRelabelConfigs to every scraped series before it's appended.
+	RelabelConfigs       []*relabel.Config `yaml:"relabel_configs,omitempty"`
+	MetricRelabelConfigs []*relabel.Config `yaml:"metric_relabel_configs,omitempty"`
+}
+
+// UnmarshalYAML fills the defaults in first, HonorTimestamps and
+// FollowRedirects can't tell false from missing afterwards.
+func (c *ScrapeConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	*c = DefaultScrapeConfig
+	type plain ScrapeConfig
+	return unmarshal((*plain)(c))
+}
+
+// ScrapeProtocol is a format the targets can expose their metrics in.
+type ScrapeProtocol string
+
+const (
+	OpenMetricsText1_0_0 ScrapeProtocol = "OpenMetricsText1.0.0"
+	OpenMetricsText0_0_1 ScrapeProtocol = "OpenMetricsText0.0.1"
+	PrometheusText0_0_4  ScrapeProtocol = "PrometheusText0.0.4"
+	PrometheusProto      ScrapeProtocol = "PrometheusProto"
+)
+
+// ScrapeProtocolsHeaders are the media types of the protocols, for the
+// Accept header.
+var ScrapeProtocolsHeaders = map[ScrapeProtocol]string{
+	OpenMetricsText1_0_0: "application/openmetrics-text;version=1.0.0",
+	OpenMetricsText0_0_1: "application/openmetrics-text;version=0.0.1",
+	PrometheusText0_0_4:  "text/plain;version=0.0.4",
+	PrometheusProto:      "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited",
+}
+
+// StaticConfig is a group of targets listed in the file, with labels added
+// to all of them.
+type StaticConfig struct {
+	Targets []string      `yaml:"targets"`
+	Labels  labels.Labels `yaml:"labels,omitempty"`
+}
+
+// FileSDConfig reads targets from files, in the same format as
+// static_configs, in JSON or YAML. The last element of the path can be a
+// glob.
+type FileSDConfig struct {
+	Files []string `yaml:"files"`
+	// RefreshInterval is how often the files are read again, in case a
+	// change wasn't noticed by the watch.
+	RefreshInterval Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// DNSSDConfig finds targets in DNS records. SRV records have the port of the
+// target, A and AAAA records need it in the config.
+type DNSSDConfig struct {
+	Names           []string `yaml:"names"`
+	Type            string   `yaml:"type,omitempty"`
+	Port            int      `yaml:"port,omitempty"`
+	RefreshInterval Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// HTTPSDConfig polls a URL serving the target groups as JSON, in the same
+// format as file_sd.
+type HTTPSDConfig struct {
+	URL             string   `yaml:"url"`
+	RefreshInterval Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// KubernetesSDConfig finds targets through the Kubernetes API. Without an API
+// server it runs in the cluster, with the service account of the pod.
+type KubernetesSDConfig struct {
+	// Role is what the targets are, pod, service or endpoints.
+	Role            string    `yaml:"role"`
+	APIServer       string    `yaml:"api_server,omitempty"`
+	BearerTokenFile string    `yaml:"bearer_token_file,omitempty"`
+	TLSConfig       TLSConfig `yaml:"tls_config,omitempty"`
+	// Namespaces are where to look, all of them when empty.
+	Namespaces NamespaceDiscovery `yaml:"namespaces,omitempty"`
+}
+
+type NamespaceDiscovery struct {
+	Names []string `yaml:"names,omitempty"`
+}
+
+// Load parses the config, fills the defaults in and validates it. Unknown keys
+// are errors, they're usually typos.
+func Load(s string) (*Config, error) {
+	cfg := &Config{}
+
+	dec := yaml.NewDecoder(strings.NewReader(s))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if err := cfg.init(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func LoadFile(filename string) (*Config, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := Load(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("parsing YAML file %s: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) String() string {
+	var b bytes.Buffer
+
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return fmt.Sprintf("<error creating config string: %s>", err)
+	}
+	return b.String()
+}
+
+// init fills the defaults in, the scrape configs inherit theirs from the
+// global config, and validates the result. Errors name the offending key.
+func (c *Config) init() error {
+	if err := c.GlobalConfig.init(); err != nil {
+		return err
+	}
+
+	jobNames := make(map[string]int, len(c.ScrapeConfigs))
+	for i, sc := range c.ScrapeConfigs {
+		key := fmt.Sprintf("scrape_configs[%d]", i)
+		if sc == nil {
+			return fmt.Errorf("%s: empty scrape config", key)
+		}
+
+		if err := sc.init(key, c.GlobalConfig); err != nil {
+			return err
+		}
+
+		if j, ok := jobNames[sc.JobName]; ok {
+			return fmt.Errorf("%s.job_name: %q is already used by scrape_configs[%d]", key, sc.JobName, j)
+		}
+		jobNames[sc.JobName] = i
+	}
+
+	return nil
+}
+
+func (c *GlobalConfig) init() error {
+	if c.ScrapeInterval == 0 {
+		c.ScrapeInterval = DefaultGlobalConfig.ScrapeInterval
+	}
+	if c.ScrapeTimeout == 0 {
+		c.ScrapeTimeout = min(DefaultGlobalConfig.ScrapeTimeout, c.ScrapeInterval)
+	}
+	if c.ScrapeTimeout > c.ScrapeInterval {
+		return fmt.Errorf("global.scrape_timeout: %s is greater than the scrape interval %s", c.ScrapeTimeout, c.ScrapeInterval)
+	}
+
+	var err error
+	c.ExternalLabels.Range(func(l labels.Label) {
+		if err == nil && !labels.IsValidLabelName(l.Name) {
+			err = fmt.Errorf("global.external_labels: %q is not a valid label name", l.Name)
+		}
+	})
+	return err
+}
+
+func (c *ScrapeConfig) init(key string, global GlobalConfig) error {
+	if c.JobName == "" {
+		return fmt.Errorf("%s.job_name: missing", key)
+	}
+	key = fmt.Sprintf("%s (job %q)", key, c.JobName)
+
+	if c.ScrapeInterval == 0 {
+		c.ScrapeInterval = global.ScrapeInterval
+	}
+	if c.ScrapeTimeout == 0 {
+		c.ScrapeTimeout = min(global.ScrapeTimeout, c.ScrapeInterval)
+	}
+	if c.ScrapeTimeout > c.ScrapeInterval {
+		return fmt.Errorf("%s.scrape_timeout: %s is greater than the scrape interval %s", key, c.ScrapeTimeout, c.ScrapeInterval)
+	}
+
+	if c.MetricsPath == "" {
+		c.MetricsPath = DefaultScrapeConfig.MetricsPath
+	}
+	if !strings.HasPrefix(c.MetricsPath, "/") {
+		return fmt.Errorf("%s.metrics_path: %q doesn't start with /", key, c.MetricsPath)
+	}
+
+	if c.Scheme == "" {
+		c.Scheme = DefaultScrapeConfig.Scheme
+	}
+	if c.Scheme != "http" && c.Scheme != "https" {
+		return fmt.Errorf("%s.scheme: unknown scheme %q, only http and https are supported", key, c.Scheme)
+	}
+
+	if err := c.HTTPClientConfig.validate(key); err != nil {
+		return err
+	}
+
+	if len(c.ScrapeProtocols) == 0 {
+		c.ScrapeProtocols = append([]ScrapeProtocol(nil), DefaultScrapeProtocols...)
+	}
+	seen := make(map[ScrapeProtocol]bool, len(c.ScrapeProtocols))
+	for i, sp := range c.ScrapeProtocols {
+		if _, ok := ScrapeProtocolsHeaders[sp]; !ok {
+			return fmt.Errorf("%s.scrape_protocols[%d]: unknown protocol %q", key, i, sp)
+		}
+		if seen[sp] {
+			return fmt.Errorf("%s.scrape_protocols[%d]: %q is listed twice", key, i, sp)
+		}
+		seen[sp] = true
+	}
+
+	limits := []struct {
+		name  string
+		value int64
+	}{
+		{"sample_limit", int64(c.SampleLimit)},
+		{"label_limit", int64(c.LabelLimit)},
+		{"label_name_length_limit", int64(c.LabelNameLengthLimit)},
+		{"label_value_length_limit", int64(c.LabelValueLengthLimit)},
+		{"body_size_limit", int64(c.BodySizeLimit)},
+	}
+	for _, l := range limits {
+		if l.value < 0 {
+			return fmt.Errorf("%s.%s: can't be negative", key, l.name)
+		}
+	}
+
+	for i, sc := range c.StaticConfigs {
+		if err := sc.validate(fmt.Sprintf("%s.static_configs[%d]", key, i)); err != nil {
+			return err
+		}
+	}
+
+	for i, sd := range c.FileSDConfigs {
+		if err := sd.init(fmt.Sprintf("%s.file_sd_configs[%d]", key, i)); err != nil {
+			return err
+		}
+	}
+
+	for i, sd := range c.DNSSDConfigs {
+		if err := sd.init(fmt.Sprintf("%s.dns_sd_configs[%d]", key, i)); err != nil {
+			return err
+		}
+	}
+
+	for i, sd := range c.HTTPSDConfigs {
+		if err := sd.init(fmt.Sprintf("%s.http_sd_configs[%d]", key, i)); err != nil {
+			return err
+		}
+	}
+
+	for i, sd := range c.KubernetesSDConfigs {
+		if err := sd.validate(fmt.Sprintf("%s.kubernetes_sd_configs[%d]", key, i)); err != nil {
+			return err
+		}
+	}
+
+	if err := validateRelabelConfigs(key+".relabel_configs", c.RelabelConfigs); err != nil {
+		return err
+	}
+	if err := validateRelabelConfigs(key+".metric_relabel_configs", c.MetricRelabelConfigs); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func validateRelabelConfigs(key string, cfgs []*relabel.Config) error {
+	for i, rc := range cfgs {
+		if rc == nil {
+			return fmt.Errorf("%s[%d]: empty relabel config", key, i)
+		}
+		if err := rc.Validate(); err != nil {
+			return fmt.Errorf("%s[%d]: %w", key, i, err)
+		}
+	}
+	return nil
+}
+
+func (c *StaticConfig) validate(key string) error {
+	if c == nil {
+		return fmt.Errorf("%s: empty static config", key)
+	}
+
+	for i, t := range c.Targets {
+		if t == "" || strings.Contains(t, "/") {
+			return fmt.Errorf("%s.targets[%d]: %q is not a valid host:port address", key, i, t)
+		}
+	}
+
+	var err error
+	c.Labels.Range(func(l labels.Label) {
+		if err == nil && !labels.IsValidLabelName(l.Name) {
+			err = fmt.Errorf("%s.labels: %q is not a valid label name", key, l.Name)
+		}
+	})
+	return err
+}
+
+func (c *FileSDConfig) init(key string) error {
+	if c == nil {
+		return fmt.Errorf("%s: empty file_sd config", key)
+	}
+	if len(c.Files) == 0 {
+		return fmt.Errorf("%s.files: missing", key)
+	}
+
+	for i, f := range c.Files {
+		ext := filepath.Ext(f)
+		if ext != ".json" && ext != ".yml" && ext != ".yaml" {
+			return fmt.Errorf("%s.files[%d]: %q doesn't end in .json, .yml or .yaml", key, i, f)
+		}
+		if _, err := filepath.Match(filepath.Base(f), ""); err != nil {
+			return fmt.Errorf("%s.files[%d]: %q: %w", key, i, f, err)
+		}
+		if strings.ContainsAny(filepath.Dir(f), "*?[") {
+			return fmt.Errorf("%s.files[%d]: %q: only the file name can be a glob", key, i, f)
+		}
+	}
+
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = DefaultFileSDConfig.RefreshInterval
+	}
+	return nil
+}
+
+func (c *DNSSDConfig) init(key string) error {
+	if c == nil {
+		return fmt.Errorf("%s: empty dns_sd config", key)
+	}
+	if len(c.Names) == 0 {
+		return fmt.Errorf("%s.names: missing", key)
+	}
+
+	if c.Type == "" {
+		c.Type = DefaultDNSSDConfig.Type
+	}
+	c.Type = strings.ToUpper(c.Type)
+	switch c.Type {
+	case "SRV":
+		if c.Port != 0 {
+			return fmt.Errorf("%s.port: SRV records have the port already", key)
+		}
+	case "A", "AAAA":
+		if c.Port <= 0 || c.Port > 65535 {
+			return fmt.Errorf("%s.port: %s records need a port between 1 and 65535, got %d", key, c.Type, c.Port)
+		}
+	default:
+		return fmt.Errorf("%s.type: unknown record type %q, only SRV, A and AAAA are supported", key, c.Type)
+	}
+
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = DefaultDNSSDConfig.RefreshInterval
+	}
+	return nil
+}
+
+func (c *HTTPSDConfig) init(key string) error {
+	if c == nil {
+		return fmt.Errorf("%s: empty http_sd config", key)
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("%s.url: %w", key, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s.url: %q isn't an http or https URL", key, c.URL)
+	}
+
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = DefaultHTTPSDConfig.RefreshInterval
+	}
+	return nil
+}
+
+func (c *KubernetesSDConfig) validate(key string) error {
+	if c == nil {
+		return fmt.Errorf("%s: empty kubernetes_sd config", key)
+	}
+
+	switch c.Role {
+	case "pod", "service", "endpoints":
+	case "":
+		return fmt.Errorf("%s.role: missing", key)
+	default:
+		return fmt.Errorf("%s.role: unknown role %q, only pod, service and endpoints are supported", key, c.Role)
+	}
+
+	if c.APIServer != "" {
+		u, err := url.Parse(c.APIServer)
+		if err != nil {
+			return fmt.Errorf("%s.api_server: %w", key, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s.api_server: %q isn't an http or https URL", key, c.APIServer)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package config
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+	"github.com/pomyslowynick/scratcheus/relabel"
+)
+
+func Test_loadFile(t *testing.T) {
+	cfg, err := LoadFile("testdata/conf.good.yml")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	want := &Config{
+		GlobalConfig: GlobalConfig{
+			ScrapeInterval: Duration(15 * time.Second),
+			ScrapeTimeout:  Duration(5 * time.Second),
+			ExternalLabels: labels.FromStrings("cluster", "eu-west-1", "replica", "a"),
+		},
+		ScrapeConfigs: []*ScrapeConfig{
+			{
+				JobName:          "prometheus",
+				ScrapeInterval:   Duration(15 * time.Second),
+				ScrapeTimeout:    Duration(5 * time.Second),
+				MetricsPath:      "/metrics",
+				Scheme:           "http",
+				HonorTimestamps:  true,
+				HTTPClientConfig: HTTPClientConfig{FollowRedirects: true},
+				ScrapeProtocols:  DefaultScrapeProtocols,
+				StaticConfigs: []*StaticConfig{
+					{Targets: []string{"localhost:9090"}},
+				},
+				DNSSDConfigs: []*DNSSDConfig{
+					{Names: []string{"_prometheus._tcp.example.com"}, Type: "SRV", RefreshInterval: Duration(30 * time.Second)},
+					{Names: []string{"prometheus.example.com"}, Type: "A", Port: 9090, RefreshInterval: Duration(time.Minute)},
+				},
+			},
+			{
+				JobName:         "node",
+				ScrapeInterval:  Duration(time.Minute),
+				ScrapeTimeout:   Duration(20 * time.Second),
+				MetricsPath:     "/node/metrics",
+				Scheme:          "https",
+				HonorTimestamps: true,
+				HTTPClientConfig: HTTPClientConfig{
+					BasicAuth: &BasicAuth{Username: "scratcheus", PasswordFile: "/etc/scratcheus/node_password"},
+					TLSConfig: TLSConfig{
+						CAFile:     "/etc/scratcheus/node_ca.crt",
+						CertFile:   "/etc/scratcheus/client.crt",
+						KeyFile:    "/etc/scratcheus/client.key",
+						ServerName: "node.example.com",
+					},
+					ProxyURL: "http://proxy.example.com:3128",
+					Headers:  map[string]string{"X-Scope-OrgID": "team-a"},
+				},
+				ScrapeProtocols:       []ScrapeProtocol{PrometheusText0_0_4, OpenMetricsText1_0_0},
+				Params:                url.Values{"collect[]": {"cpu", "meminfo"}},
+				SampleLimit:           10000,
+				LabelLimit:            30,
+				LabelNameLengthLimit:  200,
+				LabelValueLengthLimit: 500,
+				BodySizeLimit:         10 << 20,
+				StaticConfigs: []*StaticConfig{
+					{Targets: []string{"node-1:9100", "node-2:9100"}, Labels: labels.FromStrings("zone", "a")},
+					{Targets: []string{"node-3:9100"}, Labels: labels.FromStrings("zone", "b")},
+				},
+				FileSDConfigs: []*FileSDConfig{
+					{Files: []string{"targets/*.json", "targets/node.yml"}, RefreshInterval: Duration(5 * time.Minute)},
+					{Files: []string{"more_targets.yaml"}, RefreshInterval: Duration(30 * time.Second)},
+				},
+				HTTPSDConfigs: []*HTTPSDConfig{
+					{URL: "https://inventory.example.com/targets?job=node", RefreshInterval: Duration(time.Minute)},
+				},
+				RelabelConfigs: []*relabel.Config{
+					{
+						SourceLabels: []string{"__address__"},
+						Separator:    ";",
+						Regex:        relabel.MustNewRegexp("(.*):9100"),
+						TargetLabel:  "host",
+						Replacement:  "$1",
+						Action:       relabel.Replace,
+					},
+				},
+				MetricRelabelConfigs: []*relabel.Config{
+					{
+						SourceLabels: []string{"__name__"},
+						Separator:    ";",
+						Regex:        relabel.MustNewRegexp("go_.*"),
+						Replacement:  "$1",
+						Action:       relabel.Drop,
+					},
+				},
+			},
+			{
+				JobName:          "kubernetes-pods",
+				ScrapeInterval:   Duration(15 * time.Second),
+				ScrapeTimeout:    Duration(5 * time.Second),
+				MetricsPath:      "/metrics",
+				Scheme:           "http",
+				HonorTimestamps:  true,
+				HTTPClientConfig: HTTPClientConfig{FollowRedirects: true},
+				ScrapeProtocols:  DefaultScrapeProtocols,
+				KubernetesSDConfigs: []*KubernetesSDConfig{
+					{Role: "pod", Namespaces: NamespaceDiscovery{Names: []string{"default", "monitoring"}}},
+					{
+						Role:            "endpoints",
+						APIServer:       "https://127.0.0.1:6443",
+						BearerTokenFile: "/etc/scratcheus/token",
+						TLSConfig:       TLSConfig{CAFile: "/etc/scratcheus/ca.crt"},
+					},
+				},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("Unexpected config:\n%s\nexpected:\n%s", cfg, want)
+	}
+}
+
+func Test_load_defaults(t *testing.T) {
+	cfg, err := Load("scrape_configs:\n  - job_name: node\n")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if cfg.GlobalConfig.ScrapeInterval != DefaultGlobalConfig.ScrapeInterval || cfg.GlobalConfig.ScrapeTimeout != DefaultGlobalConfig.ScrapeTimeout {
+		t.Errorf("Global defaults not set: %+v", cfg.GlobalConfig)
+	}
+
+	sc := cfg.ScrapeConfigs[0]
+	if sc.ScrapeInterval != DefaultGlobalConfig.ScrapeInterval || sc.MetricsPath != "/metrics" || sc.Scheme != "http" {
+		t.Errorf("Scrape config defaults not set: %+v", sc)
+	}
+	if sc.HonorLabels || !sc.HonorTimestamps {
+		t.Errorf("Expected timestamps honored and labels not by default: %+v", sc)
+	}
+	if !sc.HTTPClientConfig.FollowRedirects || !reflect.DeepEqual(sc.ScrapeProtocols, DefaultScrapeProtocols) {
+		t.Errorf("Expected redirects followed and the default protocols: %+v", sc)
+	}
+
+	cfg, err = Load("scrape_configs:\n  - job_name: node\n    honor_timestamps: false\n")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.ScrapeConfigs[0].HonorTimestamps {
+		t.Errorf("honor_timestamps: false was ignored")
+	}
+
+	// Unknown keys are still errors within a scrape config
+	if _, err := Load("scrape_configs:\n  - job_name: node\n    honor_lables: true\n"); err == nil {
+		t.Errorf("Unknown key in a scrape config didn't fail")
+	}
+
+	// A short interval caps the default timeout
+	cfg, err = Load("global:\n  scrape_interval: 5s\n")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.GlobalConfig.ScrapeTimeout != Duration(5*time.Second) {
+		t.Errorf("Expected timeout capped at 5s, got %s", cfg.GlobalConfig.ScrapeTimeout)
+	}
+
+	if _, err := Load(""); err != nil {
+		t.Errorf("Empty config failed: %v", err)
+	}
+}
+
+func Test_loadFile_errors(t *testing.T) {
+	for file, want := range map[string]string{
+		"unknown_field.bad.yml":    "line 3: field scrape_intreval not found",
+		"global_timeout.bad.yml":   "global.scrape_timeout: 1m is greater than the scrape interval 15s",
+		"scrape_timeout.bad.yml":   `scrape_configs[0] (job "node").scrape_timeout: 20s is greater than the scrape interval 10s`,
+		"duplicate_job.bad.yml":    `scrape_configs[1].job_name: "node" is already used by scrape_configs[0]`,
+		"missing_job.bad.yml":      "scrape_configs[0].job_name: missing",
+		"scheme.bad.yml":           `scrape_configs[0] (job "node").scheme: unknown scheme "ftp"`,
+		"target.bad.yml":           `scrape_configs[0] (job "node").static_configs[0].targets[0]: "http://node-1:9100" is not a valid host:port address`,
+		"external_labels.bad.yml":  `global.external_labels: "1cluster" is not a valid label name`,
+		"duration.bad.yml":         `line 2: not a valid duration string: "15 seconds"`,
+		"relabel.bad.yml":          `scrape_configs[0] (job "node").metric_relabel_configs[0]: relabel configuration for hashmod requires non-zero modulus`,
+		"relabel_action.bad.yml":   `unknown relabel action "rename"`,
+		"file_sd.bad.yml":          `scrape_configs[0] (job "node").file_sd_configs[0].files[1]: "targets/node.txt" doesn't end in .json, .yml or .yaml`,
+		"file_sd_glob.bad.yml":     `scrape_configs[0] (job "node").file_sd_configs[0].files[0]: "targets/*/node.json": only the file name can be a glob`,
+		"dns_sd_port.bad.yml":      `scrape_configs[0] (job "node").dns_sd_configs[0].port: A records need a port between 1 and 65535, got 0`,
+		"dns_sd_type.bad.yml":      `scrape_configs[0] (job "node").dns_sd_configs[0].type: unknown record type "MX"`,
+		"http_sd.bad.yml":          `scrape_configs[0] (job "node").http_sd_configs[0].url: "inventory.example.com/targets" isn't an http or https URL`,
+		"kubernetes_sd.bad.yml":    `scrape_configs[0] (job "node").kubernetes_sd_configs[0].role: unknown role "node"`,
+		"sample_limit.bad.yml":     `scrape_configs[0] (job "node").sample_limit: can't be negative`,
+		"body_size_limit.bad.yml":  `line 4: not a valid byte size: "10 megabytes"`,
+		"http_client.bad.yml":      `scrape_configs[0] (job "node"): at most one of basic_auth and bearer_token_file can be set`,
+		"tls_config.bad.yml":       `scrape_configs[0] (job "node").tls_config: cert_file and key_file go together`,
+		"headers.bad.yml":          `scrape_configs[0] (job "node").headers: "authorization" is set by the scrape itself`,
+		"scrape_protocols.bad.yml": `scrape_configs[0] (job "node").scrape_protocols[1]: unknown protocol "PrometheusText1.0.0"`,
+	} {
+		_, err := LoadFile("testdata/" + file)
+		if err == nil {
+			t.Errorf("%s: expected an error", file)
+			continue
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected error containing %q, got %q", file, want, err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package config
+
+import "github.com/pomyslowynick/scratcheus/model"
+
+// Duration is model.Duration, it lives there so PromQL can use it without
+// the config.
+type Duration = model.Duration
+
+func ParseDuration(s string) (Duration, error) {
+	return model.ParseDuration(s)
+}
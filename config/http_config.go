@@ -0,0 +1,215 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var DefaultHTTPClientConfig = HTTPClientConfig{
+	FollowRedirects: true,
+}
+
+// HTTPClientConfig is how the targets are talked to over HTTP, it's inlined
+// in the scrape config.
+type HTTPClientConfig struct {
+	BasicAuth *BasicAuth `yaml:"basic_auth,omitempty"`
+	// BearerTokenFile is read on every request, tokens get rotated.
+	BearerTokenFile string    `yaml:"bearer_token_file,omitempty"`
+	TLSConfig       TLSConfig `yaml:"tls_config,omitempty"`
+	// ProxyURL is the proxy for all the requests, otherwise it's taken from
+	// the environment, HTTP_PROXY and friends.
+	ProxyURL        string `yaml:"proxy_url,omitempty"`
+	FollowRedirects bool   `yaml:"follow_redirects"`
+	// Headers are set on every request.
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// BasicAuth has the password in the config or in a file, the file is read on
+// every request.
+type BasicAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+}
+
+// TLSConfig is how the server's certificate is checked, and the client
+// certificate for servers which want one.
+type TLSConfig struct {
+	// CAFile has the certificates of the CAs signing the server certificate,
+	// the system ones are used when it's empty.
+	CAFile string `yaml:"ca_file,omitempty"`
+	// CertFile and KeyFile are the client certificate, they're read again on
+	// every new connection, so a renewed certificate is picked up.
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+	// ServerName is the name the server certificate is checked against,
+	// rather than the host of the URL.
+	ServerName         string `yaml:"server_name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+// The headers the scrape sets itself, they can't be in headers.
+var reservedHeaders = map[string]bool{
+	"Authorization":                       true,
+	"Accept":                              true,
+	"Accept-Encoding":                     true,
+	"User-Agent":                          true,
+	"X-Prometheus-Scrape-Timeout-Seconds": true,
+}
+
+func (c *HTTPClientConfig) validate(key string) error {
+	if c.BasicAuth != nil {
+		if c.BasicAuth.Username == "" {
+			return fmt.Errorf("%s.basic_auth.username: missing", key)
+		}
+		if c.BasicAuth.Password != "" && c.BasicAuth.PasswordFile != "" {
+			return fmt.Errorf("%s.basic_auth: at most one of password and password_file can be set", key)
+		}
+		if c.BearerTokenFile != "" {
+			return fmt.Errorf("%s: at most one of basic_auth and bearer_token_file can be set", key)
+		}
+	}
+
+	if c.ProxyURL != "" {
+		u, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("%s.proxy_url: %w", key, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+			return fmt.Errorf("%s.proxy_url: %q isn't an http, https or socks5 URL", key, c.ProxyURL)
+		}
+	}
+
+	for name := range c.Headers {
+		if reservedHeaders[http.CanonicalHeaderKey(name)] {
+			return fmt.Errorf("%s.headers: %q is set by the scrape itself", key, name)
+		}
+	}
+
+	return c.TLSConfig.validate(key + ".tls_config")
+}
+
+func (c *TLSConfig) validate(key string) error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("%s: cert_file and key_file go together", key)
+	}
+	return nil
+}
+
+// NewTLSConfig reads the CA file and checks the client certificate loads, so
+// a broken file fails here rather than on every scrape.
+func (c *TLSConfig) NewTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		b, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates in %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		certFile, keyFile := c.CertFile, c.KeyFile
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("loading client certificate: %w", err)
+			}
+			return &cert, nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// NewClientFromConfig makes the client for the config. Responses aren't
+// decompressed by it, whoever asks for gzip decompresses it themselves.
+func NewClientFromConfig(cfg HTTPClientConfig) (*http.Client, error) {
+	tlsConfig, err := cfg.TLSConfig.NewTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.DisableCompression = true
+	if cfg.ProxyURL != "" {
+		u, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	client := &http.Client{
+		Transport: &authRoundTripper{cfg: cfg, next: transport},
+	}
+	if !cfg.FollowRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client, nil
+}
+
+// authRoundTripper sets the headers and the credentials of the config on
+// every request, the files are read every time.
+type authRoundTripper struct {
+	cfg  HTTPClientConfig
+	next http.RoundTripper
+}
+
+func (rt *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	cfg := rt.cfg
+	if len(cfg.Headers) == 0 && cfg.BasicAuth == nil && cfg.BearerTokenFile == "" {
+		return rt.next.RoundTrip(req)
+	}
+
+	// A round tripper mustn't change the request it's given
+	req = req.Clone(req.Context())
+	for name, value := range cfg.Headers {
+		req.Header.Set(name, value)
+	}
+
+	switch {
+	case cfg.BasicAuth != nil:
+		password := cfg.BasicAuth.Password
+		if cfg.BasicAuth.PasswordFile != "" {
+			b, err := os.ReadFile(cfg.BasicAuth.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading basic auth password: %w", err)
+			}
+			password = strings.TrimSpace(string(b))
+		}
+		req.SetBasicAuth(cfg.BasicAuth.Username, password)
+	case cfg.BearerTokenFile != "":
+		b, err := os.ReadFile(cfg.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading bearer token: %w", err)
+		}
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return nil, errors.New("bearer token file is empty")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return rt.next.RoundTrip(req)
+}
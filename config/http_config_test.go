@@ -0,0 +1,193 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, name string, b []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+	return path
+}
+
+func Test_NewClientFromConfig_auth(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer server.Close()
+
+	passwordFile := writeTestFile(t, "password", []byte("first\n"))
+	tokenFile := writeTestFile(t, "token", []byte("secret-token\n"))
+
+	client, err := NewClientFromConfig(HTTPClientConfig{
+		BasicAuth: &BasicAuth{Username: "scratcheus", PasswordFile: passwordFile},
+		Headers:   map[string]string{"X-Scope-OrgID": "team-a"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	for _, password := range []string{"first", "second"} {
+		os.WriteFile(passwordFile, []byte(password), 0o600)
+		if _, err := client.Get(server.URL); err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+
+		user, pass, ok := got.BasicAuth()
+		if !ok || user != "scratcheus" || pass != password {
+			t.Errorf("Expected basic auth scratcheus:%s, got %s:%s", password, user, pass)
+		}
+		if h := got.Header.Get("X-Scope-OrgID"); h != "team-a" {
+			t.Errorf("Expected the header set, got %q", h)
+		}
+	}
+
+	client, err = NewClientFromConfig(HTTPClientConfig{BearerTokenFile: tokenFile})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if _, err := client.Get(server.URL); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if h := got.Header.Get("Authorization"); h != "Bearer secret-token" {
+		t.Errorf("Expected the bearer token, got %q", h)
+	}
+}
+
+func Test_NewClientFromConfig_followRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	for _, follow := range []bool{true, false} {
+		client, err := NewClientFromConfig(HTTPClientConfig{FollowRedirects: follow})
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+
+		resp, err := client.Get(server.URL + "/old")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		want := http.StatusOK
+		if !follow {
+			want = http.StatusFound
+		}
+		if resp.StatusCode != want {
+			t.Errorf("follow_redirects %t: expected status %d, got %d", follow, want, resp.StatusCode)
+		}
+	}
+}
+
+// newClientCert makes a self-signed client certificate, returning the files
+// and the certificate for the server to trust.
+func newClientCert(t *testing.T) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ = x509.ParseCertificate(der)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certFile = writeTestFile(t, "client.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyFile = writeTestFile(t, "client.key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return certFile, keyFile, cert
+}
+
+func Test_NewClientFromConfig_mTLS(t *testing.T) {
+	certFile, keyFile, clientCert := newClientCert(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := writeTestFile(t, "ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	tests := []struct {
+		name    string
+		tls     TLSConfig
+		wantErr bool
+	}{
+		{
+			name: "client certificate",
+			tls:  TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "example.com"},
+		},
+		{
+			name:    "no client certificate",
+			tls:     TLSConfig{CAFile: caFile},
+			wantErr: true,
+		},
+		{
+			name:    "unknown CA",
+			tls:     TLSConfig{CertFile: certFile, KeyFile: keyFile},
+			wantErr: true,
+		},
+		{
+			name: "insecure skip verify",
+			tls:  TLSConfig{CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewClientFromConfig(HTTPClientConfig{TLSConfig: tt.tls})
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %t, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	if _, err := NewClientFromConfig(HTTPClientConfig{TLSConfig: TLSConfig{CAFile: certFile + ".missing"}}); err == nil {
+		t.Errorf("Missing CA file didn't fail")
+	}
+}
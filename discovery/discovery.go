@@ -0,0 +1,28 @@
+package discovery
+
+import (
+	"context"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+// Group is a group of targets found by a discoverer, sharing their labels.
+type Group struct {
+	// Targets are the labels of every target, its address is in
+	// __address__.
+	Targets []labels.Labels
+	// Labels are added to every target of the group, the target's own labels
+	// win.
+	Labels labels.Labels
+	// Source identifies the group within its discoverer, a group replaces
+	// the previous one with the same source. A group without targets removes
+	// it.
+	Source string
+}
+
+// Discoverer finds targets. It sends all the groups it knows of when it
+// starts, then the groups which changed whenever they change, until the
+// context is done.
+type Discoverer interface {
+	Run(ctx context.Context, up chan<- []*Group)
+}
@@ -0,0 +1,134 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+const (
+	dnsNameLabel            = "__meta_dns_name"
+	dnsSrvRecordTargetLabel = "__meta_dns_srv_record_target"
+	dnsSrvRecordPortLabel   = "__meta_dns_srv_record_port"
+)
+
+// Resolver does the lookups of the DNS discoverer, net.Resolver is one.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DNSDiscoverer looks the names up on every refresh interval, every name is
+// a group of its own.
+type DNSDiscoverer struct {
+	names    []string
+	qtype    string
+	port     int
+	interval time.Duration
+	resolver Resolver
+}
+
+// NewDNSDiscoverer uses the resolver for the lookups, or the default one
+// when it's nil.
+func NewDNSDiscoverer(cfg *config.DNSSDConfig, resolver Resolver) *DNSDiscoverer {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return &DNSDiscoverer{
+		names:    cfg.Names,
+		qtype:    cfg.Type,
+		port:     cfg.Port,
+		interval: time.Duration(cfg.RefreshInterval),
+		resolver: resolver,
+	}
+}
+
+func (d *DNSDiscoverer) Run(ctx context.Context, up chan<- []*Group) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		d.refresh(ctx, up)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh sends the groups of the names which resolved. Names which didn't
+// keep their targets from before, a DNS hiccup shouldn't stop the scrapes.
+func (d *DNSDiscoverer) refresh(ctx context.Context, up chan<- []*Group) {
+	var groups []*Group
+	for _, name := range d.names {
+		g, err := d.lookup(ctx, name)
+		if err != nil {
+			log.Printf("DNS lookup of %s failed: %v", name, err)
+			continue
+		}
+		groups = append(groups, g)
+	}
+
+	select {
+	case up <- groups:
+	case <-ctx.Done():
+	}
+}
+
+func (d *DNSDiscoverer) lookup(ctx context.Context, name string) (*Group, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.interval)
+	defer cancel()
+
+	g := &Group{Source: name}
+
+	switch d.qtype {
+	case "SRV":
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range records {
+			// The trailing dot of the fully qualified name isn't wanted in
+			// the address
+			host := strings.TrimSuffix(r.Target, ".")
+			port := strconv.Itoa(int(r.Port))
+			g.Targets = append(g.Targets, labels.FromStrings(
+				addressLabel, net.JoinHostPort(host, port),
+				dnsNameLabel, name,
+				dnsSrvRecordTargetLabel, r.Target,
+				dnsSrvRecordPortLabel, port,
+			))
+		}
+	case "A", "AAAA":
+		addrs, err := d.resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			// The lookup returns both, only the asked for ones are wanted
+			if (addr.IP.To4() != nil) != (d.qtype == "A") {
+				continue
+			}
+			g.Targets = append(g.Targets, labels.FromStrings(
+				addressLabel, net.JoinHostPort(addr.IP.String(), strconv.Itoa(d.port)),
+				dnsNameLabel, name,
+			))
+		}
+	default:
+		return nil, fmt.Errorf("unknown record type %q", d.qtype)
+	}
+
+	return g, nil
+}
@@ -0,0 +1,134 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+// stubResolver answers from its maps, names which aren't there fail.
+type stubResolver struct {
+	mtx sync.Mutex
+	srv map[string][]*net.SRV
+	ip  map[string][]net.IPAddr
+}
+
+func (r *stubResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	records, ok := r.srv[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, records, nil
+}
+
+func (r *stubResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	addrs, ok := r.ip[host]
+	if !ok {
+		return nil, errors.New("server misbehaving")
+	}
+	return addrs, nil
+}
+
+func Test_dnsDiscoverer_srv(t *testing.T) {
+	resolver := &stubResolver{srv: map[string][]*net.SRV{
+		"_metrics._tcp.node.example.com": {
+			{Target: "node-1.example.com.", Port: 9100},
+			{Target: "node-2.example.com.", Port: 9101},
+		},
+	}}
+
+	d := NewDNSDiscoverer(&config.DNSSDConfig{
+		Names:           []string{"_metrics._tcp.node.example.com", "_metrics._tcp.missing.example.com"},
+		Type:            "SRV",
+		RefreshInterval: config.Duration(10 * time.Millisecond),
+	}, resolver)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := make(chan []*Group)
+	go d.Run(ctx, up)
+
+	// The name which didn't resolve isn't there
+	groups := receive(t, up)
+	if len(groups) != 1 {
+		t.Fatalf("Expected 1 group, got %d", len(groups))
+	}
+	want := []labels.Labels{
+		labels.FromStrings(
+			"__address__", "node-1.example.com:9100",
+			"__meta_dns_name", "_metrics._tcp.node.example.com",
+			"__meta_dns_srv_record_target", "node-1.example.com.",
+			"__meta_dns_srv_record_port", "9100",
+		),
+		labels.FromStrings(
+			"__address__", "node-2.example.com:9101",
+			"__meta_dns_name", "_metrics._tcp.node.example.com",
+			"__meta_dns_srv_record_target", "node-2.example.com.",
+			"__meta_dns_srv_record_port", "9101",
+		),
+	}
+	if len(groups[0].Targets) != len(want) {
+		t.Fatalf("Expected %d targets, got %v", len(want), groups[0].Targets)
+	}
+	for i := range want {
+		if !labels.Equal(groups[0].Targets[i], want[i]) {
+			t.Errorf("Expected target %v, got %v", want[i], groups[0].Targets[i])
+		}
+	}
+
+	// The records change, the next refresh has them
+	resolver.mtx.Lock()
+	resolver.srv["_metrics._tcp.node.example.com"] = resolver.srv["_metrics._tcp.node.example.com"][1:]
+	resolver.mtx.Unlock()
+
+	for {
+		groups := receive(t, up)
+		if len(groups) == 1 && len(groups[0].Targets) == 1 {
+			break
+		}
+	}
+}
+
+func Test_dnsDiscoverer_a(t *testing.T) {
+	resolver := &stubResolver{ip: map[string][]net.IPAddr{
+		"node.example.com": {
+			{IP: net.ParseIP("10.0.0.1")},
+			{IP: net.ParseIP("fd00::1")},
+		},
+	}}
+
+	for qtype, want := range map[string]string{"A": "10.0.0.1:9100", "AAAA": "[fd00::1]:9100"} {
+		d := NewDNSDiscoverer(&config.DNSSDConfig{
+			Names:           []string{"node.example.com"},
+			Type:            qtype,
+			Port:            9100,
+			RefreshInterval: config.Duration(time.Minute),
+		}, resolver)
+
+		up := make(chan []*Group, 1)
+		d.refresh(context.Background(), up)
+		groups := <-up
+
+		if len(groups) != 1 || len(groups[0].Targets) != 1 {
+			t.Fatalf("Expected a single %s target, got %v", qtype, groups)
+		}
+		if addr := groups[0].Targets[0].Get("__address__"); addr != want {
+			t.Errorf("Expected %s target %s, got %s", qtype, want, addr)
+		}
+		if name := groups[0].Targets[0].Get("__meta_dns_name"); name != "node.example.com" {
+			t.Errorf("Expected the name in __meta_dns_name, got %q", name)
+		}
+	}
+}
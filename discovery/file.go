@@ -0,0 +1,213 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+const fileSDFilepathLabel = "__meta_filepath"
+
+// FileDiscoverer reads the target groups from files, and reads them again
+// when the watch says they changed and on every refresh interval, in case
+// the watch missed something, or couldn't be set up at all.
+type FileDiscoverer struct {
+	paths    []string
+	interval time.Duration
+
+	// groups is the number of groups last read from every file, so the
+	// groups of files which shrank or are gone can be removed.
+	groups map[string]int
+}
+
+func NewFileDiscoverer(cfg *config.FileSDConfig) *FileDiscoverer {
+	return &FileDiscoverer{
+		paths:    cfg.Files,
+		interval: time.Duration(cfg.RefreshInterval),
+		groups:   make(map[string]int),
+	}
+}
+
+func (d *FileDiscoverer) Run(ctx context.Context, up chan<- []*Group) {
+	// Watching the directories catches files created after the start, and
+	// files replaced by a rename, as config management tools like to do.
+	var (
+		events chan fsnotify.Event
+		errs   chan error
+	)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Watching files for file_sd failed, only refreshing every %s: %v", d.interval, err)
+	} else {
+		defer watcher.Close()
+		events, errs = watcher.Events, watcher.Errors
+
+		for _, dir := range d.dirs() {
+			if err := watcher.Add(dir); err != nil {
+				log.Printf("Watching %s for file_sd failed: %v", dir, err)
+			}
+		}
+	}
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	d.refresh(ctx, up)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			// Chmod is all a touch does
+			if ev.Op == fsnotify.Chmod || !d.matches(ev.Name) {
+				continue
+			}
+			d.refresh(ctx, up)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			log.Printf("Watching files for file_sd failed: %v", err)
+		case <-ticker.C:
+			d.refresh(ctx, up)
+		}
+	}
+}
+
+func (d *FileDiscoverer) dirs() []string {
+	var dirs []string
+	for _, p := range d.paths {
+		dir, _ := filepath.Split(p)
+		if dir == "" {
+			dir = "."
+		}
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+func (d *FileDiscoverer) matches(name string) bool {
+	for _, p := range d.paths {
+		if ok, _ := filepath.Match(filepath.Clean(p), filepath.Clean(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh sends the groups of all the files. Files which don't read or parse
+// keep their previous groups, a half-written file doesn't drop its targets.
+func (d *FileDiscoverer) refresh(ctx context.Context, up chan<- []*Group) {
+	seen := make(map[string]int)
+
+	var all []*Group
+	for _, p := range d.paths {
+		files, _ := filepath.Glob(p)
+		for _, file := range files {
+			groups, err := readFile(file)
+			if err != nil {
+				log.Printf("Reading file_sd file %s failed: %v", file, err)
+				if n, ok := d.groups[file]; ok {
+					seen[file] = n
+				}
+				continue
+			}
+
+			all = append(all, groups...)
+			seen[file] = len(groups)
+		}
+	}
+
+	// Empty groups remove the ones which are gone
+	for file, n := range d.groups {
+		for i := seen[file]; i < n; i++ {
+			all = append(all, &Group{Source: groupSource(file, i)})
+		}
+	}
+	d.groups = seen
+
+	select {
+	case up <- all:
+	case <-ctx.Done():
+	}
+}
+
+func groupSource(source string, i int) string {
+	return source + ":" + strconv.Itoa(i)
+}
+
+// fileGroup is a group as it's written in the file, the same as
+// static_configs. http_sd serves them too.
+type fileGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+func readFile(file string) ([]*Group, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var fgs []fileGroup
+	switch ext := filepath.Ext(file); ext {
+	case ".json":
+		err = json.Unmarshal(b, &fgs)
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(b, &fgs)
+	default:
+		err = fmt.Errorf("unknown file extension %q", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newGroups(fgs, file, labels.Label{Name: fileSDFilepathLabel, Value: file})
+}
+
+// newGroups validates the groups and adds the meta label saying where they
+// came from to them.
+func newGroups(fgs []fileGroup, source string, meta labels.Label) ([]*Group, error) {
+	groups := make([]*Group, 0, len(fgs))
+	for i, fg := range fgs {
+		lb := labels.NewBuilder(labels.FromMap(fg.Labels))
+		lb.Set(meta.Name, meta.Value)
+
+		g := &Group{
+			Labels: lb.Labels(),
+			Source: groupSource(source, i),
+		}
+		for name := range fg.Labels {
+			if !labels.IsValidLabelName(name) {
+				return nil, fmt.Errorf("%q is not a valid label name", name)
+			}
+		}
+		for _, addr := range fg.Targets {
+			if addr == "" {
+				return nil, fmt.Errorf("empty target in group %d", i)
+			}
+			g.Targets = append(g.Targets, labels.FromStrings(addressLabel, addr))
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
@@ -0,0 +1,154 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+// receive waits for the next groups from the discoverer.
+func receive(t *testing.T, up <-chan []*Group) []*Group {
+	t.Helper()
+
+	select {
+	case groups := <-up:
+		return groups
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No groups received")
+		return nil
+	}
+}
+
+func writeFile(t *testing.T, file, content string) {
+	t.Helper()
+
+	// Written next to it and renamed, so the discoverer never sees half a file
+	tmp := filepath.Join(filepath.Dir(file), ".tmp")
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		t.Fatalf("Failed to rename to %s: %v", file, err)
+	}
+}
+
+func Test_readFile(t *testing.T) {
+	dir := t.TempDir()
+
+	json := filepath.Join(dir, "targets.json")
+	writeFile(t, json, `[{"targets": ["node-1:9100", "node-2:9100"], "labels": {"zone": "a"}}, {"targets": ["node-3:9100"]}]`)
+	yml := filepath.Join(dir, "targets.yml")
+	writeFile(t, yml, "- targets: [node-1:9100, node-2:9100]\n  labels:\n    zone: a\n- targets: [node-3:9100]\n")
+
+	for _, file := range []string{json, yml} {
+		groups, err := readFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file, err)
+		}
+
+		if len(groups) != 2 {
+			t.Fatalf("Expected 2 groups in %s, got %d", file, len(groups))
+		}
+		if want := labels.FromStrings("__meta_filepath", file, "zone", "a"); !labels.Equal(groups[0].Labels, want) {
+			t.Errorf("Expected group labels %v, got %v", want, groups[0].Labels)
+		}
+		if len(groups[0].Targets) != 2 || groups[1].Targets[0].Get("__address__") != "node-3:9100" {
+			t.Errorf("Unexpected targets in %s", file)
+		}
+		if groups[0].Source != file+":0" || groups[1].Source != file+":1" {
+			t.Errorf("Unexpected sources %s and %s", groups[0].Source, groups[1].Source)
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	writeFile(t, bad, `[{"targets": ["node-1:9100"], "labels": {"1zone": "a"}}]`)
+	if _, err := readFile(bad); err == nil {
+		t.Errorf("Invalid label name didn't fail")
+	}
+}
+
+func Test_fileDiscoverer_watch(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "targets.yml")
+	writeFile(t, file, "- targets: [node-1:9100]\n- targets: [node-2:9100]\n")
+
+	// The refresh interval is too long to matter, the watch has to notice
+	d := NewFileDiscoverer(&config.FileSDConfig{
+		Files:           []string{filepath.Join(dir, "*.yml")},
+		RefreshInterval: config.Duration(time.Hour),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := make(chan []*Group)
+	go d.Run(ctx, up)
+
+	if groups := receive(t, up); len(groups) != 2 {
+		t.Fatalf("Expected 2 groups at start, got %d", len(groups))
+	}
+
+	// The second group is gone, an empty group removes it
+	writeFile(t, file, "- targets: [node-1:9100, node-3:9100]\n")
+	for {
+		groups := receive(t, up)
+		if len(groups) == 2 && len(groups[0].Targets) == 2 && len(groups[1].Targets) == 0 {
+			if groups[1].Source != file+":1" {
+				t.Errorf("Wrong group removed: %s", groups[1].Source)
+			}
+			break
+		}
+	}
+
+	// A broken file keeps its targets
+	writeFile(t, file, "- targets: [node-1:9100\n")
+	for {
+		groups := receive(t, up)
+		if len(groups) == 0 {
+			break
+		}
+	}
+
+	// A new file matching the glob is picked up
+	writeFile(t, filepath.Join(dir, "more.yml"), "- targets: [node-4:9100]\n")
+	for {
+		groups := receive(t, up)
+		if len(groups) == 1 && groups[0].Targets[0].Get("__address__") == "node-4:9100" {
+			break
+		}
+	}
+}
+
+func Test_fileDiscoverer_refresh(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "targets.json")
+	writeFile(t, file, `[{"targets": ["node-1:9100"]}]`)
+
+	d := NewFileDiscoverer(&config.FileSDConfig{
+		Files:           []string{file},
+		RefreshInterval: config.Duration(10 * time.Millisecond),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := make(chan []*Group)
+	go d.Run(ctx, up)
+
+	receive(t, up)
+	// Even unchanged, the groups are sent again on every refresh
+	if groups := receive(t, up); len(groups) != 1 {
+		t.Errorf("Expected the group sent again on refresh, got %d groups", len(groups))
+	}
+
+	os.Remove(file)
+	for {
+		groups := receive(t, up)
+		if len(groups) == 1 && len(groups[0].Targets) == 0 {
+			break
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+const (
+	httpSDURLLabel = "__meta_url"
+
+	httpSDUserAgent = "Scratcheus"
+	// httpSDMinBackoff is the first retry after a failed refresh, the retries
+	// back off from there up to the refresh interval.
+	httpSDMinBackoff = time.Second
+)
+
+// HTTPDiscoverer polls a URL for the target groups. The ETag of the last
+// response is sent along, an unchanged list isn't sent again. A failed poll
+// keeps the targets from before and is retried with a backoff.
+type HTTPDiscoverer struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+
+	etag string
+	// groups is the number of groups in the last response, so the groups
+	// which are gone can be removed.
+	groups     int
+	minBackoff time.Duration
+}
+
+// NewHTTPDiscoverer uses the client for the polls, or the default one when
+// it's nil.
+func NewHTTPDiscoverer(cfg *config.HTTPSDConfig, client *http.Client) *HTTPDiscoverer {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &HTTPDiscoverer{
+		url:        cfg.URL,
+		interval:   time.Duration(cfg.RefreshInterval),
+		client:     client,
+		minBackoff: httpSDMinBackoff,
+	}
+}
+
+func (d *HTTPDiscoverer) Run(ctx context.Context, up chan<- []*Group) {
+	var backoff time.Duration
+	for {
+		wait := d.interval
+
+		groups, err := d.refresh(ctx)
+		if err != nil {
+			backoff = min(max(2*backoff, d.minBackoff), d.interval)
+			wait = backoff
+			log.Printf("Polling %s for http_sd failed, retrying in %s: %v", d.url, wait, err)
+		} else {
+			backoff = 0
+		}
+
+		if groups != nil {
+			select {
+			case up <- groups:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// refresh returns nil groups when nothing changed since the last time.
+func (d *HTTPDiscoverer) refresh(ctx context.Context) ([]*Group, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.interval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", httpSDUserAgent)
+	if d.etag != "" {
+		req.Header.Set("If-None-Match", d.etag)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != "application/json" {
+		return nil, fmt.Errorf("unsupported content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	var fgs []fileGroup
+	if err := json.NewDecoder(resp.Body).Decode(&fgs); err != nil {
+		return nil, err
+	}
+
+	groups, err := newGroups(fgs, d.url, labels.Label{Name: httpSDURLLabel, Value: d.url})
+	if err != nil {
+		return nil, err
+	}
+
+	// Empty groups remove the ones which are gone
+	for i := len(groups); i < d.groups; i++ {
+		groups = append(groups, &Group{Source: groupSource(d.url, i)})
+	}
+	d.groups = len(fgs)
+	d.etag = resp.Header.Get("ETag")
+
+	return groups, nil
+}
@@ -0,0 +1,134 @@
+package discovery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+// inventory serves the groups with an ETag, or fails when told to.
+type inventory struct {
+	mtx      sync.Mutex
+	body     string
+	etag     string
+	fail     bool
+	requests int
+	notMod   int
+}
+
+func (inv *inventory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	inv.mtx.Lock()
+	defer inv.mtx.Unlock()
+
+	inv.requests++
+	if inv.fail {
+		http.Error(w, "inventory is down", http.StatusInternalServerError)
+		return
+	}
+	if r.Header.Get("If-None-Match") == inv.etag {
+		inv.notMod++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("ETag", inv.etag)
+	w.Write([]byte(inv.body))
+}
+
+func (inv *inventory) set(body, etag string, fail bool) {
+	inv.mtx.Lock()
+	defer inv.mtx.Unlock()
+
+	inv.body, inv.etag, inv.fail = body, etag, fail
+}
+
+func Test_httpDiscoverer(t *testing.T) {
+	inv := &inventory{}
+	inv.set(`[{"targets": ["node-1:9100"], "labels": {"zone": "a"}}, {"targets": ["node-2:9100"]}]`, `"v1"`, false)
+	server := httptest.NewServer(inv)
+	defer server.Close()
+
+	d := NewHTTPDiscoverer(&config.HTTPSDConfig{URL: server.URL, RefreshInterval: config.Duration(time.Minute)}, server.Client())
+
+	groups, err := d.refresh(context.Background())
+	if err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 groups, got %d", len(groups))
+	}
+	if want := labels.FromStrings("__meta_url", server.URL, "zone", "a"); !labels.Equal(groups[0].Labels, want) {
+		t.Errorf("Expected group labels %v, got %v", want, groups[0].Labels)
+	}
+
+	// Same ETag, nothing's sent
+	groups, err = d.refresh(context.Background())
+	if err != nil || groups != nil || inv.notMod != 1 {
+		t.Errorf("Expected an unchanged response, got %v, %v", groups, err)
+	}
+
+	// The second group is gone, an empty group removes it
+	inv.set(`[{"targets": ["node-1:9100", "node-3:9100"]}]`, `"v2"`, false)
+	groups, err = d.refresh(context.Background())
+	if err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if len(groups) != 2 || len(groups[0].Targets) != 2 || len(groups[1].Targets) != 0 || groups[1].Source != server.URL+":1" {
+		t.Errorf("Expected the second group removed, got %v", groups)
+	}
+
+	inv.set(`[]`, `"v3"`, true)
+	if _, err := d.refresh(context.Background()); err == nil {
+		t.Errorf("Failed poll didn't fail")
+	}
+}
+
+func Test_httpDiscoverer_contentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	d := NewHTTPDiscoverer(&config.HTTPSDConfig{URL: server.URL, RefreshInterval: config.Duration(time.Minute)}, server.Client())
+	if _, err := d.refresh(context.Background()); err == nil {
+		t.Errorf("Response which isn't JSON didn't fail")
+	}
+}
+
+func Test_httpDiscoverer_backoff(t *testing.T) {
+	inv := &inventory{}
+	inv.set(`[]`, `"v1"`, true)
+	server := httptest.NewServer(inv)
+	defer server.Close()
+
+	// The refresh interval is too long to matter, only the retries poll
+	d := NewHTTPDiscoverer(&config.HTTPSDConfig{URL: server.URL, RefreshInterval: config.Duration(time.Hour)}, server.Client())
+	d.minBackoff = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := make(chan []*Group)
+	go d.Run(ctx, up)
+
+	// 10ms, 20ms, 40ms, the fourth poll is due after 70ms
+	time.Sleep(50 * time.Millisecond)
+	inv.mtx.Lock()
+	requests := inv.requests
+	inv.mtx.Unlock()
+	if requests < 2 || requests > 4 {
+		t.Errorf("Expected a few retries backing off, got %d polls", requests)
+	}
+
+	inv.set(`[{"targets": ["node-1:9100"]}]`, `"v2"`, false)
+	if groups := receive(t, up); len(groups) != 1 {
+		t.Errorf("Expected the groups once the inventory's back, got %v", groups)
+	}
+}
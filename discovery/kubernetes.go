@@ -0,0 +1,375 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+const (
+	k8sMetaPrefix         = "__meta_kubernetes_"
+	k8sNamespaceLabel     = k8sMetaPrefix + "namespace"
+	k8sPodPrefix          = k8sMetaPrefix + "pod_"
+	k8sServicePrefix      = k8sMetaPrefix + "service_"
+	k8sEndpointsPrefix    = k8sMetaPrefix + "endpoints_"
+	k8sEndpointPrefix     = k8sMetaPrefix + "endpoint_"
+	k8sDefaultRetryPeriod = time.Second
+)
+
+// KubernetesDiscoverer finds pods, services or endpoints, depending on the
+// role, and keeps them up to date by watching the API. Every object is a
+// group of its own, with a target for each of its ports.
+type KubernetesDiscoverer struct {
+	role       string
+	client     *k8sClient
+	namespaces []string
+	// retryInterval is the wait after a failed list or watch
+	retryInterval time.Duration
+
+	pods      informerSet[*pod]
+	services  informerSet[*service]
+	endpoints informerSet[*endpoints]
+}
+
+func NewKubernetesDiscoverer(cfg *config.KubernetesSDConfig) (*KubernetesDiscoverer, error) {
+	client, err := newK8sClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := cfg.Namespaces.Names
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+
+	return &KubernetesDiscoverer{
+		role:          cfg.Role,
+		client:        client,
+		namespaces:    namespaces,
+		retryInterval: k8sDefaultRetryPeriod,
+	}, nil
+}
+
+func (d *KubernetesDiscoverer) Run(ctx context.Context, up chan<- []*Group) {
+	send := func(groups []*Group) {
+		select {
+		case up <- groups:
+		case <-ctx.Done():
+		}
+	}
+
+	// The endpoints take the labels of their service and pods, those have to
+	// be watched too, a change to them changes the endpoints' groups
+	switch d.role {
+	case "pod":
+		d.pods = newInformerSet[*pod](d, "pods", func(keys []string) {
+			send(d.groups(keys, d.podGroup))
+		})
+	case "service":
+		d.services = newInformerSet[*service](d, "services", func(keys []string) {
+			send(d.groups(keys, d.serviceGroup))
+		})
+	case "endpoints":
+		d.endpoints = newInformerSet[*endpoints](d, "endpoints", func(keys []string) {
+			send(d.groups(keys, d.endpointsGroup))
+		})
+		d.services = newInformerSet[*service](d, "services", func(keys []string) {
+			send(d.groups(d.endpointsOfServices(keys), d.endpointsGroup))
+		})
+		d.pods = newInformerSet[*pod](d, "pods", func(keys []string) {
+			send(d.groups(d.endpointsOfPods(keys), d.endpointsGroup))
+		})
+	}
+
+	var wg sync.WaitGroup
+	d.pods.run(ctx, &wg)
+	d.services.run(ctx, &wg)
+	d.endpoints.run(ctx, &wg)
+	wg.Wait()
+}
+
+func (d *KubernetesDiscoverer) groups(keys []string, group func(key string) *Group) []*Group {
+	groups := make([]*Group, 0, len(keys))
+	for _, key := range keys {
+		groups = append(groups, group(key))
+	}
+	return groups
+}
+
+// podGroup has a target for every port of every container. Containers
+// without ports get a target without a port, to be set by relabeling.
+func (d *KubernetesDiscoverer) podGroup(key string) *Group {
+	g := &Group{Source: "pod/" + key}
+
+	p, ok := d.pods.get(key)
+	if !ok {
+		return g
+	}
+	g.Labels = podLabels(p)
+
+	// Pods which aren't running yet have no address
+	if p.Status.PodIP == "" {
+		return g
+	}
+
+	for _, c := range p.Spec.Containers {
+		if len(c.Ports) == 0 {
+			g.Targets = append(g.Targets, labels.FromStrings(
+				addressLabel, p.Status.PodIP,
+				k8sPodPrefix+"container_name", c.Name,
+				k8sPodPrefix+"container_image", c.Image,
+			))
+			continue
+		}
+
+		for _, port := range c.Ports {
+			number := strconv.Itoa(int(port.ContainerPort))
+			g.Targets = append(g.Targets, labels.FromStrings(
+				addressLabel, net.JoinHostPort(p.Status.PodIP, number),
+				k8sPodPrefix+"container_name", c.Name,
+				k8sPodPrefix+"container_image", c.Image,
+				k8sPodPrefix+"container_port_name", port.Name,
+				k8sPodPrefix+"container_port_number", number,
+				k8sPodPrefix+"container_port_protocol", port.Protocol,
+			))
+		}
+	}
+	return g
+}
+
+func podLabels(p *pod) labels.Labels {
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	lb.Set(k8sNamespaceLabel, p.Metadata.Namespace)
+	lb.Set(k8sPodPrefix+"name", p.Metadata.Name)
+	lb.Set(k8sPodPrefix+"uid", p.Metadata.UID)
+	lb.Set(k8sPodPrefix+"ip", p.Status.PodIP)
+	lb.Set(k8sPodPrefix+"phase", p.Status.Phase)
+	lb.Set(k8sPodPrefix+"node_name", p.Spec.NodeName)
+	lb.Set(k8sPodPrefix+"host_ip", p.Status.HostIP)
+
+	ready := "unknown"
+	for _, c := range p.Status.Conditions {
+		if c.Type == "Ready" {
+			ready = strings.ToLower(c.Status)
+		}
+	}
+	lb.Set(k8sPodPrefix+"ready", ready)
+
+	for _, ref := range p.Metadata.OwnerReferences {
+		if ref.Controller != nil && *ref.Controller {
+			lb.Set(k8sPodPrefix+"controller_kind", ref.Kind)
+			lb.Set(k8sPodPrefix+"controller_name", ref.Name)
+		}
+	}
+
+	addObjectMeta(lb, k8sPodPrefix, p.Metadata)
+	return lb.Labels()
+}
+
+// serviceGroup has a target for every port of the service, at the DNS name
+// of the service.
+func (d *KubernetesDiscoverer) serviceGroup(key string) *Group {
+	g := &Group{Source: "svc/" + key}
+
+	s, ok := d.services.get(key)
+	if !ok {
+		return g
+	}
+	g.Labels = serviceLabels(s)
+
+	host := s.Metadata.Name + "." + s.Metadata.Namespace + ".svc"
+	for _, port := range s.Spec.Ports {
+		number := strconv.Itoa(int(port.Port))
+		g.Targets = append(g.Targets, labels.FromStrings(
+			addressLabel, net.JoinHostPort(host, number),
+			k8sServicePrefix+"port_name", port.Name,
+			k8sServicePrefix+"port_number", number,
+			k8sServicePrefix+"port_protocol", port.Protocol,
+		))
+	}
+	return g
+}
+
+func serviceLabels(s *service) labels.Labels {
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	lb.Set(k8sNamespaceLabel, s.Metadata.Namespace)
+	lb.Set(k8sServicePrefix+"name", s.Metadata.Name)
+	lb.Set(k8sServicePrefix+"type", s.Spec.Type)
+	if s.Spec.Type == "ExternalName" {
+		lb.Set(k8sServicePrefix+"external_name", s.Spec.ExternalName)
+	} else {
+		lb.Set(k8sServicePrefix+"cluster_ip", s.Spec.ClusterIP)
+	}
+
+	addObjectMeta(lb, k8sServicePrefix, s.Metadata)
+	return lb.Labels()
+}
+
+// endpointsGroup has a target for every port of every address, ready or
+// not. The labels of the service with the same name and of the pods behind
+// the addresses are added.
+func (d *KubernetesDiscoverer) endpointsGroup(key string) *Group {
+	g := &Group{Source: "endpoints/" + key}
+
+	e, ok := d.endpoints.get(key)
+	if !ok {
+		return g
+	}
+
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	if s, ok := d.services.get(key); ok {
+		lb.Reset(serviceLabels(s))
+	}
+	lb.Set(k8sNamespaceLabel, e.Metadata.Namespace)
+	lb.Set(k8sEndpointsPrefix+"name", e.Metadata.Name)
+	addObjectMeta(lb, k8sEndpointsPrefix, e.Metadata)
+	g.Labels = lb.Labels()
+
+	for _, subset := range e.Subsets {
+		addrs := [][]endpointAddress{subset.Addresses, subset.NotReadyAddresses}
+		for i, ready := range []string{"true", "false"} {
+			for _, addr := range addrs[i] {
+				for _, port := range subset.Ports {
+					number := strconv.Itoa(int(port.Port))
+
+					tb := labels.NewBuilder(labels.EmptyLabels())
+					if addr.TargetRef != nil && addr.TargetRef.Kind == "Pod" {
+						if p, ok := d.pods.get(objectKey(addr.TargetRef.Namespace, addr.TargetRef.Name)); ok {
+							tb.Reset(podLabels(p))
+						}
+						tb.Del(k8sNamespaceLabel)
+					}
+					tb.Set(addressLabel, net.JoinHostPort(addr.IP, number))
+					tb.Set(k8sEndpointPrefix+"ready", ready)
+					tb.Set(k8sEndpointPrefix+"hostname", addr.Hostname)
+					if addr.NodeName != nil {
+						tb.Set(k8sEndpointPrefix+"node_name", *addr.NodeName)
+					}
+					if addr.TargetRef != nil {
+						tb.Set(k8sEndpointPrefix+"address_target_kind", addr.TargetRef.Kind)
+						tb.Set(k8sEndpointPrefix+"address_target_name", addr.TargetRef.Name)
+					}
+					tb.Set(k8sEndpointPrefix+"port_name", port.Name)
+					tb.Set(k8sEndpointPrefix+"port_number", number)
+					tb.Set(k8sEndpointPrefix+"port_protocol", port.Protocol)
+
+					g.Targets = append(g.Targets, tb.Labels())
+				}
+			}
+		}
+	}
+	return g
+}
+
+// endpointsOfServices are the endpoints named like the services.
+func (d *KubernetesDiscoverer) endpointsOfServices(keys []string) []string {
+	var res []string
+	for _, key := range keys {
+		if _, ok := d.endpoints.get(key); ok {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// endpointsOfPods are the endpoints with the pods behind their addresses.
+func (d *KubernetesDiscoverer) endpointsOfPods(keys []string) []string {
+	pods := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		pods[key] = struct{}{}
+	}
+
+	var res []string
+	for _, e := range d.endpoints.objects() {
+		if endpointsHavePod(e, pods) {
+			res = append(res, objectKey(e.Metadata.Namespace, e.Metadata.Name))
+		}
+	}
+	return res
+}
+
+func endpointsHavePod(e *endpoints, pods map[string]struct{}) bool {
+	for _, subset := range e.Subsets {
+		for _, addr := range slices.Concat(subset.Addresses, subset.NotReadyAddresses) {
+			if addr.TargetRef == nil || addr.TargetRef.Kind != "Pod" {
+				continue
+			}
+			if _, ok := pods[objectKey(addr.TargetRef.Namespace, addr.TargetRef.Name)]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addObjectMeta adds the labels and annotations of the object. The present
+// labels tell a label with an empty value from one which isn't there.
+func addObjectMeta(lb *labels.Builder, prefix string, m objectMeta) {
+	for name, value := range m.Labels {
+		name = sanitizeLabelName(name)
+		lb.Set(prefix+"label_"+name, value)
+		lb.Set(prefix+"labelpresent_"+name, "true")
+	}
+	for name, value := range m.Annotations {
+		name = sanitizeLabelName(name)
+		lb.Set(prefix+"annotation_"+name, value)
+		lb.Set(prefix+"annotationpresent_"+name, "true")
+	}
+}
+
+// sanitizeLabelName replaces what can't be in a label name, Kubernetes
+// label names have dots, dashes and slashes.
+func sanitizeLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// informerSet is the informers of a resource, one for every namespace.
+type informerSet[T k8sObject] []*informer[T]
+
+func newInformerSet[T k8sObject](d *KubernetesDiscoverer, resource string, onChange func(keys []string)) informerSet[T] {
+	set := make(informerSet[T], 0, len(d.namespaces))
+	for _, ns := range d.namespaces {
+		set = append(set, newInformer[T](d.client, ns, resource, d.retryInterval, onChange))
+	}
+	return set
+}
+
+func (s informerSet[T]) get(key string) (T, bool) {
+	for _, inf := range s {
+		if obj, ok := inf.get(key); ok {
+			return obj, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+func (s informerSet[T]) objects() []T {
+	var objs []T
+	for _, inf := range s {
+		objs = append(objs, inf.objects()...)
+	}
+	return objs
+}
+
+func (s informerSet[T]) run(ctx context.Context, wg *sync.WaitGroup) {
+	for _, inf := range s {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inf.run(ctx)
+		}()
+	}
+}
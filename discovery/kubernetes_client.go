@@ -0,0 +1,397 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/config"
+)
+
+// Where the service account of a pod is mounted, for running in the cluster.
+const (
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// k8sClient talks to the API server, it only needs to list and watch.
+type k8sClient struct {
+	server    string
+	client    *http.Client
+	tokenFile string
+}
+
+func newK8sClient(cfg *config.KubernetesSDConfig) (*k8sClient, error) {
+	server, tokenFile, tlsConfig := cfg.APIServer, cfg.BearerTokenFile, cfg.TLSConfig
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("no api_server and not running in a Kubernetes cluster")
+		}
+
+		server = "https://" + net.JoinHostPort(host, port)
+		if tokenFile == "" {
+			tokenFile = inClusterTokenFile
+		}
+		if tlsConfig.CAFile == "" {
+			tlsConfig.CAFile = inClusterCAFile
+		}
+	}
+
+	tc, err := tlsConfig.NewTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tc
+
+	return &k8sClient{
+		server:    strings.TrimSuffix(server, "/"),
+		client:    &http.Client{Transport: transport},
+		tokenFile: tokenFile,
+	}, nil
+}
+
+// get returns the body of a successful response, the caller closes it.
+func (c *k8sClient) get(ctx context.Context, path string, query url.Values) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	// Read on every request, service account tokens are rotated
+	if c.tokenFile != "" {
+		token, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			return nil, errGone
+		}
+		return nil, fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// errGone is the resource version being too old to watch from, it takes
+// listing everything again.
+var errGone = errors.New("resource version too old")
+
+// The parts of the API objects the discoverer uses.
+type (
+	objectMeta struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		UID             string            `json:"uid"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Labels          map[string]string `json:"labels"`
+		Annotations     map[string]string `json:"annotations"`
+		OwnerReferences []ownerReference  `json:"ownerReferences"`
+	}
+
+	ownerReference struct {
+		Kind       string `json:"kind"`
+		Name       string `json:"name"`
+		Controller *bool  `json:"controller"`
+	}
+
+	pod struct {
+		Metadata objectMeta `json:"metadata"`
+		Spec     struct {
+			NodeName   string         `json:"nodeName"`
+			Containers []k8sContainer `json:"containers"`
+		} `json:"spec"`
+		Status struct {
+			Phase      string `json:"phase"`
+			PodIP      string `json:"podIP"`
+			HostIP     string `json:"hostIP"`
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	}
+
+	k8sContainer struct {
+		Name  string `json:"name"`
+		Image string `json:"image"`
+		Ports []struct {
+			Name          string `json:"name"`
+			ContainerPort int32  `json:"containerPort"`
+			Protocol      string `json:"protocol"`
+		} `json:"ports"`
+	}
+
+	service struct {
+		Metadata objectMeta `json:"metadata"`
+		Spec     struct {
+			Type         string `json:"type"`
+			ClusterIP    string `json:"clusterIP"`
+			ExternalName string `json:"externalName"`
+			Ports        []struct {
+				Name     string `json:"name"`
+				Port     int32  `json:"port"`
+				Protocol string `json:"protocol"`
+			} `json:"ports"`
+		} `json:"spec"`
+	}
+
+	endpoints struct {
+		Metadata objectMeta `json:"metadata"`
+		Subsets  []struct {
+			Addresses         []endpointAddress `json:"addresses"`
+			NotReadyAddresses []endpointAddress `json:"notReadyAddresses"`
+			Ports             []struct {
+				Name     string `json:"name"`
+				Port     int32  `json:"port"`
+				Protocol string `json:"protocol"`
+			} `json:"ports"`
+		} `json:"subsets"`
+	}
+
+	endpointAddress struct {
+		IP        string  `json:"ip"`
+		Hostname  string  `json:"hostname"`
+		NodeName  *string `json:"nodeName"`
+		TargetRef *struct {
+			Kind      string `json:"kind"`
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"targetRef"`
+	}
+)
+
+func (p *pod) meta() *objectMeta       { return &p.Metadata }
+func (s *service) meta() *objectMeta   { return &s.Metadata }
+func (e *endpoints) meta() *objectMeta { return &e.Metadata }
+
+type k8sObject interface {
+	*pod | *service | *endpoints
+	meta() *objectMeta
+}
+
+// informer keeps the objects of a resource up to date, listing them and then
+// watching for changes. onChange gets the keys of the objects which were
+// added, changed or deleted, namespace/name.
+type informer[T k8sObject] struct {
+	client *k8sClient
+	// path is the resource, in a namespace or in all of them
+	path     string
+	onChange func(keys []string)
+	// retryInterval is the wait after a failed list or watch
+	retryInterval time.Duration
+
+	mtx   sync.RWMutex
+	store map[string]T
+}
+
+func newInformer[T k8sObject](client *k8sClient, namespace, resource string, retryInterval time.Duration, onChange func(keys []string)) *informer[T] {
+	path := "/api/v1/" + resource
+	if namespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(namespace) + "/" + resource
+	}
+
+	return &informer[T]{
+		client:        client,
+		path:          path,
+		onChange:      onChange,
+		retryInterval: retryInterval,
+		store:         make(map[string]T),
+	}
+}
+
+func objectKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+func (inf *informer[T]) get(key string) (T, bool) {
+	inf.mtx.RLock()
+	defer inf.mtx.RUnlock()
+
+	obj, ok := inf.store[key]
+	return obj, ok
+}
+
+// objects returns all the objects, to be looked through.
+func (inf *informer[T]) objects() []T {
+	inf.mtx.RLock()
+	defer inf.mtx.RUnlock()
+
+	objs := make([]T, 0, len(inf.store))
+	for _, obj := range inf.store {
+		objs = append(objs, obj)
+	}
+	return objs
+}
+
+// run lists and watches until the context is done. A watch which ends is
+// started again from the last resource version seen, one which is too old
+// for the API server lists everything again.
+func (inf *informer[T]) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		rv, err := inf.list(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Listing %s failed: %v", inf.path, err)
+			}
+			inf.wait(ctx)
+			continue
+		}
+
+		for ctx.Err() == nil {
+			rv, err = inf.watch(ctx, rv)
+			if errors.Is(err, errGone) {
+				break
+			}
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Watching %s failed: %v", inf.path, err)
+				inf.wait(ctx)
+			}
+		}
+	}
+}
+
+func (inf *informer[T]) wait(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(inf.retryInterval):
+	}
+}
+
+// list replaces the store with the objects listed, returning the resource
+// version to watch from.
+func (inf *informer[T]) list(ctx context.Context) (string, error) {
+	body, err := inf.client.get(ctx, inf.path, nil)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []T `json:"items"`
+	}
+	if err := json.NewDecoder(body).Decode(&list); err != nil {
+		return "", err
+	}
+
+	store := make(map[string]T, len(list.Items))
+	for _, obj := range list.Items {
+		if obj == nil {
+			return "", errors.New("list with a null item")
+		}
+		m := obj.meta()
+		store[objectKey(m.Namespace, m.Name)] = obj
+	}
+
+	inf.mtx.Lock()
+	keys := make([]string, 0, len(store)+len(inf.store))
+	for key := range inf.store {
+		if _, ok := store[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	for key := range store {
+		keys = append(keys, key)
+	}
+	inf.store = store
+	inf.mtx.Unlock()
+
+	inf.onChange(keys)
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watchEvent is a line of the watch stream. Errors come as a Status object.
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// watch applies the changes from the resource version on, until the API
+// server ends the watch. It returns the last resource version seen.
+func (inf *informer[T]) watch(ctx context.Context, rv string) (string, error) {
+	query := url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {rv},
+		"allowWatchBookmarks": {"true"},
+	}
+	body, err := inf.client.get(ctx, inf.path, query)
+	if err != nil {
+		return rv, err
+	}
+	defer body.Close()
+
+	dec := json.NewDecoder(body)
+	for {
+		var ev watchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if errors.Is(err, io.EOF) {
+				return rv, nil
+			}
+			return rv, err
+		}
+
+		if ev.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal(ev.Object, &status); err != nil {
+				return rv, fmt.Errorf("decoding watch error: %w", err)
+			}
+			if status.Code == http.StatusGone {
+				return rv, errGone
+			}
+			return rv, fmt.Errorf("watch error: %s", status.Message)
+		}
+
+		var obj T
+		if err := json.Unmarshal(ev.Object, &obj); err != nil {
+			return rv, err
+		}
+		if obj == nil {
+			return rv, fmt.Errorf("watch event %s without an object", ev.Type)
+		}
+		m := obj.meta()
+		rv = m.ResourceVersion
+
+		key := objectKey(m.Namespace, m.Name)
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			inf.mtx.Lock()
+			inf.store[key] = obj
+			inf.mtx.Unlock()
+		case "DELETED":
+			inf.mtx.Lock()
+			delete(inf.store, key)
+			inf.mtx.Unlock()
+		default:
+			// BOOKMARK, only the resource version is news
+			continue
+		}
+
+		inf.onChange([]string{key})
+	}
+}
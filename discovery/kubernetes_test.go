@@ -0,0 +1,496 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+// fakeAPI is enough of the Kubernetes API for the discoverer: listing and
+// watching pods, services and endpoints, in all namespaces or in one.
+type fakeAPI struct {
+	mtx      sync.Mutex
+	rv       int
+	objects  map[string]map[string]map[string]any
+	watchers map[string][]chan watchEvent
+	// history is every event, for watches from an older resource version
+	history map[string][]watchEvent
+	// requests are the paths and queries asked for
+	requests []string
+}
+
+func newFakeAPI(t *testing.T) (*fakeAPI, *httptest.Server) {
+	api := &fakeAPI{
+		objects:  make(map[string]map[string]map[string]any),
+		watchers: make(map[string][]chan watchEvent),
+		history:  make(map[string][]watchEvent),
+	}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return api, server
+}
+
+func (api *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// /api/v1/<resource> or /api/v1/namespaces/<namespace>/<resource>
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")
+	resource, namespace := parts[len(parts)-1], ""
+	if len(parts) == 3 {
+		namespace = parts[1]
+	}
+
+	api.mtx.Lock()
+	api.requests = append(api.requests, r.URL.Path+"?"+r.URL.RawQuery)
+
+	if r.URL.Query().Get("watch") != "true" {
+		items := []map[string]any{}
+		for key, obj := range api.objects[resource] {
+			if namespace == "" || strings.HasPrefix(key, namespace+"/") {
+				items = append(items, obj)
+			}
+		}
+		rv := strconv.Itoa(api.rv)
+		api.mtx.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"metadata": map[string]any{"resourceVersion": rv},
+			"items":    items,
+		})
+		return
+	}
+
+	events := make(chan watchEvent, 100)
+	rv, _ := strconv.Atoi(r.URL.Query().Get("resourceVersion"))
+	for _, ev := range api.history[resource] {
+		if resourceVersionOf(ev) > rv {
+			events <- ev
+		}
+	}
+	api.watchers[resource] = append(api.watchers[resource], events)
+	api.mtx.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if ns := namespaceOf(ev); namespace != "" && ns != "" && ns != namespace {
+				continue
+			}
+			enc.Encode(ev)
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+func resourceVersionOf(ev watchEvent) int {
+	var obj struct {
+		Metadata objectMeta `json:"metadata"`
+	}
+	json.Unmarshal(ev.Object, &obj)
+	rv, _ := strconv.Atoi(obj.Metadata.ResourceVersion)
+	return rv
+}
+
+func namespaceOf(ev watchEvent) string {
+	var obj struct {
+		Metadata objectMeta `json:"metadata"`
+	}
+	json.Unmarshal(ev.Object, &obj)
+	return obj.Metadata.Namespace
+}
+
+// apply stores the object, or deletes it, and tells the watchers.
+func (api *fakeAPI) apply(resource, evType string, obj map[string]any) {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+
+	api.rv++
+	meta := obj["metadata"].(map[string]any)
+	meta["resourceVersion"] = strconv.Itoa(api.rv)
+	key := objectKey(meta["namespace"].(string), meta["name"].(string))
+
+	if api.objects[resource] == nil {
+		api.objects[resource] = make(map[string]map[string]any)
+	}
+	if evType == "DELETED" {
+		delete(api.objects[resource], key)
+	} else {
+		api.objects[resource][key] = obj
+	}
+
+	b, _ := json.Marshal(obj)
+	ev := watchEvent{Type: evType, Object: b}
+	api.history[resource] = append(api.history[resource], ev)
+	for _, w := range api.watchers[resource] {
+		w <- ev
+	}
+}
+
+// expire ends the watches with the resource version being too old, as the
+// API server does after compacting its history.
+func (api *fakeAPI) expire(resource string) {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+
+	b, _ := json.Marshal(map[string]any{"kind": "Status", "code": 410, "message": "too old resource version"})
+	for _, w := range api.watchers[resource] {
+		w <- watchEvent{Type: "ERROR", Object: b}
+		close(w)
+	}
+	api.watchers[resource] = nil
+}
+
+// waitForWatch waits for the discoverer to be watching the resource.
+func (api *fakeAPI) waitForWatch(t *testing.T, resource string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		api.mtx.Lock()
+		n := len(api.watchers[resource])
+		api.mtx.Unlock()
+		if n > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("No watch of %s", resource)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// deleteQuietly deletes the object without telling the watchers, as if the
+// event was lost.
+func (api *fakeAPI) deleteQuietly(resource, key string) {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+
+	delete(api.objects[resource], key)
+}
+
+func testPod(name, ip string, podLabels map[string]any) map[string]any {
+	return map[string]any{
+		"metadata": map[string]any{
+			"name":      name,
+			"namespace": "default",
+			"uid":       "uid-" + name,
+			"labels":    podLabels,
+			"ownerReferences": []any{
+				map[string]any{"kind": "ReplicaSet", "name": "node-exporter-1234", "controller": true},
+			},
+		},
+		"spec": map[string]any{
+			"nodeName": "kind-worker",
+			"containers": []any{
+				map[string]any{
+					"name":  "exporter",
+					"image": "prom/node-exporter",
+					"ports": []any{map[string]any{"name": "metrics", "containerPort": 9100, "protocol": "TCP"}},
+				},
+				map[string]any{"name": "sidecar", "image": "busybox"},
+			},
+		},
+		"status": map[string]any{
+			"phase":      "Running",
+			"podIP":      ip,
+			"hostIP":     "172.18.0.2",
+			"conditions": []any{map[string]any{"type": "Ready", "status": "True"}},
+		},
+	}
+}
+
+func testService(name string) map[string]any {
+	return map[string]any{
+		"metadata": map[string]any{
+			"name":        name,
+			"namespace":   "default",
+			"labels":      map[string]any{"app.kubernetes.io/name": name},
+			"annotations": map[string]any{"prometheus.io/scrape": "true"},
+		},
+		"spec": map[string]any{
+			"type":      "ClusterIP",
+			"clusterIP": "10.96.0.10",
+			"ports":     []any{map[string]any{"name": "metrics", "port": 9100, "protocol": "TCP"}},
+		},
+	}
+}
+
+func testEndpoints(name string, pods ...string) map[string]any {
+	var addrs []any
+	for i, p := range pods {
+		addrs = append(addrs, map[string]any{
+			"ip":        "10.244.0." + strconv.Itoa(i+1),
+			"nodeName":  "kind-worker",
+			"targetRef": map[string]any{"kind": "Pod", "name": p, "namespace": "default"},
+		})
+	}
+
+	return map[string]any{
+		"metadata": map[string]any{"name": name, "namespace": "default"},
+		"subsets": []any{map[string]any{
+			"addresses":         addrs,
+			"notReadyAddresses": []any{map[string]any{"ip": "10.244.0.99"}},
+			"ports":             []any{map[string]any{"name": "metrics", "port": 9100, "protocol": "TCP"}},
+		}},
+	}
+}
+
+// groupCollector keeps the latest group of every source the discoverer sent.
+type groupCollector struct {
+	t      *testing.T
+	up     chan []*Group
+	groups map[string]*Group
+}
+
+func runK8sDiscoverer(t *testing.T, server *httptest.Server, role string, namespaces ...string) *groupCollector {
+	t.Helper()
+
+	d, err := NewKubernetesDiscoverer(&config.KubernetesSDConfig{
+		Role:       role,
+		APIServer:  server.URL,
+		Namespaces: config.NamespaceDiscovery{Names: namespaces},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create discoverer: %v", err)
+	}
+	d.retryInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	c := &groupCollector{t: t, up: make(chan []*Group), groups: make(map[string]*Group)}
+	go d.Run(ctx, c.up)
+	return c
+}
+
+// waitFor receives groups until f is happy with the ones collected.
+func (c *groupCollector) waitFor(f func(groups map[string]*Group) bool) {
+	c.t.Helper()
+
+	for !f(c.groups) {
+		for _, g := range receive(c.t, c.up) {
+			c.groups[g.Source] = g
+		}
+	}
+}
+
+func Test_kubernetesDiscoverer_pod(t *testing.T) {
+	api, server := newFakeAPI(t)
+	api.apply("pods", "ADDED", testPod("node-exporter-a", "10.244.0.1", map[string]any{"app.kubernetes.io/name": "node-exporter"}))
+
+	c := runK8sDiscoverer(t, server, "pod")
+	c.waitFor(func(groups map[string]*Group) bool {
+		return groups["pod/default/node-exporter-a"] != nil
+	})
+
+	g := c.groups["pod/default/node-exporter-a"]
+	wantLabels := labels.FromStrings(
+		"__meta_kubernetes_namespace", "default",
+		"__meta_kubernetes_pod_name", "node-exporter-a",
+		"__meta_kubernetes_pod_uid", "uid-node-exporter-a",
+		"__meta_kubernetes_pod_ip", "10.244.0.1",
+		"__meta_kubernetes_pod_phase", "Running",
+		"__meta_kubernetes_pod_ready", "true",
+		"__meta_kubernetes_pod_node_name", "kind-worker",
+		"__meta_kubernetes_pod_host_ip", "172.18.0.2",
+		"__meta_kubernetes_pod_controller_kind", "ReplicaSet",
+		"__meta_kubernetes_pod_controller_name", "node-exporter-1234",
+		"__meta_kubernetes_pod_label_app_kubernetes_io_name", "node-exporter",
+		"__meta_kubernetes_pod_labelpresent_app_kubernetes_io_name", "true",
+	)
+	if !labels.Equal(g.Labels, wantLabels) {
+		t.Errorf("Expected group labels\n%v\ngot\n%v", wantLabels, g.Labels)
+	}
+
+	wantTargets := []labels.Labels{
+		labels.FromStrings(
+			"__address__", "10.244.0.1:9100",
+			"__meta_kubernetes_pod_container_name", "exporter",
+			"__meta_kubernetes_pod_container_image", "prom/node-exporter",
+			"__meta_kubernetes_pod_container_port_name", "metrics",
+			"__meta_kubernetes_pod_container_port_number", "9100",
+			"__meta_kubernetes_pod_container_port_protocol", "TCP",
+		),
+		// Without ports, the address is the pod's
+		labels.FromStrings(
+			"__address__", "10.244.0.1",
+			"__meta_kubernetes_pod_container_name", "sidecar",
+			"__meta_kubernetes_pod_container_image", "busybox",
+		),
+	}
+	if len(g.Targets) != len(wantTargets) {
+		t.Fatalf("Expected %d targets, got %v", len(wantTargets), g.Targets)
+	}
+	for i := range wantTargets {
+		if !labels.Equal(g.Targets[i], wantTargets[i]) {
+			t.Errorf("Expected target\n%v\ngot\n%v", wantTargets[i], g.Targets[i])
+		}
+	}
+
+	// Watched changes come through
+	api.apply("pods", "ADDED", testPod("node-exporter-b", "10.244.0.2", nil))
+	c.waitFor(func(groups map[string]*Group) bool {
+		return groups["pod/default/node-exporter-b"] != nil
+	})
+
+	api.apply("pods", "DELETED", testPod("node-exporter-a", "10.244.0.1", nil))
+	c.waitFor(func(groups map[string]*Group) bool {
+		return len(groups["pod/default/node-exporter-a"].Targets) == 0
+	})
+}
+
+func Test_kubernetesDiscoverer_relistWhenGone(t *testing.T) {
+	api, server := newFakeAPI(t)
+	api.apply("pods", "ADDED", testPod("node-exporter-a", "10.244.0.1", nil))
+
+	c := runK8sDiscoverer(t, server, "pod")
+	c.waitFor(func(groups map[string]*Group) bool {
+		return groups["pod/default/node-exporter-a"] != nil
+	})
+
+	// The deletion is missed, the list after the watch expired finds it
+	api.waitForWatch(t, "pods")
+	api.deleteQuietly("pods", "default/node-exporter-a")
+	api.expire("pods")
+
+	c.waitFor(func(groups map[string]*Group) bool {
+		return len(groups["pod/default/node-exporter-a"].Targets) == 0
+	})
+}
+
+func Test_kubernetesDiscoverer_service(t *testing.T) {
+	api, server := newFakeAPI(t)
+	api.apply("services", "ADDED", testService("node-exporter"))
+
+	c := runK8sDiscoverer(t, server, "service")
+	c.waitFor(func(groups map[string]*Group) bool {
+		return groups["svc/default/node-exporter"] != nil
+	})
+
+	g := c.groups["svc/default/node-exporter"]
+	if want := "node-exporter.default.svc:9100"; len(g.Targets) != 1 || g.Targets[0].Get("__address__") != want {
+		t.Fatalf("Expected a target at %s, got %v", want, g.Targets)
+	}
+	if v := g.Labels.Get("__meta_kubernetes_service_annotation_prometheus_io_scrape"); v != "true" {
+		t.Errorf("Annotation label not set, got %v", g.Labels)
+	}
+	if v := g.Labels.Get("__meta_kubernetes_service_cluster_ip"); v != "10.96.0.10" {
+		t.Errorf("Cluster IP label not set, got %v", g.Labels)
+	}
+}
+
+func Test_kubernetesDiscoverer_endpoints(t *testing.T) {
+	api, server := newFakeAPI(t)
+	api.apply("endpoints", "ADDED", testEndpoints("node-exporter", "node-exporter-a"))
+	api.apply("services", "ADDED", testService("node-exporter"))
+
+	c := runK8sDiscoverer(t, server, "endpoints")
+	c.waitFor(func(groups map[string]*Group) bool {
+		g := groups["endpoints/default/node-exporter"]
+		return g != nil && g.Labels.Get("__meta_kubernetes_service_name") == "node-exporter"
+	})
+
+	g := c.groups["endpoints/default/node-exporter"]
+	if len(g.Targets) != 2 {
+		t.Fatalf("Expected a ready and a not ready target, got %v", g.Targets)
+	}
+	ready, notReady := g.Targets[0], g.Targets[1]
+	if ready.Get("__address__") != "10.244.0.1:9100" || ready.Get("__meta_kubernetes_endpoint_ready") != "true" ||
+		ready.Get("__meta_kubernetes_endpoint_address_target_name") != "node-exporter-a" ||
+		ready.Get("__meta_kubernetes_endpoint_node_name") != "kind-worker" {
+		t.Errorf("Unexpected ready target %v", ready)
+	}
+	if notReady.Get("__address__") != "10.244.0.99:9100" || notReady.Get("__meta_kubernetes_endpoint_ready") != "false" {
+		t.Errorf("Unexpected not ready target %v", notReady)
+	}
+
+	// The pod behind the address shows up later, its labels are added
+	api.apply("pods", "ADDED", testPod("node-exporter-a", "10.244.0.1", map[string]any{"tier": "infra"}))
+	c.waitFor(func(groups map[string]*Group) bool {
+		return groups["endpoints/default/node-exporter"].Targets[0].Get("__meta_kubernetes_pod_label_tier") == "infra"
+	})
+
+	// The service is gone, so are its labels
+	api.apply("services", "DELETED", testService("node-exporter"))
+	c.waitFor(func(groups map[string]*Group) bool {
+		return !groups["endpoints/default/node-exporter"].Labels.Has("__meta_kubernetes_service_name")
+	})
+}
+
+func Test_kubernetesDiscoverer_namespaces(t *testing.T) {
+	api, server := newFakeAPI(t)
+	api.apply("services", "ADDED", testService("node-exporter"))
+
+	c := runK8sDiscoverer(t, server, "service", "default", "monitoring")
+	c.waitFor(func(groups map[string]*Group) bool {
+		return groups["svc/default/node-exporter"] != nil
+	})
+
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+	for _, path := range []string{"/api/v1/namespaces/default/services?", "/api/v1/namespaces/monitoring/services?"} {
+		found := false
+		for _, r := range api.requests {
+			found = found || r == path
+		}
+		if !found {
+			t.Errorf("Expected a list of %s, got %v", path, api.requests)
+		}
+	}
+}
+
+func Test_newK8sClient_inCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "")
+	if _, err := NewKubernetesDiscoverer(&config.KubernetesSDConfig{Role: "pod"}); err == nil {
+		t.Errorf("Discoverer without an API server outside a cluster didn't fail")
+	}
+}
+
+func Test_informer_watchMalformedEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+	}{
+		{name: "null object", event: `{"type":"ADDED","object":null}`},
+		{name: "undecodable status", event: `{"type":"ERROR","object":"too old resource version"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.event + "\n"))
+			}))
+			defer server.Close()
+
+			client, err := newK8sClient(&config.KubernetesSDConfig{APIServer: server.URL})
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			inf := newInformer[*pod](client, "", "pods", time.Second, func([]string) {})
+
+			rv, err := inf.watch(context.Background(), "5")
+			if err == nil {
+				t.Errorf("Expected an error for %s", tt.event)
+			}
+			if rv != "5" {
+				t.Errorf("Expected the resource version kept at 5, got %s", rv)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package discovery
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/config"
+)
+
+// Manager runs the discoverers of every job and sends the target groups of
+// all the jobs on the sync channel whenever something changed. Updates are
+// batched, discoverers can be chatty and every send reloads the scrape pools.
+type Manager struct {
+	ctx context.Context
+
+	mtx  sync.Mutex
+	jobs map[string]*job
+
+	syncCh      chan map[string][]*Group
+	triggerSend chan struct{}
+	// updatert is how often the groups are sent at most
+	updatert time.Duration
+}
+
+// job is the discoverers of a scrape config, with the groups they found.
+type job struct {
+	cfg    jobConfig
+	cancel context.CancelFunc
+	// groups are keyed by the discoverer and the group's source
+	groups map[string]*Group
+}
+
+// jobConfig is the part of the scrape config the discoverers are made from,
+// changes to anything else don't restart them.
+type jobConfig struct {
+	StaticConfigs []*config.StaticConfig
+	FileSDConfigs []*config.FileSDConfig
+	DNSSDConfigs  []*config.DNSSDConfig
+	HTTPSDConfigs []*config.HTTPSDConfig
+
+	KubernetesSDConfigs []*config.KubernetesSDConfig
+}
+
+func newJobConfig(sc *config.ScrapeConfig) jobConfig {
+	return jobConfig{
+		StaticConfigs: sc.StaticConfigs,
+		FileSDConfigs: sc.FileSDConfigs,
+		DNSSDConfigs:  sc.DNSSDConfigs,
+		HTTPSDConfigs: sc.HTTPSDConfigs,
+
+		KubernetesSDConfigs: sc.KubernetesSDConfigs,
+	}
+}
+
+func (c jobConfig) discoverers() []Discoverer {
+	var ds []Discoverer
+	if len(c.StaticConfigs) > 0 {
+		ds = append(ds, NewStaticDiscoverer(c.StaticConfigs))
+	}
+	for _, cfg := range c.FileSDConfigs {
+		ds = append(ds, NewFileDiscoverer(cfg))
+	}
+	for _, cfg := range c.DNSSDConfigs {
+		ds = append(ds, NewDNSDiscoverer(cfg, nil))
+	}
+	for _, cfg := range c.HTTPSDConfigs {
+		ds = append(ds, NewHTTPDiscoverer(cfg, nil))
+	}
+	for _, cfg := range c.KubernetesSDConfigs {
+		d, err := NewKubernetesDiscoverer(cfg)
+		if err != nil {
+			log.Printf("Kubernetes discovery for role %s failed: %v", cfg.Role, err)
+			continue
+		}
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+// NewManager makes a manager whose discoverers run until ctx is done.
+func NewManager(ctx context.Context) *Manager {
+	return &Manager{
+		ctx:         ctx,
+		jobs:        make(map[string]*job),
+		syncCh:      make(chan map[string][]*Group),
+		triggerSend: make(chan struct{}, 1),
+		updatert:    5 * time.Second,
+	}
+}
+
+// SyncCh is where the target groups of all the jobs are sent, keyed by job.
+// Every job of the config is there, jobs without targets too.
+func (m *Manager) SyncCh() <-chan map[string][]*Group {
+	return m.syncCh
+}
+
+// Run sends the groups when they changed, until the context is done.
+func (m *Manager) Run() {
+	ticker := time.NewTicker(m.updatert)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			select {
+			case <-m.triggerSend:
+			default:
+				continue
+			}
+
+			select {
+			case m.syncCh <- m.allGroups():
+			default:
+				// The receiver's busy, try again on the next tick
+				m.trigger()
+			}
+		}
+	}
+}
+
+// ApplyConfig starts the discoverers of new jobs and restarts the ones of
+// jobs whose discovery config changed. Discoverers of jobs which are gone
+// are stopped, along with their groups.
+func (m *Manager) ApplyConfig(cfg *config.Config) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	cfgs := make(map[string]jobConfig, len(cfg.ScrapeConfigs))
+	for _, sc := range cfg.ScrapeConfigs {
+		cfgs[sc.JobName] = newJobConfig(sc)
+	}
+
+	for name, j := range m.jobs {
+		if c, ok := cfgs[name]; !ok || !reflect.DeepEqual(c, j.cfg) {
+			j.cancel()
+			delete(m.jobs, name)
+		}
+	}
+
+	for name, c := range cfgs {
+		if _, ok := m.jobs[name]; ok {
+			continue
+		}
+		m.startJob(name, c)
+	}
+
+	m.trigger()
+	return nil
+}
+
+func (m *Manager) startJob(name string, cfg jobConfig) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	j := &job{
+		cfg:    cfg,
+		cancel: cancel,
+		groups: make(map[string]*Group),
+	}
+	m.jobs[name] = j
+
+	for i, d := range cfg.discoverers() {
+		up := make(chan []*Group)
+		go d.Run(ctx, up)
+		go m.updater(ctx, name, j, strconv.Itoa(i), up)
+	}
+}
+
+// updater stores the groups a discoverer sends, until the job is stopped.
+func (m *Manager) updater(ctx context.Context, name string, j *job, key string, up <-chan []*Group) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case groups := <-up:
+			m.mtx.Lock()
+			// The job could have been replaced while the groups were on the
+			// way
+			if m.jobs[name] == j {
+				for _, g := range groups {
+					if g == nil {
+						continue
+					}
+					if len(g.Targets) == 0 {
+						delete(j.groups, key+"/"+g.Source)
+					} else {
+						j.groups[key+"/"+g.Source] = g
+					}
+				}
+			}
+			m.mtx.Unlock()
+
+			m.trigger()
+		}
+	}
+}
+
+func (m *Manager) trigger() {
+	select {
+	case m.triggerSend <- struct{}{}:
+	default:
+	}
+}
+
+// allGroups returns the groups of every job, sorted by discoverer and source
+// so the first target listed twice is always the same one.
+func (m *Manager) allGroups() map[string][]*Group {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	all := make(map[string][]*Group, len(m.jobs))
+	for name, j := range m.jobs {
+		keys := make([]string, 0, len(j.groups))
+		for k := range j.groups {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		groups := make([]*Group, 0, len(keys))
+		for _, k := range keys {
+			groups = append(groups, j.groups[k])
+		}
+		all[name] = groups
+	}
+	return all
+}
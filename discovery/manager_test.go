@@ -0,0 +1,109 @@
+package discovery
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/config"
+)
+
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	m := NewManager(ctx)
+	m.updatert = 10 * time.Millisecond
+	go m.Run()
+	return m
+}
+
+func loadConfig(t *testing.T, s string) *config.Config {
+	t.Helper()
+
+	cfg, err := config.Load(s)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	return cfg
+}
+
+// waitFor returns the first target sets f is happy with.
+func waitFor(t *testing.T, m *Manager, f func(map[string][]*Group) bool) map[string][]*Group {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case tsets := <-m.SyncCh():
+			if f(tsets) {
+				return tsets
+			}
+		case <-timeout:
+			t.Fatalf("Expected target sets not received")
+		}
+	}
+}
+
+func Test_manager_applyConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "targets.json")
+	writeFile(t, file, `[{"targets": ["node-2:9100"]}]`)
+
+	m := newTestManager(t)
+	m.ApplyConfig(loadConfig(t, `
+scrape_configs:
+  - job_name: node
+    static_configs: [{targets: ["node-1:9100"]}]
+    file_sd_configs: [{files: ["`+file+`"]}]
+  - job_name: empty
+`))
+
+	tsets := waitFor(t, m, func(tsets map[string][]*Group) bool {
+		return len(tsets["node"]) == 2
+	})
+	if groups, ok := tsets["empty"]; !ok || len(groups) != 0 {
+		t.Errorf("Job without targets should be there without groups, got %v", groups)
+	}
+
+	// The groups follow the file
+	writeFile(t, file, `[{"targets": ["node-3:9100"]}]`)
+	waitFor(t, m, func(tsets map[string][]*Group) bool {
+		return len(tsets["node"]) == 2 && tsets["node"][1].Targets[0].Get("__address__") == "node-3:9100"
+	})
+
+	// A changed job starts over, a removed one is gone
+	m.ApplyConfig(loadConfig(t, `
+scrape_configs:
+  - job_name: node
+    static_configs: [{targets: ["node-4:9100"]}]
+`))
+	waitFor(t, m, func(tsets map[string][]*Group) bool {
+		_, ok := tsets["empty"]
+		return !ok && len(tsets["node"]) == 1 && tsets["node"][0].Targets[0].Get("__address__") == "node-4:9100"
+	})
+}
+
+func Test_manager_unchangedJobKeepsRunning(t *testing.T) {
+	m := newTestManager(t)
+	cfg := `
+scrape_configs:
+  - job_name: node
+    static_configs: [{targets: ["node-1:9100"]}]
+`
+	m.ApplyConfig(loadConfig(t, cfg))
+	waitFor(t, m, func(tsets map[string][]*Group) bool { return len(tsets["node"]) == 1 })
+	j := m.jobs["node"]
+
+	// Only the scrape interval changed, discovery doesn't care
+	m.ApplyConfig(loadConfig(t, strings.Replace(cfg, "- job_name: node", "- job_name: node\n    scrape_interval: 5s", 1)))
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.jobs["node"] != j {
+		t.Errorf("Job with the same discovery config was restarted")
+	}
+}
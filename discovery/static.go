@@ -0,0 +1,38 @@
+package discovery
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+const addressLabel = "__address__"
+
+// StaticDiscoverer has the targets listed in the config, they never change.
+type StaticDiscoverer struct {
+	groups []*Group
+}
+
+func NewStaticDiscoverer(cfgs []*config.StaticConfig) *StaticDiscoverer {
+	d := &StaticDiscoverer{}
+	for i, cfg := range cfgs {
+		g := &Group{
+			Labels: cfg.Labels,
+			Source: strconv.Itoa(i),
+		}
+		for _, addr := range cfg.Targets {
+			g.Targets = append(g.Targets, labels.FromStrings(addressLabel, addr))
+		}
+		d.groups = append(d.groups, g)
+	}
+	return d
+}
+
+func (d *StaticDiscoverer) Run(ctx context.Context, up chan<- []*Group) {
+	select {
+	case up <- d.groups:
+	case <-ctx.Done():
+	}
+}
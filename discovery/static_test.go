@@ -0,0 +1,30 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+func Test_staticDiscoverer(t *testing.T) {
+	d := NewStaticDiscoverer([]*config.StaticConfig{
+		{Targets: []string{"node-1:9100", "node-2:9100"}, Labels: labels.FromStrings("zone", "a")},
+		{Targets: []string{"node-3:9100"}},
+	})
+
+	up := make(chan []*Group, 1)
+	d.Run(context.Background(), up)
+	groups := <-up
+
+	if len(groups) != 2 || groups[0].Source == groups[1].Source {
+		t.Fatalf("Expected two groups with their own sources, got %v", groups)
+	}
+	if len(groups[0].Targets) != 2 || groups[0].Targets[1].Get("__address__") != "node-2:9100" {
+		t.Errorf("Unexpected targets %v", groups[0].Targets)
+	}
+	if !labels.Equal(groups[0].Labels, labels.FromStrings("zone", "a")) {
+		t.Errorf("Unexpected group labels %v", groups[0].Labels)
+	}
+}
@@ -0,0 +1,219 @@
+package labels
+
+import (
+	"hash/fnv"
+	"strings"
+)
+
+// MetricName is the label holding the name of the metric.
+const MetricName = "__name__"
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+func (l *Label) Bytes() []byte {
+	var labelsAsBytes []byte
+
+	labelsAsBytes = append(labelsAsBytes, []byte(l.Name)...)
+
+	labelsAsBytes = append(labelsAsBytes, []byte(l.Value)...)
+	return labelsAsBytes
+}
+
+func (ls Labels) HashLabels() (uint64, error) {
+	newHash := fnv.New64()
+
+	var err error
+	ls.Range(func(l Label) {
+		if err != nil {
+			return
+		}
+		_, err = newHash.Write(l.Bytes())
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return newHash.Sum64(), nil
+}
+
+func (ls Labels) String() string {
+	var b strings.Builder
+
+	b.WriteByte('{')
+	i := 0
+	ls.Range(func(l Label) {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(l.Name)
+		b.WriteString(`="`)
+		b.WriteString(l.Value)
+		b.WriteByte('"')
+		i++
+	})
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// FromMap returns the labels of the map, sorted by name.
+func FromMap(m map[string]string) Labels {
+	ls := make([]Label, 0, len(m))
+	for name, value := range m {
+		ls = append(ls, Label{Name: name, Value: value})
+	}
+	return New(ls...)
+}
+
+func (ls Labels) Map() map[string]string {
+	m := make(map[string]string, ls.Len())
+	ls.Range(func(l Label) {
+		m[l.Name] = l.Value
+	})
+	return m
+}
+
+// UnmarshalYAML reads the labels from a YAML map, it's what the config file
+// has them as.
+func (ls *Labels) UnmarshalYAML(unmarshal func(any) error) error {
+	var m map[string]string
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+
+	*ls = FromMap(m)
+	return nil
+}
+
+func (ls Labels) MarshalYAML() (any, error) {
+	return ls.Map(), nil
+}
+
+// IsValidLabelName checks the name against [a-zA-Z_][a-zA-Z0-9_]*.
+func IsValidLabelName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+
+	for i, c := range name {
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9' && i > 0) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// Builder makes new labels out of existing ones, with labels set or deleted.
+type Builder struct {
+	base Labels
+	del  []string
+	add  []Label
+}
+
+func NewBuilder(base Labels) *Builder {
+	b := &Builder{}
+	b.Reset(base)
+	return b
+}
+
+func (b *Builder) Reset(base Labels) {
+	b.base = base
+	b.del = b.del[:0]
+	b.add = b.add[:0]
+}
+
+func (b *Builder) Get(name string) string {
+	for _, l := range b.add {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	for _, n := range b.del {
+		if n == name {
+			return ""
+		}
+	}
+	return b.base.Get(name)
+}
+
+// Set sets the label, an empty value deletes it.
+func (b *Builder) Set(name, value string) *Builder {
+	if value == "" {
+		return b.Del(name)
+	}
+
+	for i, l := range b.add {
+		if l.Name == name {
+			b.add[i].Value = value
+			return b
+		}
+	}
+	b.add = append(b.add, Label{Name: name, Value: value})
+
+	return b
+}
+
+func (b *Builder) Del(names ...string) *Builder {
+	for _, name := range names {
+		for i, l := range b.add {
+			if l.Name == name {
+				b.add = append(b.add[:i], b.add[i+1:]...)
+				break
+			}
+		}
+		b.del = append(b.del, name)
+	}
+	return b
+}
+
+func (b *Builder) Labels() Labels {
+	res := make([]Label, 0, b.base.Len()+len(b.add))
+
+	b.base.Range(func(l Label) {
+		for _, n := range b.del {
+			if n == l.Name {
+				return
+			}
+		}
+		for _, a := range b.add {
+			if a.Name == l.Name {
+				return
+			}
+		}
+		res = append(res, l)
+	})
+
+	return New(append(res, b.add...)...)
+}
+
+// Range calls f on the labels the builder would return right now. f can
+// change the builder, it's working on a copy.
+func (b *Builder) Range(f func(l Label)) {
+	b.Labels().Range(f)
+}
+
+// ScratchBuilder collects labels one by one, for building them from scratch,
+// like the parser does.
+type ScratchBuilder struct {
+	add []Label
+}
+
+func NewScratchBuilder(n int) ScratchBuilder {
+	return ScratchBuilder{add: make([]Label, 0, n)}
+}
+
+func (b *ScratchBuilder) Reset() {
+	b.add = b.add[:0]
+}
+
+func (b *ScratchBuilder) Add(name, value string) {
+	b.add = append(b.add, Label{Name: name, Value: value})
+}
+
+func (b *ScratchBuilder) Labels() Labels {
+	return New(b.add...)
+}
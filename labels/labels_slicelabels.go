@@ -0,0 +1,81 @@
+//go:build slicelabels
+
+package labels
+
+import (
+	"slices"
+	"strings"
+)
+
+// Labels is a sorted slice of labels, every name and value is a separate
+// string. Build with -tags slicelabels to use it instead of the compact one.
+type Labels []Label
+
+// New returns the labels sorted by name.
+func New(ls ...Label) Labels {
+	set := make(Labels, 0, len(ls))
+	set = append(set, ls...)
+	slices.SortStableFunc(set, func(a, b Label) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return set
+}
+
+// FromStrings takes name and value pairs.
+func FromStrings(ss ...string) Labels {
+	if len(ss)%2 != 0 {
+		panic("invalid number of strings")
+	}
+
+	ls := make([]Label, 0, len(ss)/2)
+	for i := 0; i < len(ss); i += 2 {
+		ls = append(ls, Label{Name: ss[i], Value: ss[i+1]})
+	}
+
+	return New(ls...)
+}
+
+func EmptyLabels() Labels {
+	return Labels{}
+}
+
+func (ls Labels) Len() int {
+	return len(ls)
+}
+
+func (ls Labels) IsEmpty() bool {
+	return len(ls) == 0
+}
+
+func (ls Labels) Range(f func(l Label)) {
+	for _, l := range ls {
+		f(l)
+	}
+}
+
+func (ls Labels) Get(name string) string {
+	for _, l := range ls {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+func (ls Labels) Has(name string) bool {
+	for _, l := range ls {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (ls Labels) Copy() Labels {
+	return slices.Clone(ls)
+}
+
+func Equal(a, b Labels) bool {
+	return slices.Equal(a, b)
+}
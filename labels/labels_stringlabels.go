@@ -0,0 +1,132 @@
+//go:build !slicelabels
+
+package labels
+
+import (
+	"encoding/binary"
+	"slices"
+	"strings"
+)
+
+// Labels are kept in a single string, every name and value prefixed with its
+// length as an uvarint, sorted by name. A set of labels is one allocation and
+// the labels of a series are as big as the strings in them.
+type Labels struct {
+	data string
+}
+
+// New returns the labels sorted by name.
+func New(ls ...Label) Labels {
+	sorted := slices.Clone(ls)
+	slices.SortStableFunc(sorted, func(a, b Label) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	size := 0
+	for _, l := range sorted {
+		size += encodedSize(l.Name) + encodedSize(l.Value)
+	}
+
+	buf := make([]byte, 0, size)
+	for _, l := range sorted {
+		buf = binary.AppendUvarint(buf, uint64(len(l.Name)))
+		buf = append(buf, l.Name...)
+		buf = binary.AppendUvarint(buf, uint64(len(l.Value)))
+		buf = append(buf, l.Value...)
+	}
+
+	return Labels{data: string(buf)}
+}
+
+// FromStrings takes name and value pairs.
+func FromStrings(ss ...string) Labels {
+	if len(ss)%2 != 0 {
+		panic("invalid number of strings")
+	}
+
+	ls := make([]Label, 0, len(ss)/2)
+	for i := 0; i < len(ss); i += 2 {
+		ls = append(ls, Label{Name: ss[i], Value: ss[i+1]})
+	}
+
+	return New(ls...)
+}
+
+func EmptyLabels() Labels {
+	return Labels{}
+}
+
+func (ls Labels) Len() int {
+	n := 0
+	for i := 0; i < len(ls.data); {
+		_, i = decodeString(ls.data, i)
+		_, i = decodeString(ls.data, i)
+		n++
+	}
+	return n
+}
+
+func (ls Labels) IsEmpty() bool {
+	return len(ls.data) == 0
+}
+
+// Range calls f for every label, the strings share the memory of the labels.
+func (ls Labels) Range(f func(l Label)) {
+	for i := 0; i < len(ls.data); {
+		var l Label
+		l.Name, i = decodeString(ls.data, i)
+		l.Value, i = decodeString(ls.data, i)
+		f(l)
+	}
+}
+
+func (ls Labels) Get(name string) string {
+	for i := 0; i < len(ls.data); {
+		var n, v string
+		n, i = decodeString(ls.data, i)
+		v, i = decodeString(ls.data, i)
+		if n == name {
+			return v
+		}
+	}
+	return ""
+}
+
+func (ls Labels) Has(name string) bool {
+	for i := 0; i < len(ls.data); {
+		var n string
+		n, i = decodeString(ls.data, i)
+		_, i = decodeString(ls.data, i)
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (ls Labels) Copy() Labels {
+	return Labels{data: strings.Clone(ls.data)}
+}
+
+func Equal(a, b Labels) bool {
+	return a.data == b.data
+}
+
+func encodedSize(s string) int {
+	n := 1
+	for x := len(s); x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n + len(s)
+}
+
+func decodeString(data string, i int) (string, int) {
+	// Lengths under 128 fit in one byte, that's nearly all of them
+	size, n := uint64(data[i]), 1
+	if size >= 0x80 {
+		size, n = binary.Uvarint([]byte(data[i:min(i+binary.MaxVarintLen64, len(data))]))
+	}
+	i += n
+
+	return data[i : i+int(size)], i + int(size)
+}
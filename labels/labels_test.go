@@ -1,6 +1,9 @@
 package labels
 
-import "testing"
+import (
+	"slices"
+	"testing"
+)
 
 func Test_label_bytes(t *testing.T) {
 	label := Label{
@@ -14,3 +17,142 @@ func Test_label_bytes(t *testing.T) {
 		t.Errorf("Returned bytes are not equal to the label name/value")
 	}
 }
+
+func Test_labels_equal(t *testing.T) {
+	a := FromStrings("__name__", "up", "job", "node")
+	b := New(Label{Name: "job", Value: "node"}, Label{Name: "__name__", Value: "up"})
+	c := FromStrings("__name__", "up", "job", "prometheus")
+
+	if !Equal(a, b) {
+		t.Errorf("Equal labels weren't equal")
+	}
+
+	if Equal(a, c) {
+		t.Errorf("Different labels were equal")
+	}
+}
+
+func Test_labels_access(t *testing.T) {
+	ls := FromStrings("job", "node", "__name__", "up", "instance", "localhost:9100")
+
+	var got []Label
+	ls.Range(func(l Label) {
+		got = append(got, l)
+	})
+
+	want := []Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "instance", Value: "localhost:9100"},
+		{Name: "job", Value: "node"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected labels sorted by name %v, got %v", want, got)
+	}
+
+	if ls.Len() != 3 {
+		t.Errorf("Expected 3 labels, got %d", ls.Len())
+	}
+	if ls.Get("job") != "node" || ls.Get("zone") != "" {
+		t.Errorf("Get returned wrong values")
+	}
+	if !ls.Has("instance") || ls.Has("zone") {
+		t.Errorf("Has returned wrong values")
+	}
+	if !EmptyLabels().IsEmpty() || ls.IsEmpty() {
+		t.Errorf("IsEmpty returned wrong values")
+	}
+	if s := ls.String(); s != `{__name__="up", instance="localhost:9100", job="node"}` {
+		t.Errorf("Unexpected string %s", s)
+	}
+}
+
+func Test_labels_longStrings(t *testing.T) {
+	long := string(make([]byte, 300))
+	ls := FromStrings("a", long, "b", "short")
+
+	if ls.Get("a") != long || ls.Get("b") != "short" {
+		t.Errorf("Labels with long values weren't read back")
+	}
+}
+
+func Test_labels_hash(t *testing.T) {
+	a, _ := FromStrings("__name__", "up", "job", "node").HashLabels()
+	b, _ := New(Label{Name: "job", Value: "node"}, Label{Name: "__name__", Value: "up"}).HashLabels()
+	c, _ := FromStrings("__name__", "up", "job", "prometheus").HashLabels()
+
+	if a != b {
+		t.Errorf("Same labels hashed differently")
+	}
+	if a == c {
+		t.Errorf("Different labels hashed the same")
+	}
+}
+
+func Test_builder(t *testing.T) {
+	base := FromStrings("__name__", "up", "job", "node", "instance", "localhost:9100")
+
+	b := NewBuilder(base)
+	b.Set("job", "prometheus").Set("zone", "a").Del("instance")
+
+	if b.Get("job") != "prometheus" || b.Get("instance") != "" {
+		t.Errorf("Builder returned wrong values")
+	}
+
+	want := FromStrings("__name__", "up", "job", "prometheus", "zone", "a")
+	if got := b.Labels(); !Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	if !Equal(base, FromStrings("__name__", "up", "job", "node", "instance", "localhost:9100")) {
+		t.Errorf("Builder modified the base labels")
+	}
+
+	b.Reset(base)
+	b.Set("job", "")
+	if got := b.Labels(); !Equal(got, FromStrings("__name__", "up", "instance", "localhost:9100")) {
+		t.Errorf("Setting an empty value didn't delete the label, got %v", got)
+	}
+}
+
+func Test_scratchBuilder(t *testing.T) {
+	b := NewScratchBuilder(2)
+	b.Add("job", "node")
+	b.Add("__name__", "up")
+
+	if got := b.Labels(); !Equal(got, FromStrings("__name__", "up", "job", "node")) {
+		t.Errorf("Unexpected labels %v", got)
+	}
+
+	b.Reset()
+	if !b.Labels().IsEmpty() {
+		t.Errorf("Reset didn't drop the labels")
+	}
+}
+
+func Test_labels_fromMap(t *testing.T) {
+	m := map[string]string{"job": "node", "__name__": "up"}
+	ls := FromMap(m)
+
+	if !Equal(ls, FromStrings("__name__", "up", "job", "node")) {
+		t.Errorf("Unexpected labels %v", ls)
+	}
+	if got := ls.Map(); len(got) != 2 || got["job"] != "node" || got["__name__"] != "up" {
+		t.Errorf("Unexpected map %v", got)
+	}
+}
+
+func Test_isValidLabelName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"job":        true,
+		"__name__":   true,
+		"Label_2":    true,
+		"":           false,
+		"2label":     false,
+		"with-dash":  false,
+		"with space": false,
+	} {
+		if IsValidLabelName(name) != valid {
+			t.Errorf("Expected %q valid to be %v", name, valid)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package labels
+
+import "testing"
+
+func Test_matcher_matches(t *testing.T) {
+	tests := []struct {
+		matcher *Matcher
+		value   string
+		want    bool
+	}{
+		{MustNewMatcher(MatchEqual, "job", "node"), "node", true},
+		{MustNewMatcher(MatchEqual, "job", "node"), "nodes", false},
+		{MustNewMatcher(MatchNotEqual, "job", "node"), "prometheus", true},
+		{MustNewMatcher(MatchNotEqual, "job", ""), "", false},
+		// Anchored, the whole value has to match
+		{MustNewMatcher(MatchRegexp, "job", "no.*"), "node", true},
+		{MustNewMatcher(MatchRegexp, "job", "od"), "node", false},
+		{MustNewMatcher(MatchRegexp, "job", ".*"), "", true},
+		{MustNewMatcher(MatchNotRegexp, "job", "node|prometheus"), "prometheus", false},
+		{MustNewMatcher(MatchNotRegexp, "job", "node|prometheus"), "", true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.matcher.Matches(tt.value); got != tt.want {
+			t.Errorf("%s matching %q: expected %t, got %t", tt.matcher, tt.value, tt.want, got)
+		}
+	}
+
+	if _, err := NewMatcher(MatchRegexp, "job", "(node"); err == nil {
+		t.Errorf("Broken regex didn't fail")
+	}
+}
+
+func Test_matcher_string(t *testing.T) {
+	m := MustNewMatcher(MatchNotRegexp, "path", `/api/"v1"`)
+	if got, want := m.String(), `path!~"/api/\"v1\""`; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
@@ -1,27 +1,110 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
-	"github.com/pomyslowynick/scratcheus/parser"
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/discovery"
+	"github.com/pomyslowynick/scratcheus/managers"
 	"github.com/pomyslowynick/scratcheus/tsdb"
+	"github.com/pomyslowynick/scratcheus/web"
 )
 
 func main() {
-	scrapeData, err := os.ReadFile("./test_files/metrics_five.txt")
+	var (
+		configFile    = flag.String("config.file", "scratcheus.yml", "Configuration file path.")
+		dataDir       = flag.String("data-dir", "data", "Where the head snapshot is kept between restarts.")
+		listenAddress = flag.String("web.listen-address", "0.0.0.0:9090", "Address to listen on for the API.")
+	)
+	flag.Parse()
 
+	cfg, err := config.LoadFile(*configFile)
 	if err != nil {
 		fmt.Println(err)
+		os.Exit(1)
 	}
-	timestamp := uint64(time.Now().Unix())
 
-	parsedEntries := parser.ParseScrapeData(scrapeData)
+	opts := tsdb.DefaultOptions()
+	opts.Dir = *dataDir
+	opts.EnableSnapshotOnShutdown = true
 
-	newHead := tsdb.NewHead()
+	db, err := tsdb.Open(opts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	discoveryManager := discovery.NewManager(ctx)
+	scrapeManager := managers.NewScrapeManager(db.Head())
+	if err := applyConfig(cfg, scrapeManager, discoveryManager); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	go discoveryManager.Run()
+	go scrapeManager.Run(discoveryManager.SyncCh())
+
+	webHandler := web.New(*listenAddress)
+	webErr := make(chan error, 1)
+	go func() {
+		webErr <- webHandler.Run(ctx)
+	}()
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+loop:
+	for {
+		select {
+		case <-hup:
+			if err := reloadConfig(*configFile, scrapeManager, discoveryManager); err != nil {
+				fmt.Println(err)
+			}
+		case rc := <-webHandler.Reload():
+			err := reloadConfig(*configFile, scrapeManager, discoveryManager)
+			if err != nil {
+				fmt.Println(err)
+			}
+			rc <- err
+		case err := <-webErr:
+			fmt.Println(err)
+			break loop
+		case <-term:
+			break loop
+		}
+	}
+
+	cancel()
+	scrapeManager.Stop()
+	if err := db.Close(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// reloadConfig keeps the running config if the new one doesn't load.
+func reloadConfig(filename string, scrapeManager *managers.ScrapeManager, discoveryManager *discovery.Manager) error {
+	cfg, err := config.LoadFile(filename)
+	if err != nil {
+		return fmt.Errorf("couldn't load configuration (--config.file=%q): %w", filename, err)
+	}
+
+	return applyConfig(cfg, scrapeManager, discoveryManager)
+}
 
-	for _, entry := range parsedEntries {
-		newHead.Append(entry.Labels, timestamp, entry.Value)
+// applyConfig goes to the scrape manager first, so the pools of new jobs are
+// there for the targets discovery finds.
+func applyConfig(cfg *config.Config, scrapeManager *managers.ScrapeManager, discoveryManager *discovery.Manager) error {
+	if err := scrapeManager.ApplyConfig(cfg); err != nil {
+		return err
 	}
+	return discoveryManager.ApplyConfig(cfg)
 }
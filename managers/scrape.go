@@ -0,0 +1,695 @@
+package managers
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/discovery"
+	"github.com/pomyslowynick/scratcheus/labels"
+	"github.com/pomyslowynick/scratcheus/parser"
+	"github.com/pomyslowynick/scratcheus/relabel"
+	"github.com/pomyslowynick/scratcheus/tsdb"
+)
+
+const userAgentHeader = "Scratcheus"
+
+// acceptHeader asks for the protocols in the order of the config, anything
+// else comes last.
+func acceptHeader(protocols []config.ScrapeProtocol) string {
+	if len(protocols) == 0 {
+		protocols = config.DefaultScrapeProtocols
+	}
+
+	vals := make([]string, 0, len(protocols)+1)
+	weight := len(config.ScrapeProtocolsHeaders) + 1
+	for _, sp := range protocols {
+		vals = append(vals, fmt.Sprintf("%s;q=0.%d", config.ScrapeProtocolsHeaders[sp], weight))
+		weight--
+	}
+	vals = append(vals, fmt.Sprintf("*/*;q=0.%d", weight))
+	return strings.Join(vals, ",")
+}
+
+// scrapePool scrapes the targets of a single job, every target in its own
+// scrape loop.
+type scrapePool struct {
+	cfg    *config.ScrapeConfig
+	head   *tsdb.Head
+	client *http.Client
+
+	mtx sync.Mutex
+	// groups are the targets from discovery
+	groups []*discovery.Group
+	loops  map[string]*scrapeLoop
+}
+
+func newScrapePool(cfg *config.ScrapeConfig, head *tsdb.Head, groups []*discovery.Group) (*scrapePool, error) {
+	client, err := config.NewClientFromConfig(cfg.HTTPClientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("creating HTTP client of job %s: %w", cfg.JobName, err)
+	}
+
+	return &scrapePool{
+		cfg:    cfg,
+		head:   head,
+		client: client,
+		groups: groups,
+		loops:  make(map[string]*scrapeLoop),
+	}, nil
+}
+
+// start starts a scrape loop for every target of the job.
+func (sp *scrapePool) start() {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+
+	sp.restart(sp.cfg)
+}
+
+// sync brings the scrape loops in line with the groups from discovery.
+// Loops of targets which are gone are stopped and their series marked
+// stale, new targets get a loop, the rest carry on as they are.
+func (sp *scrapePool) sync(groups []*discovery.Group) {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+
+	sp.groups = groups
+	targets := sp.targets()
+
+	var wg sync.WaitGroup
+	for url, loop := range sp.loops {
+		// A target with new labels is a new target, its series are new too
+		if t, ok := targets[url]; ok && labels.Equal(t.labels, loop.target.labels) {
+			continue
+		}
+
+		delete(sp.loops, url)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loop.stop(false)
+		}()
+	}
+	wg.Wait()
+
+	for url, t := range targets {
+		if _, ok := sp.loops[url]; ok {
+			continue
+		}
+
+		loop := newScrapeLoop(t, sp.client, NewTargetAppender(sp.head), sp.cfg)
+		sp.loops[url] = loop
+		go loop.run()
+	}
+}
+
+// reload restarts the scrape loops with the new config, waiting for the
+// scrapes in progress to finish. Targets still in the config hand their
+// series over to the new loops, so they don't go stale in between, targets
+// which are gone are stopped and their series marked stale. A config the
+// client can't be made for leaves the pool running with the old one.
+func (sp *scrapePool) reload(cfg *config.ScrapeConfig) error {
+	client, err := config.NewClientFromConfig(cfg.HTTPClientConfig)
+	if err != nil {
+		return fmt.Errorf("creating HTTP client of job %s: %w", cfg.JobName, err)
+	}
+
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+
+	sp.client = client
+	sp.restart(cfg)
+	return nil
+}
+
+// restart needs the pool locked.
+func (sp *scrapePool) restart(cfg *config.ScrapeConfig) {
+	sp.cfg = cfg
+	targets := sp.targets()
+
+	var wg sync.WaitGroup
+	for url, loop := range sp.loops {
+		_, handover := targets[url]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loop.stop(handover)
+		}()
+	}
+	wg.Wait()
+
+	loops := make(map[string]*scrapeLoop, len(targets))
+	for url, t := range targets {
+		app := NewTargetAppender(sp.head)
+		old, ok := sp.loops[url]
+		if ok {
+			// The new config can turn the same raw series into other
+			// labels, the cache starts over
+			app = old.app
+			app.clearCache()
+		}
+
+		loop := newScrapeLoop(t, sp.client, app, cfg)
+		if ok {
+			loop.reportedLimit = old.reportedLimit
+		}
+		loops[url] = loop
+		go loop.run()
+	}
+	sp.loops = loops
+}
+
+// stop stops all the scrape loops and waits for them to finish.
+func (sp *scrapePool) stop() {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+
+	var wg sync.WaitGroup
+	for _, loop := range sp.loops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loop.stop(false)
+		}()
+	}
+	wg.Wait()
+
+	clear(sp.loops)
+}
+
+// targets are keyed by their URL, the first group listing a target wins.
+// Targets dropped by relabeling aren't there.
+func (sp *scrapePool) targets() map[string]*target {
+	targets := make(map[string]*target)
+
+	for _, group := range sp.groups {
+		for _, tl := range group.Targets {
+			lb := labels.NewBuilder(group.Labels)
+			tl.Range(func(l labels.Label) {
+				lb.Set(l.Name, l.Value)
+			})
+
+			t, err := newTarget(sp.cfg, lb.Labels())
+			if err != nil {
+				log.Printf("Dropping target %s of job %s: %v", tl.Get(addressLabel), sp.cfg.JobName, err)
+				continue
+			}
+			if t == nil {
+				continue
+			}
+			if _, ok := targets[t.url]; !ok {
+				targets[t.url] = t
+			}
+		}
+	}
+
+	return targets
+}
+
+// Labels of the target which relabeling can change to change how it's
+// scraped. __param_<name> sets the URL parameter <name>.
+const (
+	addressLabel     = "__address__"
+	schemeLabel      = "__scheme__"
+	metricsPathLabel = "__metrics_path__"
+	paramLabelPrefix = "__param_"
+	// exportedLabelPrefix is for the scraped labels clashing with the target
+	// labels
+	exportedLabelPrefix = "exported_"
+	// Labels starting with it are only there for relabeling, the target
+	// doesn't keep them.
+	reservedLabelPrefix = "__"
+)
+
+type target struct {
+	url string
+	// labels are added to every series scraped from the target
+	labels labels.Labels
+}
+
+// newTarget takes the labels from discovery, with the address in
+// __address__, and adds the job and how the target's scraped in the __
+// labels, unless discovery set them already. Then the relabel configs have a
+// go at them, and instance defaults to the address. It returns nil when the
+// target was dropped by relabeling.
+func newTarget(cfg *config.ScrapeConfig, lset labels.Labels) (*target, error) {
+	lb := labels.NewBuilder(lset)
+	defaults := []labels.Label{
+		{Name: "job", Value: cfg.JobName},
+		{Name: schemeLabel, Value: cfg.Scheme},
+		{Name: metricsPathLabel, Value: cfg.MetricsPath},
+	}
+	for name, values := range cfg.Params {
+		if len(values) > 0 {
+			defaults = append(defaults, labels.Label{Name: paramLabelPrefix + name, Value: values[0]})
+		}
+	}
+	for _, l := range defaults {
+		if lb.Get(l.Name) == "" {
+			lb.Set(l.Name, l.Value)
+		}
+	}
+
+	if !relabel.ProcessBuilder(lb, cfg.RelabelConfigs...) {
+		return nil, nil
+	}
+
+	addr := lb.Get(addressLabel)
+	if addr == "" {
+		return nil, errors.New("no address")
+	}
+	if strings.Contains(addr, "/") {
+		return nil, fmt.Errorf("%q is not a valid host:port address", addr)
+	}
+	if lb.Get("instance") == "" {
+		lb.Set("instance", addr)
+	}
+
+	// Only the params relabeling set are overridden, the rest keep all
+	// their values
+	params := url.Values{}
+	for name, values := range cfg.Params {
+		params[name] = values
+	}
+
+	lb.Range(func(l labels.Label) {
+		if name, ok := strings.CutPrefix(l.Name, paramLabelPrefix); ok {
+			if values := params[name]; len(values) == 0 || values[0] != l.Value {
+				params[name] = []string{l.Value}
+			}
+		}
+	})
+
+	u := url.URL{
+		Scheme:   lb.Get(schemeLabel),
+		Host:     addr,
+		Path:     lb.Get(metricsPathLabel),
+		RawQuery: params.Encode(),
+	}
+
+	lb.Range(func(l labels.Label) {
+		if strings.HasPrefix(l.Name, reservedLabelPrefix) {
+			lb.Del(l.Name)
+		}
+	})
+
+	return &target{
+		url:    u.String(),
+		labels: lb.Labels(),
+	}, nil
+}
+
+// scrapeLoop scrapes a single target on every interval, until stopped.
+type scrapeLoop struct {
+	target   *target
+	client   *http.Client
+	app      *TargetAppender
+	interval time.Duration
+	timeout  time.Duration
+	// metricRelabelConfigs are applied to every scraped series
+	metricRelabelConfigs []*relabel.Config
+	honorLabels          bool
+	honorTimestamps      bool
+	acceptHeader         string
+	// The limits of a scrape, 0 is no limit. A scrape going over any of them
+	// fails as a whole.
+	sampleLimit           int
+	labelLimit            int
+	labelNameLengthLimit  int
+	labelValueLengthLimit int
+	bodySizeLimit         int64
+	// reportedLimit is the limit the last report said was exceeded, "" for
+	// none
+	reportedLimit string
+
+	// mtx guards lastErr, read outside the loop
+	mtx     sync.Mutex
+	lastErr error
+
+	stopc chan struct{}
+	donec chan struct{}
+	// handover is set when another loop takes over the series
+	handover bool
+}
+
+func newScrapeLoop(t *target, client *http.Client, app *TargetAppender, cfg *config.ScrapeConfig) *scrapeLoop {
+	return &scrapeLoop{
+		target:                t,
+		client:                client,
+		app:                   app,
+		interval:              time.Duration(cfg.ScrapeInterval),
+		timeout:               time.Duration(cfg.ScrapeTimeout),
+		metricRelabelConfigs:  cfg.MetricRelabelConfigs,
+		honorLabels:           cfg.HonorLabels,
+		honorTimestamps:       cfg.HonorTimestamps,
+		acceptHeader:          acceptHeader(cfg.ScrapeProtocols),
+		sampleLimit:           cfg.SampleLimit,
+		labelLimit:            cfg.LabelLimit,
+		labelNameLengthLimit:  cfg.LabelNameLengthLimit,
+		labelValueLengthLimit: cfg.LabelValueLengthLimit,
+		bodySizeLimit:         int64(cfg.BodySizeLimit),
+		stopc:                 make(chan struct{}),
+		donec:                 make(chan struct{}),
+	}
+}
+
+func (sl *scrapeLoop) run() {
+	defer close(sl.donec)
+
+	select {
+	case <-time.After(sl.offset(time.Now())):
+	case <-sl.stopc:
+		sl.endOfRun()
+		return
+	}
+
+	ticker := time.NewTicker(sl.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := sl.scrapeAndAppend(time.Now()); err != nil {
+			log.Printf("Scrape of %s failed: %v", sl.target.url, err)
+		}
+
+		select {
+		case <-sl.stopc:
+			sl.endOfRun()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stop stops the loop and waits for the scrape in progress to be appended.
+// With handover the series aren't marked stale, another loop carries on
+// scraping them.
+func (sl *scrapeLoop) stop(handover bool) {
+	sl.handover = handover
+	close(sl.stopc)
+	<-sl.donec
+}
+
+// endOfRun marks the series stale, nothing's coming from the target anymore,
+// so they end now rather than after the lookback.
+func (sl *scrapeLoop) endOfRun() {
+	if sl.handover {
+		return
+	}
+
+	ts := time.Now()
+	if err := sl.app.MarkStale(ts.UnixMilli()); err != nil {
+		log.Printf("Marking series of %s stale failed: %v", sl.target.url, err)
+	}
+	if err := sl.reportStale(ts); err != nil {
+		log.Printf("Marking report series of %s stale failed: %v", sl.target.url, err)
+	}
+}
+
+// offset is how long to wait before the first scrape. Targets are spread over
+// the interval by the hash of their URL, so they aren't all scraped at once,
+// and a target keeps its slot across restarts.
+func (sl *scrapeLoop) offset(now time.Time) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(sl.target.url))
+
+	interval := int64(sl.interval)
+	base := interval - now.UnixNano()%interval
+
+	return time.Duration((base + int64(h.Sum64()%uint64(interval))) % interval)
+}
+
+// scrapeAndAppend scrapes the target and appends the scrape in a single
+// transaction, then reports how it went. A failed scrape marks the series of
+// the previous one stale.
+func (sl *scrapeLoop) scrapeAndAppend(ts time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sl.timeout)
+	defer cancel()
+
+	start := time.Now()
+	b, contentType, err := sl.scrape(ctx)
+	duration := time.Since(start)
+
+	var res scrapeResult
+	if err == nil {
+		res, err = sl.append(b, contentType, ts)
+	}
+
+	if err != nil {
+		res = scrapeResult{}
+		if staleErr := sl.app.MarkStale(ts.UnixMilli()); staleErr != nil {
+			err = errors.Join(err, staleErr)
+		}
+	} else if res.RejectedErr != nil {
+		log.Printf("Head rejected %d samples of %s: %v", res.Rejected, sl.target.url, res.RejectedErr)
+	}
+
+	sl.mtx.Lock()
+	sl.lastErr = err
+	sl.mtx.Unlock()
+
+	if reportErr := sl.report(ts, duration, res, err); reportErr != nil {
+		return errors.Join(err, reportErr)
+	}
+	return err
+}
+
+// lastError is why the last scrape failed, nil when it didn't.
+func (sl *scrapeLoop) lastError() error {
+	sl.mtx.Lock()
+	defer sl.mtx.Unlock()
+	return sl.lastErr
+}
+
+func (sl *scrapeLoop) scrape(ctx context.Context) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sl.target.url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", sl.acceptHeader)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("User-Agent", userAgentHeader)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(sl.timeout.Seconds(), 'f', -1, 64))
+
+	resp, err := sl.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "application/vnd.google.protobuf") {
+		return nil, "", errors.New("the protobuf format can't be parsed yet, leave PrometheusProto out of scrape_protocols")
+	}
+
+	body := io.Reader(resp.Body)
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, "", err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	// The limit is on the body as it's parsed, after decompressing
+	if sl.bodySizeLimit > 0 {
+		// One byte over is enough to tell it's too big
+		body = io.LimitReader(body, sl.bodySizeLimit+1)
+	}
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, "", err
+	}
+	if sl.bodySizeLimit > 0 && int64(len(b)) > sl.bodySizeLimit {
+		return nil, "", fmt.Errorf("%w: more than %s", errBodySizeLimit, config.ByteSize(sl.bodySizeLimit))
+	}
+
+	return b, contentType, nil
+}
+
+// The errors of a scrape going over its limits.
+var (
+	errSampleLimit           = errors.New("sample limit exceeded")
+	errLabelLimit            = errors.New("label limit exceeded")
+	errLabelNameLengthLimit  = errors.New("label name length limit exceeded")
+	errLabelValueLengthLimit = errors.New("label value length limit exceeded")
+	errBodySizeLimit         = errors.New("body size limit exceeded")
+)
+
+// exceededLimit is the config key of the limit err is about, "" when it's not
+// about a limit.
+func exceededLimit(err error) string {
+	switch {
+	case errors.Is(err, errSampleLimit):
+		return "sample_limit"
+	case errors.Is(err, errLabelLimit):
+		return "label_limit"
+	case errors.Is(err, errLabelNameLengthLimit):
+		return "label_name_length_limit"
+	case errors.Is(err, errLabelValueLengthLimit):
+		return "label_value_length_limit"
+	case errors.Is(err, errBodySizeLimit):
+		return "body_size_limit"
+	}
+	return ""
+}
+
+// scrapeResult is what a scrape appended, for the report.
+type scrapeResult struct {
+	AppendResult
+	// Scraped is the number of samples the target exposed.
+	Scraped int
+	// PostRelabel is the number of samples left after metric relabeling.
+	PostRelabel int
+}
+
+// append parses the whole scrape before appending any of it, a scrape which
+// doesn't parse or goes over a limit isn't appended at all. The limits are
+// on the series as they'd be appended, after metric relabeling. Series seen
+// in earlier scrapes come from the cache, only new ones have their labels
+// parsed and relabeled.
+func (sl *scrapeLoop) append(b []byte, contentType string, ts time.Time) (scrapeResult, error) {
+	p := parser.NewParserForContentType(b, contentType)
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	app := sl.app.appender(ts.UnixMilli())
+
+	var scraped, postRelabel int
+	for {
+		et, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			app.rollback()
+			return scrapeResult{}, err
+		}
+		if et != parser.EntrySeries {
+			continue
+		}
+
+		series, v := p.Series()
+		scraped++
+
+		ce, dropped := app.get(series)
+		if dropped {
+			continue
+		}
+		if ce == nil {
+			ls, ok := sl.seriesLabels(lb, p.Labels())
+			if !ok {
+				app.drop(series)
+				continue
+			}
+			if err := sl.checkLabelLimits(ls); err != nil {
+				app.rollback()
+				return scrapeResult{}, err
+			}
+			if ce, err = app.add(series, ls); err != nil {
+				app.rollback()
+				return scrapeResult{}, err
+			}
+		}
+
+		postRelabel++
+		if sl.sampleLimit > 0 && postRelabel > sl.sampleLimit {
+			app.rollback()
+			return scrapeResult{}, fmt.Errorf("%w: more than %d samples", errSampleLimit, sl.sampleLimit)
+		}
+
+		var (
+			t            int64
+			hasTimestamp bool
+		)
+		if sl.honorTimestamps {
+			t, hasTimestamp = p.Timestamp()
+		}
+		app.append(ce, v, t, hasTimestamp)
+	}
+
+	res, err := app.commit()
+	return scrapeResult{AppendResult: res, Scraped: scraped, PostRelabel: postRelabel}, err
+}
+
+// seriesLabels turns the scraped labels into the labels of the series, with
+// the target labels and metric relabeling. It's false for a series dropped.
+func (sl *scrapeLoop) seriesLabels(lb *labels.Builder, scraped labels.Labels) (labels.Labels, bool) {
+	lb.Reset(scraped)
+	sl.addTargetLabels(lb, scraped)
+
+	if !relabel.ProcessBuilder(lb, sl.metricRelabelConfigs...) {
+		return labels.EmptyLabels(), false
+	}
+	ls := lb.Labels()
+	return ls, !ls.IsEmpty()
+}
+
+// addTargetLabels adds the target labels to the scraped ones. With
+// honor_labels the scraped ones win the clashes, otherwise the target labels
+// win and the scraped ones are kept as exported_<name>, or
+// exported_exported_<name> if that's taken too.
+func (sl *scrapeLoop) addTargetLabels(lb *labels.Builder, scraped labels.Labels) {
+	if sl.honorLabels {
+		sl.target.labels.Range(func(l labels.Label) {
+			if !scraped.Has(l.Name) {
+				lb.Set(l.Name, l.Value)
+			}
+		})
+		return
+	}
+
+	var clashes []labels.Label
+	sl.target.labels.Range(func(l labels.Label) {
+		if v := scraped.Get(l.Name); v != "" {
+			clashes = append(clashes, labels.Label{Name: l.Name, Value: v})
+		}
+		lb.Set(l.Name, l.Value)
+	})
+
+	for _, l := range clashes {
+		name := l.Name
+		for {
+			name = exportedLabelPrefix + name
+			if lb.Get(name) == "" {
+				lb.Set(name, l.Value)
+				break
+			}
+		}
+	}
+}
+
+// checkLabelLimits fails the series with too many labels, or a label name or
+// value too long.
+func (sl *scrapeLoop) checkLabelLimits(ls labels.Labels) error {
+	if sl.labelLimit > 0 && ls.Len() > sl.labelLimit {
+		return fmt.Errorf("%w: %s has %d labels, the limit is %d", errLabelLimit, ls, ls.Len(), sl.labelLimit)
+	}
+
+	var err error
+	ls.Range(func(l labels.Label) {
+		switch {
+		case err != nil:
+		case sl.labelNameLengthLimit > 0 && len(l.Name) > sl.labelNameLengthLimit:
+			err = fmt.Errorf("%w: label %q of %s is longer than %d", errLabelNameLengthLimit, l.Name, ls, sl.labelNameLengthLimit)
+		case sl.labelValueLengthLimit > 0 && len(l.Value) > sl.labelValueLengthLimit:
+			err = fmt.Errorf("%w: value of label %q of %s is longer than %d", errLabelValueLengthLimit, l.Name, ls, sl.labelValueLengthLimit)
+		}
+	})
+	return err
+}
@@ -1 +1,147 @@
 package managers
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/discovery"
+	"github.com/pomyslowynick/scratcheus/tsdb"
+)
+
+// ScrapeManager runs a scrape pool for every job, scraping the targets
+// discovery found for it.
+type ScrapeManager struct {
+	head *tsdb.Head
+
+	mtx   sync.Mutex
+	pools map[string]*scrapePool
+	// targetSets are the latest groups from discovery, by job
+	targetSets map[string][]*discovery.Group
+
+	stopc    chan struct{}
+	stopOnce sync.Once
+}
+
+func NewScrapeManager(h *tsdb.Head) *ScrapeManager {
+	return &ScrapeManager{
+		head:       h,
+		pools:      make(map[string]*scrapePool),
+		targetSets: make(map[string][]*discovery.Group),
+		stopc:      make(chan struct{}),
+	}
+}
+
+// Run syncs the scrape pools with the target groups sent by discovery,
+// until the manager is stopped.
+func (m *ScrapeManager) Run(tsets <-chan map[string][]*discovery.Group) {
+	for {
+		select {
+		case <-m.stopc:
+			return
+		case ts := <-tsets:
+			m.sync(ts)
+		}
+	}
+}
+
+func (m *ScrapeManager) sync(tsets map[string][]*discovery.Group) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.targetSets = tsets
+
+	var wg sync.WaitGroup
+	for name, pool := range m.pools {
+		groups, ok := tsets[name]
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.sync(groups)
+		}()
+	}
+	wg.Wait()
+}
+
+// ApplyConfig brings the scrape pools in line with the config. Pools of jobs
+// which are gone are stopped, new jobs get a pool, pools of changed jobs are
+// reloaded and the unchanged ones are left running as they are. The config
+// is expected to be validated already, config.Load does that. A job whose
+// HTTP client can't be made, like for a missing CA file, doesn't stop the
+// others, its error comes back with the rest.
+func (m *ScrapeManager) ApplyConfig(cfg *config.Config) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	jobs := make(map[string]*config.ScrapeConfig, len(cfg.ScrapeConfigs))
+	for _, sc := range cfg.ScrapeConfigs {
+		jobs[sc.JobName] = sc
+	}
+
+	var (
+		wg     sync.WaitGroup
+		errMtx sync.Mutex
+		errs   []error
+	)
+	for name, pool := range m.pools {
+		sc, ok := jobs[name]
+		switch {
+		case !ok:
+			delete(m.pools, name)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pool.stop()
+			}()
+		case !reflect.DeepEqual(pool.cfg, sc):
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := pool.reload(sc); err != nil {
+					errMtx.Lock()
+					errs = append(errs, err)
+					errMtx.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	for name, sc := range jobs {
+		if _, ok := m.pools[name]; ok {
+			continue
+		}
+
+		pool, err := newScrapePool(sc, m.head, m.targetSets[name])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m.pools[name] = pool
+		pool.start()
+	}
+
+	return errors.Join(errs...)
+}
+
+// Stop stops all the scrape pools and waits for them to finish.
+func (m *ScrapeManager) Stop() {
+	m.stopOnce.Do(func() { close(m.stopc) })
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.stopPools()
+}
+
+func (m *ScrapeManager) stopPools() {
+	for name, pool := range m.pools {
+		pool.stop()
+		delete(m.pools, name)
+	}
+}
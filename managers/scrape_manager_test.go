@@ -1 +1,257 @@
 package managers
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/discovery"
+	"github.com/pomyslowynick/scratcheus/labels"
+	"github.com/pomyslowynick/scratcheus/tsdb"
+)
+
+// staticTargetSets are the target sets discovery sends for the static
+// configs.
+func staticTargetSets(cfg *config.Config) map[string][]*discovery.Group {
+	tsets := make(map[string][]*discovery.Group)
+	for _, sc := range cfg.ScrapeConfigs {
+		tsets[sc.JobName] = []*discovery.Group{}
+		for i, st := range sc.StaticConfigs {
+			g := &discovery.Group{Labels: st.Labels, Source: strconv.Itoa(i)}
+			for _, addr := range st.Targets {
+				g.Targets = append(g.Targets, labels.FromStrings("__address__", addr))
+			}
+			tsets[sc.JobName] = append(tsets[sc.JobName], g)
+		}
+	}
+	return tsets
+}
+
+func Test_scrapeManager_applyConfig(t *testing.T) {
+	server := newTestServer(t, "../test_files/metrics_five.txt")
+	u, _ := url.Parse(server.URL)
+
+	cfg, err := config.Load(`
+global:
+  scrape_interval: 20ms
+scrape_configs:
+  - job_name: test
+    static_configs:
+      - targets: ["` + u.Host + `"]
+`)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	head := tsdb.NewHead()
+	m := NewScrapeManager(head)
+	defer m.Stop()
+
+	tsets := make(chan map[string][]*discovery.Group)
+	go m.Run(tsets)
+
+	if err := m.ApplyConfig(cfg); err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	// Nothing's scraped before discovery finds the targets
+	if n := len(m.pools["test"].loops); n != 0 {
+		t.Fatalf("Expected no scrape loops yet, got %d", n)
+	}
+	tsets <- staticTargetSets(cfg)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for head.Stats(0).NumSeries != 5+5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Target wasn't scraped, %d series in the head", head.Stats(0).NumSeries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_scrapeManager_reload(t *testing.T) {
+	server := newTestServer(t, "../test_files/metrics_five.txt")
+	u, _ := url.Parse(server.URL)
+
+	load := func(s string) *config.Config {
+		cfg, err := config.Load(strings.ReplaceAll(s, "TARGET", u.Host))
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+		return cfg
+	}
+
+	head := tsdb.NewHead()
+	m := NewScrapeManager(head)
+	defer m.Stop()
+
+	cfg := load(`
+scrape_configs:
+  - job_name: unchanged
+    static_configs: [{targets: [TARGET]}]
+  - job_name: changed
+    static_configs: [{targets: [TARGET]}]
+  - job_name: removed
+    static_configs: [{targets: [TARGET]}]
+`)
+	m.ApplyConfig(cfg)
+	m.sync(staticTargetSets(cfg))
+
+	unchanged := m.pools["unchanged"]
+	unchangedLoop := unchanged.loops[server.URL+"/metrics"]
+	changed := m.pools["changed"]
+	changedLoop := changed.loops[server.URL+"/metrics"]
+
+	cfg = load(`
+scrape_configs:
+  - job_name: unchanged
+    static_configs: [{targets: [TARGET]}]
+  - job_name: changed
+    scrape_interval: 30s
+    static_configs: [{targets: [TARGET]}]
+  - job_name: added
+    static_configs: [{targets: [TARGET]}]
+`)
+	m.ApplyConfig(cfg)
+	m.sync(staticTargetSets(cfg))
+
+	if m.pools["unchanged"] != unchanged || unchanged.loops[server.URL+"/metrics"] != unchangedLoop {
+		t.Errorf("Unchanged job was restarted")
+	}
+
+	if m.pools["changed"] != changed {
+		t.Errorf("Changed job got a new pool instead of a reload")
+	}
+	newLoop := changed.loops[server.URL+"/metrics"]
+	if newLoop == changedLoop || newLoop.interval != 30*time.Second {
+		t.Errorf("Changed job wasn't reloaded with the new config")
+	}
+	if newLoop.app != changedLoop.app {
+		t.Errorf("Reloaded loop didn't take over the series of the old one")
+	}
+
+	if _, ok := m.pools["removed"]; ok {
+		t.Errorf("Removed job is still running")
+	}
+	if _, ok := m.pools["added"]; !ok {
+		t.Errorf("Added job isn't running")
+	}
+}
+
+func Test_scrapePool_reloadStaleness(t *testing.T) {
+	server := newTestServer(t, "../test_files/metrics_five.txt")
+	u, _ := url.Parse(server.URL)
+
+	head := tsdb.NewHead()
+	cfg := &config.ScrapeConfig{
+		JobName:        "test",
+		ScrapeInterval: config.Duration(20 * time.Millisecond),
+		ScrapeTimeout:  config.Duration(20 * time.Millisecond),
+		MetricsPath:    "/metrics",
+		Scheme:         "http",
+	}
+	groups := []*discovery.Group{{Targets: []labels.Labels{labels.FromStrings("__address__", u.Host)}}}
+
+	sp, err := newScrapePool(cfg, head, groups)
+	if err != nil {
+		t.Fatalf("Failed to create scrape pool: %v", err)
+	}
+	sp.start()
+	defer sp.stop()
+
+	l := labels.FromStrings("__name__", "process_max_fds", "instance", u.Host, "job", "test")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for head.GetMemSeries(l) == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Target wasn't scraped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The target stays, its series stay too
+	reloaded := *cfg
+	reloaded.ScrapeTimeout = config.Duration(10 * time.Millisecond)
+	if err := sp.reload(&reloaded); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	if _, ok, _ := head.LatestSample(l, time.Now().UnixMilli(), 60*1000); !ok {
+		t.Errorf("Series of a target kept across the reload went stale")
+	}
+
+	// The target is gone, its series go stale
+	sp.sync(nil)
+
+	if _, ok, _ := head.LatestSample(l, time.Now().UnixMilli()+1, 60*1000); ok {
+		t.Errorf("Series of a removed target aren't stale")
+	}
+	up := labels.FromStrings("__name__", "up", "instance", u.Host, "job", "test")
+	if _, ok, _ := head.LatestSample(up, time.Now().UnixMilli()+1, 60*1000); ok {
+		t.Errorf("Report series of a removed target aren't stale")
+	}
+}
+
+func Test_scrapePool_sync(t *testing.T) {
+	server := newTestServer(t, "../test_files/metrics_five.txt")
+	u, _ := url.Parse(server.URL)
+
+	head := tsdb.NewHead()
+	sp, err := newScrapePool(newTestConfig(), head, nil)
+	if err != nil {
+		t.Fatalf("Failed to create scrape pool: %v", err)
+	}
+	sp.start()
+	defer sp.stop()
+
+	target := labels.FromStrings("__address__", u.Host)
+	sp.sync([]*discovery.Group{{Targets: []labels.Labels{target}, Source: "a"}})
+
+	loop := sp.loops[server.URL+"/metrics"]
+	if loop == nil {
+		t.Fatalf("Discovered target isn't scraped")
+	}
+
+	// The same target from discovery keeps its loop
+	sp.sync([]*discovery.Group{{Targets: []labels.Labels{target}, Source: "a"}})
+	if sp.loops[server.URL+"/metrics"] != loop {
+		t.Errorf("Unchanged target was restarted")
+	}
+
+	// New labels make it a new target
+	sp.sync([]*discovery.Group{{Targets: []labels.Labels{target}, Labels: labels.FromStrings("zone", "a"), Source: "a"}})
+	newLoop := sp.loops[server.URL+"/metrics"]
+	if newLoop == loop || newLoop.target.labels.Get("zone") != "a" {
+		t.Errorf("Target with new labels wasn't restarted")
+	}
+
+	sp.sync(nil)
+	if len(sp.loops) != 0 {
+		t.Errorf("Targets gone from discovery are still scraped")
+	}
+}
+
+func Test_scrapeManager_applyConfigClientError(t *testing.T) {
+	cfg, err := config.Load(`
+scrape_configs:
+  - job_name: broken
+    tls_config:
+      ca_file: testdata/missing.crt
+  - job_name: fine
+`)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	m := NewScrapeManager(tsdb.NewHead())
+	defer m.Stop()
+
+	if err := m.ApplyConfig(cfg); err == nil || !strings.Contains(err.Error(), "job broken") {
+		t.Errorf("Expected the client error of the broken job, got %v", err)
+	}
+	if _, ok := m.pools["fine"]; !ok {
+		t.Errorf("Broken job stopped the others from running")
+	}
+}
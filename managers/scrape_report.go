@@ -0,0 +1,109 @@
+package managers
+
+import (
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+// The series every scrape reports about itself, with the target labels.
+const (
+	scrapeHealthMetricName       = "up"
+	scrapeDurationMetricName     = "scrape_duration_seconds"
+	scrapeSamplesMetricName      = "scrape_samples_scraped"
+	samplesPostRelabelMetricName = "scrape_samples_post_metric_relabeling"
+	scrapeSeriesAddedMetricName  = "scrape_series_added"
+	// scrapeLimitMetricName is 1 with the limit label set to the config key of
+	// the limit, while the scrape fails going over it
+	scrapeLimitMetricName = "scrape_limit_exceeded"
+)
+
+var reportMetricNames = []string{
+	scrapeHealthMetricName,
+	scrapeDurationMetricName,
+	scrapeSamplesMetricName,
+	samplesPostRelabelMetricName,
+	scrapeSeriesAddedMetricName,
+}
+
+// report appends the report series of a scrape in a transaction of their
+// own, so they're there when the scrape failed and appended nothing. A
+// failed scrape is up 0 with the sample counts at 0, and when it went over a
+// limit scrape_limit_exceeded says which one. That series is marked stale
+// once the scrape gets under the limit.
+func (sl *scrapeLoop) report(ts time.Time, duration time.Duration, res scrapeResult, scrapeErr error) error {
+	health := 1.0
+	if scrapeErr != nil {
+		health = 0
+	}
+
+	values := map[string]float64{
+		scrapeHealthMetricName:       health,
+		scrapeDurationMetricName:     duration.Seconds(),
+		scrapeSamplesMetricName:      float64(res.Scraped),
+		samplesPostRelabelMetricName: float64(res.PostRelabel),
+		scrapeSeriesAddedMetricName:  float64(res.SeriesAdded),
+	}
+
+	app := sl.app.head.Appender()
+	for _, name := range reportMetricNames {
+		if _, err := app.Append(0, sl.reportLabels(name), ts.UnixMilli(), values[name]); err != nil {
+			app.Rollback()
+			return err
+		}
+	}
+
+	limit := exceededLimit(scrapeErr)
+	if sl.reportedLimit != "" && sl.reportedLimit != limit {
+		if err := appendStaleMarker(app, 0, sl.limitLabels(sl.reportedLimit), ts.UnixMilli()); err != nil {
+			app.Rollback()
+			return err
+		}
+	}
+	if limit != "" {
+		if _, err := app.Append(0, sl.limitLabels(limit), ts.UnixMilli(), 1); err != nil {
+			app.Rollback()
+			return err
+		}
+	}
+
+	if err := app.Commit(); err != nil {
+		return err
+	}
+	sl.reportedLimit = limit
+	return nil
+}
+
+// reportStale ends the report series along with the series of the target.
+func (sl *scrapeLoop) reportStale(ts time.Time) error {
+	app := sl.app.head.Appender()
+	for _, name := range reportMetricNames {
+		if err := appendStaleMarker(app, 0, sl.reportLabels(name), ts.UnixMilli()); err != nil {
+			app.Rollback()
+			return err
+		}
+	}
+	if sl.reportedLimit != "" {
+		if err := appendStaleMarker(app, 0, sl.limitLabels(sl.reportedLimit), ts.UnixMilli()); err != nil {
+			app.Rollback()
+			return err
+		}
+	}
+
+	if err := commitStaleMarkers(app); err != nil {
+		return err
+	}
+	sl.reportedLimit = ""
+	return nil
+}
+
+func (sl *scrapeLoop) reportLabels(name string) labels.Labels {
+	return labels.NewBuilder(sl.target.labels).Set(labels.MetricName, name).Labels()
+}
+
+func (sl *scrapeLoop) limitLabels(limit string) labels.Labels {
+	return labels.NewBuilder(sl.target.labels).
+		Set(labels.MetricName, scrapeLimitMetricName).
+		Set("limit", limit).
+		Labels()
+}
@@ -0,0 +1,102 @@
+package managers
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+	"github.com/pomyslowynick/scratcheus/tsdb"
+)
+
+func Test_scrapeLoop_report(t *testing.T) {
+	server := newTestServer(t, "../test_files/metrics_five.txt")
+	u, _ := url.Parse(server.URL)
+
+	head := tsdb.NewHead()
+	loop := newTestLoop(server, head)
+
+	reported := func(name string, ts time.Time) float64 {
+		t.Helper()
+
+		l := labels.FromStrings("__name__", name, "instance", u.Host, "job", "test")
+		s, ok, err := head.LatestSample(l, ts.UnixMilli(), 1000)
+		if err != nil || !ok {
+			t.Fatalf("No %s reported: %v", name, err)
+		}
+		return s.F()
+	}
+
+	ts := time.Now()
+	if err := loop.scrapeAndAppend(ts); err != nil {
+		t.Fatalf("Scrape failed: %v", err)
+	}
+
+	for name, want := range map[string]float64{
+		"up":                                    1,
+		"scrape_samples_scraped":                5,
+		"scrape_samples_post_metric_relabeling": 5,
+		"scrape_series_added":                   5,
+	} {
+		if got := reported(name, ts); got != want {
+			t.Errorf("Expected %s %v, got %v", name, want, got)
+		}
+	}
+	if d := reported("scrape_duration_seconds", ts); d <= 0 || d > 10 {
+		t.Errorf("Unexpected scrape duration %v", d)
+	}
+
+	// Nothing new in the second scrape
+	ts = ts.Add(time.Second)
+	loop.scrapeAndAppend(ts)
+	if got := reported("scrape_series_added", ts); got != 0 {
+		t.Errorf("Expected no series added, got %v", got)
+	}
+
+	// The target fails
+	ts = ts.Add(time.Second)
+	loop.target.url = server.URL + "/missing"
+	loop.scrapeAndAppend(ts)
+
+	if got := reported("up", ts); got != 0 {
+		t.Errorf("Expected up 0 for a failed scrape, got %v", got)
+	}
+	if got := reported("scrape_samples_scraped", ts); got != 0 {
+		t.Errorf("Expected no samples for a failed scrape, got %v", got)
+	}
+}
+
+func Test_scrapeLoop_reportLimit(t *testing.T) {
+	server := newTestServer(t, "../test_files/metrics_full.txt")
+	u, _ := url.Parse(server.URL)
+
+	head := tsdb.NewHead()
+	cfg := newTestConfig()
+	cfg.SampleLimit = 100
+	loop := newTestLoopWithConfig(server, head, cfg)
+
+	limit := labels.FromStrings("__name__", "scrape_limit_exceeded", "instance", u.Host, "job", "test", "limit", "sample_limit")
+
+	ts := time.Now()
+	if err := loop.scrapeAndAppend(ts); !errors.Is(err, errSampleLimit) {
+		t.Fatalf("Expected the sample limit to fail the scrape, got %v", err)
+	}
+	s, ok, _ := head.LatestSample(limit, ts.UnixMilli(), 1000)
+	if !ok || s.F() != 1 {
+		t.Fatalf("Expected %s 1 for a scrape over the sample limit", limit)
+	}
+
+	// Under the limit again, the reason goes stale
+	loop.sampleLimit = 0
+	ts = ts.Add(time.Second)
+	if err := loop.scrapeAndAppend(ts); err != nil {
+		t.Fatalf("Scrape failed: %v", err)
+	}
+	if _, ok, _ := head.LatestSample(limit, ts.UnixMilli(), 60*1000); ok {
+		t.Errorf("Limit series should be stale once the scrape is under the limit")
+	}
+	if loop.lastError() != nil {
+		t.Errorf("Expected no last error, got %v", loop.lastError())
+	}
+}
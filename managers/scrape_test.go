@@ -0,0 +1,529 @@
+package managers
+
+import (
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/config"
+	"github.com/pomyslowynick/scratcheus/labels"
+	"github.com/pomyslowynick/scratcheus/relabel"
+	"github.com/pomyslowynick/scratcheus/tsdb"
+)
+
+func newTestServer(t *testing.T, file string) *httptest.Server {
+	t.Helper()
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", file, err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(b)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func newTestConfig() *config.ScrapeConfig {
+	return &config.ScrapeConfig{
+		JobName:        "test",
+		ScrapeInterval: config.Duration(time.Minute),
+		ScrapeTimeout:  config.Duration(10 * time.Second),
+		MetricsPath:    "/metrics",
+		Scheme:         "http",
+	}
+}
+
+func newTestLoop(server *httptest.Server, head *tsdb.Head) *scrapeLoop {
+	return newTestLoopWithConfig(server, head, newTestConfig())
+}
+
+func newTestLoopWithConfig(server *httptest.Server, head *tsdb.Head, cfg *config.ScrapeConfig) *scrapeLoop {
+	u, _ := url.Parse(server.URL)
+	t, _ := newTarget(cfg, labels.FromStrings("__address__", u.Host))
+
+	return newScrapeLoop(t, server.Client(), NewTargetAppender(head), cfg)
+}
+
+func Test_scrapeLoop_scrapeAndAppend(t *testing.T) {
+	server := newTestServer(t, "../test_files/metrics_full.txt")
+	head := tsdb.NewHead()
+	loop := newTestLoop(server, head)
+
+	ts := time.Now()
+	if err := loop.scrapeAndAppend(ts); err != nil {
+		t.Fatalf("Scrape failed: %v", err)
+	}
+
+	// The report series come on top of the scraped ones
+	if n := head.Stats(0).NumSeries; n != 532+5 {
+		t.Errorf("Expected 537 series, got %d", n)
+	}
+
+	u, _ := url.Parse(server.URL)
+	l := labels.FromStrings("__name__", "promhttp_metric_handler_requests_total", "code", "503", "job", "test", "instance", u.Host)
+	if _, ok, _ := head.LatestSample(l, ts.UnixMilli(), 1000); !ok {
+		t.Errorf("Series with the target labels not found")
+	}
+}
+
+func Test_scrapeLoop_failedScrape(t *testing.T) {
+	server := newTestServer(t, "../test_files/metrics_five.txt")
+	head := tsdb.NewHead()
+	loop := newTestLoop(server, head)
+
+	ts := time.Now()
+	if err := loop.scrapeAndAppend(ts); err != nil {
+		t.Fatalf("Scrape failed: %v", err)
+	}
+
+	loop.target.url = server.URL + "/missing"
+	if err := loop.scrapeAndAppend(ts.Add(time.Second)); err == nil {
+		t.Fatalf("Scrape of a missing page didn't fail")
+	}
+
+	u, _ := url.Parse(server.URL)
+	l := labels.FromStrings("__name__", "process_max_fds", "job", "test", "instance", u.Host)
+	if _, ok, _ := head.LatestSample(l, ts.Add(time.Second).UnixMilli(), 60*1000); ok {
+		t.Errorf("Series of the failed target should be stale")
+	}
+}
+
+func Test_scrapeLoop_parseErrorAppendsNothing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("up 1\nbroken{ 2\n"))
+	}))
+	defer server.Close()
+
+	head := tsdb.NewHead()
+	loop := newTestLoop(server, head)
+	loop.target.url = server.URL
+
+	if err := loop.scrapeAndAppend(time.Now()); err == nil {
+		t.Fatalf("Broken scrape didn't fail")
+	}
+	if n := head.Stats(0).NumSeries; n != 5 {
+		t.Errorf("Expected only the report series appended, got %d series", n)
+	}
+}
+
+func Test_scrapeLoop_offset(t *testing.T) {
+	loop := &scrapeLoop{target: &target{url: "http://localhost:9090/metrics"}, interval: 15 * time.Second}
+	now := time.Now()
+
+	offset := loop.offset(now)
+	if offset < 0 || offset >= loop.interval {
+		t.Fatalf("Offset %v outside of the interval", offset)
+	}
+
+	// The scrape lands on the same point of the interval whenever it starts
+	later := now.Add(4 * time.Second)
+	if now.Add(offset).UnixNano()%int64(loop.interval) != later.Add(loop.offset(later)).UnixNano()%int64(loop.interval) {
+		t.Errorf("Scrape moved within the interval")
+	}
+}
+
+func Test_newTarget(t *testing.T) {
+	cfg := &config.ScrapeConfig{
+		JobName:     "node",
+		MetricsPath: "/node/metrics",
+		Scheme:      "https",
+		Params:      url.Values{"collect[]": {"cpu"}},
+	}
+
+	target, err := newTarget(cfg, labels.FromStrings("__address__", "node-1:9100", "zone", "a"))
+	if err != nil {
+		t.Fatalf("Failed to create target: %v", err)
+	}
+	if target.url != "https://node-1:9100/node/metrics?collect%5B%5D=cpu" {
+		t.Errorf("Unexpected URL %s", target.url)
+	}
+	if want := labels.FromStrings("instance", "node-1:9100", "job", "node", "zone", "a"); !labels.Equal(target.labels, want) {
+		t.Errorf("Expected labels %v, got %v", want, target.labels)
+	}
+
+	// The group can set the job and instance itself
+	target, _ = newTarget(cfg, labels.FromStrings("__address__", "node-1:9100", "instance", "node-1", "job", "other"))
+	if want := labels.FromStrings("instance", "node-1", "job", "other"); !labels.Equal(target.labels, want) {
+		t.Errorf("Expected labels %v, got %v", want, target.labels)
+	}
+}
+
+func Test_newTarget_relabel(t *testing.T) {
+	cfg := &config.ScrapeConfig{
+		JobName:     "node",
+		MetricsPath: "/metrics",
+		Scheme:      "http",
+		Params:      url.Values{"collect[]": {"cpu", "meminfo"}, "format": {"text"}},
+		RelabelConfigs: []*relabel.Config{
+			// Scrape through a proxy, keeping the target as the instance
+			{SourceLabels: []string{"__address__"}, Separator: ";", Regex: relabel.MustNewRegexp("(.*)"), TargetLabel: "instance", Replacement: "$1", Action: relabel.Replace},
+			{SourceLabels: []string{"__address__"}, Separator: ";", Regex: relabel.MustNewRegexp("(.*)"), TargetLabel: "__param_target", Replacement: "$1", Action: relabel.Replace},
+			{Separator: ";", Regex: relabel.MustNewRegexp("(.*)"), TargetLabel: "__address__", Replacement: "proxy:9115", Action: relabel.Replace},
+			{Separator: ";", Regex: relabel.MustNewRegexp("(.*)"), TargetLabel: "__metrics_path__", Replacement: "/probe", Action: relabel.Replace},
+			{Separator: ";", Regex: relabel.MustNewRegexp("(.*)"), TargetLabel: "__param_format", Replacement: "json", Action: relabel.Replace},
+			{SourceLabels: []string{"zone"}, Separator: ";", Regex: relabel.MustNewRegexp("b"), Replacement: "$1", Action: relabel.Drop},
+		},
+	}
+
+	target, err := newTarget(cfg, labels.FromStrings("__address__", "node-1:9100", "zone", "a", "__tmp", "x"))
+	if err != nil {
+		t.Fatalf("Failed to create target: %v", err)
+	}
+	if want := "http://proxy:9115/probe?collect%5B%5D=cpu&collect%5B%5D=meminfo&format=json&target=node-1%3A9100"; target.url != want {
+		t.Errorf("Expected URL %s, got %s", want, target.url)
+	}
+	if want := labels.FromStrings("instance", "node-1:9100", "job", "node", "zone", "a"); !labels.Equal(target.labels, want) {
+		t.Errorf("Expected labels %v, got %v", want, target.labels)
+	}
+
+	target, err = newTarget(cfg, labels.FromStrings("__address__", "node-2:9100", "zone", "b"))
+	if err != nil || target != nil {
+		t.Errorf("Expected the target dropped, got %v, %v", target, err)
+	}
+
+	cfg.RelabelConfigs = []*relabel.Config{
+		{Separator: ";", Regex: relabel.MustNewRegexp(".*"), TargetLabel: "__address__", Replacement: "", Action: relabel.Replace},
+	}
+	if _, err := newTarget(cfg, labels.FromStrings("__address__", "node-1:9100")); err == nil {
+		t.Errorf("Target without an address didn't fail")
+	}
+}
+
+func Test_scrapeLoop_metricRelabel(t *testing.T) {
+	server := newTestServer(t, "../test_files/metrics_full.txt")
+	head := tsdb.NewHead()
+
+	cfg := newTestConfig()
+	cfg.MetricRelabelConfigs = []*relabel.Config{
+		{SourceLabels: []string{"__name__"}, Separator: ";", Regex: relabel.MustNewRegexp("go_.*"), Replacement: "$1", Action: relabel.Drop},
+		{SourceLabels: []string{"code"}, Separator: ";", Regex: relabel.MustNewRegexp("(.*)"), TargetLabel: "status", Replacement: "$1", Action: relabel.Replace},
+		{Separator: ";", Regex: relabel.MustNewRegexp("code"), Replacement: "$1", Action: relabel.LabelDrop},
+	}
+	loop := newTestLoopWithConfig(server, head, cfg)
+
+	ts := time.Now()
+	res, err := loop.append(mustReadFile(t, "../test_files/metrics_full.txt"), "text/plain", ts)
+	if err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if res.Scraped != 532 || res.PostRelabel >= res.Scraped {
+		t.Errorf("Expected 532 scraped and fewer left after relabeling, got %d and %d", res.Scraped, res.PostRelabel)
+	}
+
+	u, _ := url.Parse(server.URL)
+	l := labels.FromStrings("__name__", "go_goroutines", "job", "test", "instance", u.Host)
+	if _, ok, _ := head.LatestSample(l, ts.UnixMilli(), 1000); ok {
+		t.Errorf("Dropped series was appended")
+	}
+	l = labels.FromStrings("__name__", "promhttp_metric_handler_requests_total", "status", "503", "job", "test", "instance", u.Host)
+	if _, ok, _ := head.LatestSample(l, ts.UnixMilli(), 1000); !ok {
+		t.Errorf("Relabeled series not found")
+	}
+}
+
+func mustReadFile(t *testing.T, file string) []byte {
+	t.Helper()
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", file, err)
+	}
+	return b
+}
+
+func Test_scrapeLoop_honorLabels(t *testing.T) {
+	server := newTestServer(t, "../test_files/metrics_five.txt")
+	u, _ := url.Parse(server.URL)
+	scrape := []byte("pushed_total{job=\"batch\",instance=\"worker-1\",exported_job=\"old\"} 7 1700000000000\n")
+
+	tests := []struct {
+		name            string
+		honorLabels     bool
+		honorTimestamps bool
+		labels          labels.Labels
+		timestamp       int64
+	}{
+		{
+			name:   "target labels win",
+			labels: labels.FromStrings("__name__", "pushed_total", "job", "test", "instance", u.Host, "exported_job", "old", "exported_exported_job", "batch", "exported_instance", "worker-1"),
+		},
+		{
+			name:            "scraped labels and timestamps win",
+			honorLabels:     true,
+			honorTimestamps: true,
+			labels:          labels.FromStrings("__name__", "pushed_total", "job", "batch", "instance", "worker-1", "exported_job", "old"),
+			timestamp:       1700000000000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head := tsdb.NewHead()
+			cfg := newTestConfig()
+			cfg.HonorLabels, cfg.HonorTimestamps = tt.honorLabels, tt.honorTimestamps
+			loop := newTestLoopWithConfig(server, head, cfg)
+
+			ts := time.Now()
+			if _, err := loop.append(scrape, "text/plain", ts); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+
+			want := tt.timestamp
+			if want == 0 {
+				want = ts.UnixMilli()
+			}
+			s, ok, _ := head.LatestSample(tt.labels, want, 1)
+			if !ok {
+				t.Fatalf("Series %s not found", tt.labels)
+			}
+			if s.T() != want {
+				t.Errorf("Expected the sample at %d, got %d", want, s.T())
+			}
+		})
+	}
+}
+
+func Test_scrapeLoop_limits(t *testing.T) {
+	server := newTestServer(t, "../test_files/metrics_full.txt")
+	u, _ := url.Parse(server.URL)
+
+	tests := []struct {
+		name    string
+		limit   func(cfg *config.ScrapeConfig)
+		wantErr error
+	}{
+		{
+			name: "within the limits",
+			limit: func(cfg *config.ScrapeConfig) {
+				cfg.SampleLimit, cfg.LabelLimit = 532, 10
+				cfg.LabelNameLengthLimit, cfg.LabelValueLengthLimit = 100, 1000
+				cfg.BodySizeLimit = 1 << 20
+			},
+		},
+		{
+			name:    "sample limit",
+			limit:   func(cfg *config.ScrapeConfig) { cfg.SampleLimit = 100 },
+			wantErr: errSampleLimit,
+		},
+		{
+			name:    "label limit",
+			limit:   func(cfg *config.ScrapeConfig) { cfg.LabelLimit = 3 },
+			wantErr: errLabelLimit,
+		},
+		{
+			name:    "label name length limit",
+			limit:   func(cfg *config.ScrapeConfig) { cfg.LabelNameLengthLimit = 5 },
+			wantErr: errLabelNameLengthLimit,
+		},
+		{
+			name:    "label value length limit",
+			limit:   func(cfg *config.ScrapeConfig) { cfg.LabelValueLengthLimit = 10 },
+			wantErr: errLabelValueLengthLimit,
+		},
+		{
+			name:    "body size limit",
+			limit:   func(cfg *config.ScrapeConfig) { cfg.BodySizeLimit = 64 << 10 },
+			wantErr: errBodySizeLimit,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head := tsdb.NewHead()
+			cfg := newTestConfig()
+			tt.limit(cfg)
+			loop := newTestLoopWithConfig(server, head, cfg)
+
+			ts := time.Now()
+			err := loop.scrapeAndAppend(ts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if !errors.Is(loop.lastError(), tt.wantErr) {
+				t.Errorf("Expected last error %v, got %v", tt.wantErr, loop.lastError())
+			}
+
+			wantSeries, wantUp := 532+5, 1.0
+			if tt.wantErr != nil {
+				// Nothing of the scrape, only the report and the limit
+				wantSeries, wantUp = 5+1, 0
+			}
+			if n := head.Stats(0).NumSeries; n != wantSeries {
+				t.Errorf("Expected %d series, got %d", wantSeries, n)
+			}
+			if tt.wantErr != nil {
+				limit := labels.FromStrings("__name__", "scrape_limit_exceeded", "job", "test", "instance", u.Host, "limit", exceededLimit(tt.wantErr))
+				if s, ok, _ := head.LatestSample(limit, ts.UnixMilli(), 1000); !ok || s.F() != 1 {
+					t.Errorf("Expected %s reported", limit)
+				}
+			}
+
+			l := labels.FromStrings("__name__", "up", "job", "test", "instance", u.Host)
+			s, ok, _ := head.LatestSample(l, ts.UnixMilli(), 1000)
+			if !ok {
+				t.Fatalf("up not found")
+			}
+			if s.F() != wantUp {
+				t.Errorf("Expected up %v, got %v", wantUp, s.F())
+			}
+		})
+	}
+}
+
+func Test_scrapeLoop_cache(t *testing.T) {
+	server := newTestServer(t, "../test_files/metrics_full.txt")
+	head := tsdb.NewHead()
+
+	cfg := newTestConfig()
+	cfg.MetricRelabelConfigs = []*relabel.Config{
+		{SourceLabels: []string{"__name__"}, Separator: ";", Regex: relabel.MustNewRegexp("go_.*"), Replacement: "$1", Action: relabel.Drop},
+	}
+	loop := newTestLoopWithConfig(server, head, cfg)
+	b := mustReadFile(t, "../test_files/metrics_full.txt")
+
+	ts := time.Now()
+	first, err := loop.append(b, "text/plain", ts)
+	if err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if n := len(loop.app.series) + len(loop.app.dropped); n != 532 {
+		t.Errorf("Expected all 532 series cached, got %d", n)
+	}
+	if len(loop.app.dropped) != first.Scraped-first.PostRelabel {
+		t.Errorf("Expected %d dropped series cached, got %d", first.Scraped-first.PostRelabel, len(loop.app.dropped))
+	}
+
+	// Nothing's parsed this time round, it all comes from the cache
+	loop.metricRelabelConfigs = nil
+	second, err := loop.append(b, "text/plain", ts.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if second.PostRelabel != first.PostRelabel || second.Appended != first.Appended || second.SeriesAdded != 0 {
+		t.Errorf("Expected the same series as the first scrape and none added, got %+v and %+v", first, second)
+	}
+
+	u, _ := url.Parse(server.URL)
+	l := labels.FromStrings("__name__", "promhttp_metric_handler_requests_total", "code", "503", "job", "test", "instance", u.Host)
+	if _, ok, _ := head.LatestSample(l, ts.Add(time.Minute).UnixMilli(), 1000); !ok {
+		t.Errorf("Cached series wasn't appended")
+	}
+}
+
+func Test_acceptHeader(t *testing.T) {
+	for _, tt := range []struct {
+		protocols []config.ScrapeProtocol
+		want      string
+	}{
+		{
+			protocols: config.DefaultScrapeProtocols,
+			want:      "application/openmetrics-text;version=1.0.0;q=0.5,application/openmetrics-text;version=0.0.1;q=0.4,text/plain;version=0.0.4;q=0.3,*/*;q=0.2",
+		},
+		{
+			protocols: []config.ScrapeProtocol{config.PrometheusText0_0_4},
+			want:      "text/plain;version=0.0.4;q=0.5,*/*;q=0.4",
+		},
+	} {
+		if got := acceptHeader(tt.protocols); got != tt.want {
+			t.Errorf("Expected %q, got %q", tt.want, got)
+		}
+	}
+}
+
+func Test_scrapeLoop_gzip(t *testing.T) {
+	b := mustReadFile(t, "../test_files/metrics_five.txt")
+	var accept string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept")
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write(b)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write(b)
+		gz.Close()
+	}))
+	defer server.Close()
+
+	cfg := newTestConfig()
+	cfg.ScrapeProtocols = []config.ScrapeProtocol{config.PrometheusText0_0_4}
+	loop := newTestLoopWithConfig(server, tsdb.NewHead(), cfg)
+	loop.target.url = server.URL
+
+	got, _, err := loop.scrape(t.Context())
+	if err != nil {
+		t.Fatalf("Scrape failed: %v", err)
+	}
+	if string(got) != string(b) {
+		t.Errorf("Expected the decompressed body, got %q", got)
+	}
+	if accept != acceptHeader(cfg.ScrapeProtocols) {
+		t.Errorf("Expected the Accept header of the protocols, got %q", accept)
+	}
+
+	// The limit is on the decompressed body, it's bigger than the compressed one
+	loop.bodySizeLimit = int64(len(b) - 1)
+	if _, _, err := loop.scrape(t.Context()); !errors.Is(err, errBodySizeLimit) {
+		t.Errorf("Expected the body size limit exceeded, got %v", err)
+	}
+}
+
+func Test_scrapeLoop_protobuf(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", config.ScrapeProtocolsHeaders[config.PrometheusProto])
+		w.Write([]byte{0x0a, 0x02})
+	}))
+	defer server.Close()
+
+	loop := newTestLoop(server, tsdb.NewHead())
+	loop.target.url = server.URL
+
+	if _, _, err := loop.scrape(t.Context()); err == nil || !strings.Contains(err.Error(), "protobuf") {
+		t.Errorf("Expected the protobuf response refused, got %v", err)
+	}
+}
+
+func Test_scrapePool_basicAuth(t *testing.T) {
+	b := mustReadFile(t, "../test_files/metrics_five.txt")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "scratcheus" || pass != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write(b)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	head := tsdb.NewHead()
+	cfg := newTestConfig()
+	cfg.HTTPClientConfig.BasicAuth = &config.BasicAuth{Username: "scratcheus", Password: "secret"}
+	sp, err := newScrapePool(cfg, head, nil)
+	if err != nil {
+		t.Fatalf("Failed to create scrape pool: %v", err)
+	}
+
+	tgt, _ := newTarget(cfg, labels.FromStrings("__address__", u.Host))
+	loop := newScrapeLoop(tgt, sp.client, NewTargetAppender(head), cfg)
+	if err := loop.scrapeAndAppend(time.Now()); err != nil {
+		t.Fatalf("Scrape with basic auth failed: %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package managers
+
+import (
+	"errors"
+	"math"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+	"github.com/pomyslowynick/scratcheus/tsdb"
+	"github.com/pomyslowynick/scratcheus/value"
+)
+
+// TargetAppender appends consecutive scrapes of a single target to the head,
+// every scrape in a transaction of its own. It caches the series by their raw
+// text in the scrape, so a series seen before skips parsing its labels,
+// relabeling and hashing, and goes straight to the head by its ref. It
+// remembers the series of the previous scrape too, so the ones missing from
+// the current scrape get a stale marker and drop out of queries straight away
+// rather than lingering for the whole lookback.
+type TargetAppender struct {
+	head *tsdb.Head
+
+	// iter counts the scrapes, entries not in the last appended scrape are
+	// dropped from the cache
+	iter   uint64
+	series map[string]*cacheEntry
+	// dropped are the raw series which metric relabeling dropped, by the last
+	// scrape they were in
+	dropped map[string]uint64
+
+	// previous and current are the series of the previous and the current
+	// scrape by the hash of their labels. Series with timestamps of their own
+	// aren't in them, their samples can come from anywhen, as with
+	// federation, so they aren't marked stale.
+	previous map[uint64]*cacheEntry
+	current  map[uint64]*cacheEntry
+	// seen are all the series of the previous scrape, for counting the new
+	// ones
+	seen     map[uint64]struct{}
+	seenCurr map[uint64]struct{}
+
+	// samples are the samples of the scrape being appended, kept to save
+	// allocating them on every scrape
+	samples []scrapedSample
+}
+
+// cacheEntry is a series as it's appended, after relabeling.
+type cacheEntry struct {
+	ref      uint64
+	lset     labels.Labels
+	hash     uint64
+	lastIter uint64
+}
+
+func NewTargetAppender(h *tsdb.Head) *TargetAppender {
+	return &TargetAppender{
+		head:     h,
+		series:   make(map[string]*cacheEntry),
+		dropped:  make(map[string]uint64),
+		previous: make(map[uint64]*cacheEntry),
+		current:  make(map[uint64]*cacheEntry),
+		seen:     make(map[uint64]struct{}),
+		seenCurr: make(map[uint64]struct{}),
+	}
+}
+
+// clearCache forgets the series cached, for when what the raw series turn
+// into changes, like with new metric relabel configs. The series of the
+// previous scrape are kept, they still go stale.
+func (a *TargetAppender) clearCache() {
+	clear(a.series)
+	clear(a.dropped)
+}
+
+// AppendResult is what a scrape added to the head.
+type AppendResult struct {
+	// Appended is the number of samples the head accepted.
+	Appended int
+	// SeriesAdded is the number of series which weren't in the previous
+	// scrape.
+	SeriesAdded int
+	// Rejected is the number of samples the head rejected, as out of order,
+	// duplicates or out of bounds. RejectedErr is the first of the errors.
+	Rejected    int
+	RejectedErr error
+}
+
+// scrapeAppender appends a single scrape taken at t. Nothing of it goes to
+// the head until commit, a scrape rolled back doesn't even create series.
+type scrapeAppender struct {
+	a *TargetAppender
+	t int64
+}
+
+type scrapedSample struct {
+	ce           *cacheEntry
+	v            float64
+	t            int64
+	hasTimestamp bool
+}
+
+func (a *TargetAppender) appender(t int64) *scrapeAppender {
+	a.iter++
+	a.samples = a.samples[:0]
+
+	return &scrapeAppender{a: a, t: t}
+}
+
+// get returns the cached series of the raw series, or dropped if metric
+// relabeling dropped it. Neither means it's a series not seen before.
+func (s *scrapeAppender) get(series []byte) (ce *cacheEntry, dropped bool) {
+	if ce, ok := s.a.series[string(series)]; ok {
+		return ce, false
+	}
+	if _, ok := s.a.dropped[string(series)]; ok {
+		s.a.dropped[string(series)] = s.a.iter
+		return nil, true
+	}
+	return nil, false
+}
+
+// add caches the labels the raw series turned into.
+func (s *scrapeAppender) add(series []byte, lset labels.Labels) (*cacheEntry, error) {
+	hash, err := lset.HashLabels()
+	if err != nil {
+		return nil, err
+	}
+
+	ce := &cacheEntry{lset: lset, hash: hash}
+	s.a.series[string(series)] = ce
+	return ce, nil
+}
+
+// drop caches the raw series as dropped by metric relabeling.
+func (s *scrapeAppender) drop(series []byte) {
+	s.a.dropped[string(series)] = s.a.iter
+}
+
+// append adds a sample of the series to the scrape, at its own timestamp if
+// it has one.
+func (s *scrapeAppender) append(ce *cacheEntry, v float64, ts int64, hasTimestamp bool) {
+	ce.lastIter = s.a.iter
+	s.a.samples = append(s.a.samples, scrapedSample{ce: ce, v: v, t: ts, hasTimestamp: hasTimestamp})
+}
+
+// commit appends the scrape and marks the series which disappeared since the
+// previous scrape as stale. A sample rejected by the head doesn't stop the
+// rest of the scrape, it's counted in the result. The series not in the
+// scrape are dropped from the cache. The error is for the scrape which
+// couldn't be appended at all.
+func (s *scrapeAppender) commit() (AppendResult, error) {
+	a := s.a
+	var res AppendResult
+	app := a.head.Appender()
+	clear(a.current)
+	clear(a.seenCurr)
+
+	for _, sample := range a.samples {
+		ce := sample.ce
+		if _, ok := a.seenCurr[ce.hash]; !ok {
+			a.seenCurr[ce.hash] = struct{}{}
+			if _, ok := a.seen[ce.hash]; !ok {
+				res.SeriesAdded++
+			}
+		}
+
+		ts := sample.t
+		if !sample.hasTimestamp {
+			a.current[ce.hash] = ce
+			ts = s.t
+		}
+
+		ref, err := app.Append(ce.ref, ce.lset, ts, sample.v)
+		if ref != 0 {
+			ce.ref = ref
+		}
+		if err != nil {
+			res.Rejected++
+			if res.RejectedErr == nil {
+				res.RejectedErr = err
+			}
+			continue
+		}
+		res.Appended++
+	}
+
+	for hash, ce := range a.previous {
+		if _, ok := a.current[hash]; ok {
+			continue
+		}
+
+		if err := appendStaleMarker(app, ce.ref, ce.lset, s.t); err != nil {
+			app.Rollback()
+			return AppendResult{}, err
+		}
+	}
+
+	if err := app.Commit(); err != nil {
+		var cerr *tsdb.CommitError
+		if !errors.As(err, &cerr) {
+			return AppendResult{}, err
+		}
+		// Another writer of the same series got in between, that's the
+		// only way a stale marker gets rejected as well
+		res.Rejected += cerr.Rejected
+		res.Appended = max(res.Appended-cerr.Rejected, 0)
+		if res.RejectedErr == nil {
+			res.RejectedErr = cerr.Err
+		}
+	}
+
+	a.previous, a.current = a.current, a.previous
+	a.seen, a.seenCurr = a.seenCurr, a.seen
+
+	for series, ce := range a.series {
+		if ce.lastIter != a.iter {
+			delete(a.series, series)
+		}
+	}
+	for series, iter := range a.dropped {
+		if iter != a.iter {
+			delete(a.dropped, series)
+		}
+	}
+
+	return res, nil
+}
+
+// rollback drops the scrape, the series of the previous one are still the
+// ones to go stale.
+func (s *scrapeAppender) rollback() {
+	s.a.samples = s.a.samples[:0]
+}
+
+// MarkStale appends a stale marker to every series of the previous scrape, it's
+// for when the scrape fails or the target goes away.
+func (a *TargetAppender) MarkStale(t int64) error {
+	var firstErr error
+	app := a.head.Appender()
+
+	for _, ce := range a.previous {
+		if err := appendStaleMarker(app, ce.ref, ce.lset, t); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if err := commitStaleMarkers(app); err != nil {
+		return err
+	}
+
+	clear(a.previous)
+	clear(a.seen)
+	return firstErr
+}
+
+// appendStaleMarker ignores the series having a newer sample already, there's
+// nothing to mark in that case.
+func appendStaleMarker(app *tsdb.HeadAppender, ref uint64, l labels.Labels, t int64) error {
+	_, err := app.Append(ref, l, t, math.Float64frombits(value.StaleNaN))
+	if errors.Is(err, tsdb.ErrOutOfOrderSample) || errors.Is(err, tsdb.ErrDuplicateSampleForTimestamp) {
+		return nil
+	}
+	return err
+}
+
+// commitStaleMarkers commits a transaction of stale markers, the ones the head
+// rejects by then are ignored like appendStaleMarker does.
+func commitStaleMarkers(app *tsdb.HeadAppender) error {
+	var cerr *tsdb.CommitError
+	if err := app.Commit(); err != nil && !errors.As(err, &cerr) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package managers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+	"github.com/pomyslowynick/scratcheus/parser"
+	"github.com/pomyslowynick/scratcheus/tsdb"
+)
+
+var (
+	upLabels  = labels.FromStrings("__name__", "up")
+	fdsLabels = labels.FromStrings("__name__", "process_max_fds")
+)
+
+// appendSamples appends the samples as a scrape, with the labels as the raw
+// series.
+func appendSamples(a *TargetAppender, samples []parser.ParsedSample, t int64) (AppendResult, error) {
+	app := a.appender(t)
+	for _, s := range samples {
+		series := []byte(s.Labels.String())
+		ce, _ := app.get(series)
+		if ce == nil {
+			var err error
+			if ce, err = app.add(series, s.Labels); err != nil {
+				app.rollback()
+				return AppendResult{}, err
+			}
+		}
+		app.append(ce, s.Value, s.Timestamp, s.HasTimestamp)
+	}
+	return app.commit()
+}
+
+func Test_targetAppender_staleSeries(t *testing.T) {
+	head := tsdb.NewHead()
+	app := NewTargetAppender(head)
+
+	_, err := appendSamples(app, []parser.ParsedSample{{Labels: upLabels, Value: 1}, {Labels: fdsLabels, Value: 1024}}, 1000)
+	if err != nil {
+		t.Fatalf("Failed to append the first scrape: %v", err)
+	}
+
+	if _, err := appendSamples(app, []parser.ParsedSample{{Labels: upLabels, Value: 1}}, 2000); err != nil {
+		t.Fatalf("Failed to append the second scrape: %v", err)
+	}
+
+	if _, ok, _ := head.LatestSample(fdsLabels, 2500, 5*60*1000); ok {
+		t.Errorf("Series missing from the second scrape should be stale")
+	}
+
+	if _, ok, _ := head.LatestSample(fdsLabels, 1500, 5*60*1000); !ok {
+		t.Errorf("Series should be returned before it went stale")
+	}
+
+	if _, ok, _ := head.LatestSample(upLabels, 2500, 5*60*1000); !ok {
+		t.Errorf("Series present in both scrapes shouldn't be stale")
+	}
+
+	// Series coming back after being stale
+	res, err := appendSamples(app, []parser.ParsedSample{{Labels: upLabels, Value: 1}, {Labels: fdsLabels, Value: 1024}}, 3000)
+	if err != nil {
+		t.Fatalf("Failed to append the third scrape: %v", err)
+	}
+
+	if _, ok, _ := head.LatestSample(fdsLabels, 3500, 5*60*1000); !ok {
+		t.Errorf("Series which came back shouldn't be stale")
+	}
+
+	if res.Appended != 2 || res.SeriesAdded != 1 {
+		t.Errorf("Expected 2 appended and 1 added series, got %+v", res)
+	}
+}
+
+func Test_targetAppender_rejectedSamples(t *testing.T) {
+	head := tsdb.NewHead()
+	app := NewTargetAppender(head)
+
+	appendSamples(app, []parser.ParsedSample{{Labels: upLabels, Value: 1}}, 2000)
+
+	res, err := appendSamples(app, []parser.ParsedSample{{Labels: upLabels, Value: 1}, {Labels: fdsLabels, Value: 1024}}, 1000)
+	if err != nil {
+		t.Fatalf("Rejected sample failed the whole scrape: %v", err)
+	}
+
+	if res.Appended != 1 || res.Rejected != 1 || !errors.Is(res.RejectedErr, tsdb.ErrOutOfOrderSample) {
+		t.Errorf("Expected 1 appended and 1 out of order sample, got %+v", res)
+	}
+}
+
+func Test_targetAppender_markStale(t *testing.T) {
+	head := tsdb.NewHead()
+	app := NewTargetAppender(head)
+
+	appendSamples(app, []parser.ParsedSample{{Labels: upLabels, Value: 1}, {Labels: fdsLabels, Value: 1024}}, 1000)
+
+	if err := app.MarkStale(2000); err != nil {
+		t.Fatalf("Failed to mark the target stale: %v", err)
+	}
+
+	for _, l := range []labels.Labels{upLabels, fdsLabels} {
+		if _, ok, _ := head.LatestSample(l, 2500, 5*60*1000); ok {
+			t.Errorf("Series %v should be stale after the target went away", l)
+		}
+	}
+}
+
+func Test_targetAppender_ownTimestamps(t *testing.T) {
+	head := tsdb.NewHead()
+	app := NewTargetAppender(head)
+
+	samples := []parser.ParsedSample{
+		{Labels: upLabels, Value: 1},
+		{Labels: fdsLabels, Value: 1024, Timestamp: 500, HasTimestamp: true},
+	}
+	if _, err := appendSamples(app, samples, 1000); err != nil {
+		t.Fatalf("Failed to append the first scrape: %v", err)
+	}
+
+	s, ok, _ := head.LatestSample(fdsLabels, 1000, 5*60*1000)
+	if !ok || s.T() != 500 {
+		t.Errorf("Expected the sample at its own timestamp 500, got %v", s)
+	}
+
+	// Gone from the scrape, but it has its own timestamps, it isn't stale
+	if _, err := appendSamples(app, samples[:1], 2000); err != nil {
+		t.Fatalf("Failed to append the second scrape: %v", err)
+	}
+	if _, ok, _ := head.LatestSample(fdsLabels, 2500, 5*60*1000); !ok {
+		t.Errorf("Series with its own timestamps was marked stale")
+	}
+}
+
+func Test_targetAppender_cache(t *testing.T) {
+	head := tsdb.NewHead()
+	a := NewTargetAppender(head)
+
+	app := a.appender(1000)
+	up, err := app.add([]byte("up"), upLabels)
+	if err != nil {
+		t.Fatalf("Failed to cache up: %v", err)
+	}
+	app.append(up, 1, 0, false)
+	app.drop([]byte(`go_goroutines 12`))
+	if _, err := app.commit(); err != nil {
+		t.Fatalf("Failed to append the first scrape: %v", err)
+	}
+	if up.ref == 0 {
+		t.Errorf("Cached series didn't get the ref of the head series")
+	}
+
+	app = a.appender(2000)
+	if ce, _ := app.get([]byte("up")); ce != up {
+		t.Errorf("Series of the previous scrape isn't cached")
+	}
+	if _, dropped := app.get([]byte(`go_goroutines 12`)); !dropped {
+		t.Errorf("Dropped series isn't cached")
+	}
+	app.append(up, 1, 0, false)
+	res, err := app.commit()
+	if err != nil {
+		t.Fatalf("Failed to append the second scrape: %v", err)
+	}
+	if res.Appended != 1 || res.SeriesAdded != 0 {
+		t.Errorf("Expected 1 appended and no series added, got %+v", res)
+	}
+
+	// Gone from the scrape, gone from the cache
+	app = a.appender(3000)
+	if _, err := app.commit(); err != nil {
+		t.Fatalf("Failed to append the third scrape: %v", err)
+	}
+	if len(a.series) != 0 || len(a.dropped) != 0 {
+		t.Errorf("Expected the cache emptied, got %d series and %d dropped", len(a.series), len(a.dropped))
+	}
+	if _, ok, _ := head.LatestSample(upLabels, 3500, 5*60*1000); ok {
+		t.Errorf("Series missing from the scrape should be stale")
+	}
+}
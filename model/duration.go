@@ -0,0 +1,122 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration written the way Prometheus does, with units of
+// y, w, d, h, m, s and ms in that order, like 1d12h or 30s.
+type Duration time.Duration
+
+var durationUnits = []struct {
+	name string
+	d    time.Duration
+}{
+	{"y", 365 * 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+	{"ms", time.Millisecond},
+}
+
+func ParseDuration(s string) (Duration, error) {
+	if s == "0" {
+		return 0, nil
+	}
+	if s == "" {
+		return 0, errors.New("empty duration string")
+	}
+
+	orig := s
+	var d time.Duration
+	next := 0
+
+	for s != "" {
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("not a valid duration string: %q", orig)
+		}
+		n, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("not a valid duration string: %q", orig)
+		}
+		s = s[i:]
+
+		j := 0
+		for j < len(s) && (s[j] < '0' || s[j] > '9') {
+			j++
+		}
+		unit := s[:j]
+		s = s[j:]
+
+		// Units have to come from the biggest to the smallest, once each
+		found := false
+		for ; next < len(durationUnits); next++ {
+			if durationUnits[next].name == unit {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("not a valid duration string: %q", orig)
+		}
+
+		if n > int64((1<<63-1)/durationUnits[next].d) {
+			return 0, fmt.Errorf("duration out of range: %q", orig)
+		}
+		d += time.Duration(n) * durationUnits[next].d
+		if d < 0 {
+			return 0, fmt.Errorf("duration out of range: %q", orig)
+		}
+		next++
+	}
+
+	return Duration(d), nil
+}
+
+func (d Duration) String() string {
+	if d == 0 {
+		return "0s"
+	}
+
+	var b strings.Builder
+	rest := time.Duration(d)
+	for _, u := range durationUnits {
+		if n := rest / u.d; n > 0 {
+			b.WriteString(strconv.FormatInt(int64(n), 10))
+			b.WriteString(u.name)
+			rest -= n * u.d
+		}
+	}
+	return b.String()
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+
+	parsed, err := ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+
+	*d = parsed
+	return nil
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return d.String(), nil
+}
@@ -0,0 +1,48 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_parseDuration(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"0":       0,
+		"30s":     30 * time.Second,
+		"1m30s":   90 * time.Second,
+		"500ms":   500 * time.Millisecond,
+		"1d12h":   36 * time.Hour,
+		"2w":      14 * 24 * time.Hour,
+		"1y":      365 * 24 * time.Hour,
+		"1h0m10s": time.Hour + 10*time.Second,
+	} {
+		d, err := ParseDuration(s)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", s, err)
+			continue
+		}
+		if time.Duration(d) != want {
+			t.Errorf("Expected %q to be %v, got %v", s, want, time.Duration(d))
+		}
+	}
+
+	for _, s := range []string{"", "1", "s", "1x", "1s1m", "1m1m", "-1s", "1.5s", "99999999999999999999y"} {
+		if _, err := ParseDuration(s); err == nil {
+			t.Errorf("Invalid duration %q was accepted", s)
+		}
+	}
+}
+
+func Test_duration_string(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                                   "0s",
+		15 * time.Second:                    "15s",
+		90 * time.Second:                    "1m30s",
+		36*time.Hour + 500*time.Millisecond: "1d12h500ms",
+		8 * 24 * time.Hour:                  "1w1d",
+	} {
+		if got := Duration(d).String(); got != want {
+			t.Errorf("Expected %v as %q, got %q", d, want, got)
+		}
+	}
+}
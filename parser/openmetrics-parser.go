@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -15,8 +16,14 @@ import (
 type MetricType string
 
 const (
-	MetricTypeCounter = MetricType("counter")
-	MetricTypeUnknown = MetricType("unknown")
+	MetricTypeCounter        = MetricType("counter")
+	MetricTypeGauge          = MetricType("gauge")
+	MetricTypeHistogram      = MetricType("histogram")
+	MetricTypeGaugeHistogram = MetricType("gaugehistogram")
+	MetricTypeSummary        = MetricType("summary")
+	MetricTypeInfo           = MetricType("info")
+	MetricTypeStateset       = MetricType("stateset")
+	MetricTypeUnknown        = MetricType("unknown")
 )
 
 type token int
@@ -67,6 +74,10 @@ type OpenMetricsLexer struct {
 type ParsedSample struct {
 	Labels labels.Labels
 	Value  float64
+	// Timestamp is in milliseconds, when HasTimestamp says the sample has
+	// one of its own.
+	Timestamp    int64
+	HasTimestamp bool
 }
 
 func New(data []byte) OpenMetricsLexer {
@@ -127,6 +138,11 @@ type OpenMetricsParser struct {
 	// visitedMFName is the metric family name of the last visited metric when peeking ahead
 	// for _created series during the execution of the CreatedTimestamp method.
 	visitedMFName []byte
+
+	// textFormat is the Prometheus text format, it doesn't end with # EOF
+	// and has timestamps in milliseconds rather than seconds.
+	textFormat bool
+	hasTS      bool
 }
 
 // Entry represents the type of a parsed entry.
@@ -137,6 +153,7 @@ const (
 	EntryType    Entry = 0
 	EntrySeries  Entry = 1 // EntrySeries marks a series with a simple float64 as value.
 	EntryUnit    Entry = 2
+	EntryHelp    Entry = 3
 )
 
 func NewParser(b []byte) *OpenMetricsParser {
@@ -147,6 +164,24 @@ func NewParser(b []byte) *OpenMetricsParser {
 	return parser
 }
 
+// NewTextParser parses the Prometheus text format, which is what most targets
+// expose unless they're asked for OpenMetrics.
+func NewTextParser(b []byte) *OpenMetricsParser {
+	parser := NewParser(b)
+	parser.textFormat = true
+
+	return parser
+}
+
+// NewParserForContentType picks the parser by the Content-Type header of the
+// scrape response, anything which isn't OpenMetrics is parsed as text.
+func NewParserForContentType(b []byte, contentType string) *OpenMetricsParser {
+	if strings.HasPrefix(contentType, "application/openmetrics-text") {
+		return NewParser(b)
+	}
+	return NewTextParser(b)
+}
+
 // nextToken returns the next token from the openMetricsLexer.
 func (p *OpenMetricsParser) nextToken() token {
 	tok := p.l.Lex()
@@ -208,6 +243,7 @@ func (p *OpenMetricsParser) Next() (Entry, error) {
 
 	p.start = p.l.i
 	p.offsets = p.offsets[:0]
+	p.hasTS = false
 
 	switch t := p.nextToken(); t {
 	case tEOFWord:
@@ -216,8 +252,11 @@ func (p *OpenMetricsParser) Next() (Entry, error) {
 		}
 		return EntryInvalid, io.EOF
 	case tEOF:
+		if p.textFormat {
+			return EntryInvalid, io.EOF
+		}
 		return EntryInvalid, errors.New("data does not end with # EOF")
-	case tType, tUnit:
+	case tHelp, tType, tUnit:
 		switch t2 := p.nextToken(); t2 {
 		case tMName:
 			mStart := p.l.start
@@ -244,15 +283,17 @@ func (p *OpenMetricsParser) Next() (Entry, error) {
 		switch t {
 		case tType:
 			switch s := yoloString(p.text); s {
-			case "counter":
-				p.mtype = MetricTypeCounter
-			case "unknown":
+			case "counter", "gauge", "histogram", "gaugehistogram", "summary", "info", "stateset", "unknown":
+				p.mtype = MetricType(s)
+			case "untyped":
 				p.mtype = MetricTypeUnknown
 			default:
 				return EntryInvalid, fmt.Errorf("invalid metric type %q", s)
 			}
 		}
 		switch t {
+		case tHelp:
+			return EntryHelp, nil
 		case tType:
 			return EntryType, nil
 		case tUnit:
@@ -404,16 +445,53 @@ func (p *OpenMetricsParser) parseSeriesEndOfLine(t token) error {
 		return err
 	}
 
-	switch t2 := p.nextToken(); t2 {
+	t2 := p.nextToken()
+	if t2 == tTimestamp {
+		if p.ts, err = p.parseTimestamp(); err != nil {
+			return err
+		}
+		p.hasTS = true
+		t2 = p.nextToken()
+	}
+
+	switch t2 {
 	case tEOF:
-		return errors.New("data does not end with # EOF")
+		// The last line of the text format can go without a line break
+		if !p.textFormat {
+			return errors.New("data does not end with # EOF")
+		}
 	case tLinebreak:
 		break
+	default:
+		return p.parseError("expected timestamp or line break after value", t2)
 	}
 
 	return nil
 }
 
+// parseTimestamp returns the timestamp in milliseconds, OpenMetrics has them
+// in seconds with a fraction, the text format in milliseconds.
+func (p *OpenMetricsParser) parseTimestamp() (int64, error) {
+	s := yoloString(p.l.buf()[1:])
+
+	if p.textFormat {
+		ts, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w while parsing: %q", err, p.l.b[p.start:p.l.i])
+		}
+		return ts, nil
+	}
+
+	ts, err := parseFloat(s)
+	if err != nil {
+		return 0, fmt.Errorf("%w while parsing: %q", err, p.l.b[p.start:p.l.i])
+	}
+	if math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return 0, fmt.Errorf("invalid timestamp %f", ts)
+	}
+	return int64(ts * 1000), nil
+}
+
 // typeRequiresCT returns true if the metric type requires a _created timestamp.
 func typeRequiresCT(t MetricType) bool {
 	switch t {
@@ -447,30 +525,46 @@ func (p *OpenMetricsParser) Series() ([]byte, float64) {
 	return p.series, p.val
 }
 
+// Timestamp returns the timestamp of the current series in milliseconds, if
+// it has one.
+func (p *OpenMetricsParser) Timestamp() (int64, bool) {
+	return p.ts, p.hasTS
+}
+
+// Help returns the metric name and the text of the current HELP entry.
+func (p *OpenMetricsParser) Help() ([]byte, []byte) {
+	return p.l.b[p.offsets[0]:p.offsets[1]], p.text
+}
+
+// Type returns the metric name and the type of the current TYPE entry.
+func (p *OpenMetricsParser) Type() ([]byte, MetricType) {
+	return p.l.b[p.offsets[0]:p.offsets[1]], p.mtype
+}
+
+// Labels returns the labels of the current series, the metric name included.
+func (p *OpenMetricsParser) Labels() labels.Labels {
+	_, l := p.labels()
+	return l
+}
+
 func (p *OpenMetricsParser) labels() (string, labels.Labels) {
 
 	labelsCount := len(p.offsets) / 2
 
-	allLabels := make(labels.Labels, 0, labelsCount)
+	b := labels.NewScratchBuilder(labelsCount)
 
 	metricName := string(p.l.b[p.offsets[0]:p.offsets[1]])
-	allLabels = append(allLabels, labels.Label{
-		Name:  "__name__",
-		Value: metricName,
-	})
+	b.Add(labels.MetricName, metricName)
 
 	if len(p.offsets) > 2 {
 		for i := 2; len(p.offsets)-2 > i; i += 4 {
 			labelName := string(p.l.b[p.offsets[i]:p.offsets[i+1]])
 			labelValue := string(p.l.b[p.offsets[i+2]:p.offsets[i+3]])
-			allLabels = append(allLabels, labels.Label{
-				Name:  labelName,
-				Value: labelValue,
-			})
+			b.Add(labelName, labelValue)
 
 		}
 	}
-	return metricName, allLabels
+	return metricName, b.Labels()
 }
 
 func ParseScrapeData(scrapeData []byte) map[string]ParsedSample {
@@ -1,9 +1,10 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"slices"
 	"testing"
 
 	"github.com/pomyslowynick/scratcheus/labels"
@@ -20,43 +21,37 @@ func Test_parser_metric(t *testing.T) {
 
 	expectedSamples := map[string]ParsedSample{
 		"prometheus_http_requests_total": ParsedSample{
-			Labels: labels.Labels{
-				labels.Label{Name: "__name__", Value: "prometheus_http_requests_total"},
-				labels.Label{Name: "code", Value: "200"},
-				labels.Label{Name: "handler", Value: "/"},
-			},
+			Labels: labels.FromStrings(
+				"__name__", "prometheus_http_requests_total",
+				"code", "200",
+				"handler", "/",
+			),
 			Value: 0,
 		},
 		"prometheus_engine_query_log_enabled": ParsedSample{
-			Labels: labels.Labels{
-				labels.Label{Name: "__name__", Value: "prometheus_engine_query_log_enabled"},
-			},
-			Value: 0,
+			Labels: labels.FromStrings("__name__", "prometheus_engine_query_log_enabled"),
+			Value:  0,
 		},
 		"prometheus_build_info": ParsedSample{
-			Labels: labels.Labels{
-				labels.Label{Name: "__name__", Value: "prometheus_build_info"},
-				labels.Label{Name: "branch", Value: "release-2.54"},
-				labels.Label{Name: "goarch", Value: "amd64"},
-				labels.Label{Name: "goos", Value: "linux"},
-				labels.Label{Name: "goversion", Value: "go1.23.4"},
-				labels.Label{Name: "revision", Value: "c5e015d29534f06bd1d238c64a06b7ac41abdd7f"},
-				labels.Label{Name: "tags", Value: "netgo,builtinassets,stringlabels"},
-				labels.Label{Name: "version", Value: "2.54.1"},
-			},
+			Labels: labels.FromStrings(
+				"__name__", "prometheus_build_info",
+				"branch", "release-2.54",
+				"goarch", "amd64",
+				"goos", "linux",
+				"goversion", "go1.23.4",
+				"revision", "c5e015d29534f06bd1d238c64a06b7ac41abdd7f",
+				"tags", "netgo,builtinassets,stringlabels",
+				"version", "2.54.1",
+			),
 			Value: 1,
 		},
 		"process_cpu_seconds_total": ParsedSample{
-			Labels: labels.Labels{
-				labels.Label{Name: "__name__", Value: "process_cpu_seconds_total"},
-			},
-			Value: 0.47,
+			Labels: labels.FromStrings("__name__", "process_cpu_seconds_total"),
+			Value:  0.47,
 		},
 		"process_max_fds": ParsedSample{
-			Labels: labels.Labels{
-				labels.Label{Name: "__name__", Value: "process_max_fds"},
-			},
-			Value: 1048576,
+			Labels: labels.FromStrings("__name__", "process_max_fds"),
+			Value:  1048576,
 		},
 	}
 
@@ -66,8 +61,113 @@ func Test_parser_metric(t *testing.T) {
 			t.Fatalf("Sample not present in expected samples: %v", i)
 		}
 
-		if !slices.Equal(l.Labels, sample.Labels) {
+		if !labels.Equal(l.Labels, sample.Labels) {
 			t.Fatalf("Sample labels not equal for %s: \ngot: %v \nexpected: %v", i, l.Labels, sample.Labels)
 		}
 	}
 }
+
+func Test_parser_textFormat(t *testing.T) {
+	scrapeData, err := os.ReadFile("../test_files/metrics_full.txt")
+	if err != nil {
+		t.Fatalf("failed to read the metrics test file")
+	}
+
+	p := NewTextParser(scrapeData)
+
+	var series, help, types int
+	for {
+		et, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to parse after %d series: %v", series, err)
+		}
+
+		switch et {
+		case EntrySeries:
+			series++
+		case EntryHelp:
+			help++
+		case EntryType:
+			types++
+		}
+	}
+
+	if series != 532 || help != 216 || types != 216 {
+		t.Errorf("Expected 532 series, 216 help and type entries, got %d, %d and %d", series, help, types)
+	}
+}
+
+func Test_parser_entries(t *testing.T) {
+	scrapeData := []byte(`# HELP http_requests_total Requests served.
+# TYPE http_requests_total counter
+http_requests_total{code="200"} 1027 1714000000.5
+http_requests_total{code="500"} 3
+# EOF
+`)
+
+	p := NewParser(scrapeData)
+
+	if et, err := p.Next(); et != EntryHelp || err != nil {
+		t.Fatalf("Expected help entry, got %v, %v", et, err)
+	}
+	if name, text := p.Help(); string(name) != "http_requests_total" || string(text) != "Requests served." {
+		t.Errorf("Unexpected help %q %q", name, text)
+	}
+
+	if et, err := p.Next(); et != EntryType || err != nil {
+		t.Fatalf("Expected type entry, got %v, %v", et, err)
+	}
+	if _, mtype := p.Type(); mtype != MetricTypeCounter {
+		t.Errorf("Expected counter, got %s", mtype)
+	}
+
+	if et, err := p.Next(); et != EntrySeries || err != nil {
+		t.Fatalf("Expected series, got %v, %v", et, err)
+	}
+	if ts, ok := p.Timestamp(); !ok || ts != 1714000000500 {
+		t.Errorf("Expected timestamp 1714000000500, got %d, %v", ts, ok)
+	}
+	if l := p.Labels(); !labels.Equal(l, labels.FromStrings("__name__", "http_requests_total", "code", "200")) {
+		t.Errorf("Unexpected labels %v", l)
+	}
+
+	if et, err := p.Next(); et != EntrySeries || err != nil {
+		t.Fatalf("Expected series, got %v, %v", et, err)
+	}
+	if _, ok := p.Timestamp(); ok {
+		t.Errorf("Series without a timestamp has one")
+	}
+	if _, v := p.Series(); v != 3 {
+		t.Errorf("Expected value 3, got %f", v)
+	}
+
+	if _, err := p.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func Test_parser_textFormatTimestamp(t *testing.T) {
+	p := NewTextParser([]byte("up 1 1714000000500"))
+
+	if et, err := p.Next(); et != EntrySeries || err != nil {
+		t.Fatalf("Expected series, got %v, %v", et, err)
+	}
+	if ts, ok := p.Timestamp(); !ok || ts != 1714000000500 {
+		t.Errorf("Expected timestamp 1714000000500, got %d, %v", ts, ok)
+	}
+	if _, err := p.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func Test_parser_missingEOF(t *testing.T) {
+	p := NewParser([]byte("up 1\n"))
+
+	p.Next()
+	if _, err := p.Next(); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("OpenMetrics without # EOF was accepted")
+	}
+}
@@ -0,0 +1,365 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+	"github.com/pomyslowynick/scratcheus/model"
+)
+
+// ValueType is what an expression evaluates to.
+type ValueType string
+
+const (
+	ValueTypeNone   ValueType = "none"
+	ValueTypeVector ValueType = "vector"
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeMatrix ValueType = "matrix"
+	ValueTypeString ValueType = "string"
+)
+
+// documented is the type the way the docs call it, for errors.
+func (t ValueType) documented() string {
+	switch t {
+	case ValueTypeVector:
+		return "instant vector"
+	case ValueTypeMatrix:
+		return "range vector"
+	}
+	return string(t)
+}
+
+// Node is a node of the AST. String prints it back as a query.
+type Node interface {
+	String() string
+	PositionRange() PositionRange
+}
+
+// Expr is a node which evaluates to a value.
+type Expr interface {
+	Node
+	Type() ValueType
+	expr()
+}
+
+// AggregateExpr aggregates the series of a vector, like sum by (job) (...).
+type AggregateExpr struct {
+	Op   ItemType
+	Expr Expr
+	// Param is the first argument of topk, bottomk, count_values and
+	// quantile.
+	Param    Expr
+	Grouping []string
+	// Without aggregates away the grouping labels rather than by them.
+	Without  bool
+	PosRange PositionRange
+}
+
+// BinaryExpr is an operation on two expressions. VectorMatching is there when
+// both sides are vectors.
+type BinaryExpr struct {
+	Op             ItemType
+	LHS, RHS       Expr
+	VectorMatching *VectorMatching
+	// ReturnBool returns 0 or 1 from a comparison rather than filtering.
+	ReturnBool bool
+}
+
+// Call is a function call.
+type Call struct {
+	Func     *Function
+	Args     []Expr
+	PosRange PositionRange
+}
+
+// MatrixSelector is a vector selector with a range, foo[5m]. Offset and @ are
+// on the vector selector.
+type MatrixSelector struct {
+	VectorSelector *VectorSelector
+	Range          time.Duration
+	EndPos         Pos
+}
+
+// SubqueryExpr evaluates an instant vector expression over a range, at every
+// step, expr[30m:1m]. A zero step is the default evaluation interval.
+type SubqueryExpr struct {
+	Expr  Expr
+	Range time.Duration
+	Step  time.Duration
+
+	OriginalOffset time.Duration
+	// Timestamp is the @ modifier in milliseconds, StartOrEnd is for @ start()
+	// and @ end().
+	Timestamp  *int64
+	StartOrEnd ItemType
+	EndPos     Pos
+}
+
+type NumberLiteral struct {
+	Val      float64
+	PosRange PositionRange
+}
+
+type StringLiteral struct {
+	Val      string
+	PosRange PositionRange
+}
+
+type ParenExpr struct {
+	Expr     Expr
+	PosRange PositionRange
+}
+
+// UnaryExpr is a minus or plus in front of an expression, a minus in front of
+// a number is folded into the number.
+type UnaryExpr struct {
+	Op       ItemType
+	Expr     Expr
+	StartPos Pos
+}
+
+// VectorSelector selects the series by their labels. A metric name in front
+// of the braces is a __name__ matcher, it's in LabelMatchers too.
+type VectorSelector struct {
+	Name          string
+	LabelMatchers []*labels.Matcher
+
+	OriginalOffset time.Duration
+	Timestamp      *int64
+	StartOrEnd     ItemType
+	PosRange       PositionRange
+}
+
+// VectorMatchCardinality is how many series of one side match the series of
+// the other.
+type VectorMatchCardinality int
+
+const (
+	CardOneToOne VectorMatchCardinality = iota
+	CardManyToOne
+	CardOneToMany
+	CardManyToMany
+)
+
+func (c VectorMatchCardinality) String() string {
+	switch c {
+	case CardOneToOne:
+		return "one-to-one"
+	case CardManyToOne:
+		return "many-to-one"
+	case CardOneToMany:
+		return "one-to-many"
+	case CardManyToMany:
+		return "many-to-many"
+	}
+	return fmt.Sprintf("<invalid cardinality %d>", int(c))
+}
+
+// VectorMatching is how the series of the two sides of a binary operation are
+// matched up. With On they match on MatchingLabels only, otherwise on all
+// the labels but those. Include are the labels of the "one" side kept in the
+// result, from group_left and group_right.
+type VectorMatching struct {
+	Card           VectorMatchCardinality
+	MatchingLabels []string
+	On             bool
+	Include        []string
+}
+
+func (e *AggregateExpr) Type() ValueType  { return ValueTypeVector }
+func (e *BinaryExpr) Type() ValueType     { return binaryType(e.LHS, e.RHS) }
+func (e *Call) Type() ValueType           { return e.Func.ReturnType }
+func (e *MatrixSelector) Type() ValueType { return ValueTypeMatrix }
+func (e *SubqueryExpr) Type() ValueType   { return ValueTypeMatrix }
+func (e *NumberLiteral) Type() ValueType  { return ValueTypeScalar }
+func (e *StringLiteral) Type() ValueType  { return ValueTypeString }
+func (e *ParenExpr) Type() ValueType      { return e.Expr.Type() }
+func (e *UnaryExpr) Type() ValueType      { return e.Expr.Type() }
+func (e *VectorSelector) Type() ValueType { return ValueTypeVector }
+
+func binaryType(lhs, rhs Expr) ValueType {
+	if lhs.Type() == ValueTypeScalar && rhs.Type() == ValueTypeScalar {
+		return ValueTypeScalar
+	}
+	return ValueTypeVector
+}
+
+func (*AggregateExpr) expr()  {}
+func (*BinaryExpr) expr()     {}
+func (*Call) expr()           {}
+func (*MatrixSelector) expr() {}
+func (*SubqueryExpr) expr()   {}
+func (*NumberLiteral) expr()  {}
+func (*StringLiteral) expr()  {}
+func (*ParenExpr) expr()      {}
+func (*UnaryExpr) expr()      {}
+func (*VectorSelector) expr() {}
+
+func (e *AggregateExpr) PositionRange() PositionRange { return e.PosRange }
+func (e *Call) PositionRange() PositionRange          { return e.PosRange }
+func (e *NumberLiteral) PositionRange() PositionRange { return e.PosRange }
+func (e *StringLiteral) PositionRange() PositionRange { return e.PosRange }
+func (e *ParenExpr) PositionRange() PositionRange     { return e.PosRange }
+func (e *VectorSelector) PositionRange() PositionRange {
+	return e.PosRange
+}
+
+func (e *BinaryExpr) PositionRange() PositionRange {
+	return PositionRange{Start: e.LHS.PositionRange().Start, End: e.RHS.PositionRange().End}
+}
+
+func (e *MatrixSelector) PositionRange() PositionRange {
+	return PositionRange{Start: e.VectorSelector.PositionRange().Start, End: e.EndPos}
+}
+
+func (e *SubqueryExpr) PositionRange() PositionRange {
+	return PositionRange{Start: e.Expr.PositionRange().Start, End: e.EndPos}
+}
+
+func (e *UnaryExpr) PositionRange() PositionRange {
+	return PositionRange{Start: e.StartPos, End: e.Expr.PositionRange().End}
+}
+
+func (e *AggregateExpr) String() string {
+	var b strings.Builder
+	b.WriteString(e.Op.String())
+	switch {
+	case e.Without:
+		fmt.Fprintf(&b, " without (%s) ", strings.Join(e.Grouping, ", "))
+	case len(e.Grouping) > 0:
+		fmt.Fprintf(&b, " by (%s) ", strings.Join(e.Grouping, ", "))
+	}
+
+	b.WriteByte('(')
+	if e.Param != nil {
+		b.WriteString(e.Param.String())
+		b.WriteString(", ")
+	}
+	b.WriteString(e.Expr.String())
+	b.WriteByte(')')
+	return b.String()
+}
+
+func (e *BinaryExpr) String() string {
+	var b strings.Builder
+	b.WriteString(e.LHS.String())
+	b.WriteByte(' ')
+	b.WriteString(e.Op.String())
+	if e.ReturnBool {
+		b.WriteString(" bool")
+	}
+
+	if vm := e.VectorMatching; vm != nil && (len(vm.MatchingLabels) > 0 || vm.On) {
+		if vm.On {
+			b.WriteString(" on")
+		} else {
+			b.WriteString(" ignoring")
+		}
+		fmt.Fprintf(&b, " (%s)", strings.Join(vm.MatchingLabels, ", "))
+
+		switch vm.Card {
+		case CardManyToOne:
+			b.WriteString(" group_left")
+		case CardOneToMany:
+			b.WriteString(" group_right")
+		}
+		if vm.Card == CardManyToOne || vm.Card == CardOneToMany {
+			fmt.Fprintf(&b, " (%s)", strings.Join(vm.Include, ", "))
+		}
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(e.RHS.String())
+	return b.String()
+}
+
+func (e *Call) String() string {
+	args := make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = arg.String()
+	}
+	return e.Func.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (e *MatrixSelector) String() string {
+	// The modifiers go after the range
+	vs := *e.VectorSelector
+	vs.OriginalOffset, vs.Timestamp, vs.StartOrEnd = 0, nil, 0
+
+	return vs.String() + "[" + model.Duration(e.Range).String() + "]" +
+		modifiersString(e.VectorSelector.OriginalOffset, e.VectorSelector.Timestamp, e.VectorSelector.StartOrEnd)
+}
+
+func (e *SubqueryExpr) String() string {
+	step := ""
+	if e.Step != 0 {
+		step = model.Duration(e.Step).String()
+	}
+	return e.Expr.String() + "[" + model.Duration(e.Range).String() + ":" + step + "]" +
+		modifiersString(e.OriginalOffset, e.Timestamp, e.StartOrEnd)
+}
+
+func (e *NumberLiteral) String() string {
+	switch {
+	case math.IsInf(e.Val, 1):
+		return "Inf"
+	case math.IsInf(e.Val, -1):
+		return "-Inf"
+	case math.IsNaN(e.Val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(e.Val, 'f', -1, 64)
+}
+
+func (e *StringLiteral) String() string {
+	return strconv.Quote(e.Val)
+}
+
+func (e *ParenExpr) String() string {
+	return "(" + e.Expr.String() + ")"
+}
+
+func (e *UnaryExpr) String() string {
+	return e.Op.String() + e.Expr.String()
+}
+
+func (e *VectorSelector) String() string {
+	matchers := make([]string, 0, len(e.LabelMatchers))
+	for _, m := range e.LabelMatchers {
+		// The name is in front of the braces already
+		if e.Name != "" && m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+			continue
+		}
+		matchers = append(matchers, m.String())
+	}
+
+	s := e.Name
+	if len(matchers) > 0 || s == "" {
+		s += "{" + strings.Join(matchers, ", ") + "}"
+	}
+	return s + modifiersString(e.OriginalOffset, e.Timestamp, e.StartOrEnd)
+}
+
+func modifiersString(offset time.Duration, ts *int64, startOrEnd ItemType) string {
+	var s string
+	switch {
+	case offset > 0:
+		s += " offset " + model.Duration(offset).String()
+	case offset < 0:
+		s += " offset -" + model.Duration(-offset).String()
+	}
+
+	switch {
+	case ts != nil:
+		s += fmt.Sprintf(" @ %.3f", float64(*ts)/1000)
+	case startOrEnd == START:
+		s += " @ start()"
+	case startOrEnd == END:
+		s += " @ end()"
+	}
+	return s
+}
@@ -0,0 +1,79 @@
+package parser
+
+// Function is the signature of a PromQL function. Variadic is how many of
+// the last arguments can be left out, -1 is for the last one repeating any
+// number of times, including none.
+type Function struct {
+	Name       string
+	ArgTypes   []ValueType
+	Variadic   int
+	ReturnType ValueType
+}
+
+// Functions are the functions known to the parser, by name.
+var Functions = map[string]*Function{}
+
+func init() {
+	var (
+		vector = ValueTypeVector
+		matrix = ValueTypeMatrix
+		scalar = ValueTypeScalar
+		str    = ValueTypeString
+	)
+
+	fns := []*Function{
+		{Name: "abs", ArgTypes: []ValueType{vector}, ReturnType: vector},
+		{Name: "absent", ArgTypes: []ValueType{vector}, ReturnType: vector},
+		{Name: "absent_over_time", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "ceil", ArgTypes: []ValueType{vector}, ReturnType: vector},
+		{Name: "changes", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "clamp", ArgTypes: []ValueType{vector, scalar, scalar}, ReturnType: vector},
+		{Name: "clamp_max", ArgTypes: []ValueType{vector, scalar}, ReturnType: vector},
+		{Name: "clamp_min", ArgTypes: []ValueType{vector, scalar}, ReturnType: vector},
+		{Name: "delta", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "deriv", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "exp", ArgTypes: []ValueType{vector}, ReturnType: vector},
+		{Name: "floor", ArgTypes: []ValueType{vector}, ReturnType: vector},
+		{Name: "histogram_quantile", ArgTypes: []ValueType{scalar, vector}, ReturnType: vector},
+		{Name: "idelta", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "increase", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "irate", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "label_join", ArgTypes: []ValueType{vector, str, str, str}, Variadic: -1, ReturnType: vector},
+		{Name: "label_replace", ArgTypes: []ValueType{vector, str, str, str, str}, ReturnType: vector},
+		{Name: "ln", ArgTypes: []ValueType{vector}, ReturnType: vector},
+		{Name: "log2", ArgTypes: []ValueType{vector}, ReturnType: vector},
+		{Name: "log10", ArgTypes: []ValueType{vector}, ReturnType: vector},
+		{Name: "predict_linear", ArgTypes: []ValueType{matrix, scalar}, ReturnType: vector},
+		{Name: "rate", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "resets", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "round", ArgTypes: []ValueType{vector, scalar}, Variadic: 1, ReturnType: vector},
+		{Name: "scalar", ArgTypes: []ValueType{vector}, ReturnType: scalar},
+		{Name: "sgn", ArgTypes: []ValueType{vector}, ReturnType: vector},
+		{Name: "sort", ArgTypes: []ValueType{vector}, ReturnType: vector},
+		{Name: "sort_desc", ArgTypes: []ValueType{vector}, ReturnType: vector},
+		{Name: "sqrt", ArgTypes: []ValueType{vector}, ReturnType: vector},
+		{Name: "time", ArgTypes: []ValueType{}, ReturnType: scalar},
+		{Name: "timestamp", ArgTypes: []ValueType{vector}, ReturnType: vector},
+		{Name: "vector", ArgTypes: []ValueType{scalar}, ReturnType: vector},
+
+		{Name: "avg_over_time", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "count_over_time", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "last_over_time", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "max_over_time", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "min_over_time", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "present_over_time", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "quantile_over_time", ArgTypes: []ValueType{scalar, matrix}, ReturnType: vector},
+		{Name: "stddev_over_time", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "stdvar_over_time", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+		{Name: "sum_over_time", ArgTypes: []ValueType{matrix}, ReturnType: vector},
+	}
+
+	// The time of the sample by default, the time of the series given
+	for _, name := range []string{"day_of_month", "day_of_week", "day_of_year", "days_in_month", "hour", "minute", "month", "year"} {
+		fns = append(fns, &Function{Name: name, ArgTypes: []ValueType{vector}, Variadic: 1, ReturnType: vector})
+	}
+
+	for _, f := range fns {
+		Functions[f.Name] = f
+	}
+}
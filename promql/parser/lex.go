@@ -0,0 +1,531 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ItemType is the type of a token of the query, the operators and keywords
+// are the ones the AST uses too.
+type ItemType int
+
+const (
+	EOF ItemType = iota
+	ERROR
+	IDENTIFIER
+	// METRIC_IDENTIFIER is an identifier with a colon in it, it can only be a
+	// metric name, as with recording rules.
+	METRIC_IDENTIFIER
+	NUMBER
+	DURATION
+	STRING
+	LEFT_PAREN
+	RIGHT_PAREN
+	LEFT_BRACE
+	RIGHT_BRACE
+	LEFT_BRACKET
+	RIGHT_BRACKET
+	COMMA
+	COLON
+	AT
+
+	operatorsStart
+	ADD
+	SUB
+	MUL
+	DIV
+	MOD
+	POW
+	ATAN2
+	EQLC
+	NEQ
+	LTE
+	LSS
+	GTE
+	GTR
+	// EQL, EQL_REGEX and NEQ_REGEX only go in label matchers, with NEQ
+	EQL
+	EQL_REGEX
+	NEQ_REGEX
+	LAND
+	LOR
+	LUNLESS
+	operatorsEnd
+
+	aggregatorsStart
+	SUM
+	AVG
+	COUNT
+	MIN
+	MAX
+	GROUP
+	STDDEV
+	STDVAR
+	TOPK
+	BOTTOMK
+	COUNT_VALUES
+	QUANTILE
+	aggregatorsEnd
+
+	keywordsStart
+	BOOL
+	BY
+	WITHOUT
+	ON
+	IGNORING
+	GROUP_LEFT
+	GROUP_RIGHT
+	OFFSET
+	START
+	END
+	keywordsEnd
+)
+
+// key are the operators and keywords spelled out as words, they're case
+// insensitive like in Prometheus.
+var key = map[string]ItemType{
+	"and":    LAND,
+	"or":     LOR,
+	"unless": LUNLESS,
+	"atan2":  ATAN2,
+
+	"sum":          SUM,
+	"avg":          AVG,
+	"count":        COUNT,
+	"min":          MIN,
+	"max":          MAX,
+	"group":        GROUP,
+	"stddev":       STDDEV,
+	"stdvar":       STDVAR,
+	"topk":         TOPK,
+	"bottomk":      BOTTOMK,
+	"count_values": COUNT_VALUES,
+	"quantile":     QUANTILE,
+
+	"bool":        BOOL,
+	"by":          BY,
+	"without":     WITHOUT,
+	"on":          ON,
+	"ignoring":    IGNORING,
+	"group_left":  GROUP_LEFT,
+	"group_right": GROUP_RIGHT,
+	"offset":      OFFSET,
+	"start":       START,
+	"end":         END,
+}
+
+var itemTypeStr = map[ItemType]string{
+	EOF:               "end of input",
+	ERROR:             "error",
+	IDENTIFIER:        "identifier",
+	METRIC_IDENTIFIER: "metric identifier",
+	NUMBER:            "number",
+	DURATION:          "duration",
+	STRING:            "string",
+	LEFT_PAREN:        "(",
+	RIGHT_PAREN:       ")",
+	LEFT_BRACE:        "{",
+	RIGHT_BRACE:       "}",
+	LEFT_BRACKET:      "[",
+	RIGHT_BRACKET:     "]",
+	COMMA:             ",",
+	COLON:             ":",
+	AT:                "@",
+
+	ADD:       "+",
+	SUB:       "-",
+	MUL:       "*",
+	DIV:       "/",
+	MOD:       "%",
+	POW:       "^",
+	EQLC:      "==",
+	NEQ:       "!=",
+	LTE:       "<=",
+	LSS:       "<",
+	GTE:       ">=",
+	GTR:       ">",
+	EQL:       "=",
+	EQL_REGEX: "=~",
+	NEQ_REGEX: "!~",
+}
+
+func init() {
+	for s, typ := range key {
+		itemTypeStr[typ] = s
+	}
+}
+
+func (t ItemType) String() string {
+	if s, ok := itemTypeStr[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("<item %d>", int(t))
+}
+
+func (t ItemType) IsOperator() bool   { return t > operatorsStart && t < operatorsEnd }
+func (t ItemType) IsAggregator() bool { return t > aggregatorsStart && t < aggregatorsEnd }
+func (t ItemType) IsKeyword() bool    { return t > keywordsStart && t < keywordsEnd }
+
+// IsComparisonOperator is for the operators which filter, or return 0 and 1
+// with bool.
+func (t ItemType) IsComparisonOperator() bool {
+	switch t {
+	case EQLC, NEQ, LTE, LSS, GTE, GTR:
+		return true
+	}
+	return false
+}
+
+// IsSetOperator is for the operators which work on the series of both sides
+// rather than their values.
+func (t ItemType) IsSetOperator() bool {
+	switch t {
+	case LAND, LOR, LUNLESS:
+		return true
+	}
+	return false
+}
+
+// IsAggregatorWithParam is for the aggregations taking a parameter before
+// the expression, like topk(5, ...).
+func (t ItemType) IsAggregatorWithParam() bool {
+	return t == TOPK || t == BOTTOMK || t == COUNT_VALUES || t == QUANTILE
+}
+
+// Pos is a byte offset in the query.
+type Pos int
+
+// PositionRange is where a node or an error is in the query, End is past the
+// last byte.
+type PositionRange struct {
+	Start Pos
+	End   Pos
+}
+
+// item is a token of the query. val is the text of it, strings still have
+// their quotes.
+type item struct {
+	typ ItemType
+	pos Pos
+	val string
+}
+
+func (i item) end() Pos {
+	return i.pos + Pos(len(i.val))
+}
+
+// desc describes the item for errors.
+func (i item) desc() string {
+	switch {
+	case i.typ == EOF:
+		return "end of input"
+	case i.typ == ERROR:
+		return i.val
+	case i.typ.IsOperator(), i.typ.IsAggregator(), i.typ.IsKeyword():
+		return fmt.Sprintf("%q", i.val)
+	case i.typ == STRING:
+		return "string " + i.val
+	case i.typ == IDENTIFIER, i.typ == METRIC_IDENTIFIER, i.typ == NUMBER, i.typ == DURATION:
+		return fmt.Sprintf("%s %q", i.typ, i.val)
+	}
+	return i.typ.desc()
+}
+
+// desc describes an item type expected in its place, for errors.
+func (t ItemType) desc() string {
+	switch t {
+	case EOF:
+		return "end of input"
+	case IDENTIFIER, METRIC_IDENTIFIER, NUMBER, DURATION, STRING:
+		return t.String()
+	}
+	return fmt.Sprintf("%q", t)
+}
+
+// lexer splits the query into items in one go. An error ends the items with
+// an ERROR, its val is the message.
+type lexer struct {
+	input string
+	pos   int
+	start int
+	items []item
+	// brackets is how deep in [] the lexer is, a colon in there splits a
+	// subquery rather than being part of a metric name
+	brackets int
+}
+
+func lex(input string) []item {
+	l := &lexer{input: input}
+	for l.next() {
+	}
+	return l.items
+}
+
+func (l *lexer) emit(t ItemType) {
+	l.items = append(l.items, item{typ: t, pos: Pos(l.start), val: l.input[l.start:l.pos]})
+	l.start = l.pos
+}
+
+func (l *lexer) errorf(format string, args ...any) bool {
+	l.items = append(l.items, item{typ: ERROR, pos: Pos(l.start), val: fmt.Sprintf(format, args...)})
+	return false
+}
+
+func (l *lexer) peek(n int) byte {
+	if l.pos+n >= len(l.input) {
+		return 0
+	}
+	return l.input[l.pos+n]
+}
+
+// next lexes the next item, it's false after the last one.
+func (l *lexer) next() bool {
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		if c == '#' {
+			for l.pos < len(l.input) && l.input[l.pos] != '\n' {
+				l.pos++
+			}
+			continue
+		}
+		if !isSpace(c) {
+			break
+		}
+		l.pos++
+	}
+	l.start = l.pos
+
+	if l.pos >= len(l.input) {
+		if l.brackets > 0 {
+			return l.errorf("unclosed left bracket")
+		}
+		l.emit(EOF)
+		return false
+	}
+
+	c := l.input[l.pos]
+	two := func(second byte, long, short ItemType) {
+		l.pos++
+		if l.peek(0) == second {
+			l.pos++
+			l.emit(long)
+			return
+		}
+		l.emit(short)
+	}
+
+	switch {
+	case c == '(':
+		l.pos++
+		l.emit(LEFT_PAREN)
+	case c == ')':
+		l.pos++
+		l.emit(RIGHT_PAREN)
+	case c == '{':
+		l.pos++
+		l.emit(LEFT_BRACE)
+	case c == '}':
+		l.pos++
+		l.emit(RIGHT_BRACE)
+	case c == '[':
+		l.brackets++
+		l.pos++
+		l.emit(LEFT_BRACKET)
+	case c == ']':
+		if l.brackets == 0 {
+			return l.errorf("unexpected right bracket %q", c)
+		}
+		l.brackets--
+		l.pos++
+		l.emit(RIGHT_BRACKET)
+	case c == ',':
+		l.pos++
+		l.emit(COMMA)
+	case c == '@':
+		l.pos++
+		l.emit(AT)
+	case c == ':' && l.brackets > 0:
+		l.pos++
+		l.emit(COLON)
+	case c == '+':
+		l.pos++
+		l.emit(ADD)
+	case c == '-':
+		l.pos++
+		l.emit(SUB)
+	case c == '*':
+		l.pos++
+		l.emit(MUL)
+	case c == '/':
+		l.pos++
+		l.emit(DIV)
+	case c == '%':
+		l.pos++
+		l.emit(MOD)
+	case c == '^':
+		l.pos++
+		l.emit(POW)
+	case c == '=':
+		l.pos++
+		switch l.peek(0) {
+		case '=':
+			l.pos++
+			l.emit(EQLC)
+		case '~':
+			l.pos++
+			l.emit(EQL_REGEX)
+		default:
+			l.emit(EQL)
+		}
+	case c == '!':
+		l.pos++
+		switch l.peek(0) {
+		case '=':
+			l.pos++
+			l.emit(NEQ)
+		case '~':
+			l.pos++
+			l.emit(NEQ_REGEX)
+		default:
+			return l.errorf("unexpected character after '!': %q", l.peek(0))
+		}
+	case c == '<':
+		two('=', LTE, LSS)
+	case c == '>':
+		two('=', GTE, GTR)
+	case c == '"' || c == '\'' || c == '`':
+		return l.lexString(c)
+	case isDigit(c) || (c == '.' && isDigit(l.peek(1))):
+		return l.lexNumberOrDuration()
+	case isAlpha(c) || c == ':':
+		l.lexIdentifier()
+	default:
+		return l.errorf("unexpected character %q", c)
+	}
+	return true
+}
+
+func (l *lexer) lexString(quote byte) bool {
+	l.pos++
+	for {
+		if l.pos >= len(l.input) {
+			return l.errorf("unterminated quoted string")
+		}
+
+		c := l.input[l.pos]
+		switch {
+		case c == '\\' && quote != '`':
+			// Escapes are checked when the string is unquoted
+			l.pos += 2
+			continue
+		case c == '\n' && quote != '`':
+			return l.errorf("unterminated quoted string")
+		case c == quote:
+			l.pos++
+			l.emit(STRING)
+			return true
+		}
+		l.pos++
+	}
+}
+
+// lexNumberOrDuration takes 5m and 1h30m as durations, the rest as numbers,
+// 1.5, 1e3 and 0x1f.
+func (l *lexer) lexNumberOrDuration() bool {
+	if l.scanDuration() {
+		l.emit(DURATION)
+		return true
+	}
+
+	l.pos = l.start
+	digits := "0123456789"
+	if l.peek(0) == '0' && (l.peek(1) == 'x' || l.peek(1) == 'X') {
+		l.pos += 2
+		digits = "0123456789abcdefABCDEF"
+	}
+	l.acceptRun(digits)
+	if l.accept(".") {
+		l.acceptRun(digits)
+	}
+	if len(digits) == 10 && l.accept("eE") {
+		l.accept("+-")
+		l.acceptRun("0123456789")
+	}
+
+	if c := l.peek(0); isAlpha(c) || isDigit(c) || c == '.' {
+		l.pos++
+		return l.errorf("bad number or duration syntax: %q", l.input[l.start:l.pos])
+	}
+	l.emit(NUMBER)
+	return true
+}
+
+// scanDuration moves past a duration, it's false when there isn't one.
+func (l *lexer) scanDuration() bool {
+	units := 0
+	for isDigit(l.peek(0)) {
+		l.acceptRun("0123456789")
+		switch {
+		case l.peek(0) == 'm' && l.peek(1) == 's':
+			l.pos += 2
+		case strings.IndexByte("smhdwy", l.peek(0)) >= 0:
+			l.pos++
+		default:
+			return false
+		}
+		units++
+	}
+	c := l.peek(0)
+	return units > 0 && !isAlpha(c) && c != '.'
+}
+
+// lexIdentifier lexes metric and label names and the keywords. Inf and NaN
+// are numbers.
+func (l *lexer) lexIdentifier() {
+	for c := l.peek(0); isAlpha(c) || isDigit(c) || c == ':'; c = l.peek(0) {
+		if c == ':' && l.brackets > 0 {
+			break
+		}
+		l.pos++
+	}
+
+	word := l.input[l.start:l.pos]
+	lower := strings.ToLower(word)
+	switch {
+	case lower == "inf" || lower == "nan":
+		l.emit(NUMBER)
+	case strings.Contains(word, ":"):
+		l.emit(METRIC_IDENTIFIER)
+	default:
+		if t, ok := key[lower]; ok {
+			l.emit(t)
+			return
+		}
+		l.emit(IDENTIFIER)
+	}
+}
+
+func (l *lexer) accept(valid string) bool {
+	if c := l.peek(0); c != 0 && strings.IndexByte(valid, c) >= 0 {
+		l.pos++
+		return true
+	}
+	return false
+}
+
+func (l *lexer) acceptRun(valid string) {
+	for l.accept(valid) {
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
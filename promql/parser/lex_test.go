@@ -0,0 +1,99 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_lex(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []item
+	}{
+		{
+			input: `rate(http_requests_total{job=~"api.*"}[5m])`,
+			want: []item{
+				{IDENTIFIER, 0, "rate"},
+				{LEFT_PAREN, 4, "("},
+				{IDENTIFIER, 5, "http_requests_total"},
+				{LEFT_BRACE, 24, "{"},
+				{IDENTIFIER, 25, "job"},
+				{EQL_REGEX, 28, "=~"},
+				{STRING, 30, `"api.*"`},
+				{RIGHT_BRACE, 37, "}"},
+				{LEFT_BRACKET, 38, "["},
+				{DURATION, 39, "5m"},
+				{RIGHT_BRACKET, 41, "]"},
+				{RIGHT_PAREN, 42, ")"},
+				{EOF, 43, ""},
+			},
+		},
+		{
+			// The colon is a metric name inside braces, a subquery inside brackets
+			input: `job:up:sum[1h:1m]`,
+			want: []item{
+				{METRIC_IDENTIFIER, 0, "job:up:sum"},
+				{LEFT_BRACKET, 10, "["},
+				{DURATION, 11, "1h"},
+				{COLON, 13, ":"},
+				{DURATION, 14, "1m"},
+				{RIGHT_BRACKET, 16, "]"},
+				{EOF, 17, ""},
+			},
+		},
+		{
+			input: `SUM BY (job) (foo) >= bool 0x1F # a comment`,
+			want: []item{
+				{SUM, 0, "SUM"},
+				{BY, 4, "BY"},
+				{LEFT_PAREN, 7, "("},
+				{IDENTIFIER, 8, "job"},
+				{RIGHT_PAREN, 11, ")"},
+				{LEFT_PAREN, 13, "("},
+				{IDENTIFIER, 14, "foo"},
+				{RIGHT_PAREN, 17, ")"},
+				{GTE, 19, ">="},
+				{BOOL, 22, "bool"},
+				{NUMBER, 27, "0x1F"},
+				{EOF, 43, ""},
+			},
+		},
+		{
+			input: `foo offset -1.5e3 @ start() != Inf`,
+			want: []item{
+				{IDENTIFIER, 0, "foo"},
+				{OFFSET, 4, "offset"},
+				{SUB, 11, "-"},
+				{NUMBER, 12, "1.5e3"},
+				{AT, 18, "@"},
+				{START, 20, "start"},
+				{LEFT_PAREN, 25, "("},
+				{RIGHT_PAREN, 26, ")"},
+				{NEQ, 28, "!="},
+				{NUMBER, 31, "Inf"},
+				{EOF, 34, ""},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := lex(tt.input); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lexing %q:\nexpected %v\ngot      %v", tt.input, tt.want, got)
+		}
+	}
+}
+
+func Test_lex_errors(t *testing.T) {
+	for _, input := range []string{
+		`foo{job="node}`,
+		`foo $ bar`,
+		`foo[5m`,
+		`foo{job!}`,
+		"`unterminated",
+	} {
+		items := lex(input)
+		if last := items[len(items)-1]; last.typ != ERROR {
+			t.Errorf("Lexing %q: expected an error at the end, got %v", input, items)
+		}
+	}
+}
@@ -0,0 +1,686 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+	"github.com/pomyslowynick/scratcheus/model"
+)
+
+// ParseErr is an error at a position of the query.
+type ParseErr struct {
+	PositionRange PositionRange
+	Err           error
+	Query         string
+}
+
+// Error has the line and column of the error, both from 1.
+func (e *ParseErr) Error() string {
+	pos := min(int(e.PositionRange.Start), len(e.Query))
+	before := e.Query[:pos]
+	line := strings.Count(before, "\n") + 1
+	col := pos - strings.LastIndexByte(before, '\n')
+
+	return fmt.Sprintf("%d:%d: parse error: %s", line, col, e.Err)
+}
+
+func (e *ParseErr) Unwrap() error {
+	return e.Err
+}
+
+// ParseExpr parses a query and checks the types of its expressions add up.
+func ParseExpr(input string) (expr Expr, err error) {
+	p := newParser(input)
+	defer p.recover(&err)
+
+	expr = p.parseExpr(0)
+	p.expect(EOF, "expression")
+	return expr, nil
+}
+
+// ParseMetricSelector parses a vector selector on its own, like in the
+// match[] of the series API.
+func ParseMetricSelector(input string) (m []*labels.Matcher, err error) {
+	p := newParser(input)
+	defer p.recover(&err)
+
+	var vs *VectorSelector
+	switch t := p.peek().typ; t {
+	case IDENTIFIER, METRIC_IDENTIFIER, LEFT_BRACE:
+		vs = p.parseVectorSelector()
+	default:
+		p.unexpected("metric selector", "")
+	}
+	p.expect(EOF, "metric selector")
+	return vs.LabelMatchers, nil
+}
+
+type parser struct {
+	input string
+	items []item
+	pos   int
+}
+
+func newParser(input string) *parser {
+	return &parser{input: input, items: lex(input)}
+}
+
+// errorf stops the parsing, recover returns the error.
+func (p *parser) errorf(pr PositionRange, format string, args ...any) {
+	panic(&ParseErr{PositionRange: pr, Err: fmt.Errorf(format, args...), Query: p.input})
+}
+
+func (p *parser) recover(errp *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if err, ok := r.(*ParseErr); ok {
+		*errp = err
+		return
+	}
+	panic(r)
+}
+
+func (p *parser) peek() item {
+	return p.items[p.pos]
+}
+
+func (p *parser) next() item {
+	it := p.items[p.pos]
+	// The lexer stops at an EOF or an ERROR, both are the last item
+	if p.pos < len(p.items)-1 {
+		p.pos++
+	}
+	return it
+}
+
+func (p *parser) expect(t ItemType, context string) item {
+	if p.peek().typ != t {
+		p.unexpected(context, t.desc())
+	}
+	return p.next()
+}
+
+// unexpected fails on the next item, with what was expected instead if
+// there's something to say about it.
+func (p *parser) unexpected(context, expected string) {
+	it := p.peek()
+	if it.typ == ERROR {
+		p.errorf(PositionRange{Start: it.pos, End: it.pos}, "%s", it.val)
+	}
+
+	msg := fmt.Sprintf("unexpected %s", it.desc())
+	if context != "" {
+		msg += " in " + context
+	}
+	if expected != "" {
+		msg += ", expected " + expected
+	}
+	p.errorf(PositionRange{Start: it.pos, End: it.end()}, "%s", msg)
+}
+
+// Operator precedence, from the loosest. Unary operators come between
+// multiplication and power, -2^2 is -4.
+func precedence(t ItemType) int {
+	switch t {
+	case LOR:
+		return 1
+	case LAND, LUNLESS:
+		return 2
+	case EQLC, NEQ, LTE, LSS, GTE, GTR:
+		return 3
+	case ADD, SUB:
+		return 4
+	case MUL, DIV, MOD, ATAN2:
+		return 5
+	case POW:
+		return 6
+	}
+	return 0
+}
+
+// parseExpr parses binary expressions with operators of at least minPrec,
+// by precedence climbing. All of them but ^ are left associative.
+func (p *parser) parseExpr(minPrec int) Expr {
+	lhs := p.parseUnary()
+
+	for {
+		op := p.peek()
+		prec := precedence(op.typ)
+		if prec == 0 || prec < minPrec {
+			return lhs
+		}
+		p.next()
+
+		returnBool, matching := p.parseBinaryModifiers(op)
+
+		nextPrec := prec + 1
+		if op.typ == POW {
+			nextPrec = prec
+		}
+		rhs := p.parseExpr(nextPrec)
+
+		lhs = p.newBinaryExpr(op, lhs, rhs, returnBool, matching)
+	}
+}
+
+func (p *parser) parseUnary() Expr {
+	if t := p.peek(); t.typ == ADD || t.typ == SUB {
+		p.next()
+		e := p.parseExpr(precedence(POW))
+
+		if e.Type() != ValueTypeScalar && e.Type() != ValueTypeVector {
+			p.errorf(e.PositionRange(), "unary expression only allowed on expressions of type scalar or instant vector, got %q", e.Type().documented())
+		}
+		if n, ok := e.(*NumberLiteral); ok {
+			if t.typ == SUB {
+				n.Val = -n.Val
+			}
+			n.PosRange.Start = t.pos
+			return n
+		}
+		return &UnaryExpr{Op: t.typ, Expr: e, StartPos: t.pos}
+	}
+
+	return p.parsePostfix(p.parsePrimary())
+}
+
+func (p *parser) parsePrimary() Expr {
+	switch it := p.peek(); {
+	case it.typ == NUMBER:
+		p.next()
+		return p.newNumberLiteral(it)
+	case it.typ == STRING:
+		p.next()
+		return &StringLiteral{Val: p.unquote(it), PosRange: PositionRange{Start: it.pos, End: it.end()}}
+	case it.typ == LEFT_PAREN:
+		p.next()
+		e := p.parseExpr(0)
+		end := p.expect(RIGHT_PAREN, "parenthesized expression")
+		return &ParenExpr{Expr: e, PosRange: PositionRange{Start: it.pos, End: end.end()}}
+	case it.typ == IDENTIFIER && p.items[p.pos+1].typ == LEFT_PAREN:
+		return p.parseCall()
+	case it.typ == IDENTIFIER || it.typ == METRIC_IDENTIFIER || it.typ == LEFT_BRACE:
+		return p.parseVectorSelector()
+	case it.typ.IsAggregator():
+		return p.parseAggregateExpr()
+	}
+
+	p.unexpected("expression", "")
+	return nil
+}
+
+// parsePostfix parses the ranges, subqueries and modifiers following an
+// expression.
+func (p *parser) parsePostfix(e Expr) Expr {
+	for {
+		switch p.peek().typ {
+		case LEFT_BRACKET:
+			e = p.parseRangeOrSubquery(e)
+		case OFFSET:
+			p.parseOffset(e)
+		case AT:
+			p.parseAt(e)
+		default:
+			return e
+		}
+	}
+}
+
+func (p *parser) newNumberLiteral(it item) *NumberLiteral {
+	pr := PositionRange{Start: it.pos, End: it.end()}
+
+	var (
+		f   float64
+		err error
+	)
+	switch strings.ToLower(it.val) {
+	case "inf":
+		f = math.Inf(1)
+	case "nan":
+		f = math.NaN()
+	default:
+		if strings.HasPrefix(it.val, "0x") || strings.HasPrefix(it.val, "0X") {
+			var u uint64
+			u, err = strconv.ParseUint(it.val[2:], 16, 64)
+			f = float64(u)
+		} else {
+			f, err = strconv.ParseFloat(it.val, 64)
+		}
+	}
+	if err != nil {
+		p.errorf(pr, "error parsing number: %s", err)
+	}
+	return &NumberLiteral{Val: f, PosRange: pr}
+}
+
+// unquote takes the quotes off a string, '...' and "..." have the escapes of
+// Go strings, `...` is taken as it is.
+func (p *parser) unquote(it item) string {
+	quote := it.val[0]
+	s := it.val[1 : len(it.val)-1]
+	if quote == '`' {
+		return s
+	}
+
+	var b strings.Builder
+	for len(s) > 0 {
+		r, multibyte, tail, err := strconv.UnquoteChar(s, quote)
+		if err != nil {
+			p.errorf(PositionRange{Start: it.pos, End: it.end()}, "invalid escape in string %s", it.val)
+		}
+		if multibyte {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte(byte(r))
+		}
+		s = tail
+	}
+	return b.String()
+}
+
+func (p *parser) parseDuration(it item) time.Duration {
+	d, err := model.ParseDuration(it.val)
+	if err != nil {
+		p.errorf(PositionRange{Start: it.pos, End: it.end()}, "%s", err)
+	}
+	return time.Duration(d)
+}
+
+// parseVectorSelector parses foo, foo{job="node"} and {job="node"}.
+func (p *parser) parseVectorSelector() *VectorSelector {
+	start := p.peek()
+	vs := &VectorSelector{PosRange: PositionRange{Start: start.pos, End: start.end()}}
+
+	if start.typ == IDENTIFIER || start.typ == METRIC_IDENTIFIER {
+		p.next()
+		vs.Name = start.val
+	}
+
+	if p.peek().typ == LEFT_BRACE {
+		p.next()
+		for p.peek().typ != RIGHT_BRACE {
+			vs.LabelMatchers = append(vs.LabelMatchers, p.parseLabelMatcher())
+			if p.peek().typ != COMMA {
+				break
+			}
+			p.next()
+		}
+		end := p.expect(RIGHT_BRACE, "label matching")
+		vs.PosRange.End = end.end()
+	}
+
+	if vs.Name != "" {
+		for _, m := range vs.LabelMatchers {
+			if m.Name == labels.MetricName {
+				p.errorf(vs.PosRange, "metric name must not be set twice: %q or %q", vs.Name, m.Value)
+			}
+		}
+		vs.LabelMatchers = append(vs.LabelMatchers, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, vs.Name))
+		return vs
+	}
+
+	// Something has to be there, {} would be every series
+	for _, m := range vs.LabelMatchers {
+		if !m.Matches("") {
+			return vs
+		}
+	}
+	p.errorf(vs.PosRange, "vector selector must contain at least one non-empty matcher")
+	return nil
+}
+
+func (p *parser) parseLabelMatcher() *labels.Matcher {
+	name := p.parseLabelName("label matching")
+
+	var mt labels.MatchType
+	switch op := p.peek(); op.typ {
+	case EQL:
+		mt = labels.MatchEqual
+	case NEQ:
+		mt = labels.MatchNotEqual
+	case EQL_REGEX:
+		mt = labels.MatchRegexp
+	case NEQ_REGEX:
+		mt = labels.MatchNotRegexp
+	default:
+		p.unexpected("label matching", "label matching operator")
+	}
+	p.next()
+
+	value := p.expect(STRING, "label matching")
+	m, err := labels.NewMatcher(mt, name.val, p.unquote(value))
+	if err != nil {
+		p.errorf(PositionRange{Start: name.pos, End: value.end()}, "%s", err)
+	}
+	return m
+}
+
+// parseLabelName takes keywords as label names too, by and on are fine
+// names.
+func (p *parser) parseLabelName(context string) item {
+	it := p.peek()
+	if (it.typ == IDENTIFIER || it.typ.IsKeyword() || it.typ.IsAggregator() || it.typ.IsOperator()) && labels.IsValidLabelName(it.val) {
+		return p.next()
+	}
+	p.unexpected(context, "label")
+	return item{}
+}
+
+// parseLabels parses the labels of by, without, on, ignoring and the groups.
+func (p *parser) parseLabels(context string) []string {
+	p.expect(LEFT_PAREN, context)
+
+	ls := []string{}
+	for p.peek().typ != RIGHT_PAREN {
+		ls = append(ls, p.parseLabelName(context).val)
+		if p.peek().typ != COMMA {
+			break
+		}
+		p.next()
+	}
+	p.expect(RIGHT_PAREN, context)
+	return ls
+}
+
+// parseRangeOrSubquery parses [5m] after a vector selector, or [30m:1m] after
+// any instant vector expression.
+func (p *parser) parseRangeOrSubquery(e Expr) Expr {
+	p.next()
+	rng := p.parseDuration(p.expect(DURATION, "range"))
+
+	if p.peek().typ != COLON {
+		end := p.expect(RIGHT_BRACKET, "range")
+
+		vs, ok := e.(*VectorSelector)
+		if !ok {
+			p.errorf(PositionRange{Start: e.PositionRange().Start, End: end.end()}, "ranges only allowed for vector selectors")
+		}
+		if vs.OriginalOffset != 0 || vs.Timestamp != nil || vs.StartOrEnd != 0 {
+			p.errorf(PositionRange{Start: vs.PosRange.Start, End: end.end()}, "no offset or @ modifiers allowed before range")
+		}
+		return &MatrixSelector{VectorSelector: vs, Range: rng, EndPos: end.end()}
+	}
+
+	p.next()
+	var step time.Duration
+	if p.peek().typ == DURATION {
+		step = p.parseDuration(p.next())
+	}
+	end := p.expect(RIGHT_BRACKET, "subquery")
+
+	if e.Type() != ValueTypeVector {
+		p.errorf(PositionRange{Start: e.PositionRange().Start, End: end.end()}, "subquery is only allowed on instant vector, got %s instead", e.Type().documented())
+	}
+	return &SubqueryExpr{Expr: e, Range: rng, Step: step, EndPos: end.end()}
+}
+
+// modifiers returns the offset and @ fields of the expression, with the end
+// of its position to be moved past them.
+func (p *parser) modifiers(e Expr, mod item) (offset *time.Duration, ts **int64, startOrEnd *ItemType, end *Pos) {
+	switch e := e.(type) {
+	case *VectorSelector:
+		return &e.OriginalOffset, &e.Timestamp, &e.StartOrEnd, &e.PosRange.End
+	case *MatrixSelector:
+		vs := e.VectorSelector
+		return &vs.OriginalOffset, &vs.Timestamp, &vs.StartOrEnd, &e.EndPos
+	case *SubqueryExpr:
+		return &e.OriginalOffset, &e.Timestamp, &e.StartOrEnd, &e.EndPos
+	}
+
+	p.errorf(PositionRange{Start: mod.pos, End: mod.end()}, "%s modifier must be preceded by an instant vector selector or range vector selector or a subquery", mod.val)
+	return nil, nil, nil, nil
+}
+
+func (p *parser) parseOffset(e Expr) {
+	mod := p.next()
+	offset, _, _, end := p.modifiers(e, mod)
+	if *offset != 0 {
+		p.errorf(PositionRange{Start: mod.pos, End: mod.end()}, "offset may not be set multiple times")
+	}
+
+	sign := time.Duration(1)
+	if p.peek().typ == SUB {
+		p.next()
+		sign = -1
+	}
+	it := p.expect(DURATION, "offset")
+
+	*offset = sign * p.parseDuration(it)
+	*end = it.end()
+}
+
+func (p *parser) parseAt(e Expr) {
+	mod := p.next()
+	_, ts, startOrEnd, end := p.modifiers(e, mod)
+	if *ts != nil || *startOrEnd != 0 {
+		p.errorf(PositionRange{Start: mod.pos, End: mod.end()}, "@ <timestamp> may not be set multiple times")
+	}
+
+	switch it := p.peek(); it.typ {
+	case START, END:
+		p.next()
+		p.expect(LEFT_PAREN, "@")
+		*end = p.expect(RIGHT_PAREN, "@").end()
+		*startOrEnd = it.typ
+		return
+	}
+
+	sign := 1.0
+	if t := p.peek().typ; t == ADD || t == SUB {
+		if t == SUB {
+			sign = -1
+		}
+		p.next()
+	}
+	if p.peek().typ != NUMBER {
+		p.unexpected("@", "timestamp")
+	}
+	it := p.next()
+	n := p.newNumberLiteral(it)
+
+	f := sign * n.Val * 1000
+	if math.IsNaN(f) || math.IsInf(f, 0) || f >= math.MaxInt64 || f <= math.MinInt64 {
+		p.errorf(PositionRange{Start: mod.pos, End: it.end()}, "timestamp out of bounds for @ modifier: %f", sign*n.Val)
+	}
+	ms := int64(math.Round(f))
+	*ts = &ms
+	*end = it.end()
+}
+
+func (p *parser) parseCall() Expr {
+	name := p.next()
+	fn, ok := Functions[name.val]
+	if !ok {
+		p.errorf(PositionRange{Start: name.pos, End: name.end()}, "unknown function with name %q", name.val)
+	}
+
+	p.expect(LEFT_PAREN, "function call")
+	var args []Expr
+	for p.peek().typ != RIGHT_PAREN {
+		args = append(args, p.parseExpr(0))
+		if p.peek().typ != COMMA {
+			break
+		}
+		p.next()
+	}
+	end := p.expect(RIGHT_PAREN, "function call")
+
+	call := &Call{Func: fn, Args: args, PosRange: PositionRange{Start: name.pos, End: end.end()}}
+	p.checkCall(call)
+	return call
+}
+
+func (p *parser) checkCall(call *Call) {
+	fn, nargs := call.Func, len(call.Args)
+
+	switch {
+	case fn.Variadic == 0:
+		if nargs != len(fn.ArgTypes) {
+			p.errorf(call.PosRange, "expected %d argument(s) in call to %q, got %d", len(fn.ArgTypes), fn.Name, nargs)
+		}
+	case fn.Variadic > 0:
+		least := len(fn.ArgTypes) - fn.Variadic
+		if nargs < least || nargs > len(fn.ArgTypes) {
+			p.errorf(call.PosRange, "expected %d to %d argument(s) in call to %q, got %d", least, len(fn.ArgTypes), fn.Name, nargs)
+		}
+	default:
+		if least := len(fn.ArgTypes) - 1; nargs < least {
+			p.errorf(call.PosRange, "expected at least %d argument(s) in call to %q, got %d", least, fn.Name, nargs)
+		}
+	}
+
+	for i, arg := range call.Args {
+		want := fn.ArgTypes[min(i, len(fn.ArgTypes)-1)]
+		if arg.Type() != want {
+			p.errorf(arg.PositionRange(), "expected type %s in call to function %q, got %s", want.documented(), fn.Name, arg.Type().documented())
+		}
+	}
+}
+
+// parseAggregateExpr parses sum(foo), sum by (job) (foo), sum(foo) by (job)
+// and the ones with a parameter, topk(5, foo).
+func (p *parser) parseAggregateExpr() Expr {
+	op := p.next()
+	agg := &AggregateExpr{Op: op.typ, PosRange: PositionRange{Start: op.pos}}
+
+	grouped := p.parseGrouping(agg)
+
+	p.expect(LEFT_PAREN, "aggregation")
+	var args []Expr
+	for p.peek().typ != RIGHT_PAREN {
+		args = append(args, p.parseExpr(0))
+		if p.peek().typ != COMMA {
+			break
+		}
+		p.next()
+	}
+	end := p.expect(RIGHT_PAREN, "aggregation")
+	agg.PosRange.End = end.end()
+
+	if !grouped && p.parseGrouping(agg) {
+		agg.PosRange.End = p.items[p.pos-1].end()
+	}
+
+	want := 1
+	if op.typ.IsAggregatorWithParam() {
+		want = 2
+	}
+	if len(args) != want {
+		p.errorf(agg.PosRange, "wrong number of arguments for aggregate expression provided, expected %d, got %d", want, len(args))
+	}
+	if want == 2 {
+		agg.Param = args[0]
+	}
+	agg.Expr = args[len(args)-1]
+
+	if agg.Expr.Type() != ValueTypeVector {
+		p.errorf(agg.Expr.PositionRange(), "expected type instant vector in aggregation expression, got %s", agg.Expr.Type().documented())
+	}
+	if agg.Param != nil {
+		wantParam := ValueTypeScalar
+		if op.typ == COUNT_VALUES {
+			wantParam = ValueTypeString
+		}
+		if agg.Param.Type() != wantParam {
+			p.errorf(agg.Param.PositionRange(), "expected type %s in aggregation parameter, got %s", wantParam.documented(), agg.Param.Type().documented())
+		}
+	}
+	return agg
+}
+
+// parseGrouping parses by (...) or without (...), if it's there.
+func (p *parser) parseGrouping(agg *AggregateExpr) bool {
+	switch p.peek().typ {
+	case BY:
+	case WITHOUT:
+		agg.Without = true
+	default:
+		return false
+	}
+	p.next()
+	agg.Grouping = p.parseLabels("grouping")
+	return true
+}
+
+// parseBinaryModifiers parses bool, on, ignoring, group_left and group_right
+// after a binary operator.
+func (p *parser) parseBinaryModifiers(op item) (bool, *VectorMatching) {
+	returnBool := false
+	if it := p.peek(); it.typ == BOOL {
+		if !op.typ.IsComparisonOperator() {
+			p.errorf(PositionRange{Start: it.pos, End: it.end()}, "bool modifier can only be used on comparison operators")
+		}
+		p.next()
+		returnBool = true
+	}
+
+	var vm *VectorMatching
+	switch p.peek().typ {
+	case ON, IGNORING:
+		on := p.next().typ == ON
+		vm = &VectorMatching{On: on, MatchingLabels: p.parseLabels("vector matching")}
+	default:
+		return returnBool, nil
+	}
+
+	switch it := p.peek(); it.typ {
+	case GROUP_LEFT, GROUP_RIGHT:
+		p.next()
+		if op.typ.IsSetOperator() {
+			p.errorf(PositionRange{Start: it.pos, End: it.end()}, "no grouping allowed for %q operation", op.val)
+		}
+
+		vm.Card = CardManyToOne
+		if it.typ == GROUP_RIGHT {
+			vm.Card = CardOneToMany
+		}
+		vm.Include = []string{}
+		if p.peek().typ == LEFT_PAREN {
+			vm.Include = p.parseLabels("grouping")
+		}
+
+		for _, l := range vm.Include {
+			for _, m := range vm.MatchingLabels {
+				if vm.On && l == m {
+					p.errorf(PositionRange{Start: it.pos, End: p.items[p.pos-1].end()}, "label %q must not occur in ON and GROUP clause at once", l)
+				}
+			}
+		}
+	}
+	return returnBool, vm
+}
+
+func (p *parser) newBinaryExpr(op item, lhs, rhs Expr, returnBool bool, vm *VectorMatching) Expr {
+	e := &BinaryExpr{Op: op.typ, LHS: lhs, RHS: rhs, ReturnBool: returnBool, VectorMatching: vm}
+	pr := e.PositionRange()
+
+	for _, side := range []Expr{lhs, rhs} {
+		if t := side.Type(); t != ValueTypeScalar && t != ValueTypeVector {
+			p.errorf(side.PositionRange(), "binary expression must contain only scalar and instant vector types")
+		}
+	}
+
+	bothVectors := lhs.Type() == ValueTypeVector && rhs.Type() == ValueTypeVector
+	switch {
+	case op.typ.IsComparisonOperator() && e.Type() == ValueTypeScalar && !returnBool:
+		p.errorf(pr, "comparisons between scalars must use BOOL modifier")
+	case op.typ.IsSetOperator() && !bothVectors:
+		p.errorf(pr, "set operator %q not allowed in binary scalar expression", op.val)
+	case vm != nil && !bothVectors:
+		p.errorf(pr, "vector matching only allowed between instant vectors")
+	}
+
+	if bothVectors && vm == nil {
+		e.VectorMatching = &VectorMatching{Card: CardOneToOne}
+	}
+	if op.typ.IsSetOperator() {
+		e.VectorMatching.Card = CardManyToMany
+	}
+	return e
+}
@@ -0,0 +1,306 @@
+package parser
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+func Test_parseExpr(t *testing.T) {
+	ts := int64(1700000000500)
+
+	tests := []struct {
+		input string
+		want  Expr
+	}{
+		{
+			input: `-1.5`,
+			want:  &NumberLiteral{Val: -1.5, PosRange: PositionRange{Start: 0, End: 4}},
+		},
+		{
+			input: `'a\tb'`,
+			want:  &StringLiteral{Val: "a\tb", PosRange: PositionRange{Start: 0, End: 6}},
+		},
+		{
+			input: `up{job="node", instance!~"a.*"}`,
+			want: &VectorSelector{
+				Name: "up",
+				LabelMatchers: []*labels.Matcher{
+					labels.MustNewMatcher(labels.MatchEqual, "job", "node"),
+					labels.MustNewMatcher(labels.MatchNotRegexp, "instance", "a.*"),
+					labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "up"),
+				},
+				PosRange: PositionRange{Start: 0, End: 31},
+			},
+		},
+		{
+			input: `foo[5m] offset 1h @ 1700000000.5`,
+			want: &MatrixSelector{
+				VectorSelector: &VectorSelector{
+					Name:           "foo",
+					LabelMatchers:  []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "foo")},
+					OriginalOffset: time.Hour,
+					Timestamp:      &ts,
+					PosRange:       PositionRange{Start: 0, End: 3},
+				},
+				Range:  5 * time.Minute,
+				EndPos: 32,
+			},
+		},
+		{
+			input: `sum without (instance) (rate(foo[1m]))`,
+			want: &AggregateExpr{
+				Op: SUM,
+				Expr: &Call{
+					Func: Functions["rate"],
+					Args: []Expr{&MatrixSelector{
+						VectorSelector: &VectorSelector{
+							Name:          "foo",
+							LabelMatchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "foo")},
+							PosRange:      PositionRange{Start: 29, End: 32},
+						},
+						Range:  time.Minute,
+						EndPos: 36,
+					}},
+					PosRange: PositionRange{Start: 24, End: 37},
+				},
+				Grouping: []string{"instance"},
+				Without:  true,
+				PosRange: PositionRange{Start: 0, End: 38},
+			},
+		},
+		{
+			input: `a / on (job) group_left (env) b`,
+			want: &BinaryExpr{
+				Op: DIV,
+				LHS: &VectorSelector{
+					Name:          "a",
+					LabelMatchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "a")},
+					PosRange:      PositionRange{Start: 0, End: 1},
+				},
+				RHS: &VectorSelector{
+					Name:          "b",
+					LabelMatchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "b")},
+					PosRange:      PositionRange{Start: 30, End: 31},
+				},
+				VectorMatching: &VectorMatching{
+					Card:           CardManyToOne,
+					MatchingLabels: []string{"job"},
+					On:             true,
+					Include:        []string{"env"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseExpr(tt.input)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parsing %q:\nexpected %#v\ngot      %#v", tt.input, tt.want, got)
+		}
+	}
+}
+
+func Test_parseExpr_precedence(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`1 + 2 * 3`, `1 + 2 * 3`},
+		{`(1 + 2) * 3`, `(1 + 2) * 3`},
+		// Left associative, but for ^
+		{`a - b - c`, `(a - b) - c`},
+		{`2 ^ 3 ^ 2`, `2 ^ (3 ^ 2)`},
+		{`-2 ^ 2`, `-(2 ^ 2)`},
+		{`a or b and c unless d`, `a or ((b and c) unless d)`},
+		{`a > b + c`, `a > (b + c)`},
+	}
+
+	// Group the binary expressions explicitly, to compare the trees
+	var group func(e Expr) string
+	group = func(e Expr) string {
+		switch e := e.(type) {
+		case *BinaryExpr:
+			return "(" + group(e.LHS) + " " + e.Op.String() + " " + group(e.RHS) + ")"
+		case *ParenExpr:
+			return group(e.Expr)
+		case *UnaryExpr:
+			return e.Op.String() + group(e.Expr)
+		}
+		return e.String()
+	}
+
+	for _, tt := range tests {
+		got, err := ParseExpr(tt.input)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tt.input, err)
+		}
+		want, err := ParseExpr(tt.want)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tt.want, err)
+		}
+		if group(got) != group(want) {
+			t.Errorf("Parsing %q: expected %s, got %s", tt.input, group(want), group(got))
+		}
+	}
+
+	// -2 ^ 2 is folded into a number only after the power
+	e, _ := ParseExpr(`-2 ^ 2`)
+	if u, ok := e.(*UnaryExpr); !ok || u.Op != SUB {
+		t.Errorf("Expected a unary minus, got %#v", e)
+	}
+}
+
+func Test_parseExpr_string(t *testing.T) {
+	for _, input := range []string{
+		`up`,
+		`{job="node"}`,
+		`up{job="node", instance=~"a.*"}`,
+		`foo offset 5m`,
+		`foo offset -1h30m`,
+		`foo @ 1700000000.000`,
+		`foo[5m] offset 1d @ end()`,
+		`rate(foo[5m])[30m:1m] @ start()`,
+		`max_over_time(rate(foo[5m])[30m:])`,
+		`sum by (job, env) (foo)`,
+		`topk(5, foo)`,
+		`count_values("version", build_info)`,
+		`quantile without (instance) (0.9, foo)`,
+		`foo + ignoring (instance) bar`,
+		`foo > bool 5`,
+		`foo * on (job) group_right () bar`,
+		`foo and on (job) bar`,
+		`-foo`,
+		`1 + -Inf`,
+		`label_join(foo, "dst", ",", "a", "b", "c")`,
+		`round(foo)`,
+		`time()`,
+		`"text"`,
+	} {
+		e, err := ParseExpr(input)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", input, err)
+			continue
+		}
+		if got := e.String(); got != input {
+			t.Errorf("Expected %s, got %s", input, got)
+		}
+	}
+}
+
+func Test_parseExpr_normalized(t *testing.T) {
+	for input, want := range map[string]string{
+		`SUM(foo) BY (job)`:                 `sum by (job) (foo)`,
+		`foo{job="node",}`:                  `foo{job="node"}`,
+		`foo / on(job)group_left bar`:       `foo / on (job) group_left () bar`,
+		`{__name__="foo",job="node"}`:       `{__name__="foo", job="node"}`,
+		"foo{job=`a\\b`}":                   `foo{job="a\\b"}`,
+		`0x10 + 1e2`:                        `16 + 100`,
+		`foo @ 1.0005`:                      `foo @ 1.001`,
+		`sum(foo) without (instance) # why`: `sum without (instance) (foo)`,
+	} {
+		e, err := ParseExpr(input)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", input, err)
+			continue
+		}
+		if got := e.String(); got != want {
+			t.Errorf("Parsing %s: expected %s, got %s", input, want, got)
+		}
+	}
+
+	e, err := ParseExpr(`NaN`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := e.(*NumberLiteral); !ok || !math.IsNaN(n.Val) {
+		t.Errorf("Expected NaN, got %s", e)
+	}
+}
+
+func Test_parseExpr_errors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{``, `1:1: parse error: unexpected end of input in expression`},
+		{`foo{`, `1:5: parse error: unexpected end of input in label matching, expected label`},
+		{`foo{job="node"`, `1:15: parse error: unexpected end of input in label matching, expected "}"`},
+		{`foo{job}`, `1:8: parse error: unexpected "}" in label matching, expected label matching operator`},
+		{`{}`, `1:1: parse error: vector selector must contain at least one non-empty matcher`},
+		{`{job=""}`, `1:1: parse error: vector selector must contain at least one non-empty matcher`},
+		{`foo{__name__="bar"}`, `1:1: parse error: metric name must not be set twice: "foo" or "bar"`},
+		{`foo{job=~"("}`, `1:5: parse error: error parsing regexp: missing closing ): ` + "`^(?s:()$`"},
+		{`foo bar`, `1:5: parse error: unexpected identifier "bar" in expression, expected end of input`},
+		{`unknown(foo)`, `1:1: parse error: unknown function with name "unknown"`},
+		{`rate(foo)`, `1:6: parse error: expected type range vector in call to function "rate", got instant vector`},
+		{`rate(foo[5m], 1)`, `1:1: parse error: expected 1 argument(s) in call to "rate", got 2`},
+		{`round()`, `1:1: parse error: expected 1 to 2 argument(s) in call to "round", got 0`},
+		{`label_join(foo, "a")`, `1:1: parse error: expected at least 3 argument(s) in call to "label_join", got 2`},
+		{`sum(foo, bar)`, `1:1: parse error: wrong number of arguments for aggregate expression provided, expected 1, got 2`},
+		{`topk(foo)`, `1:1: parse error: wrong number of arguments for aggregate expression provided, expected 2, got 1`},
+		{`topk("5", foo)`, `1:6: parse error: expected type scalar in aggregation parameter, got string`},
+		{`sum(1)`, `1:5: parse error: expected type instant vector in aggregation expression, got scalar`},
+		{`sum by (job) (foo) by (env)`, `1:20: parse error: unexpected "by" in expression, expected end of input`},
+		{`rate(foo[5m])[5m]`, `1:1: parse error: ranges only allowed for vector selectors`},
+		{`foo offset 5m[5m]`, `1:1: parse error: no offset or @ modifiers allowed before range`},
+		{`1[5m:]`, `1:1: parse error: subquery is only allowed on instant vector, got scalar instead`},
+		{`foo[5m:1m][1h:]`, `1:1: parse error: subquery is only allowed on instant vector, got range vector instead`},
+		{`foo offset 5m offset 1m`, `1:15: parse error: offset may not be set multiple times`},
+		{`foo @ 1 @ 2`, `1:9: parse error: @ <timestamp> may not be set multiple times`},
+		{`sum(foo) offset 5m`, `1:10: parse error: offset modifier must be preceded by an instant vector selector or range vector selector or a subquery`},
+		{`foo @ Inf`, `1:5: parse error: timestamp out of bounds for @ modifier: +Inf`},
+		{`foo[5x]`, `1:5: parse error: bad number or duration syntax: "5x"`},
+		{`1 > 2`, `1:1: parse error: comparisons between scalars must use BOOL modifier`},
+		{`foo + bool bar`, `1:7: parse error: bool modifier can only be used on comparison operators`},
+		{`foo and 1`, `1:1: parse error: set operator "and" not allowed in binary scalar expression`},
+		{`foo or on (job) group_left bar`, `1:17: parse error: no grouping allowed for "or" operation`},
+		{`1 + on (job) foo`, `1:1: parse error: vector matching only allowed between instant vectors`},
+		{`foo * on (job) group_left (job) bar`, `1:16: parse error: label "job" must not occur in ON and GROUP clause at once`},
+		{`foo[5m] + 1`, `1:1: parse error: binary expression must contain only scalar and instant vector types`},
+		{`-"a"`, `1:2: parse error: unary expression only allowed on expressions of type scalar or instant vector, got "string"`},
+		{"foo +\n  bar{", `2:7: parse error: unexpected end of input in label matching, expected label`},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseExpr(tt.input)
+		if err == nil {
+			t.Errorf("Parsing %q didn't fail", tt.input)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("Parsing %q:\nexpected %s\ngot      %s", tt.input, tt.want, err)
+		}
+		if _, ok := err.(*ParseErr); !ok {
+			t.Errorf("Parsing %q: expected a *ParseErr, got %T", tt.input, err)
+		}
+	}
+}
+
+func Test_parseMetricSelector(t *testing.T) {
+	m, err := ParseMetricSelector(`up{job="node"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "job", "node"),
+		labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "up"),
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("Expected %v, got %v", want, m)
+	}
+
+	for _, input := range []string{`sum(up)`, `up[5m]`, `up + 1`} {
+		if _, err := ParseMetricSelector(input); err == nil || !strings.Contains(err.Error(), "parse error") {
+			t.Errorf("Expected %q to fail, got %v", input, err)
+		}
+	}
+}
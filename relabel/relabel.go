@@ -0,0 +1,297 @@
+package relabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+var (
+	relabelTarget = regexp.MustCompile(`^(?:(?:[a-zA-Z_]|\$(?:\{\w+\}|\w+))+\w*)+$`)
+
+	DefaultRelabelConfig = Config{
+		Action:      Replace,
+		Separator:   ";",
+		Regex:       MustNewRegexp("(.*)"),
+		Replacement: "$1",
+	}
+)
+
+// Action is what a relabel config does with the labels.
+type Action string
+
+const (
+	// Replace sets the target label to the replacement, with the regex
+	// groups expanded, if the regex matches the source labels.
+	Replace Action = "replace"
+	// Keep drops the labels the regex doesn't match.
+	Keep Action = "keep"
+	// Drop drops the labels the regex matches.
+	Drop Action = "drop"
+	// KeepEqual drops the labels whose source labels don't equal the target
+	// label.
+	KeepEqual Action = "keepequal"
+	// DropEqual drops the labels whose source labels equal the target label.
+	DropEqual Action = "dropequal"
+	// HashMod sets the target label to the modulus of the hash of the source
+	// labels.
+	HashMod Action = "hashmod"
+	// LabelMap copies the labels with names matching the regex to names made
+	// from the replacement.
+	LabelMap Action = "labelmap"
+	// LabelDrop removes the labels with names matching the regex.
+	LabelDrop Action = "labeldrop"
+	// LabelKeep removes the labels with names not matching the regex.
+	LabelKeep Action = "labelkeep"
+	// Lowercase sets the target label to the lowercased source labels.
+	Lowercase Action = "lowercase"
+	// Uppercase sets the target label to the uppercased source labels.
+	Uppercase Action = "uppercase"
+)
+
+func (a *Action) UnmarshalYAML(unmarshal func(any) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	switch act := Action(strings.ToLower(s)); act {
+	case Replace, Keep, Drop, KeepEqual, DropEqual, HashMod, LabelMap, LabelDrop, LabelKeep, Lowercase, Uppercase:
+		*a = act
+		return nil
+	}
+	return fmt.Errorf("unknown relabel action %q", s)
+}
+
+// Config is a single step of relabeling, as relabel_configs and
+// metric_relabel_configs have them.
+type Config struct {
+	// SourceLabels are joined with the separator into the value the regex
+	// is matched against.
+	SourceLabels []string `yaml:"source_labels,flow,omitempty"`
+	Separator    string   `yaml:"separator,omitempty"`
+	Regex        Regexp   `yaml:"regex,omitempty"`
+	Modulus      uint64   `yaml:"modulus,omitempty"`
+	TargetLabel  string   `yaml:"target_label,omitempty"`
+	Replacement  string   `yaml:"replacement,omitempty"`
+	Action       Action   `yaml:"action,omitempty"`
+}
+
+// UnmarshalYAML fills the defaults in for what's missing.
+func (c *Config) UnmarshalYAML(unmarshal func(any) error) error {
+	*c = DefaultRelabelConfig
+	type plain Config
+	return unmarshal((*plain)(c))
+}
+
+// Validate checks the fields needed by the action are there, and the ones
+// it ignores aren't.
+func (c *Config) Validate() error {
+	if c.Action == "" {
+		return fmt.Errorf("relabel action cannot be empty")
+	}
+	if c.Regex.Regexp == nil {
+		c.Regex = MustNewRegexp("")
+	}
+
+	switch c.Action {
+	case Replace, HashMod, Lowercase, Uppercase, KeepEqual, DropEqual:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel configuration for %s action requires 'target_label' value", c.Action)
+		}
+	}
+	if c.Action == Replace && !strings.Contains(c.TargetLabel, "$") && !labels.IsValidLabelName(c.TargetLabel) {
+		return fmt.Errorf("%q is invalid 'target_label' for %s action", c.TargetLabel, c.Action)
+	}
+	if c.Action == Replace && strings.Contains(c.TargetLabel, "$") && !relabelTarget.MatchString(c.TargetLabel) {
+		return fmt.Errorf("%q is invalid 'target_label' for %s action", c.TargetLabel, c.Action)
+	}
+	if (c.Action == HashMod || c.Action == Lowercase || c.Action == Uppercase || c.Action == KeepEqual || c.Action == DropEqual) && !labels.IsValidLabelName(c.TargetLabel) {
+		return fmt.Errorf("%q is invalid 'target_label' for %s action", c.TargetLabel, c.Action)
+	}
+
+	if c.Action == HashMod && c.Modulus == 0 {
+		return fmt.Errorf("relabel configuration for hashmod requires non-zero modulus")
+	}
+
+	if c.Action == LabelDrop || c.Action == LabelKeep {
+		if c.SourceLabels != nil ||
+			c.TargetLabel != DefaultRelabelConfig.TargetLabel ||
+			c.Modulus != DefaultRelabelConfig.Modulus ||
+			c.Separator != DefaultRelabelConfig.Separator ||
+			c.Replacement != DefaultRelabelConfig.Replacement {
+			return fmt.Errorf("%s action requires only 'regex', and no other fields", c.Action)
+		}
+	}
+
+	if c.Action == KeepEqual || c.Action == DropEqual {
+		if c.Regex.String() != DefaultRelabelConfig.Regex.String() ||
+			c.Modulus != DefaultRelabelConfig.Modulus ||
+			c.Separator != DefaultRelabelConfig.Separator ||
+			c.Replacement != DefaultRelabelConfig.Replacement {
+			return fmt.Errorf("%s action requires only 'source_labels' and 'target_label', and no other fields", c.Action)
+		}
+	}
+
+	for _, name := range c.SourceLabels {
+		if !labels.IsValidLabelName(name) {
+			return fmt.Errorf("%q is not a valid label name in 'source_labels'", name)
+		}
+	}
+
+	return nil
+}
+
+// Regexp is anchored on both ends, a regex has to match the whole value.
+type Regexp struct {
+	*regexp.Regexp
+}
+
+func NewRegexp(s string) (Regexp, error) {
+	re, err := regexp.Compile("^(?s:" + s + ")$")
+	return Regexp{Regexp: re}, err
+}
+
+func MustNewRegexp(s string) Regexp {
+	re, err := NewRegexp(s)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+func (re *Regexp) UnmarshalYAML(unmarshal func(any) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	r, err := NewRegexp(s)
+	if err != nil {
+		return err
+	}
+	*re = r
+	return nil
+}
+
+func (re Regexp) MarshalYAML() (any, error) {
+	if re.Regexp == nil {
+		return nil, nil
+	}
+	return re.String(), nil
+}
+
+// String is the regex without the anchors.
+func (re Regexp) String() string {
+	if re.Regexp == nil {
+		return ""
+	}
+
+	s := re.Regexp.String()
+	return s[len("^(?s:") : len(s)-len(")$")]
+}
+
+// Process runs the labels through the configs in order. It returns false
+// when the labels were dropped, by an action or by ending up empty.
+func Process(ls labels.Labels, cfgs ...*Config) (labels.Labels, bool) {
+	lb := labels.NewBuilder(ls)
+	if !ProcessBuilder(lb, cfgs...) {
+		return labels.EmptyLabels(), false
+	}
+
+	res := lb.Labels()
+	return res, !res.IsEmpty()
+}
+
+// ProcessBuilder is Process working on a builder, so the caller can carry on
+// changing the labels.
+func ProcessBuilder(lb *labels.Builder, cfgs ...*Config) bool {
+	for _, cfg := range cfgs {
+		if !relabel(cfg, lb) {
+			return false
+		}
+	}
+	return true
+}
+
+func relabel(cfg *Config, lb *labels.Builder) bool {
+	var va [16]string
+	values := va[:0]
+	for _, name := range cfg.SourceLabels {
+		values = append(values, lb.Get(name))
+	}
+	val := strings.Join(values, cfg.Separator)
+
+	switch cfg.Action {
+	case Drop:
+		if cfg.Regex.MatchString(val) {
+			return false
+		}
+	case Keep:
+		if !cfg.Regex.MatchString(val) {
+			return false
+		}
+	case DropEqual:
+		if lb.Get(cfg.TargetLabel) == val {
+			return false
+		}
+	case KeepEqual:
+		if lb.Get(cfg.TargetLabel) != val {
+			return false
+		}
+	case Replace:
+		indexes := cfg.Regex.FindStringSubmatchIndex(val)
+		// Nothing to replace if the regex doesn't match
+		if indexes == nil {
+			break
+		}
+
+		target := string(cfg.Regex.ExpandString(nil, cfg.TargetLabel, val, indexes))
+		if !labels.IsValidLabelName(target) {
+			break
+		}
+
+		res := cfg.Regex.ExpandString(nil, cfg.Replacement, val, indexes)
+		if len(res) == 0 {
+			lb.Del(target)
+			break
+		}
+		lb.Set(target, string(res))
+	case Lowercase:
+		lb.Set(cfg.TargetLabel, strings.ToLower(val))
+	case Uppercase:
+		lb.Set(cfg.TargetLabel, strings.ToUpper(val))
+	case HashMod:
+		hash := md5.Sum([]byte(val))
+		// Only the lower 8 bytes, it's what Prometheus does too
+		mod := binary.BigEndian.Uint64(hash[8:]) % cfg.Modulus
+		lb.Set(cfg.TargetLabel, fmt.Sprintf("%d", mod))
+	case LabelMap:
+		lb.Range(func(l labels.Label) {
+			if cfg.Regex.MatchString(l.Name) {
+				res := cfg.Regex.ReplaceAllString(l.Name, cfg.Replacement)
+				lb.Set(res, l.Value)
+			}
+		})
+	case LabelDrop:
+		lb.Range(func(l labels.Label) {
+			if cfg.Regex.MatchString(l.Name) {
+				lb.Del(l.Name)
+			}
+		})
+	case LabelKeep:
+		lb.Range(func(l labels.Label) {
+			if !cfg.Regex.MatchString(l.Name) {
+				lb.Del(l.Name)
+			}
+		})
+	default:
+		panic(fmt.Errorf("relabel: unknown relabel action type %q", cfg.Action))
+	}
+
+	return true
+}
@@ -0,0 +1,274 @@
+package relabel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+func Test_process(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  labels.Labels
+		cfgs   []*Config
+		output labels.Labels
+		drop   bool
+	}{
+		{
+			name:  "replace with regex groups",
+			input: labels.FromStrings("__address__", "node-1:9100", "job", "node"),
+			cfgs: []*Config{{
+				SourceLabels: []string{"__address__"},
+				Regex:        MustNewRegexp("(.*):(\\d+)"),
+				TargetLabel:  "host",
+				Replacement:  "$1",
+				Action:       Replace,
+			}},
+			output: labels.FromStrings("__address__", "node-1:9100", "host", "node-1", "job", "node"),
+		},
+		{
+			name:  "replace with joined source labels",
+			input: labels.FromStrings("a", "foo", "b", "bar"),
+			cfgs: []*Config{{
+				SourceLabels: []string{"a", "b"},
+				Separator:    ";",
+				Regex:        MustNewRegexp("(.*)"),
+				TargetLabel:  "c",
+				Replacement:  "$1",
+				Action:       Replace,
+			}},
+			output: labels.FromStrings("a", "foo", "b", "bar", "c", "foo;bar"),
+		},
+		{
+			name:  "replace without a match leaves the labels",
+			input: labels.FromStrings("a", "foo"),
+			cfgs: []*Config{{
+				SourceLabels: []string{"a"},
+				Regex:        MustNewRegexp("bar"),
+				TargetLabel:  "b",
+				Replacement:  "baz",
+				Action:       Replace,
+			}},
+			output: labels.FromStrings("a", "foo"),
+		},
+		{
+			name:  "replace with an empty result deletes the target",
+			input: labels.FromStrings("a", "foo", "b", "bar"),
+			cfgs: []*Config{{
+				SourceLabels: []string{"a"},
+				Regex:        MustNewRegexp("foo"),
+				TargetLabel:  "b",
+				Replacement:  "",
+				Action:       Replace,
+			}},
+			output: labels.FromStrings("a", "foo"),
+		},
+		{
+			name:  "replace with a templated target",
+			input: labels.FromStrings("a", "some-name-value"),
+			cfgs: []*Config{{
+				SourceLabels: []string{"a"},
+				Regex:        MustNewRegexp("some-([^-]+)-([^,]+)"),
+				TargetLabel:  "${1}",
+				Replacement:  "${2}",
+				Action:       Replace,
+			}},
+			output: labels.FromStrings("a", "some-name-value", "name", "value"),
+		},
+		{
+			name:  "drop",
+			input: labels.FromStrings("__name__", "go_goroutines"),
+			cfgs: []*Config{{
+				SourceLabels: []string{"__name__"},
+				Regex:        MustNewRegexp("go_.*"),
+				Action:       Drop,
+			}},
+			drop: true,
+		},
+		{
+			name:  "drop without a match",
+			input: labels.FromStrings("__name__", "up"),
+			cfgs: []*Config{{
+				SourceLabels: []string{"__name__"},
+				Regex:        MustNewRegexp("go_.*"),
+				Action:       Drop,
+			}},
+			output: labels.FromStrings("__name__", "up"),
+		},
+		{
+			name:  "keep",
+			input: labels.FromStrings("__name__", "up"),
+			cfgs: []*Config{{
+				SourceLabels: []string{"__name__"},
+				Regex:        MustNewRegexp("go_.*"),
+				Action:       Keep,
+			}},
+			drop: true,
+		},
+		{
+			name:  "keepequal",
+			input: labels.FromStrings("a", "foo", "b", "foo"),
+			cfgs: []*Config{{
+				SourceLabels: []string{"a"},
+				TargetLabel:  "b",
+				Action:       KeepEqual,
+			}},
+			output: labels.FromStrings("a", "foo", "b", "foo"),
+		},
+		{
+			name:  "dropequal",
+			input: labels.FromStrings("a", "foo", "b", "foo"),
+			cfgs: []*Config{{
+				SourceLabels: []string{"a"},
+				TargetLabel:  "b",
+				Action:       DropEqual,
+			}},
+			drop: true,
+		},
+		{
+			name:  "hashmod",
+			input: labels.FromStrings("a", "foo"),
+			cfgs: []*Config{{
+				SourceLabels: []string{"a"},
+				TargetLabel:  "shard",
+				Modulus:      1000,
+				Action:       HashMod,
+			}},
+			output: labels.FromStrings("a", "foo", "shard", "696"),
+		},
+		{
+			name:  "labelmap",
+			input: labels.FromStrings("__meta_zone", "a", "__meta_rack", "b", "job", "node"),
+			cfgs: []*Config{{
+				Regex:       MustNewRegexp("__meta_(.+)"),
+				Replacement: "$1",
+				Action:      LabelMap,
+			}},
+			output: labels.FromStrings("__meta_zone", "a", "__meta_rack", "b", "zone", "a", "rack", "b", "job", "node"),
+		},
+		{
+			name:  "labeldrop",
+			input: labels.FromStrings("__name__", "up", "pod", "p-1", "pod_ip", "10.0.0.1"),
+			cfgs: []*Config{{
+				Regex:  MustNewRegexp("pod.*"),
+				Action: LabelDrop,
+			}},
+			output: labels.FromStrings("__name__", "up"),
+		},
+		{
+			name:  "labelkeep",
+			input: labels.FromStrings("__name__", "up", "pod", "p-1", "job", "node"),
+			cfgs: []*Config{{
+				Regex:  MustNewRegexp("__name__|job"),
+				Action: LabelKeep,
+			}},
+			output: labels.FromStrings("__name__", "up", "job", "node"),
+		},
+		{
+			name:  "lowercase and uppercase",
+			input: labels.FromStrings("a", "FooBar"),
+			cfgs: []*Config{
+				{SourceLabels: []string{"a"}, TargetLabel: "lower", Action: Lowercase},
+				{SourceLabels: []string{"a"}, TargetLabel: "upper", Action: Uppercase},
+			},
+			output: labels.FromStrings("a", "FooBar", "lower", "foobar", "upper", "FOOBAR"),
+		},
+		{
+			name:  "dropping every label drops the series",
+			input: labels.FromStrings("a", "foo"),
+			cfgs: []*Config{{
+				Regex:  MustNewRegexp(".*"),
+				Action: LabelDrop,
+			}},
+			drop: true,
+		},
+		{
+			name:  "configs run in order",
+			input: labels.FromStrings("__name__", "go_goroutines", "job", "node"),
+			cfgs: []*Config{
+				{SourceLabels: []string{"__name__"}, Regex: MustNewRegexp("go_(.*)"), TargetLabel: "__name__", Replacement: "runtime_$1", Action: Replace},
+				{SourceLabels: []string{"__name__"}, Regex: MustNewRegexp("go_.*"), Action: Drop},
+			},
+			output: labels.FromStrings("__name__", "runtime_goroutines", "job", "node"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, cfg := range tt.cfgs {
+				if cfg.Separator == "" {
+					cfg.Separator = ";"
+				}
+				if cfg.Regex.Regexp == nil {
+					cfg.Regex = DefaultRelabelConfig.Regex
+				}
+				// Replace is the only one tested with an empty replacement
+				if cfg.Replacement == "" && cfg.Action != Replace {
+					cfg.Replacement = DefaultRelabelConfig.Replacement
+				}
+				if err := cfg.Validate(); err != nil {
+					t.Fatalf("Invalid config: %v", err)
+				}
+			}
+
+			got, keep := Process(tt.input, tt.cfgs...)
+			if keep == tt.drop {
+				t.Fatalf("Expected drop %t, got labels %s", tt.drop, got)
+			}
+			if !tt.drop && !labels.Equal(got, tt.output) {
+				t.Errorf("Expected %s, got %s", tt.output, got)
+			}
+		})
+	}
+}
+
+func Test_config_validate(t *testing.T) {
+	tests := []struct {
+		cfg Config
+		err string
+	}{
+		{
+			cfg: Config{Action: Replace, Regex: DefaultRelabelConfig.Regex, Separator: ";", Replacement: "$1"},
+			err: "requires 'target_label' value",
+		},
+		{
+			cfg: Config{Action: Replace, TargetLabel: "1abc", Regex: DefaultRelabelConfig.Regex, Separator: ";", Replacement: "$1"},
+			err: `"1abc" is invalid 'target_label'`,
+		},
+		{
+			cfg: Config{Action: HashMod, TargetLabel: "shard", Regex: DefaultRelabelConfig.Regex, Separator: ";", Replacement: "$1"},
+			err: "requires non-zero modulus",
+		},
+		{
+			cfg: Config{Action: LabelDrop, TargetLabel: "foo", Regex: DefaultRelabelConfig.Regex, Separator: ";", Replacement: "$1"},
+			err: "labeldrop action requires only 'regex'",
+		},
+		{
+			cfg: Config{Action: KeepEqual, TargetLabel: "foo", Regex: MustNewRegexp("a"), Separator: ";", Replacement: "$1"},
+			err: "keepequal action requires only 'source_labels' and 'target_label'",
+		},
+		{
+			cfg: Config{Action: Keep, SourceLabels: []string{"a-b"}, Regex: DefaultRelabelConfig.Regex, Separator: ";", Replacement: "$1"},
+			err: `"a-b" is not a valid label name`,
+		},
+	}
+
+	for _, tt := range tests {
+		err := tt.cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Expected error containing %q, got %v", tt.err, err)
+		}
+	}
+}
+
+func Test_regexp_string(t *testing.T) {
+	re := MustNewRegexp("go_.*")
+
+	if !re.MatchString("go_goroutines") || re.MatchString("process_go_info") {
+		t.Errorf("Regex isn't anchored")
+	}
+	if re.String() != "go_.*" {
+		t.Errorf("Expected the regex without anchors, got %q", re.String())
+	}
+}
@@ -23,6 +23,11 @@
 // OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package tsdb
 
+import (
+	"encoding/binary"
+	"io"
+)
+
 type bit bool
 
 const (
@@ -82,6 +87,34 @@ func (b *bstream) writeBits(bits uint64, nbits int) {
 	}
 }
 
+func (b *bstream) writeVarint(v int64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, v)
+
+	for _, byt := range buf[:n] {
+		b.writeByte(byt)
+	}
+}
+
+func (b *bstream) writeUvarint(v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+
+	for _, byt := range buf[:n] {
+		b.writeByte(byt)
+	}
+}
+
+// compact drops the spare capacity of the stream, once nothing more is going
+// to be written to it.
+func (b *bstream) compact() {
+	if l := len(b.stream); cap(b.stream) > l+32 {
+		buf := make([]byte, l)
+		copy(buf, b.stream)
+		b.stream = buf
+	}
+}
+
 func (b *bstream) bytes() []byte {
 	return b.stream
 }
@@ -91,23 +124,39 @@ func (b *bstream) Reset(stream []byte) {
 	b.count = 0
 }
 
-type Iterator struct {
+type bstreamReader struct {
 	b         bstream
 	countBit  int
 	countByte int
+	err       error
 }
 
-func NewIterator(b bstream) Iterator {
-	return Iterator{
+func newBReader(b bstream) bstreamReader {
+	return bstreamReader{
 		b:        b,
 		countBit: 0,
 	}
 }
 
-func (i *Iterator) nextBit() (ret bit) {
-	// We should probably return an error if nextBit is called when stream has been iterated over
+// outOfBounds records an error once the stream has been read past its end,
+// after that the reads keep returning zeros and the error is in Err.
+func (i *bstreamReader) outOfBounds() bool {
 	if len(i.b.stream)-1 < i.countByte {
-		panic("out of bounds")
+		if i.err == nil {
+			i.err = io.ErrUnexpectedEOF
+		}
+		return true
+	}
+	return false
+}
+
+func (i *bstreamReader) Err() error {
+	return i.err
+}
+
+func (i *bstreamReader) nextBit() (ret bit) {
+	if i.outOfBounds() {
+		return zero
 	}
 
 	tempByte := (i.b.stream[i.countByte] >> (7 - i.countBit)) & byte(1)
@@ -128,12 +177,7 @@ func (i *Iterator) nextBit() (ret bit) {
 	}
 }
 
-func (i *Iterator) nextBits(count int) (ret []bit) {
-	// We should probably return an error if nextBit is called when stream has been iterated over
-	if len(i.b.stream)-1 < i.countByte {
-		panic("out of bounds")
-	}
-
+func (i *bstreamReader) nextBits(count int) (ret []bit) {
 	for y := 0; count > y; y++ {
 		b := i.nextBit()
 		ret = append(ret, b)
@@ -142,10 +186,9 @@ func (i *Iterator) nextBits(count int) (ret []bit) {
 	return ret
 }
 
-func (i *Iterator) nextByte() (ret byte) {
-	// We should probably return an error if nextBit is called when stream has been iterated over
-	if len(i.b.stream)-1 < i.countByte {
-		panic("out of bounds")
+func (i *bstreamReader) nextByte() (ret byte) {
+	if i.outOfBounds() {
+		return 0
 	}
 
 	ret = i.b.stream[i.countByte]
@@ -155,11 +198,17 @@ func (i *Iterator) nextByte() (ret byte) {
 	return ret
 }
 
-func (i *Iterator) nextBytes(count int) (ret []byte) {
+// ReadByte reads the next 8 bits, unlike nextByte they don't have to be
+// aligned to a byte. It's there so varints can be read with encoding/binary.
+func (i *bstreamReader) ReadByte() (byte, error) {
 	if len(i.b.stream)-1 < i.countByte {
-		panic("out of bounds")
+		return 0, io.EOF
 	}
 
+	return byte(bitsSliceToInt(i.nextBits(8))), nil
+}
+
+func (i *bstreamReader) nextBytes(count int) (ret []byte) {
 	for y := 0; count > y; y++ {
 		ret = append(ret, i.nextByte())
 	}
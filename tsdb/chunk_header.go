@@ -0,0 +1,74 @@
+package tsdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Every chunk starts with a fixed size header, so it can be decoded without
+// any information from the outside:
+//
+//	┌──────────────┬─────────────────┬──────────────┬──────────────┐
+//	│ encoding <1> │ num samples <4> │ min time <8> │ max time <8> │
+//	└──────────────┴─────────────────┴──────────────┴──────────────┘
+//
+// Number of samples and times are big endian, the sample count and max time
+// are updated in place with every append.
+const (
+	chunkEncodingOffset   = 0
+	chunkNumSamplesOffset = 1
+	chunkMinTimeOffset    = 5
+	chunkMaxTimeOffset    = 13
+	chunkHeaderSize       = 21
+)
+
+// ErrInvalidChunk is returned when chunk bytes can't be decoded.
+var ErrInvalidChunk = errors.New("invalid chunk")
+
+type chunkHeader struct {
+	encoding   Encoding
+	numSamples uint32
+	minTime    int64
+	maxTime    int64
+}
+
+func newChunkStream(encoding Encoding) []byte {
+	stream := make([]byte, chunkHeaderSize)
+	stream[chunkEncodingOffset] = byte(encoding)
+	return stream
+}
+
+func readChunkHeader(b []byte) (chunkHeader, error) {
+	if len(b) < chunkHeaderSize {
+		return chunkHeader{}, fmt.Errorf("%w: %d bytes is shorter than the header", ErrInvalidChunk, len(b))
+	}
+
+	h := chunkHeader{
+		encoding:   Encoding(b[chunkEncodingOffset]),
+		numSamples: chunkNumSamples(b),
+		minTime:    int64(binary.BigEndian.Uint64(b[chunkMinTimeOffset:])),
+		maxTime:    int64(binary.BigEndian.Uint64(b[chunkMaxTimeOffset:])),
+	}
+
+	if h.numSamples > 0 && h.minTime > h.maxTime {
+		return chunkHeader{}, fmt.Errorf("%w: min time %d is after max time %d", ErrInvalidChunk, h.minTime, h.maxTime)
+	}
+
+	return h, nil
+}
+
+func chunkNumSamples(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b[chunkNumSamplesOffset:])
+}
+
+// updateChunkHeader records a newly appended sample in the header.
+func updateChunkHeader(b []byte, t int64) {
+	num := chunkNumSamples(b)
+	if num == 0 {
+		binary.BigEndian.PutUint64(b[chunkMinTimeOffset:], uint64(t))
+	}
+
+	binary.BigEndian.PutUint32(b[chunkNumSamplesOffset:], num+1)
+	binary.BigEndian.PutUint64(b[chunkMaxTimeOffset:], uint64(t))
+}
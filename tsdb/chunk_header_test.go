@@ -0,0 +1,25 @@
+package tsdb
+
+import "testing"
+
+func Test_chunk_header(t *testing.T) {
+	stream := newChunkStream(EncXOR)
+
+	updateChunkHeader(stream, -500)
+	updateChunkHeader(stream, 1000)
+	updateChunkHeader(stream, 2000)
+
+	header, err := readChunkHeader(stream)
+	if err != nil {
+		t.Fatalf("Failed to read the header: %v", err)
+	}
+
+	expected := chunkHeader{encoding: EncXOR, numSamples: 3, minTime: -500, maxTime: 2000}
+	if header != expected {
+		t.Errorf("Header not as expected: \ngot: %+v \nexpected: %+v", header, expected)
+	}
+
+	if _, err := readChunkHeader(stream[:chunkHeaderSize-1]); err == nil {
+		t.Errorf("Reading a truncated header should fail")
+	}
+}
@@ -0,0 +1,104 @@
+package tsdb
+
+import (
+	"fmt"
+)
+
+// Encoding identifies the codec a chunk was written with, it's stored as the
+// first byte of the chunk header.
+type Encoding uint8
+
+const (
+	EncNone Encoding = iota
+	EncXOR
+	EncHistogram
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case EncNone:
+		return "none"
+	case EncXOR:
+		return "XOR"
+	case EncHistogram:
+		return "histogram"
+	}
+	return fmt.Sprintf("<unknown encoding: %d>", uint8(e))
+}
+
+// ValueType is the type of the sample an Iterator is positioned at.
+type ValueType uint8
+
+const (
+	ValNone ValueType = iota
+	ValFloat
+	ValHistogram
+)
+
+// Chunk holds a sequence of samples encoded with a single Encoding.
+type Chunk interface {
+	// Bytes returns the encoded chunk, header included.
+	Bytes() []byte
+	Encoding() Encoding
+	// Appender returns an appender which continues after the last sample.
+	Appender() (Appender, error)
+	Iterator() Iterator
+	NumSamples() int
+	// Compact trims the underlying buffer once no more appends are expected.
+	Compact()
+}
+
+// Appender adds samples to a chunk. Chunks hold one type of samples, so an
+// appender panics if given the other type.
+type Appender interface {
+	Append(t int64, v float64)
+	AppendHistogram(t int64, h *Histogram)
+}
+
+// Iterator walks over the samples of a chunk.
+type Iterator interface {
+	// Next moves to the next sample and returns its type, ValNone is returned
+	// when there are no more samples or an error happened.
+	Next() ValueType
+	At() (int64, float64)
+	AtHistogram() (int64, *Histogram)
+	Err() error
+}
+
+type encodingFuncs struct {
+	newChunk func() Chunk
+	fromData func([]byte) (Chunk, error)
+}
+
+var encodings = map[Encoding]encodingFuncs{}
+
+// RegisterEncoding makes an encoding available to NewEmptyChunk and FromData,
+// encodings register themselves in init.
+func RegisterEncoding(e Encoding, newChunk func() Chunk, fromData func([]byte) (Chunk, error)) {
+	if _, ok := encodings[e]; ok {
+		panic(fmt.Sprintf("encoding %s registered twice", e))
+	}
+	encodings[e] = encodingFuncs{newChunk: newChunk, fromData: fromData}
+}
+
+func NewEmptyChunk(e Encoding) (Chunk, error) {
+	funcs, ok := encodings[e]
+	if !ok {
+		return nil, fmt.Errorf("unknown chunk encoding %s", e)
+	}
+	return funcs.newChunk(), nil
+}
+
+// FromData wraps encoded chunk bytes, the encoding is taken from the header.
+func FromData(b []byte) (Chunk, error) {
+	header, err := readChunkHeader(b)
+	if err != nil {
+		return nil, err
+	}
+
+	funcs, ok := encodings[header.encoding]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown encoding %s", ErrInvalidChunk, header.encoding)
+	}
+	return funcs.fromData(b)
+}
@@ -0,0 +1,80 @@
+package tsdb
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func Test_chunkenc_newEmptyChunk(t *testing.T) {
+	chunk, err := NewEmptyChunk(EncXOR)
+	if err != nil {
+		t.Fatalf("Failed to create XOR chunk: %v", err)
+	}
+
+	if chunk.Encoding() != EncXOR || chunk.NumSamples() != 0 {
+		t.Errorf("Expected empty XOR chunk, got %s chunk with %d samples", chunk.Encoding(), chunk.NumSamples())
+	}
+
+	if _, err := NewEmptyChunk(EncNone); err == nil {
+		t.Errorf("Creating a chunk with no encoding should fail")
+	}
+}
+
+func Test_chunkenc_fromData(t *testing.T) {
+	chunk := NewXORChunk()
+	app, err := chunk.Appender()
+	if err != nil {
+		t.Fatalf("Failed to get an appender: %v", err)
+	}
+
+	for i := range 5 {
+		app.Append(int64(i)*15000, float64(i)*0.5)
+	}
+
+	// Continue appending to a chunk restored from its bytes, it has to pick up
+	// in the middle of the last byte
+	restored, err := FromData(slices.Clone(chunk.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to restore the chunk: %v", err)
+	}
+
+	if restored.Encoding() != EncXOR {
+		t.Errorf("Expected XOR encoding, got %s", restored.Encoding())
+	}
+
+	restoredApp, err := restored.Appender()
+	if err != nil {
+		t.Fatalf("Failed to get an appender for the restored chunk: %v", err)
+	}
+
+	for i := 5; i < 10; i++ {
+		restoredApp.Append(int64(i)*15000, float64(i)*0.5)
+	}
+
+	it := restored.Iterator()
+	i := 0
+	for it.Next() == ValFloat {
+		ts, v := it.At()
+		if ts != int64(i)*15000 || v != float64(i)*0.5 {
+			t.Errorf("Sample %d: expected %d %v, got %d %v", i, int64(i)*15000, float64(i)*0.5, ts, v)
+		}
+		i++
+	}
+
+	if it.Err() != nil {
+		t.Fatalf("Iterating the restored chunk failed: %v", it.Err())
+	}
+
+	if i != 10 {
+		t.Errorf("Expected 10 samples, got %d", i)
+	}
+}
+
+func Test_chunkenc_fromDataInvalid(t *testing.T) {
+	stream := newChunkStream(Encoding(200))
+
+	if _, err := FromData(stream); !errors.Is(err, ErrInvalidChunk) {
+		t.Errorf("Expected ErrInvalidChunk for unknown encoding, got: %v", err)
+	}
+}
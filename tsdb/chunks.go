@@ -1,37 +1,60 @@
 package tsdb
 
-import (
-	"time"
-)
-
-type Chunk struct {
-	ts       int64
+// memChunk is a chunk in the head, chained to the chunks cut before it.
+type memChunk struct {
+	chunk    Chunk
+	app      Appender
+	minTime  int64
+	maxTime  int64
 	mmaped   bool
-	app      xorAppender
-	previous *Chunk
+	previous *memChunk
 }
 
-func cutNewChunk() *Chunk {
-	return &Chunk{
-		app:    NewAppender(),
-		ts:     time.Now().Unix(),
+func cutNewChunk(e Encoding) *memChunk {
+	chunk, err := NewEmptyChunk(e)
+	if err != nil {
+		panic("Should never happen")
+	}
+
+	app, err := chunk.Appender()
+	if err != nil {
+		panic("Should never happen")
+	}
+
+	return &memChunk{
+		chunk:  chunk,
+		app:    app,
 		mmaped: false,
 	}
 }
 
-func (c *Chunk) Append(t uint64, v float64) {
+func (c *memChunk) Append(t int64, v float64) {
+	if c.SamplesNum() == 0 {
+		c.minTime = t
+	}
+	c.maxTime = t
+
 	c.app.Append(t, v)
 }
 
-func (c *Chunk) Bytes() bstream {
-	return c.app.b
+func (c *memChunk) AppendHistogram(t int64, h *Histogram) {
+	if c.SamplesNum() == 0 {
+		c.minTime = t
+	}
+	c.maxTime = t
+
+	c.app.AppendHistogram(t, h)
+}
+
+func (c *memChunk) Bytes() []byte {
+	return c.chunk.Bytes()
 }
 
-func (c *Chunk) SamplesNum() int {
-	return c.app.SamplesNum()
+func (c *memChunk) SamplesNum() int {
+	return c.chunk.NumSamples()
 }
 
-func (c *Chunk) chunksListLength() int {
+func (c *memChunk) chunksListLength() int {
 	chunk := c
 	counter := 1
 
@@ -1,5 +1,172 @@
 package tsdb
 
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRetentionDuration is 15 days in milliseconds.
+	DefaultRetentionDuration int64 = 15 * 24 * 60 * 60 * 1000
+	DefaultGCInterval              = time.Minute
+)
+
+type Options struct {
+	HeadOptions
+	// RetentionDuration is how long samples are kept in the head, counted
+	// back from the newest sample, in milliseconds.
+	RetentionDuration int64
+	// GCInterval is how often the head is garbage collected.
+	GCInterval time.Duration
+	// Dir is where the head snapshot is kept, nothing is written to disk
+	// without it.
+	Dir string
+	// EnableSnapshotOnShutdown writes the head to Dir on Close, Open loads it
+	// back so the samples survive a restart. Without it a snapshot left in
+	// Dir is ignored.
+	EnableSnapshotOnShutdown bool
+}
+
+func DefaultOptions() Options {
+	return Options{
+		RetentionDuration: DefaultRetentionDuration,
+		GCInterval:        DefaultGCInterval,
+	}
+}
+
 type DB struct {
-	head Head
+	head *Head
+	opts Options
+
+	stopc chan struct{}
+	donec chan struct{}
+	// closeOnce lets Close be called more than once, closeErr is what the
+	// first call returned
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Open creates the DB and starts the periodic garbage collection of the head,
+// which runs until Close.
+func Open(opts Options) (*DB, error) {
+	if opts.RetentionDuration <= 0 {
+		opts.RetentionDuration = DefaultRetentionDuration
+	}
+	if opts.GCInterval <= 0 {
+		opts.GCInterval = DefaultGCInterval
+	}
+
+	head, err := openHead(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		head:  head,
+		opts:  opts,
+		stopc: make(chan struct{}),
+		donec: make(chan struct{}),
+	}
+
+	go db.run()
+
+	return db, nil
+}
+
+// openHead loads the head from the snapshot if there's one. A corrupt snapshot
+// isn't fatal, there's no WAL to replay instead, so the head starts empty and
+// the snapshot is moved aside to chunk_snapshot.corrupt for a look at it.
+// The snapshot is removed once read, after an unclean shutdown the next start
+// would bring back the same old head otherwise.
+func openHead(opts Options) (*Head, error) {
+	if opts.Dir == "" || !opts.EnableSnapshotOnShutdown {
+		return NewHeadWithOptions(opts.HeadOptions), nil
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o777); err != nil {
+		return nil, err
+	}
+
+	head, err := readSnapshotFile(opts.Dir, opts.HeadOptions)
+	if err != nil {
+		path, mvErr := moveCorruptSnapshotFile(opts.Dir)
+		if mvErr != nil {
+			return nil, fmt.Errorf("moving aside head snapshot: %w", mvErr)
+		}
+		log.Printf("Loading the head snapshot failed, moved it to %s and starting with an empty head: %v", path, err)
+		return NewHeadWithOptions(opts.HeadOptions), nil
+	}
+	if err := removeSnapshotFile(opts.Dir); err != nil {
+		return nil, fmt.Errorf("removing head snapshot: %w", err)
+	}
+	if head == nil {
+		return NewHeadWithOptions(opts.HeadOptions), nil
+	}
+
+	return head, nil
+}
+
+func (db *DB) Head() *Head {
+	return db.head
+}
+
+// Stats is the head's statistics, see Head.Stats.
+func (db *DB) Stats(limit int) HeadStats {
+	return db.head.Stats(limit)
+}
+
+func (db *DB) run() {
+	defer close(db.donec)
+
+	ticker := time.NewTicker(db.opts.GCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.stopc:
+			return
+		case <-ticker.C:
+			db.gc()
+		}
+	}
+}
+
+// gc truncates the head to the retention duration. There's no WAL yet, once
+// there is, this is where it gets checkpointed, so the records of removed
+// series are dropped with them.
+func (db *DB) gc() GCStats {
+	maxt := db.head.MaxTime()
+	if maxt == math.MinInt64 {
+		return GCStats{}
+	}
+
+	return db.head.Truncate(maxt - db.opts.RetentionDuration)
+}
+
+// Close stops the garbage collection and, if enabled, snapshots the head.
+// Calling it again does nothing and returns the error of the first call.
+func (db *DB) Close() error {
+	db.closeOnce.Do(func() {
+		db.closeErr = db.close()
+	})
+	return db.closeErr
+}
+
+func (db *DB) close() error {
+	close(db.stopc)
+	<-db.donec
+
+	if !db.opts.EnableSnapshotOnShutdown || db.opts.Dir == "" {
+		return nil
+	}
+
+	if err := writeSnapshotFile(db.opts.Dir, db.head); err != nil {
+		return fmt.Errorf("writing head snapshot: %w", err)
+	}
+
+	return nil
 }
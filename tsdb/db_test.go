@@ -0,0 +1,68 @@
+package tsdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+func Test_db_periodicGC(t *testing.T) {
+	opts := DefaultOptions()
+	opts.RetentionDuration = 60 * 1000
+	opts.GCInterval = 10 * time.Millisecond
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open the DB: %v", err)
+	}
+	defer db.Close()
+
+	goneLabels := labels.FromStrings("__name__", "gone")
+
+	db.Head().Append(goneLabels, timestamp, 1)
+	db.Head().Append(labelsLong, timestamp+2*60*1000, 1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Head().GetMemSeries(goneLabels) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Series older than the retention wasn't garbage collected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if db.Head().GetMemSeries(labelsLong) == nil {
+		t.Errorf("Series within the retention was garbage collected")
+	}
+}
+
+func Test_db_closeTwice(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Dir = t.TempDir()
+	opts.EnableSnapshotOnShutdown = true
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open the DB: %v", err)
+	}
+	db.Head().Append(labelsLong, timestamp, 1)
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close the DB: %v", err)
+	}
+
+	// The second call doesn't write the snapshot again
+	path := filepath.Join(opts.Dir, snapshotFilename)
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Failed to remove the snapshot: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Second close failed: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Second close wrote the snapshot again")
+	}
+}
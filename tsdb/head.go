@@ -1,91 +1,613 @@
 package tsdb
 
 import (
+	"errors"
+	"math"
+	"sync"
+
 	"github.com/pomyslowynick/scratcheus/labels"
 )
 
+var (
+	// ErrOutOfOrderSample is returned when a sample is older than the newest
+	// sample of its series and can't be accepted into the out-of-order chunk.
+	ErrOutOfOrderSample = errors.New("out of order sample")
+	// ErrDuplicateSampleForTimestamp is returned when a sample has the same
+	// timestamp as an existing sample of its series, but a different value.
+	ErrDuplicateSampleForTimestamp = errors.New("duplicate sample for timestamp")
+	// ErrOutOfBounds is returned for samples older than the head's minimum
+	// time, they'd be garbage collected straight away.
+	ErrOutOfBounds = errors.New("out of bounds")
+)
+
+const (
+	// DefaultChunkRange is the block duration, chunks never cross a multiple
+	// of it, so the head can be compacted into blocks without splitting them.
+	DefaultChunkRange int64 = 2 * 60 * 60 * 1000
+	// DefaultSamplesPerChunk is how many samples a chunk is aiming for.
+	DefaultSamplesPerChunk = 120
+)
+
+type HeadOptions struct {
+	// OutOfOrderTimeWindow is how far behind the newest sample in the head an
+	// out-of-order sample can be and still get appended, in milliseconds. Zero
+	// disables it.
+	OutOfOrderTimeWindow int64
+	// ChunkRange is the block duration in milliseconds, DefaultChunkRange if
+	// not set.
+	ChunkRange int64
+	// SamplesPerChunk is DefaultSamplesPerChunk if not set.
+	SamplesPerChunk int
+}
+
+// chunkOpts is what a series needs to know to decide when to cut a chunk.
+type chunkOpts struct {
+	chunkRange      int64
+	samplesPerChunk int
+}
+
 type Head struct {
+	mtx           sync.RWMutex
 	lastSeriesRef uint64
-	series        map[uint64]*memSeries
+	// series are keyed by their ref, hashes by the hash of their labels, with
+	// more than one series for a hash if labels collide
+	series   map[uint64]*memSeries
+	hashes   map[uint64][]*memSeries
+	postings *memPostings
+	opts     HeadOptions
+	minTime  int64
+	maxTime  int64
+
+	// Totals of what garbage collection removed since the head was created
+	seriesRemoved int
+	chunksRemoved int
+	// churn counts the series created and removed per label pair, it's reset
+	// by every garbage collection, so it only covers the latest one and the
+	// series created since
+	churn map[labels.Label]int
 }
 
-func NewHead() Head {
-	return Head{
+func NewHead() *Head {
+	return NewHeadWithOptions(HeadOptions{})
+}
+
+func NewHeadWithOptions(opts HeadOptions) *Head {
+	if opts.ChunkRange <= 0 {
+		opts.ChunkRange = DefaultChunkRange
+	}
+	if opts.SamplesPerChunk <= 0 {
+		opts.SamplesPerChunk = DefaultSamplesPerChunk
+	}
+
+	return &Head{
 		lastSeriesRef: 1,
 		series:        make(map[uint64]*memSeries),
+		hashes:        make(map[uint64][]*memSeries),
+		postings:      newMemPostings(),
+		churn:         make(map[labels.Label]int),
+		opts:          opts,
+		minTime:       math.MinInt64,
+		maxTime:       math.MinInt64,
 	}
 }
 
+func (h *Head) getByLabels(l labels.Labels) *memSeries {
+	hash, err := l.HashLabels()
+	if err != nil {
+		panic("Should never happen")
+	}
+
+	for _, s := range h.hashes[hash] {
+		if labels.Equal(s.labels, l) {
+			return s
+		}
+	}
+	return nil
+}
+
 func (h *Head) createOrGetMemSeries(l labels.Labels) *memSeries {
-	id, err := l.HashLabels()
+	if s := h.getByLabels(l); s != nil {
+		return s
+	}
 
+	hash, err := l.HashLabels()
 	if err != nil {
 		panic("Should never happen")
 	}
 
-	if v, ok := h.series[id]; ok {
-		return v
-	} else {
-		newSeries := newMemSeries(l)
-		h.series[id] = &newSeries
-		return &newSeries
+	newSeries := newMemSeries(h.lastSeriesRef, l)
+	h.lastSeriesRef++
+
+	h.series[newSeries.ref] = newSeries
+	h.hashes[hash] = append(h.hashes[hash], newSeries)
+	h.postings.add(newSeries.ref, newSeries.labels)
+	h.addChurn(newSeries.labels)
+
+	return newSeries
+}
+
+func (h *Head) Append(l labels.Labels, t int64, v float64) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if t < h.minTime {
+		return ErrOutOfBounds
 	}
+
+	return h.appendSample(h.createOrGetMemSeries(l), t, v)
 }
 
-func (h *Head) Append(l labels.Labels, t uint64, v float64) {
-	memSeries := h.createOrGetMemSeries(l)
+// AppendHistogram appends a native histogram sample. Out-of-order histograms
+// aren't supported, they're rejected even with the out-of-order window set.
+func (h *Head) AppendHistogram(l labels.Labels, t int64, hist *Histogram) error {
+	if err := hist.Validate(); err != nil {
+		return err
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if t < h.minTime {
+		return ErrOutOfBounds
+	}
 
-	memSeries.Append(t, v)
+	return h.appendHistogramSample(h.createOrGetMemSeries(l), t, hist)
 }
 
-func (h *Head) GetMemSeries(l labels.Labels) *memSeries {
-	id, err := l.HashLabels()
+// appendSample needs the head locked.
+func (h *Head) appendSample(s *memSeries, t int64, v float64) error {
+	action, err := s.appendable(t, v, h.oooEnabled(), h.oooMinTime())
 	if err != nil {
-		panic("Should never happen")
+		return err
 	}
 
-	if v, ok := h.series[id]; ok {
-		return v
-	} else {
+	switch action {
+	case appendSkip:
 		return nil
+	case appendOOO:
+		return s.appendOOO(t, v)
+	}
+
+	s.Append(t, v, h.chunkOpts())
+	if t > h.maxTime {
+		h.maxTime = t
+	}
+	return nil
+}
+
+// appendHistogramSample needs the head locked.
+func (h *Head) appendHistogramSample(s *memSeries, t int64, hist *Histogram) error {
+	action, err := s.histogramAppendable(t, hist)
+	if err != nil || action == appendSkip {
+		return err
+	}
+
+	s.AppendHistogram(t, hist, h.chunkOpts())
+	if t > h.maxTime {
+		h.maxTime = t
+	}
+	return nil
+}
+
+func (h *Head) chunkOpts() chunkOpts {
+	return chunkOpts{
+		chunkRange:      h.opts.ChunkRange,
+		samplesPerChunk: h.opts.SamplesPerChunk,
+	}
+}
+
+func (h *Head) oooEnabled() bool {
+	return h.opts.OutOfOrderTimeWindow > 0
+}
+
+// oooMinTime is the oldest timestamp accepted into the out-of-order chunks,
+// the window trails the newest sample appended to the head.
+func (h *Head) oooMinTime() int64 {
+	return h.oooMinTimeAt(h.maxTime)
+}
+
+// oooMinTimeAt is oooMinTime with maxTime as the newest sample.
+func (h *Head) oooMinTimeAt(maxTime int64) int64 {
+	if maxTime < math.MinInt64+h.opts.OutOfOrderTimeWindow {
+		return math.MinInt64
+	}
+	return maxTime - h.opts.OutOfOrderTimeWindow
+}
+
+func (h *Head) GetMemSeries(l labels.Labels) *memSeries {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	return h.getByLabels(l)
+}
+
+func (h *Head) ReadMemSeries(l labels.Labels) (Series, error) {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	if series := h.getByLabels(l); series != nil {
+		samples, err := series.samples()
+		return Series{samples: samples}, err
+	} else {
+		return Series{}, nil
+	}
+}
+
+func (h *Head) MinTime() int64 {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	return h.minTime
+}
+
+func (h *Head) MaxTime() int64 {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	return h.maxTime
+}
+
+// GCStats is what a single garbage collection removed from the head.
+type GCStats struct {
+	SeriesRemoved int
+	ChunksRemoved int
+}
+
+// Truncate moves the minimum time of the head to mint and garbage collects
+// everything older than it.
+func (h *Head) Truncate(mint int64) GCStats {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if mint > h.minTime {
+		h.minTime = mint
+	}
+
+	return h.gc()
+}
+
+// gc drops the chunks which end before the minimum time of the head, then
+// the series left with no samples newer than it, from the series maps and
+// the postings.
+func (h *Head) gc() GCStats {
+	var stats GCStats
+	deleted := make(map[uint64]struct{})
+	clear(h.churn)
+
+	for ref, s := range h.series {
+		stats.ChunksRemoved += s.truncateChunksBefore(h.minTime)
+
+		if s.headChunk.SamplesNum() > 0 && s.headChunk.maxTime >= h.minTime {
+			continue
+		}
+
+		if s.headChunk.SamplesNum() > 0 {
+			stats.ChunksRemoved++
+		}
+
+		delete(h.series, ref)
+		h.deleteHash(s)
+		h.addChurn(s.labels)
+		deleted[ref] = struct{}{}
+		stats.SeriesRemoved++
 	}
+
+	h.postings.delete(deleted)
+
+	h.seriesRemoved += stats.SeriesRemoved
+	h.chunksRemoved += stats.ChunksRemoved
+
+	return stats
 }
 
-func (h *Head) ReadMemSeries(l labels.Labels) Series {
-	id, err := l.HashLabels()
+func (h *Head) deleteHash(s *memSeries) {
+	hash, err := s.labels.HashLabels()
 	if err != nil {
 		panic("Should never happen")
 	}
 
-	if series, ok := h.series[id]; ok {
-		reader := NewXorReader(series.headChunk.Bytes())
-		return reader.readSeries()
+	remaining := h.hashes[hash][:0]
+	for _, other := range h.hashes[hash] {
+		if other != s {
+			remaining = append(remaining, other)
+		}
+	}
+
+	if len(remaining) == 0 {
+		delete(h.hashes, hash)
 	} else {
-		return Series{}
+		h.hashes[hash] = remaining
 	}
 }
 
+// LatestSample returns the newest sample of the series at or before t, which
+// is at most lookback old. A stale marker means the series is gone, so when
+// the newest sample is one nothing is returned, even if there are older
+// samples within the lookback.
+func (h *Head) LatestSample(l labels.Labels, t, lookback int64) (Sample, bool, error) {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	series := h.getByLabels(l)
+	if series == nil {
+		return Sample{}, false, nil
+	}
+
+	samples, err := series.samples()
+	if err != nil {
+		return Sample{}, false, err
+	}
+
+	for i := len(samples) - 1; i >= 0; i-- {
+		s := samples[i]
+		if s.timestamp > t {
+			continue
+		}
+
+		if s.timestamp <= t-lookback || s.isStale() {
+			return Sample{}, false, nil
+		}
+		return s, true, nil
+	}
+
+	return Sample{}, false, nil
+}
+
 type memSeries struct {
-	labels    labels.Labels
-	headChunk *Chunk
+	ref          uint64
+	labels       labels.Labels
+	headChunk    *memChunk
+	oooHeadChunk *oooChunk
+	lastValue    float64
+	// lastHistogram is set when the newest sample is a histogram
+	lastHistogram *Histogram
+	// nextAt is the timestamp at which the head chunk gets cut
+	nextAt int64
 }
 
-func newMemSeries(l labels.Labels) memSeries {
-	return memSeries{
+func newMemSeries(ref uint64, l labels.Labels) *memSeries {
+	return &memSeries{
+		ref:       ref,
 		labels:    l,
-		headChunk: cutNewChunk(),
+		headChunk: cutNewChunk(EncXOR),
 	}
 }
 
-func (m *memSeries) Append(t uint64, v float64) {
-	if m.headChunk.SamplesNum() >= 120 {
-		previous := m.headChunk
-		m.headChunk = cutNewChunk()
-		m.headChunk.previous = previous
+// sampleAppend is where appendable puts a sample.
+type sampleAppend int
+
+const (
+	appendInOrder sampleAppend = iota
+	appendOOO
+	// appendSkip is for a sample the series has already, it's accepted but
+	// not stored twice
+	appendSkip
+)
+
+// appendable checks a sample against the newest sample in the series.
+func (m *memSeries) appendable(t int64, v float64, oooEnabled bool, oooMinTime int64) (sampleAppend, error) {
+	if m.headChunk.SamplesNum() == 0 {
+		return appendInOrder, nil
 	}
+
+	lastT, lastV := m.headChunk.maxTime, m.lastValue
+	switch {
+	case t > lastT:
+		return appendInOrder, nil
+	case t == lastT:
+		// Comparing bits rather than floats, so NaN is equal to itself
+		if m.lastHistogram != nil || math.Float64bits(v) != math.Float64bits(lastV) {
+			return appendInOrder, ErrDuplicateSampleForTimestamp
+		}
+		return appendSkip, nil
+	}
+
+	if oooEnabled && t >= oooMinTime {
+		return m.oooAppendable(t, v)
+	}
+	return appendInOrder, ErrOutOfOrderSample
+}
+
+// oooAppendable checks an out-of-order sample against a sample the series
+// might have at its timestamp already, in the in-order chunks or in the
+// out-of-order one. The in-order sample wins when they're merged, so a
+// different value would be lost.
+func (m *memSeries) oooAppendable(t int64, v float64) (sampleAppend, error) {
+	sameValue := func(s Sample) (sampleAppend, error) {
+		if s.histogram != nil || math.Float64bits(s.value) != math.Float64bits(v) {
+			return appendOOO, ErrDuplicateSampleForTimestamp
+		}
+		return appendSkip, nil
+	}
+
+	for c := m.headChunk; c != nil; c = c.previous {
+		if c.SamplesNum() == 0 || t < c.minTime || t > c.maxTime {
+			continue
+		}
+
+		it := c.chunk.Iterator()
+		for vt := it.Next(); vt != ValNone; vt = it.Next() {
+			if vt == ValHistogram {
+				if ht, h := it.AtHistogram(); ht == t {
+					return sameValue(Sample{timestamp: ht, histogram: h})
+				}
+				continue
+			}
+			if st, sv := it.At(); st == t {
+				return sameValue(Sample{timestamp: st, value: sv})
+			}
+		}
+		if it.Err() != nil {
+			return appendOOO, it.Err()
+		}
+		break
+	}
+
+	if m.oooHeadChunk != nil {
+		if s, ok := m.oooHeadChunk.Get(t); ok {
+			return sameValue(s)
+		}
+	}
+	return appendOOO, nil
+}
+
+func (m *memSeries) histogramAppendable(t int64, h *Histogram) (sampleAppend, error) {
+	if m.headChunk.SamplesNum() == 0 {
+		return appendInOrder, nil
+	}
+
+	lastT := m.headChunk.maxTime
+	switch {
+	case t > lastT:
+		return appendInOrder, nil
+	case t == lastT:
+		if !h.Equals(m.lastHistogram) {
+			return appendInOrder, ErrDuplicateSampleForTimestamp
+		}
+		return appendSkip, nil
+	}
+
+	return appendInOrder, ErrOutOfOrderSample
+}
+
+func (m *memSeries) Append(t int64, v float64, o chunkOpts) {
+	m.appendPreprocessor(t, EncXOR, o)
 	m.headChunk.Append(t, v)
+	m.lastValue = v
+	m.lastHistogram = nil
+}
+
+func (m *memSeries) AppendHistogram(t int64, h *Histogram, o chunkOpts) {
+	m.appendPreprocessor(t, EncHistogram, o)
+	if !m.headChunk.app.(*histogramAppender).appendable(h) {
+		m.cutNewHeadChunk(t, EncHistogram, o.chunkRange)
+	}
+	m.headChunk.AppendHistogram(t, h)
+	m.lastHistogram = h.Copy()
+}
+
+// appendPreprocessor cuts a new head chunk if the sample doesn't belong in the
+// current one. Chunks are cut based on time, once a quarter of the samples is
+// in, the sample rate so far is used to predict when the chunk will be full.
+// The prediction spreads the samples evenly between the chunks left until the
+// end of the block, so no chunk crosses the block boundary.
+func (m *memSeries) appendPreprocessor(t int64, e Encoding, o chunkOpts) {
+	if m.headChunk.chunk.Encoding() != e {
+		m.cutNewHeadChunk(t, e, o.chunkRange)
+	}
+
+	c := m.headChunk
+	numSamples := c.SamplesNum()
+	if numSamples == 0 {
+		m.nextAt = rangeForTimestamp(t, o.chunkRange)
+		return
+	}
+
+	if numSamples == o.samplesPerChunk/4 {
+		m.nextAt = computeChunkEndTime(c.minTime, c.maxTime, m.nextAt, 4)
+	}
+
+	// Twice the samples means the sample rate went up since the prediction,
+	// so we don't wait until nextAt
+	if t >= m.nextAt || numSamples >= o.samplesPerChunk*2 {
+		m.cutNewHeadChunk(t, e, o.chunkRange)
+	}
+}
+
+// cutNewHeadChunk starts a new head chunk, an empty head chunk is replaced
+// rather than kept in the list.
+func (m *memSeries) cutNewHeadChunk(t int64, e Encoding, chunkRange int64) {
+	previous := m.headChunk
+	if previous.SamplesNum() == 0 {
+		previous = previous.previous
+	}
+
+	m.headChunk = cutNewChunk(e)
+	m.headChunk.previous = previous
+	m.nextAt = rangeForTimestamp(t, chunkRange)
+}
+
+// computeChunkEndTime estimates the end of a chunk which started at start and
+// has its last sample at cur, with ratioToFull being how many times more
+// samples fit into the chunk. The chunks left until maxT get equal time ranges.
+func computeChunkEndTime(start, cur, maxT int64, ratioToFull float64) int64 {
+	n := float64(maxT-start) / (float64(cur-start+1) * ratioToFull)
+	if n <= 1 {
+		return maxT
+	}
+	return int64(float64(start) + float64(maxT-start)/math.Floor(n))
+}
+
+// rangeForTimestamp returns the end of the block t belongs to.
+func rangeForTimestamp(t, width int64) int64 {
+	// Floor rather than truncate, so negative timestamps get the right block
+	start := t / width * width
+	if t < 0 && start != t {
+		start -= width
+	}
+	return start + width
+}
+
+func (m *memSeries) appendOOO(t int64, v float64) error {
+	if m.oooHeadChunk == nil {
+		m.oooHeadChunk = &oooChunk{}
+	}
+
+	if !m.oooHeadChunk.Insert(t, v) {
+		return ErrDuplicateSampleForTimestamp
+	}
+	return nil
+}
+
+// truncateChunksBefore drops the chunks which end before mint, except for
+// the head chunk, and returns how many were dropped.
+func (m *memSeries) truncateChunksBefore(mint int64) int {
+	if m.oooHeadChunk != nil {
+		m.oooHeadChunk.truncateBefore(mint)
+	}
+
+	for c := m.headChunk; c.previous != nil; c = c.previous {
+		if c.previous.maxTime < mint {
+			removed := c.previous.chunksListLength()
+			c.previous = nil
+			return removed
+		}
+	}
+
+	return 0
+}
+
+// samples decodes all the chunks of the series, oldest first, and merges in
+// the out-of-order samples.
+func (m *memSeries) samples() ([]Sample, error) {
+	var chunks []*memChunk
+	for c := m.headChunk; c != nil; c = c.previous {
+		chunks = append(chunks, c)
+	}
+
+	var inOrder []Sample
+	for i := len(chunks) - 1; i >= 0; i-- {
+		it := chunks[i].chunk.Iterator()
+		for vt := it.Next(); vt != ValNone; vt = it.Next() {
+			if vt == ValHistogram {
+				t, h := it.AtHistogram()
+				inOrder = append(inOrder, Sample{timestamp: t, histogram: h})
+				continue
+			}
+			t, v := it.At()
+			inOrder = append(inOrder, Sample{timestamp: t, value: v})
+		}
+		if it.Err() != nil {
+			return nil, it.Err()
+		}
+	}
+
+	if m.oooHeadChunk == nil {
+		return inOrder, nil
+	}
+	return mergeSamples(inOrder, m.oooHeadChunk.samples), nil
 }
 
 func (m *memSeries) headChunkBytes() []byte {
-	return m.headChunk.app.Series()
+	return m.headChunk.Bytes()
 }
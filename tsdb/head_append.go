@@ -0,0 +1,215 @@
+package tsdb
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+// HeadAppender batches samples into a transaction, nothing is visible in the
+// head until Commit, and Rollback drops the lot. Samples are checked as
+// they're appended, so the errors come back per sample like they do from
+// Head.Append.
+type HeadAppender struct {
+	head    *Head
+	samples []pendingSample
+	// last is the newest sample appended per series in this transaction
+	last map[*memSeries]pendingSample
+}
+
+type pendingSample struct {
+	series    *memSeries
+	t         int64
+	v         float64
+	histogram *Histogram
+}
+
+// Appender starts a new transaction, an appender isn't safe to be used from
+// more than one goroutine.
+func (h *Head) Appender() *HeadAppender {
+	return &HeadAppender{
+		head: h,
+		last: make(map[*memSeries]pendingSample),
+	}
+}
+
+// Append adds a sample to the transaction and returns the ref of its series.
+// With a non-zero ref from an earlier Append the series is looked up by it,
+// which saves hashing the labels. A ref of a series which is gone by now is
+// ignored and the labels are used instead.
+func (a *HeadAppender) Append(ref uint64, l labels.Labels, t int64, v float64) (uint64, error) {
+	a.head.mtx.Lock()
+	defer a.head.mtx.Unlock()
+
+	if t < a.head.minTime {
+		return 0, ErrOutOfBounds
+	}
+
+	s := a.getOrCreate(ref, l)
+
+	if action, err := a.appendable(s, t, v); err != nil || action == appendSkip {
+		return s.ref, err
+	}
+
+	sample := pendingSample{series: s, t: t, v: v}
+	a.samples = append(a.samples, sample)
+	if last, ok := a.last[s]; !ok || t > last.t {
+		a.last[s] = sample
+	}
+
+	return s.ref, nil
+}
+
+// AppendHistogram is Append for native histograms.
+func (a *HeadAppender) AppendHistogram(ref uint64, l labels.Labels, t int64, h *Histogram) (uint64, error) {
+	if err := h.Validate(); err != nil {
+		return 0, err
+	}
+
+	a.head.mtx.Lock()
+	defer a.head.mtx.Unlock()
+
+	if t < a.head.minTime {
+		return 0, ErrOutOfBounds
+	}
+
+	s := a.getOrCreate(ref, l)
+
+	if last, ok := a.last[s]; ok {
+		if t <= last.t {
+			return s.ref, ErrOutOfOrderSample
+		}
+	} else if action, err := s.histogramAppendable(t, h); err != nil || action == appendSkip {
+		return s.ref, err
+	}
+
+	sample := pendingSample{series: s, t: t, histogram: h.Copy()}
+	a.samples = append(a.samples, sample)
+	a.last[s] = sample
+
+	return s.ref, nil
+}
+
+// CommitError is returned by Commit for the samples the head rejected by
+// then, the rest of the transaction is in the head.
+type CommitError struct {
+	// Rejected is the number of samples rejected, Err is the first of the
+	// errors.
+	Rejected int
+	Err      error
+}
+
+func (e *CommitError) Error() string {
+	return fmt.Sprintf("%d samples rejected on commit, first: %v", e.Rejected, e.Err)
+}
+
+func (e *CommitError) Unwrap() error {
+	return e.Err
+}
+
+// Commit appends the whole transaction to the head under a single lock.
+// Samples made invalid by another transaction committed in the meantime,
+// like a newer sample of the same series, are rejected and returned in a
+// *CommitError.
+func (a *HeadAppender) Commit() error {
+	h := a.head
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	var cerr *CommitError
+	reject := func(err error) {
+		if cerr == nil {
+			cerr = &CommitError{Err: err}
+		}
+		cerr.Rejected++
+	}
+
+	for _, sample := range a.samples {
+		if sample.t < h.minTime {
+			reject(ErrOutOfBounds)
+			continue
+		}
+
+		s := sample.series
+		// The series could have been garbage collected, it had no samples yet
+		if h.series[s.ref] != s {
+			s = h.createOrGetMemSeries(s.labels)
+		}
+
+		var err error
+		if sample.histogram != nil {
+			err = h.appendHistogramSample(s, sample.t, sample.histogram)
+		} else {
+			err = h.appendSample(s, sample.t, sample.v)
+		}
+		if err != nil {
+			reject(err)
+		}
+	}
+
+	a.reset()
+	if cerr != nil {
+		return cerr
+	}
+	return nil
+}
+
+// Rollback drops the transaction. Series it created stay in the head without
+// samples until the next garbage collection.
+func (a *HeadAppender) Rollback() error {
+	a.reset()
+	return nil
+}
+
+func (a *HeadAppender) reset() {
+	a.samples = a.samples[:0]
+	clear(a.last)
+}
+
+// getOrCreate needs the head locked.
+func (a *HeadAppender) getOrCreate(ref uint64, l labels.Labels) *memSeries {
+	if s, ok := a.head.series[ref]; ok {
+		return s
+	}
+	return a.head.createOrGetMemSeries(l)
+}
+
+// appendable checks a float sample against the samples of its series in the
+// transaction and in the head. The out-of-order window trails the newest of
+// them, the transaction's samples are in the head by the time this one is.
+// Needs the head locked.
+func (a *HeadAppender) appendable(s *memSeries, t int64, v float64) (sampleAppend, error) {
+	last, ok := a.last[s]
+	if !ok {
+		return s.appendable(t, v, a.head.oooEnabled(), a.head.oooMinTime())
+	}
+
+	switch {
+	case last.histogram != nil && t <= last.t:
+		return appendInOrder, ErrOutOfOrderSample
+	case t > last.t:
+		return appendInOrder, nil
+	case t == last.t:
+		if math.Float64bits(v) != math.Float64bits(last.v) {
+			return appendInOrder, ErrDuplicateSampleForTimestamp
+		}
+		return appendSkip, nil
+	}
+
+	oooMinTime := a.head.oooMinTimeAt(max(a.head.maxTime, last.t))
+	if !a.head.oooEnabled() || t < oooMinTime {
+		return appendInOrder, ErrOutOfOrderSample
+	}
+	for _, p := range a.samples {
+		if p.series != s || p.t != t {
+			continue
+		}
+		if p.histogram != nil || math.Float64bits(v) != math.Float64bits(p.v) {
+			return appendOOO, ErrDuplicateSampleForTimestamp
+		}
+		return appendSkip, nil
+	}
+	return s.appendable(t, v, true, oooMinTime)
+}
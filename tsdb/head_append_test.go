@@ -0,0 +1,182 @@
+package tsdb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+func Test_headAppender_commit(t *testing.T) {
+	head := NewHead()
+	app := head.Appender()
+
+	ref, err := app.Append(0, labelsLong, timestamp, 1)
+	if err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if _, err := app.Append(ref, labelsLong, timestamp+1000, 2); err != nil {
+		t.Fatalf("Failed to append by ref: %v", err)
+	}
+
+	if series, _ := head.ReadMemSeries(labelsLong); len(series.samples) != 0 {
+		t.Errorf("Samples were visible before the commit")
+	}
+
+	if err := app.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	series, _ := head.ReadMemSeries(labelsLong)
+	if len(series.samples) != 2 {
+		t.Errorf("Expected 2 samples after the commit, got %d", len(series.samples))
+	}
+	if head.MaxTime() != timestamp+1000 {
+		t.Errorf("Expected max time %d, got %d", timestamp+1000, head.MaxTime())
+	}
+}
+
+func Test_headAppender_rollback(t *testing.T) {
+	head := NewHead()
+	app := head.Appender()
+
+	app.Append(0, labelsLong, timestamp, 1)
+	if err := app.Rollback(); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	app.Commit()
+
+	if series, _ := head.ReadMemSeries(labelsLong); len(series.samples) != 0 {
+		t.Errorf("Rolled back samples got committed")
+	}
+
+	// The series without samples goes with the next garbage collection
+	if stats := head.Truncate(timestamp); stats.SeriesRemoved != 1 {
+		t.Errorf("Expected the empty series to be removed, got %+v", stats)
+	}
+}
+
+func Test_headAppender_commitRejected(t *testing.T) {
+	head := NewHead()
+	first, second := head.Appender(), head.Appender()
+
+	first.Append(0, labelsLong, timestamp+1000, 1)
+	second.Append(0, labelsLong, timestamp, 1)
+	second.Append(0, labelsLong, timestamp+2000, 2)
+
+	if err := first.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	// The first transaction has a newer sample in the head by now
+	err := second.Commit()
+	var cerr *CommitError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("Expected a commit error, got %v", err)
+	}
+	if cerr.Rejected != 1 || !errors.Is(err, ErrOutOfOrderSample) {
+		t.Errorf("Expected 1 out of order sample rejected, got %v", err)
+	}
+
+	series, _ := head.ReadMemSeries(labelsLong)
+	if len(series.samples) != 2 {
+		t.Errorf("Expected the rest of the transaction committed, got %d samples", len(series.samples))
+	}
+}
+
+func Test_headAppender_errors(t *testing.T) {
+	head := NewHead()
+	head.Append(labelsLong, timestamp+1000, 1)
+
+	app := head.Appender()
+
+	if _, err := app.Append(0, labelsLong, timestamp, 1); !errors.Is(err, ErrOutOfOrderSample) {
+		t.Errorf("Expected %v against the committed sample, got %v", ErrOutOfOrderSample, err)
+	}
+
+	other := labels.FromStrings("__name__", "other")
+	app.Append(0, other, timestamp+2000, 1)
+
+	if _, err := app.Append(0, other, timestamp+1500, 1); !errors.Is(err, ErrOutOfOrderSample) {
+		t.Errorf("Expected %v against the pending sample, got %v", ErrOutOfOrderSample, err)
+	}
+	if _, err := app.Append(0, other, timestamp+2000, 2); !errors.Is(err, ErrDuplicateSampleForTimestamp) {
+		t.Errorf("Expected %v against the pending sample, got %v", ErrDuplicateSampleForTimestamp, err)
+	}
+
+	head.Truncate(timestamp + 1500)
+	if _, err := app.Append(0, other, timestamp+1000, 1); !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("Expected %v, got %v", ErrOutOfBounds, err)
+	}
+
+	// The other series was garbage collected before the commit, it's
+	// created again
+	if err := app.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if series, _ := head.ReadMemSeries(other); len(series.samples) != 1 {
+		t.Errorf("Expected 1 sample of the other series, got %d", len(series.samples))
+	}
+}
+
+func Test_headAppender_outOfOrder(t *testing.T) {
+	head := NewHeadWithOptions(HeadOptions{OutOfOrderTimeWindow: 5000})
+	head.Append(labelsLong, timestamp, 1)
+
+	app := head.Appender()
+	app.Append(0, labelsLong, timestamp+3000, 4)
+
+	// Older than the sample pending, but within the window trailing it
+	if _, err := app.Append(0, labelsLong, timestamp+2000, 3); err != nil {
+		t.Fatalf("Sample within the out-of-order window was rejected: %v", err)
+	}
+	if _, err := app.Append(0, labelsLong, timestamp+2000, 3); err != nil {
+		t.Errorf("Sample with the same timestamp and value should be accepted, got: %v", err)
+	}
+	if _, err := app.Append(0, labelsLong, timestamp+2000, 5); !errors.Is(err, ErrDuplicateSampleForTimestamp) {
+		t.Errorf("Expected %v against the pending sample, got %v", ErrDuplicateSampleForTimestamp, err)
+	}
+	if _, err := app.Append(0, labelsLong, timestamp, 2); !errors.Is(err, ErrDuplicateSampleForTimestamp) {
+		t.Errorf("Expected %v against the committed sample, got %v", ErrDuplicateSampleForTimestamp, err)
+	}
+	if _, err := app.Append(0, labelsLong, timestamp-3000, 0); !errors.Is(err, ErrOutOfOrderSample) {
+		t.Errorf("Expected %v outside the window, got %v", ErrOutOfOrderSample, err)
+	}
+
+	if err := app.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	series, _ := head.ReadMemSeries(labelsLong)
+	if len(series.samples) != 3 {
+		t.Fatalf("Expected 3 samples, got %d", len(series.samples))
+	}
+	for i, want := range []int64{timestamp, timestamp + 2000, timestamp + 3000} {
+		if got := series.samples[i].timestamp; got != want {
+			t.Errorf("Expected sample %d at %d, got %d", i, want, got)
+		}
+	}
+}
+
+func Test_headAppender_histogram(t *testing.T) {
+	head := NewHead()
+	app := head.Appender()
+
+	for i := range 3 {
+		if _, err := app.AppendHistogram(0, labelsLong, timestamp+int64(i)*1000, testHistogram(i)); err != nil {
+			t.Fatalf("Failed to append histogram: %v", err)
+		}
+	}
+	if _, err := app.AppendHistogram(0, labelsLong, timestamp, testHistogram(0)); !errors.Is(err, ErrOutOfOrderSample) {
+		t.Errorf("Expected %v, got %v", ErrOutOfOrderSample, err)
+	}
+	app.Commit()
+
+	series, _ := head.ReadMemSeries(labelsLong)
+	if len(series.samples) != 3 {
+		t.Fatalf("Expected 3 histograms, got %d", len(series.samples))
+	}
+	if !series.samples[2].histogram.Equals(testHistogram(2)) {
+		t.Errorf("Histogram changed on the way to the head")
+	}
+}
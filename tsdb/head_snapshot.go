@@ -0,0 +1,402 @@
+package tsdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+const (
+	snapshotFilename = "chunk_snapshot"
+	// corruptSnapshotFilename is where a snapshot which failed to load goes
+	corruptSnapshotFilename = snapshotFilename + ".corrupt"
+	snapshotMagic           = 0x5C5A5A01
+	snapshotVersion         = 1
+)
+
+var (
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrCorruptSnapshot is returned when the snapshot can't be decoded.
+	ErrCorruptSnapshot = errors.New("corrupt head snapshot")
+)
+
+// The snapshot holds every series of the head with all its chunks:
+//
+//	┌──────────────────────────────┬──────────────────────────────────────┐
+//	│ magic <4>                    │ version <1>                          │
+//	├──────────────────────────────┴──────────────────────────────────────┤
+//	│ min time <8> │ max time <8> │ last series ref <8> │ #series <uvar>  │
+//	├─────────────────────────────────────────────────────────────────────┤
+//	│ series 1 ... series n                                               │
+//	├─────────────────────────────────────────────────────────────────────┤
+//	│ CRC32 Castagnoli of everything above <4>                            │
+//	└─────────────────────────────────────────────────────────────────────┘
+//
+// A series is its ref, labels as length prefixed strings, next cut time,
+// chunks as length prefixed bytes oldest first, and out-of-order samples.
+// The chunks carry their own headers, so they're written as they are.
+
+// writeSnapshot encodes the whole head, it's locked for the duration.
+func (h *Head) writeSnapshot(w io.Writer) error {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	var buf bytes.Buffer
+	enc := encbuf{b: &buf}
+
+	enc.be32(snapshotMagic)
+	enc.byte(snapshotVersion)
+	enc.be64(uint64(h.minTime))
+	enc.be64(uint64(h.maxTime))
+	enc.be64(h.lastSeriesRef)
+	enc.uvarint(uint64(len(h.series)))
+
+	refs := make([]uint64, 0, len(h.series))
+	for ref := range h.series {
+		refs = append(refs, ref)
+	}
+	slices.Sort(refs)
+
+	for _, ref := range refs {
+		s := h.series[ref]
+
+		enc.uvarint(s.ref)
+		enc.uvarint(uint64(s.labels.Len()))
+		s.labels.Range(func(l labels.Label) {
+			enc.string(l.Name)
+			enc.string(l.Value)
+		})
+		enc.varint(s.nextAt)
+
+		var chunks []*memChunk
+		for c := s.headChunk; c != nil; c = c.previous {
+			chunks = append(chunks, c)
+		}
+		enc.uvarint(uint64(len(chunks)))
+		for i := len(chunks) - 1; i >= 0; i-- {
+			enc.uvarint(uint64(len(chunks[i].Bytes())))
+			buf.Write(chunks[i].Bytes())
+		}
+
+		var ooo []Sample
+		if s.oooHeadChunk != nil {
+			ooo = s.oooHeadChunk.samples
+		}
+		enc.uvarint(uint64(len(ooo)))
+		for _, sample := range ooo {
+			enc.varint(sample.timestamp)
+			enc.be64(math.Float64bits(sample.value))
+		}
+	}
+
+	enc.be32(crc32.Checksum(buf.Bytes(), castagnoliTable))
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readSnapshot builds a head out of the snapshot bytes.
+func readSnapshot(b []byte, opts HeadOptions) (*Head, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("%w: too short", ErrCorruptSnapshot)
+	}
+
+	content, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.Checksum(content, castagnoliTable) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptSnapshot)
+	}
+
+	dec := decbuf{b: content}
+	if dec.be32() != snapshotMagic {
+		return nil, fmt.Errorf("%w: invalid magic number", ErrCorruptSnapshot)
+	}
+	if v := dec.byte(); v != snapshotVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrCorruptSnapshot, v)
+	}
+
+	h := NewHeadWithOptions(opts)
+	h.minTime = int64(dec.be64())
+	h.maxTime = int64(dec.be64())
+	h.lastSeriesRef = dec.be64()
+
+	numSeries := dec.uvarint()
+	for i := uint64(0); i < numSeries && dec.err == nil; i++ {
+		s, err := readSnapshotSeries(&dec)
+		if err != nil {
+			return nil, fmt.Errorf("%w: series %d: %w", ErrCorruptSnapshot, i, err)
+		}
+
+		hash, err := s.labels.HashLabels()
+		if err != nil {
+			return nil, err
+		}
+		h.series[s.ref] = s
+		h.hashes[hash] = append(h.hashes[hash], s)
+		h.postings.add(s.ref, s.labels)
+	}
+
+	if dec.err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptSnapshot, dec.err)
+	}
+	if len(dec.b) != 0 {
+		return nil, fmt.Errorf("%w: %d bytes left after the last series", ErrCorruptSnapshot, len(dec.b))
+	}
+
+	return h, nil
+}
+
+func readSnapshotSeries(dec *decbuf) (*memSeries, error) {
+	ref := dec.uvarint()
+
+	numLabels := dec.uvarint()
+	if numLabels > uint64(len(dec.b)) {
+		return nil, fmt.Errorf("%d labels in %d bytes", numLabels, len(dec.b))
+	}
+	b := labels.NewScratchBuilder(int(numLabels))
+	for range numLabels {
+		b.Add(dec.string(), dec.string())
+	}
+
+	s := &memSeries{ref: ref, labels: b.Labels(), nextAt: dec.varint()}
+
+	numChunks := dec.uvarint()
+	if numChunks == 0 || numChunks > uint64(len(dec.b)) {
+		return nil, fmt.Errorf("%d chunks in %d bytes", numChunks, len(dec.b))
+	}
+	for range numChunks {
+		// Copy, so the chunks don't keep the whole snapshot in memory
+		chunk, err := FromData(slices.Clone(dec.bytes(int(dec.uvarint()))))
+		if dec.err != nil {
+			return nil, dec.err
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		header, err := readChunkHeader(chunk.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		s.headChunk = &memChunk{
+			chunk:    chunk,
+			minTime:  header.minTime,
+			maxTime:  header.maxTime,
+			previous: s.headChunk,
+		}
+	}
+
+	app, err := s.headChunk.chunk.Appender()
+	if err != nil {
+		return nil, err
+	}
+	s.headChunk.app = app
+
+	if err := s.restoreLastSample(); err != nil {
+		return nil, err
+	}
+
+	numOOO := dec.uvarint()
+	if numOOO > uint64(len(dec.b)) {
+		return nil, fmt.Errorf("%d out-of-order samples in %d bytes", numOOO, len(dec.b))
+	}
+	if numOOO > 0 {
+		s.oooHeadChunk = &oooChunk{}
+		for range numOOO {
+			s.oooHeadChunk.samples = append(s.oooHeadChunk.samples, Sample{
+				timestamp: dec.varint(),
+				value:     math.Float64frombits(dec.be64()),
+			})
+		}
+	}
+
+	return s, dec.err
+}
+
+// restoreLastSample reads the head chunk to get the newest sample back, it's
+// what new samples get checked against.
+func (m *memSeries) restoreLastSample() error {
+	it := m.headChunk.chunk.Iterator()
+	for vt := it.Next(); vt != ValNone; vt = it.Next() {
+		if vt == ValHistogram {
+			_, m.lastHistogram = it.AtHistogram()
+			continue
+		}
+		_, m.lastValue = it.At()
+		m.lastHistogram = nil
+	}
+	return it.Err()
+}
+
+// writeSnapshotFile writes the snapshot next to a temporary name first, so a
+// crash halfway through doesn't leave a broken snapshot behind.
+func writeSnapshotFile(dir string, h *Head) error {
+	tmp := filepath.Join(dir, snapshotFilename+".tmp")
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if err := h.writeSnapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, snapshotFilename))
+}
+
+// readSnapshotFile returns a nil head without an error if there's no snapshot.
+func readSnapshotFile(dir string, opts HeadOptions) (*Head, error) {
+	b, err := os.ReadFile(filepath.Join(dir, snapshotFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return readSnapshot(b, opts)
+}
+
+func removeSnapshotFile(dir string) error {
+	err := os.Remove(filepath.Join(dir, snapshotFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// moveCorruptSnapshotFile renames the snapshot to corruptSnapshotFilename,
+// replacing one moved there before, and returns its new path.
+func moveCorruptSnapshotFile(dir string) (string, error) {
+	path := filepath.Join(dir, corruptSnapshotFilename)
+	return path, os.Rename(filepath.Join(dir, snapshotFilename), path)
+}
+
+type encbuf struct {
+	b *bytes.Buffer
+}
+
+func (e encbuf) byte(b byte) {
+	e.b.WriteByte(b)
+}
+
+func (e encbuf) be32(v uint32) {
+	e.b.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (e encbuf) be64(v uint64) {
+	e.b.Write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (e encbuf) uvarint(v uint64) {
+	e.b.Write(binary.AppendUvarint(nil, v))
+}
+
+func (e encbuf) varint(v int64) {
+	e.b.Write(binary.AppendVarint(nil, v))
+}
+
+func (e encbuf) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.b.WriteString(s)
+}
+
+// decbuf reads what encbuf wrote, after the first error all reads return
+// zero values and the error stays in err.
+type decbuf struct {
+	b   []byte
+	err error
+}
+
+func (d *decbuf) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decbuf) byte() byte {
+	b := d.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decbuf) be32() uint32 {
+	b := d.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decbuf) be64() uint64 {
+	b := d.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *decbuf) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = fmt.Errorf("invalid uvarint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decbuf) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = fmt.Errorf("invalid varint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decbuf) string() string {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	return string(d.bytes(int(n)))
+}
@@ -0,0 +1,200 @@
+package tsdb
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+func Test_headSnapshot_roundTrip(t *testing.T) {
+	opts := HeadOptions{OutOfOrderTimeWindow: 60 * 1000, SamplesPerChunk: 30}
+	head := NewHeadWithOptions(opts)
+
+	histogramLabels := labels.FromStrings("__name__", "histogram")
+
+	for i := range 100 {
+		if err := head.Append(labelsLong, timestamp+int64(i)*1000, float64(i)); err != nil {
+			t.Fatalf("Failed to append sample: %v", err)
+		}
+		if err := head.AppendHistogram(histogramLabels, timestamp+int64(i)*1000, testHistogram(i)); err != nil {
+			t.Fatalf("Failed to append histogram: %v", err)
+		}
+	}
+	if err := head.Append(labelsLong, timestamp+90500, 0.5); err != nil {
+		t.Fatalf("Failed to append out-of-order sample: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := head.writeSnapshot(&buf); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+
+	loaded, err := readSnapshot(buf.Bytes(), opts)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+
+	if loaded.MinTime() != head.MinTime() || loaded.MaxTime() != head.MaxTime() {
+		t.Errorf("Expected time range [%d, %d], got [%d, %d]", head.MinTime(), head.MaxTime(), loaded.MinTime(), loaded.MaxTime())
+	}
+
+	for _, l := range []labels.Labels{labelsLong, histogramLabels} {
+		want, err := head.ReadMemSeries(l)
+		if err != nil {
+			t.Fatalf("Failed to read series: %v", err)
+		}
+		got, err := loaded.ReadMemSeries(l)
+		if err != nil {
+			t.Fatalf("Failed to read loaded series: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Series %v differs after loading the snapshot", l)
+		}
+		if loaded.GetMemSeries(l).ref != head.GetMemSeries(l).ref {
+			t.Errorf("Series %v got a different ref", l)
+		}
+	}
+
+	if got, want := loaded.GetMemSeries(labelsLong).oooHeadChunk, head.GetMemSeries(labelsLong).oooHeadChunk; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected out-of-order chunk %v, got %v", want, got)
+	}
+
+	// The loaded head has to keep appending where the old one stopped
+	if err := loaded.Append(labelsLong, timestamp+99*1000, 1); !errors.Is(err, ErrDuplicateSampleForTimestamp) {
+		t.Errorf("Expected %v, got %v", ErrDuplicateSampleForTimestamp, err)
+	}
+	if err := loaded.Append(labelsLong, timestamp+100*1000, 100); err != nil {
+		t.Errorf("Failed to append after loading: %v", err)
+	}
+	if err := loaded.AppendHistogram(histogramLabels, timestamp+100*1000, testHistogram(100)); err != nil {
+		t.Errorf("Failed to append histogram after loading: %v", err)
+	}
+
+	newLabels := labels.FromStrings("__name__", "new")
+	if err := loaded.Append(newLabels, timestamp+100*1000, 1); err != nil {
+		t.Fatalf("Failed to append new series: %v", err)
+	}
+	if ref := loaded.GetMemSeries(newLabels).ref; ref == head.GetMemSeries(labelsLong).ref || ref == head.GetMemSeries(histogramLabels).ref {
+		t.Errorf("New series reused ref %d", ref)
+	}
+}
+
+func Test_db_snapshotOnShutdown(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Dir = t.TempDir()
+	opts.EnableSnapshotOnShutdown = true
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open the DB: %v", err)
+	}
+	for i := range 10 {
+		db.Head().Append(labelsLong, timestamp+int64(i)*1000, float64(i))
+	}
+	want, _ := db.Head().ReadMemSeries(labelsLong)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close the DB: %v", err)
+	}
+
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen the DB: %v", err)
+	}
+	defer db.Close()
+
+	got, err := db.Head().ReadMemSeries(labelsLong)
+	if err != nil {
+		t.Fatalf("Failed to read series: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v after restart, got %v", want, got)
+	}
+
+	// Until the next Close there's no snapshot, a crash doesn't bring back
+	// the old head
+	if _, err := os.Stat(filepath.Join(opts.Dir, snapshotFilename)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the snapshot to be removed once loaded, got %v", err)
+	}
+}
+
+func Test_db_snapshotDisabled(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Dir = t.TempDir()
+	opts.EnableSnapshotOnShutdown = true
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open the DB: %v", err)
+	}
+	db.Head().Append(labelsLong, timestamp, 1)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close the DB: %v", err)
+	}
+
+	opts.EnableSnapshotOnShutdown = false
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen the DB: %v", err)
+	}
+	defer db.Close()
+
+	if db.Head().GetMemSeries(labelsLong) != nil {
+		t.Errorf("Snapshot was loaded with snapshots disabled")
+	}
+}
+
+func Test_db_corruptSnapshot(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Dir = t.TempDir()
+	opts.EnableSnapshotOnShutdown = true
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open the DB: %v", err)
+	}
+	db.Head().Append(labelsLong, timestamp, 1)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close the DB: %v", err)
+	}
+
+	path := filepath.Join(opts.Dir, snapshotFilename)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	b[len(b)/2] ^= 0xff
+	if err := os.WriteFile(path, b, 0o666); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+
+	if _, err := readSnapshot(b, opts.HeadOptions); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Errorf("Expected %v, got %v", ErrCorruptSnapshot, err)
+	}
+
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Corrupt snapshot failed the open: %v", err)
+	}
+	defer db.Close()
+
+	if db.Head().GetMemSeries(labelsLong) != nil {
+		t.Errorf("Expected an empty head after a corrupt snapshot")
+	}
+
+	// The corrupt snapshot is kept aside, not loaded again
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the corrupt snapshot moved away, got %v", err)
+	}
+	moved, err := os.ReadFile(filepath.Join(opts.Dir, corruptSnapshotFilename))
+	if err != nil {
+		t.Fatalf("Corrupt snapshot wasn't kept: %v", err)
+	}
+	if !bytes.Equal(moved, b) {
+		t.Errorf("Corrupt snapshot kept isn't the one which failed to load")
+	}
+}
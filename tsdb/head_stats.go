@@ -0,0 +1,114 @@
+package tsdb
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+// Stat is a single entry of the cardinality top lists.
+type Stat struct {
+	Name  string
+	Value int
+}
+
+type HeadStats struct {
+	NumSeries int
+	NumChunks int
+	// NumSamples and NumBytes only cover the encoded chunks, out-of-order
+	// samples aren't encoded and are counted separately.
+	NumSamples    int
+	NumBytes      int
+	NumOOOSamples int
+	// BytesPerSample is zero for an empty head.
+	BytesPerSample float64
+	MinTime        int64
+	MaxTime        int64
+	// SeriesRemoved and ChunksRemoved are the totals of all the garbage
+	// collections so far.
+	SeriesRemoved int
+	ChunksRemoved int
+
+	// SeriesCountByMetricName is the metrics with the most series.
+	SeriesCountByMetricName []Stat
+	// LabelValueCountByLabelName is the label names with the most values.
+	LabelValueCountByLabelName []Stat
+	// SeriesChurnByLabelPair is the label pairs with the most series created
+	// and removed since the last garbage collection, including the series it
+	// removed. The names are formatted as name="value".
+	SeriesChurnByLabelPair []Stat
+}
+
+// Stats goes through the whole head, with the top lists cut to limit entries.
+func (h *Head) Stats(limit int) HeadStats {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	stats := HeadStats{
+		NumSeries:     len(h.series),
+		MinTime:       h.minTime,
+		MaxTime:       h.maxTime,
+		SeriesRemoved: h.seriesRemoved,
+		ChunksRemoved: h.chunksRemoved,
+	}
+
+	for _, s := range h.series {
+		for c := s.headChunk; c != nil; c = c.previous {
+			if c.SamplesNum() == 0 {
+				continue
+			}
+			stats.NumChunks++
+			stats.NumSamples += c.SamplesNum()
+			stats.NumBytes += len(c.Bytes())
+		}
+		if s.oooHeadChunk != nil {
+			stats.NumOOOSamples += s.oooHeadChunk.NumSamples()
+		}
+	}
+
+	if stats.NumSamples > 0 {
+		stats.BytesPerSample = float64(stats.NumBytes) / float64(stats.NumSamples)
+	}
+
+	var byMetricName, byLabelName []Stat
+	for name, values := range h.postings.m {
+		byLabelName = append(byLabelName, Stat{Name: name, Value: len(values)})
+	}
+	for value, refs := range h.postings.m[labels.MetricName] {
+		byMetricName = append(byMetricName, Stat{Name: value, Value: len(refs)})
+	}
+
+	var byChurn []Stat
+	for l, churn := range h.churn {
+		byChurn = append(byChurn, Stat{Name: l.Name + "=" + `"` + l.Value + `"`, Value: churn})
+	}
+
+	stats.SeriesCountByMetricName = topStats(byMetricName, limit)
+	stats.LabelValueCountByLabelName = topStats(byLabelName, limit)
+	stats.SeriesChurnByLabelPair = topStats(byChurn, limit)
+
+	return stats
+}
+
+func (h *Head) addChurn(l labels.Labels) {
+	l.Range(func(label labels.Label) {
+		h.churn[label]++
+	})
+}
+
+// topStats sorts by value, highest first, and by name on ties, so the lists
+// don't change between calls.
+func topStats(stats []Stat, limit int) []Stat {
+	slices.SortFunc(stats, func(a, b Stat) int {
+		if c := cmp.Compare(b.Value, a.Value); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	if limit >= 0 && len(stats) > limit {
+		stats = stats[:limit]
+	}
+	return stats
+}
@@ -0,0 +1,64 @@
+package tsdb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+func Test_head_stats(t *testing.T) {
+	head := NewHeadWithOptions(HeadOptions{SamplesPerChunk: 10})
+
+	for i := range 3 {
+		l := labels.FromStrings(
+			"__name__", "http_requests_total",
+			"instance", string(rune('a'+i)),
+			"job", "api",
+		)
+		for j := range 30 {
+			head.Append(l, timestamp+int64(j)*1000, float64(j))
+		}
+	}
+	head.Append(labels.FromStrings("__name__", "up", "job", "api"), timestamp, 1)
+
+	stats := head.Stats(2)
+
+	if stats.NumSeries != 4 {
+		t.Errorf("Expected 4 series, got %d", stats.NumSeries)
+	}
+	if stats.NumSamples != 91 {
+		t.Errorf("Expected 91 samples, got %d", stats.NumSamples)
+	}
+	numChunks := 0
+	for _, s := range head.series {
+		numChunks += s.headChunk.chunksListLength()
+	}
+	if stats.NumChunks != numChunks {
+		t.Errorf("Expected %d chunks, got %d", numChunks, stats.NumChunks)
+	}
+	if stats.BytesPerSample <= 0 || stats.BytesPerSample > 16 {
+		t.Errorf("Bytes per sample out of range: %f", stats.BytesPerSample)
+	}
+
+	if want := []Stat{{"http_requests_total", 3}, {"up", 1}}; !reflect.DeepEqual(stats.SeriesCountByMetricName, want) {
+		t.Errorf("Expected metric names %v, got %v", want, stats.SeriesCountByMetricName)
+	}
+	if want := []Stat{{"instance", 3}, {"__name__", 2}}; !reflect.DeepEqual(stats.LabelValueCountByLabelName, want) {
+		t.Errorf("Expected label names %v, got %v", want, stats.LabelValueCountByLabelName)
+	}
+	if want := []Stat{{`job="api"`, 4}, {`__name__="http_requests_total"`, 3}}; !reflect.DeepEqual(stats.SeriesChurnByLabelPair, want) {
+		t.Errorf("Expected churn %v, got %v", want, stats.SeriesChurnByLabelPair)
+	}
+
+	// Only up goes away, the churn is what the collection removed
+	head.Truncate(timestamp + 1)
+	stats = head.Stats(10)
+
+	if stats.NumSeries != 3 || stats.SeriesRemoved != 1 {
+		t.Errorf("Expected 3 series with 1 removed, got %d with %d removed", stats.NumSeries, stats.SeriesRemoved)
+	}
+	if want := []Stat{{`__name__="up"`, 1}, {`job="api"`, 1}}; !reflect.DeepEqual(stats.SeriesChurnByLabelPair, want) {
+		t.Errorf("Expected churn %v, got %v", want, stats.SeriesChurnByLabelPair)
+	}
+}
@@ -1,24 +1,31 @@
 package tsdb
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/pomyslowynick/scratcheus/labels"
+	"github.com/pomyslowynick/scratcheus/value"
 )
 
-var labelsLong labels.Labels = labels.Labels{
-	labels.Label{Value: "prometheus_build_info", Name: "__name__"},
-	labels.Label{Value: "release-2.54", Name: "branch"},
-	labels.Label{Value: "amd64", Name: "goarch"},
-	labels.Label{Value: "linux", Name: "goos"},
-	labels.Label{Value: "go1.23.4", Name: "goversion"},
-	labels.Label{Value: "c5e015d29534f06bd1d238c64a06b7ac41abdd7f", Name: "revision"},
-	labels.Label{Value: "netgo,builtinassets,stringlabels", Name: "tags"},
-	labels.Label{Value: "2.54.1", Name: "version"},
-}
+var labelsLong labels.Labels = labels.FromStrings(
+	"__name__", "prometheus_build_info",
+	"branch", "release-2.54",
+	"goarch", "amd64",
+	"goos", "linux",
+	"goversion", "go1.23.4",
+	"revision", "c5e015d29534f06bd1d238c64a06b7ac41abdd7f",
+	"tags", "netgo,builtinassets,stringlabels",
+	"version", "2.54.1",
+)
 
-var timestamp uint64 = uint64(time.Date(2025, time.April, 27, 12, 10, 10, 10, time.UTC).Unix())
+var timestamp int64 = time.Date(2025, time.April, 27, 12, 10, 10, 10, time.UTC).UnixMilli()
 
 func Test_head_append(t *testing.T) {
 	value := 2.75231
@@ -28,7 +35,7 @@ func Test_head_append(t *testing.T) {
 	if memS := head.GetMemSeries(labelsLong); memS == nil {
 		t.Errorf("memSeries is nil after head.Append")
 	} else {
-		if len(memS.headChunkBytes()) <= 2 {
+		if len(memS.headChunkBytes()) <= chunkHeaderSize {
 			t.Errorf("No samples were appended")
 		}
 	}
@@ -58,9 +65,16 @@ func Test_head_getMemSeries(t *testing.T) {
 		t.Errorf("Created series wasn't returned")
 	}
 
-	series := head.ReadMemSeries(labelsLong)
-	expectedValues := []float64{2.75231, 2.75231, 2.75231, 3.75231, 4.75231, 5.75231, 10.75231}
-	expectedTimestamps := []uint64{1745755810, 1745755810, 1745755810, 1745755813, 1745755840, 1745755870, 1745756310}
+	series, err := head.ReadMemSeries(labelsLong)
+	if err != nil {
+		t.Fatalf("Failed to read the series: %v", err)
+	}
+	// The same sample appended three times is stored once
+	expectedValues := []float64{2.75231, 3.75231, 4.75231, 5.75231, 10.75231}
+	expectedTimestamps := []int64{1745755810000, 1745755810003, 1745755810030, 1745755810060, 1745755810500}
+	if len(series.samples) != len(expectedValues) {
+		t.Fatalf("Expected %d samples, got %d", len(expectedValues), len(series.samples))
+	}
 
 	for i, v := range series.samples {
 		if expectedValues[i] != v.value {
@@ -77,25 +91,416 @@ func Test_head_cutNewChunk(t *testing.T) {
 	head := NewHead()
 
 	value := 2.75231
+	blockStart := rangeForTimestamp(timestamp, DefaultChunkRange)
 
-	for _ = range 121 {
-		head.Append(labelsLong, timestamp, value)
+	// Two hours of samples every 15 seconds fill four chunks of 120 samples
+	for i := range 480 {
+		head.Append(labelsLong, blockStart+int64(i)*15000, value)
 	}
 
 	memSeries := head.GetMemSeries(labelsLong)
 	if memSeries == nil {
-		t.Errorf("Created series wasn't returned")
+		t.Fatalf("Created series wasn't returned")
 	}
 
 	if memSeries.headChunk.previous == nil {
 		t.Errorf("No new chunk created")
 	}
 
-	for _ = range 121 {
-		head.Append(labelsLong, timestamp, value)
+	if memSeries.headChunk.chunksListLength() != 4 {
+		t.Errorf("Head chunks list should be equal to 4, instead it's: %d", memSeries.headChunk.chunksListLength())
+	}
+
+	for c := memSeries.headChunk; c != nil; c = c.previous {
+		if c.SamplesNum() != 120 {
+			t.Errorf("Chunk starting at %d has %d samples instead of 120", c.minTime, c.SamplesNum())
+		}
+	}
+
+	head.Append(labelsLong, blockStart+DefaultChunkRange, value)
+
+	if memSeries.headChunk.chunksListLength() != 5 {
+		t.Errorf("Head chunks list should be equal to 5, instead it's: %d", memSeries.headChunk.chunksListLength())
+	}
+}
+
+func Test_head_cutNewChunkAtBlockBoundary(t *testing.T) {
+	head := NewHead()
+
+	// Start 10 minutes before the end of the block, the first chunk can only
+	// take 40 samples
+	blockEnd := rangeForTimestamp(timestamp, DefaultChunkRange)
+	start := blockEnd - 10*60*1000
+
+	for i := range 80 {
+		head.Append(labelsLong, start+int64(i)*15000, float64(i))
+	}
+
+	memSeries := head.GetMemSeries(labelsLong)
+	if memSeries.headChunk.chunksListLength() != 2 {
+		t.Fatalf("Head chunks list should be equal to 2, instead it's: %d", memSeries.headChunk.chunksListLength())
+	}
+
+	previous := memSeries.headChunk.previous
+	if previous.SamplesNum() != 40 || previous.maxTime >= blockEnd {
+		t.Errorf("First chunk crosses the block boundary: %d samples, max time %d, block end %d", previous.SamplesNum(), previous.maxTime, blockEnd)
+	}
+
+	if memSeries.headChunk.minTime != blockEnd {
+		t.Errorf("Second chunk should start at the block boundary %d, starts at %d", blockEnd, memSeries.headChunk.minTime)
+	}
+}
+
+func Test_head_cutNewChunkSampleRateUp(t *testing.T) {
+	head := NewHead()
+	value := 2.75231
+
+	// The prediction is made with a sample a second, then they come every
+	// millisecond and never reach the predicted end, the chunk is cut at
+	// twice the samples per chunk
+	ts := int64(timestamp)
+	for i := range 241 {
+		if i < 30 {
+			ts += 1000
+		} else {
+			ts++
+		}
+		head.Append(labelsLong, ts, value)
+	}
+
+	memSeries := head.GetMemSeries(labelsLong)
+	if memSeries.headChunk.chunksListLength() != 2 {
+		t.Errorf("Head chunks list should be equal to 2, instead it's: %d", memSeries.headChunk.chunksListLength())
+	}
+
+	if memSeries.headChunk.previous.SamplesNum() != 240 {
+		t.Errorf("First chunk should have 240 samples, has %d", memSeries.headChunk.previous.SamplesNum())
+	}
+}
+
+func Test_head_rangeForTimestamp(t *testing.T) {
+	cases := []struct{ t, width, expected int64 }{
+		{0, 100, 100},
+		{99, 100, 100},
+		{100, 100, 200},
+		{-1, 100, 0},
+		{-100, 100, 0},
+		{-101, 100, -100},
+	}
+
+	for _, c := range cases {
+		if got := rangeForTimestamp(c.t, c.width); got != c.expected {
+			t.Errorf("rangeForTimestamp(%d, %d): expected %d, got %d", c.t, c.width, c.expected, got)
+		}
+	}
+}
+
+func Test_head_appendOutOfOrder(t *testing.T) {
+	head := NewHead()
+	value := 2.75231
+
+	if err := head.Append(labelsLong, timestamp+60, value); err != nil {
+		t.Fatalf("Unexpected error appending first sample: %v", err)
+	}
+
+	if err := head.Append(labelsLong, timestamp, value); !errors.Is(err, ErrOutOfOrderSample) {
+		t.Errorf("Expected ErrOutOfOrderSample, got: %v", err)
+	}
+
+	if err := head.Append(labelsLong, timestamp+60, value+1); !errors.Is(err, ErrDuplicateSampleForTimestamp) {
+		t.Errorf("Expected ErrDuplicateSampleForTimestamp, got: %v", err)
+	}
+
+	if err := head.Append(labelsLong, timestamp+60, value); err != nil {
+		t.Errorf("Sample with the same timestamp and value should be accepted, got: %v", err)
+	}
+
+	series, err := head.ReadMemSeries(labelsLong)
+	if err != nil {
+		t.Fatalf("Failed to read the series: %v", err)
+	}
+	// The identical duplicate isn't stored a second time
+	if len(series.samples) != 1 {
+		t.Fatalf("Expected 1 sample, got %v", series.samples)
+	}
+	if s := series.samples[0]; s.timestamp != timestamp+60 || s.value != value {
+		t.Errorf("Rejected sample ended up in the series: %v", s)
+	}
+}
+
+func Test_head_outOfOrderWindow(t *testing.T) {
+	head := NewHeadWithOptions(HeadOptions{OutOfOrderTimeWindow: 100})
+
+	head.Append(labelsLong, timestamp, 1)
+	head.Append(labelsLong, timestamp+200, 4)
+
+	if err := head.Append(labelsLong, timestamp+150, 3); err != nil {
+		t.Errorf("Sample within the out-of-order window was rejected: %v", err)
+	}
+
+	if err := head.Append(labelsLong, timestamp+120, 2); err != nil {
+		t.Errorf("Sample within the out-of-order window was rejected: %v", err)
+	}
+
+	if err := head.Append(labelsLong, timestamp+150, 5); !errors.Is(err, ErrDuplicateSampleForTimestamp) {
+		t.Errorf("Expected ErrDuplicateSampleForTimestamp, got: %v", err)
+	}
+
+	if err := head.Append(labelsLong, timestamp+50, 2); !errors.Is(err, ErrOutOfOrderSample) {
+		t.Errorf("Sample outside of the out-of-order window should be rejected, got: %v", err)
+	}
+
+	series, err := head.ReadMemSeries(labelsLong)
+	if err != nil {
+		t.Fatalf("Failed to read the series: %v", err)
+	}
+	expectedTimestamps := []int64{timestamp, timestamp + 120, timestamp + 150, timestamp + 200}
+	expectedValues := []float64{1, 2, 3, 4}
+
+	if len(series.samples) != len(expectedValues) {
+		t.Fatalf("Expected %d samples, got %d", len(expectedValues), len(series.samples))
+	}
+
+	for i, s := range series.samples {
+		if s.timestamp != expectedTimestamps[i] || s.value != expectedValues[i] {
+			t.Errorf("Sample %d not merged in order: expected %d %v, actual %d %v", i, expectedTimestamps[i], expectedValues[i], s.timestamp, s.value)
+		}
+	}
+}
+
+func Test_head_outOfOrderDuplicate(t *testing.T) {
+	head := NewHeadWithOptions(HeadOptions{OutOfOrderTimeWindow: 5000})
+
+	head.Append(labelsLong, 1000, 1)
+	head.Append(labelsLong, 3000, 3)
+
+	// The timestamp is taken by an in-order sample already
+	if err := head.Append(labelsLong, 1000, 5); !errors.Is(err, ErrDuplicateSampleForTimestamp) {
+		t.Errorf("Expected ErrDuplicateSampleForTimestamp, got: %v", err)
+	}
+	if err := head.Append(labelsLong, 1000, 1); err != nil {
+		t.Errorf("Sample with the same timestamp and value should be accepted, got: %v", err)
+	}
+
+	if err := head.Append(labelsLong, 2000, 2); err != nil {
+		t.Fatalf("Sample within the out-of-order window was rejected: %v", err)
+	}
+	if err := head.Append(labelsLong, 2000, 6); !errors.Is(err, ErrDuplicateSampleForTimestamp) {
+		t.Errorf("Expected ErrDuplicateSampleForTimestamp, got: %v", err)
+	}
+	if err := head.Append(labelsLong, 2000, 2); err != nil {
+		t.Errorf("Sample with the same timestamp and value should be accepted, got: %v", err)
+	}
+
+	app := head.Appender()
+	if _, err := app.Append(0, labelsLong, 1000, 7); !errors.Is(err, ErrDuplicateSampleForTimestamp) {
+		t.Errorf("Expected ErrDuplicateSampleForTimestamp from the appender, got: %v", err)
+	}
+	app.Append(0, labelsLong, 1000, 1)
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	series, err := head.ReadMemSeries(labelsLong)
+	if err != nil {
+		t.Fatalf("Failed to read the series: %v", err)
+	}
+	expected := []Sample{{timestamp: 1000, value: 1}, {timestamp: 2000, value: 2}, {timestamp: 3000, value: 3}}
+	if len(series.samples) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, series.samples)
+	}
+	for i := range expected {
+		if series.samples[i] != expected[i] {
+			t.Errorf("Sample %d: expected %v, got %v", i, expected[i], series.samples[i])
+		}
+	}
+	if n := head.GetMemSeries(labelsLong).oooHeadChunk.NumSamples(); n != 1 {
+		t.Errorf("Expected 1 out-of-order sample, got %d", n)
+	}
+}
+
+func Test_head_appendHistogram(t *testing.T) {
+	head := NewHead()
+
+	head.Append(labelsLong, timestamp, 1)
+	for i := range 3 {
+		if err := head.AppendHistogram(labelsLong, timestamp+int64(i+1)*1000, testHistogram(i)); err != nil {
+			t.Fatalf("Failed to append histogram: %v", err)
+		}
+	}
+
+	// Different buckets need a new chunk
+	changed := testHistogram(3)
+	changed.PositiveSpans = []Span{{Offset: 0, Length: 4}}
+	if err := head.AppendHistogram(labelsLong, timestamp+4000, changed); err != nil {
+		t.Fatalf("Failed to append histogram: %v", err)
+	}
+
+	if err := head.AppendHistogram(labelsLong, timestamp+4000, testHistogram(4)); !errors.Is(err, ErrDuplicateSampleForTimestamp) {
+		t.Errorf("Expected ErrDuplicateSampleForTimestamp, got: %v", err)
+	}
+
+	if err := head.AppendHistogram(labelsLong, timestamp+500, testHistogram(4)); !errors.Is(err, ErrOutOfOrderSample) {
+		t.Errorf("Expected ErrOutOfOrderSample, got: %v", err)
 	}
 
+	memSeries := head.GetMemSeries(labelsLong)
 	if memSeries.headChunk.chunksListLength() != 3 {
-		t.Errorf("Head chunks list should be equal to 3, instead it's: %d", memSeries.headChunk.chunksListLength())
+		t.Errorf("Expected float chunk and two histogram chunks, got %d chunks", memSeries.headChunk.chunksListLength())
+	}
+
+	series, err := head.ReadMemSeries(labelsLong)
+	if err != nil {
+		t.Fatalf("Failed to read the series: %v", err)
+	}
+
+	if len(series.samples) != 5 {
+		t.Fatalf("Expected 5 samples, got %d", len(series.samples))
+	}
+
+	if series.samples[0].histogram != nil || series.samples[0].value != 1 {
+		t.Errorf("First sample should be a float, got: %+v", series.samples[0])
+	}
+
+	for i, s := range series.samples[1:4] {
+		if !s.histogram.Equals(testHistogram(i)) {
+			t.Errorf("Sample %d: histogram not equal: \ngot: %+v \nexpected: %+v", i+1, s.histogram, testHistogram(i))
+		}
+	}
+
+	if !series.samples[4].histogram.Equals(changed) {
+		t.Errorf("Last sample should be the histogram with changed buckets, got: %+v", series.samples[4].histogram)
+	}
+}
+
+func Test_head_latestSample(t *testing.T) {
+	head := NewHead()
+	lookback := int64(5 * 60 * 1000)
+	staleNaN := math.Float64frombits(value.StaleNaN)
+
+	head.Append(labelsLong, timestamp, 1)
+	head.Append(labelsLong, timestamp+15000, math.NaN())
+
+	if err := head.Append(labelsLong, timestamp+15000, staleNaN); !errors.Is(err, ErrDuplicateSampleForTimestamp) {
+		t.Errorf("Stale marker on the timestamp of a NaN should be a duplicate, got: %v", err)
+	}
+
+	if s, ok, err := head.LatestSample(labelsLong, timestamp+20000, lookback); err != nil || !ok || !math.IsNaN(s.value) {
+		t.Errorf("NaN sample should be returned like any other value, got: %v %v %v", s, ok, err)
+	}
+
+	if _, ok, _ := head.LatestSample(labelsLong, timestamp+15000+lookback, lookback); ok {
+		t.Errorf("Samples older than the lookback shouldn't be returned")
+	}
+
+	head.Append(labelsLong, timestamp+30000, staleNaN)
+
+	if _, ok, _ := head.LatestSample(labelsLong, timestamp+40000, lookback); ok {
+		t.Errorf("Nothing should be returned after the stale marker")
+	}
+
+	if s, ok, _ := head.LatestSample(labelsLong, timestamp+5000, lookback); !ok || s.value != 1 {
+		t.Errorf("Sample before the stale marker should be returned, got: %v %v", s, ok)
+	}
+
+	head.Append(labelsLong, timestamp+45000, 3)
+
+	if s, ok, _ := head.LatestSample(labelsLong, timestamp+50000, lookback); !ok || s.value != 3 {
+		t.Errorf("Series coming back after a stale marker should be returned, got: %v %v", s, ok)
+	}
+}
+
+func Test_head_truncate(t *testing.T) {
+	head := NewHead()
+
+	oldLabels := labels.FromStrings("__name__", "old", "job", "churn")
+	newLabels := labels.FromStrings("__name__", "new", "job", "churn")
+	blockStart := rangeForTimestamp(timestamp, DefaultChunkRange)
+
+	// Four chunks of the new series, the old one stops after the first hour
+	for i := range 480 {
+		ts := blockStart + int64(i)*15000
+		head.Append(newLabels, ts, float64(i))
+		if i < 240 {
+			head.Append(oldLabels, ts, float64(i))
+		}
+	}
+
+	stats := head.Truncate(blockStart + DefaultChunkRange/2)
+
+	if stats.SeriesRemoved != 1 {
+		t.Errorf("Expected 1 series removed, got %d", stats.SeriesRemoved)
+	}
+
+	// Two chunks of each series are older than an hour
+	if stats.ChunksRemoved != 4 {
+		t.Errorf("Expected 4 chunks removed, got %d", stats.ChunksRemoved)
+	}
+
+	if head.GetMemSeries(oldLabels) != nil {
+		t.Errorf("Series without samples newer than the head min time wasn't removed")
+	}
+
+	memSeries := head.GetMemSeries(newLabels)
+	if memSeries == nil {
+		t.Fatalf("Series with newer samples was removed")
+	}
+
+	if memSeries.headChunk.chunksListLength() != 2 {
+		t.Errorf("Expected 2 chunks left, got %d", memSeries.headChunk.chunksListLength())
+	}
+
+	if refs := head.postings.get("job", "churn"); len(refs) != 1 || refs[0] != memSeries.ref {
+		t.Errorf("Removed series wasn't removed from the postings: %v", refs)
+	}
+
+	if refs := head.postings.get("__name__", "old"); len(refs) != 0 {
+		t.Errorf("Postings of the removed series are left: %v", refs)
+	}
+
+	if err := head.Append(oldLabels, blockStart, 1); !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("Expected ErrOutOfBounds for sample older than the head min time, got: %v", err)
+	}
+}
+
+// BenchmarkHead_memoryPerSeries reports the heap used per series, 10 labels
+// each, most of them shared. Every string is a new copy, like the parser
+// makes them. Run with -tags slicelabels to compare with the labels kept as
+// a slice.
+func BenchmarkHead_memoryPerSeries(b *testing.B) {
+	const numSeries = 10000
+
+	scraped := func(s string) string {
+		return strings.Clone(s)
+	}
+
+	for range b.N {
+		runtime.GC()
+		var before runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		head := NewHead()
+		for i := range numSeries {
+			l := labels.FromStrings(
+				scraped("__name__"), scraped("http_requests_total"),
+				scraped("job"), scraped("api-server"),
+				scraped("instance"), fmt.Sprintf("10.0.%d.%d:9090", i/256%256, i%256),
+				scraped("method"), scraped([]string{"GET", "POST", "PUT", "DELETE"}[i%4]),
+				scraped("code"), scraped([]string{"200", "404", "500"}[i%3]),
+				scraped("handler"), fmt.Sprintf("/api/v1/handler/%d", i%50),
+				scraped("env"), scraped("production"),
+				scraped("region"), scraped("eu-west-1"),
+				scraped("cluster"), scraped("main"),
+				scraped("id"), strconv.Itoa(i),
+			)
+			head.Append(l, timestamp, float64(i))
+		}
+
+		runtime.GC()
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/numSeries, "B/series")
+		runtime.KeepAlive(head)
 	}
 }
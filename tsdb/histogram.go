@@ -0,0 +1,113 @@
+package tsdb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Span is a run of consecutive buckets. Offset is the number of empty buckets
+// between the previous span and this one, for the first span it's the index
+// of its first bucket.
+type Span struct {
+	Offset int32
+	Length uint32
+}
+
+// Histogram is a sparse native histogram with exponential buckets. Bucket
+// boundaries are powers of 2^(2^-Schema), only the buckets in the spans are
+// stored and their counts are delta encoded, so each count is the difference
+// to the previous bucket.
+type Histogram struct {
+	Schema        int32
+	ZeroThreshold float64
+	ZeroCount     uint64
+	Count         uint64
+	Sum           float64
+
+	PositiveSpans   []Span
+	NegativeSpans   []Span
+	PositiveBuckets []int64
+	NegativeBuckets []int64
+}
+
+var ErrInvalidHistogram = errors.New("invalid histogram")
+
+// Validate checks that the spans describe exactly the buckets present and
+// that no bucket has a negative count.
+func (h *Histogram) Validate() error {
+	if h.Schema < -4 || h.Schema > 8 {
+		return fmt.Errorf("%w: schema %d outside of [-4, 8]", ErrInvalidHistogram, h.Schema)
+	}
+
+	if err := validateBuckets(h.PositiveSpans, h.PositiveBuckets); err != nil {
+		return fmt.Errorf("%w: positive buckets: %w", ErrInvalidHistogram, err)
+	}
+
+	if err := validateBuckets(h.NegativeSpans, h.NegativeBuckets); err != nil {
+		return fmt.Errorf("%w: negative buckets: %w", ErrInvalidHistogram, err)
+	}
+
+	return nil
+}
+
+func validateBuckets(spans []Span, buckets []int64) error {
+	var spanBuckets uint32
+	for i, s := range spans {
+		if i > 0 && s.Offset < 0 {
+			return fmt.Errorf("span %d has negative offset %d", i, s.Offset)
+		}
+		spanBuckets += s.Length
+	}
+
+	if int(spanBuckets) != len(buckets) {
+		return fmt.Errorf("spans describe %d buckets, got %d", spanBuckets, len(buckets))
+	}
+
+	var count int64
+	for i, delta := range buckets {
+		count += delta
+		if count < 0 {
+			return fmt.Errorf("bucket %d has negative count %d", i, count)
+		}
+	}
+
+	return nil
+}
+
+func (h *Histogram) Copy() *Histogram {
+	c := *h
+	c.PositiveSpans = slices.Clone(h.PositiveSpans)
+	c.NegativeSpans = slices.Clone(h.NegativeSpans)
+	c.PositiveBuckets = slices.Clone(h.PositiveBuckets)
+	c.NegativeBuckets = slices.Clone(h.NegativeBuckets)
+	return &c
+}
+
+// Equals compares the histograms field by field, sums are compared by their
+// bits so NaN equals NaN.
+func (h *Histogram) Equals(o *Histogram) bool {
+	if h == nil || o == nil {
+		return h == o
+	}
+
+	return h.Schema == o.Schema &&
+		h.ZeroThreshold == o.ZeroThreshold &&
+		h.ZeroCount == o.ZeroCount &&
+		h.Count == o.Count &&
+		math.Float64bits(h.Sum) == math.Float64bits(o.Sum) &&
+		slices.Equal(h.PositiveSpans, o.PositiveSpans) &&
+		slices.Equal(h.NegativeSpans, o.NegativeSpans) &&
+		slices.Equal(h.PositiveBuckets, o.PositiveBuckets) &&
+		slices.Equal(h.NegativeBuckets, o.NegativeBuckets)
+}
+
+// sameLayout reports whether both histograms have the same buckets, which is
+// what a histogram chunk needs to hold them both.
+func (h *Histogram) sameLayout(o *Histogram) bool {
+	return h.Schema == o.Schema &&
+		h.ZeroThreshold == o.ZeroThreshold &&
+		slices.Equal(h.PositiveSpans, o.PositiveSpans) &&
+		slices.Equal(h.NegativeSpans, o.NegativeSpans)
+}
@@ -0,0 +1,367 @@
+package tsdb
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+func init() {
+	RegisterEncoding(EncHistogram,
+		func() Chunk { return NewHistogramChunk() },
+		func(b []byte) (Chunk, error) { return &HistogramChunk{b: bstream{stream: b}}, nil },
+	)
+}
+
+// HistogramChunk holds native histograms which all have the same buckets. The
+// bucket layout is written once, between the chunk header and the first
+// sample:
+//
+//	┌─────────────────┬─────────────────────┬────────────────┬────────────────┐
+//	│ schema <varint> │ zero threshold <64> │ positive spans │ negative spans │
+//	└─────────────────┴─────────────────────┴────────────────┴────────────────┘
+//
+// Spans are written as their number followed by offset and length varints.
+//
+// The first sample holds its timestamp, count and zero count as varints, the
+// sum as a raw float and then the delta encoded bucket counts. Samples after
+// it hold the timestamp delta, which turns into delta of delta from the third
+// sample on like in XORChunk, the count and zero count deltas, the sum XORed
+// with the previous one and for every bucket the difference to the previous
+// sample.
+type HistogramChunk struct {
+	b bstream
+}
+
+func NewHistogramChunk() *HistogramChunk {
+	return &HistogramChunk{b: bstream{stream: newChunkStream(EncHistogram)}}
+}
+
+func (c *HistogramChunk) Bytes() []byte {
+	return c.b.bytes()
+}
+
+func (c *HistogramChunk) Encoding() Encoding {
+	return EncHistogram
+}
+
+func (c *HistogramChunk) NumSamples() int {
+	return int(chunkNumSamples(c.b.stream))
+}
+
+func (c *HistogramChunk) Compact() {
+	c.b.compact()
+}
+
+func (c *HistogramChunk) Iterator() Iterator {
+	return newHistogramIterator(c.b.stream)
+}
+
+// Appender reads through the whole chunk to restore the state the previous
+// appender had after the last sample.
+func (c *HistogramChunk) Appender() (Appender, error) {
+	it := newHistogramIterator(c.b.stream)
+	for it.Next() != ValNone {
+	}
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+
+	if it.br.countBit == 0 {
+		c.b.count = 0
+	} else {
+		c.b.stream = c.b.stream[:it.br.countByte+1]
+		c.b.count = 8 - it.br.countBit
+	}
+
+	app := &histogramAppender{
+		b:         &c.b,
+		t:         it.t,
+		tDelta:    it.tDelta,
+		count:     it.count,
+		zeroCount: it.zeroCount,
+		sum:       it.sum,
+		leading:   it.leading,
+		trailing:  it.trailing,
+		pBuckets:  it.pBuckets,
+		nBuckets:  it.nBuckets,
+	}
+	if it.numRead > 0 {
+		app.layout = &it.layout
+	}
+
+	return app, nil
+}
+
+type histogramAppender struct {
+	b *bstream
+	// layout holds the schema, zero threshold and spans of the chunk, it's nil
+	// until the first sample is appended
+	layout *Histogram
+
+	t         int64
+	tDelta    int64
+	count     uint64
+	zeroCount uint64
+	sum       float64
+	leading   int
+	trailing  int
+	pBuckets  []int64
+	nBuckets  []int64
+}
+
+func (a *histogramAppender) Append(int64, float64) {
+	panic("appending a float to a histogram chunk")
+}
+
+// appendable reports whether the histogram has the bucket layout of the chunk,
+// a histogram with different buckets needs a new chunk.
+func (a *histogramAppender) appendable(h *Histogram) bool {
+	return a.layout == nil || a.layout.sameLayout(h)
+}
+
+func (a *histogramAppender) AppendHistogram(t int64, h *Histogram) {
+	num := chunkNumSamples(a.b.stream)
+
+	switch num {
+	case 0:
+		writeHistogramLayout(a.b, h)
+		a.layout = &Histogram{
+			Schema:        h.Schema,
+			ZeroThreshold: h.ZeroThreshold,
+			PositiveSpans: slices.Clone(h.PositiveSpans),
+			NegativeSpans: slices.Clone(h.NegativeSpans),
+		}
+		a.leading = unsetLeadingZeros
+
+		a.b.writeVarint(t)
+		a.b.writeUvarint(h.Count)
+		a.b.writeUvarint(h.ZeroCount)
+		a.b.writeBits(math.Float64bits(h.Sum), 64)
+		for _, bucket := range h.PositiveBuckets {
+			a.b.writeVarint(bucket)
+		}
+		for _, bucket := range h.NegativeBuckets {
+			a.b.writeVarint(bucket)
+		}
+	default:
+		tDelta := t - a.t
+		if num == 1 {
+			a.b.writeVarint(tDelta)
+		} else {
+			writeDod(a.b, tDelta-a.tDelta)
+		}
+		a.tDelta = tDelta
+
+		// Counts go down on counter resets, so the deltas are signed
+		a.b.writeVarint(int64(h.Count) - int64(a.count))
+		a.b.writeVarint(int64(h.ZeroCount) - int64(a.zeroCount))
+		xorWrite(a.b, h.Sum, a.sum, &a.leading, &a.trailing)
+		for i, bucket := range h.PositiveBuckets {
+			a.b.writeVarint(bucket - a.pBuckets[i])
+		}
+		for i, bucket := range h.NegativeBuckets {
+			a.b.writeVarint(bucket - a.nBuckets[i])
+		}
+	}
+
+	updateChunkHeader(a.b.stream, t)
+
+	a.t = t
+	a.count = h.Count
+	a.zeroCount = h.ZeroCount
+	a.sum = h.Sum
+	a.pBuckets = slices.Clone(h.PositiveBuckets)
+	a.nBuckets = slices.Clone(h.NegativeBuckets)
+}
+
+func writeHistogramLayout(b *bstream, h *Histogram) {
+	b.writeVarint(int64(h.Schema))
+	b.writeBits(math.Float64bits(h.ZeroThreshold), 64)
+
+	for _, spans := range [][]Span{h.PositiveSpans, h.NegativeSpans} {
+		b.writeUvarint(uint64(len(spans)))
+		for _, s := range spans {
+			b.writeVarint(int64(s.Offset))
+			b.writeUvarint(uint64(s.Length))
+		}
+	}
+}
+
+func readHistogramLayout(br *bstreamReader) (Histogram, error) {
+	layout := Histogram{
+		Schema:        int32(readVarint(br)),
+		ZeroThreshold: math.Float64frombits(bitsSliceToInt(br.nextBits(64))),
+	}
+
+	for _, spans := range []*[]Span{&layout.PositiveSpans, &layout.NegativeSpans} {
+		num := readUvarint(br)
+		if br.Err() != nil {
+			return Histogram{}, br.Err()
+		}
+
+		// Every span takes at least two bytes, more than that is corrupted
+		if num > uint64(len(br.b.stream)) {
+			return Histogram{}, fmt.Errorf("%d spans in a %d bytes chunk", num, len(br.b.stream))
+		}
+
+		for range num {
+			*spans = append(*spans, Span{
+				Offset: int32(readVarint(br)),
+				Length: uint32(readUvarint(br)),
+			})
+		}
+	}
+
+	if br.Err() != nil {
+		return Histogram{}, br.Err()
+	}
+
+	return layout, nil
+}
+
+// histogramIterator is the Iterator of HistogramChunk.
+type histogramIterator struct {
+	br      bstreamReader
+	header  chunkHeader
+	numRead int
+	err     error
+
+	layout    Histogram
+	t         int64
+	tDelta    int64
+	count     uint64
+	zeroCount uint64
+	sum       float64
+	leading   int
+	trailing  int
+	pBuckets  []int64
+	nBuckets  []int64
+}
+
+func newHistogramIterator(b []byte) *histogramIterator {
+	it := &histogramIterator{
+		br:      newBReader(bstream{stream: b}),
+		leading: unsetLeadingZeros,
+	}
+
+	header, err := readChunkHeader(b)
+	switch {
+	case err != nil:
+		it.err = err
+	case header.encoding != EncHistogram:
+		it.err = fmt.Errorf("%w: unexpected encoding %s", ErrInvalidChunk, header.encoding)
+	}
+
+	it.header = header
+	it.br.countByte = chunkHeaderSize
+
+	return it
+}
+
+func (it *histogramIterator) Next() ValueType {
+	if it.err != nil || it.numRead == int(it.header.numSamples) {
+		return ValNone
+	}
+
+	if it.numRead == 0 {
+		layout, err := readHistogramLayout(&it.br)
+		if err != nil {
+			it.err = fmt.Errorf("%w: reading bucket layout: %w", ErrInvalidChunk, err)
+			return ValNone
+		}
+		it.layout = layout
+		it.readFirstSample()
+	} else {
+		it.readSample()
+	}
+
+	if it.br.Err() != nil {
+		it.err = fmt.Errorf("%w: reading sample %d of %d: %w", ErrInvalidChunk, it.numRead+1, it.header.numSamples, it.br.Err())
+		return ValNone
+	}
+	it.numRead++
+
+	if (it.numRead == 1 && it.t != it.header.minTime) || (it.numRead == int(it.header.numSamples) && it.t != it.header.maxTime) {
+		it.err = fmt.Errorf("%w: samples don't match the header time range", ErrInvalidChunk)
+		return ValNone
+	}
+
+	return ValHistogram
+}
+
+func (it *histogramIterator) bucketsNum() (int, int) {
+	var positive, negative int
+	for _, s := range it.layout.PositiveSpans {
+		positive += int(s.Length)
+	}
+	for _, s := range it.layout.NegativeSpans {
+		negative += int(s.Length)
+	}
+	return positive, negative
+}
+
+func (it *histogramIterator) readFirstSample() {
+	it.t = readVarint(&it.br)
+	it.count = readUvarint(&it.br)
+	it.zeroCount = readUvarint(&it.br)
+	it.sum = math.Float64frombits(readUnencoded(&it.br))
+
+	positive, negative := it.bucketsNum()
+	if positive+negative > len(it.br.b.stream) {
+		it.br.err = fmt.Errorf("%d buckets in a %d bytes chunk", positive+negative, len(it.br.b.stream))
+		return
+	}
+
+	it.pBuckets = make([]int64, positive)
+	for i := range it.pBuckets {
+		it.pBuckets[i] = readVarint(&it.br)
+	}
+	it.nBuckets = make([]int64, negative)
+	for i := range it.nBuckets {
+		it.nBuckets[i] = readVarint(&it.br)
+	}
+}
+
+func (it *histogramIterator) readSample() {
+	if it.numRead == 1 {
+		it.tDelta = readVarint(&it.br)
+	} else {
+		it.tDelta += readDod(&it.br)
+	}
+	it.t += it.tDelta
+
+	it.count = uint64(int64(it.count) + readVarint(&it.br))
+	it.zeroCount = uint64(int64(it.zeroCount) + readVarint(&it.br))
+	it.sum = xorRead(&it.br, it.sum, &it.leading, &it.trailing)
+
+	for i := range it.pBuckets {
+		it.pBuckets[i] += readVarint(&it.br)
+	}
+	for i := range it.nBuckets {
+		it.nBuckets[i] += readVarint(&it.br)
+	}
+}
+
+func (it *histogramIterator) At() (int64, float64) {
+	panic("reading a float from a histogram chunk")
+}
+
+// AtHistogram returns a copy, the iterator keeps updating its buckets.
+func (it *histogramIterator) AtHistogram() (int64, *Histogram) {
+	return it.t, &Histogram{
+		Schema:          it.layout.Schema,
+		ZeroThreshold:   it.layout.ZeroThreshold,
+		ZeroCount:       it.zeroCount,
+		Count:           it.count,
+		Sum:             it.sum,
+		PositiveSpans:   slices.Clone(it.layout.PositiveSpans),
+		NegativeSpans:   slices.Clone(it.layout.NegativeSpans),
+		PositiveBuckets: slices.Clone(it.pBuckets),
+		NegativeBuckets: slices.Clone(it.nBuckets),
+	}
+}
+
+func (it *histogramIterator) Err() error {
+	return it.err
+}
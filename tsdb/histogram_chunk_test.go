@@ -0,0 +1,148 @@
+package tsdb
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"testing"
+)
+
+func testHistogram(i int) *Histogram {
+	return &Histogram{
+		Schema:        3,
+		ZeroThreshold: 0.001,
+		ZeroCount:     uint64(2 + i),
+		Count:         uint64(20 + 5*i),
+		Sum:           18.4 * float64(i+1),
+		PositiveSpans: []Span{{Offset: 0, Length: 2}, {Offset: 1, Length: 2}},
+		NegativeSpans: []Span{{Offset: -2, Length: 1}},
+		// Delta encoded counts: 1, 3, 2, 4 on the first sample
+		PositiveBuckets: []int64{1, 2, -1, int64(2 + i)},
+		NegativeBuckets: []int64{int64(3 + i)},
+	}
+}
+
+func Test_histogram_chunk_roundTrip(t *testing.T) {
+	chunk := NewHistogramChunk()
+	app, err := chunk.Appender()
+	if err != nil {
+		t.Fatalf("Failed to get an appender: %v", err)
+	}
+
+	var expected []*Histogram
+	for i := range 10 {
+		h := testHistogram(i)
+		// Counter reset in the middle and a NaN sum
+		if i == 5 {
+			h.Count, h.ZeroCount = 1, 0
+		}
+		if i == 7 {
+			h.Sum = math.NaN()
+		}
+		expected = append(expected, h)
+		app.AppendHistogram(int64(i)*15000+int64(i%3), h)
+	}
+
+	it := chunk.Iterator()
+	i := 0
+	for it.Next() == ValHistogram {
+		ts, h := it.AtHistogram()
+		if ts != int64(i)*15000+int64(i%3) {
+			t.Errorf("Sample %d: expected timestamp %d, got %d", i, int64(i)*15000+int64(i%3), ts)
+		}
+		if !h.Equals(expected[i]) {
+			t.Errorf("Sample %d: histogram not equal: \ngot: %+v \nexpected: %+v", i, h, expected[i])
+		}
+		i++
+	}
+
+	if it.Err() != nil {
+		t.Fatalf("Iterating the chunk failed: %v", it.Err())
+	}
+
+	if i != 10 {
+		t.Errorf("Expected 10 samples, got %d", i)
+	}
+}
+
+func Test_histogram_chunk_fromData(t *testing.T) {
+	chunk := NewHistogramChunk()
+	app, _ := chunk.Appender()
+	for i := range 3 {
+		app.AppendHistogram(int64(i)*1000, testHistogram(i))
+	}
+
+	restored, err := FromData(slices.Clone(chunk.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to restore the chunk: %v", err)
+	}
+
+	if restored.Encoding() != EncHistogram {
+		t.Fatalf("Expected histogram encoding, got %s", restored.Encoding())
+	}
+
+	restoredApp, err := restored.Appender()
+	if err != nil {
+		t.Fatalf("Failed to get an appender for the restored chunk: %v", err)
+	}
+
+	if !restoredApp.(*histogramAppender).appendable(testHistogram(3)) {
+		t.Errorf("Histogram with the same layout should be appendable")
+	}
+
+	changed := testHistogram(3)
+	changed.Schema = 2
+	if restoredApp.(*histogramAppender).appendable(changed) {
+		t.Errorf("Histogram with a different schema shouldn't be appendable")
+	}
+
+	restoredApp.AppendHistogram(3000, testHistogram(3))
+
+	it := restored.Iterator()
+	i := 0
+	for it.Next() == ValHistogram {
+		if _, h := it.AtHistogram(); !h.Equals(testHistogram(i)) {
+			t.Errorf("Sample %d: histogram not equal: \ngot: %+v \nexpected: %+v", i, h, testHistogram(i))
+		}
+		i++
+	}
+
+	if it.Err() != nil || i != 4 {
+		t.Errorf("Expected 4 samples without error, got %d samples and error: %v", i, it.Err())
+	}
+}
+
+func Test_histogram_chunk_readCorrupt(t *testing.T) {
+	chunk := NewHistogramChunk()
+	app, _ := chunk.Appender()
+	for i := range 3 {
+		app.AppendHistogram(int64(i)*1000, testHistogram(i))
+	}
+
+	truncated := chunk.Bytes()[:len(chunk.Bytes())-4]
+	it := newHistogramIterator(truncated)
+	for it.Next() != ValNone {
+	}
+
+	if !errors.Is(it.Err(), ErrInvalidChunk) {
+		t.Errorf("Expected ErrInvalidChunk, got: %v", it.Err())
+	}
+}
+
+func Test_histogram_validate(t *testing.T) {
+	if err := testHistogram(0).Validate(); err != nil {
+		t.Errorf("Valid histogram failed validation: %v", err)
+	}
+
+	missingBucket := testHistogram(0)
+	missingBucket.PositiveBuckets = missingBucket.PositiveBuckets[1:]
+
+	negativeCount := testHistogram(0)
+	negativeCount.PositiveBuckets[1] = -5
+
+	for name, h := range map[string]*Histogram{"missing bucket": missingBucket, "negative count": negativeCount} {
+		if err := h.Validate(); !errors.Is(err, ErrInvalidHistogram) {
+			t.Errorf("%s: expected ErrInvalidHistogram, got: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package tsdb
+
+import (
+	"math"
+	"sort"
+)
+
+// oooChunk holds the out-of-order samples of a series. XOR encoding only
+// works for samples in order, so these are kept sorted in a plain slice and
+// merged with the in-order chunks when the series is read.
+type oooChunk struct {
+	samples []Sample
+}
+
+// Insert puts the sample in its place in the chunk. It returns false if there
+// is already a sample with the same timestamp and a different value.
+func (o *oooChunk) Insert(t int64, v float64) bool {
+	i := sort.Search(len(o.samples), func(i int) bool { return o.samples[i].timestamp >= t })
+
+	if i < len(o.samples) && o.samples[i].timestamp == t {
+		return math.Float64bits(o.samples[i].value) == math.Float64bits(v)
+	}
+
+	o.samples = append(o.samples, Sample{})
+	copy(o.samples[i+1:], o.samples[i:])
+	o.samples[i] = Sample{timestamp: t, value: v}
+
+	return true
+}
+
+// Get returns the sample at timestamp t, if there is one.
+func (o *oooChunk) Get(t int64) (Sample, bool) {
+	i := sort.Search(len(o.samples), func(i int) bool { return o.samples[i].timestamp >= t })
+	if i < len(o.samples) && o.samples[i].timestamp == t {
+		return o.samples[i], true
+	}
+	return Sample{}, false
+}
+
+// truncateBefore drops the samples older than mint.
+func (o *oooChunk) truncateBefore(mint int64) {
+	i := sort.Search(len(o.samples), func(i int) bool { return o.samples[i].timestamp >= mint })
+	o.samples = o.samples[i:]
+}
+
+func (o *oooChunk) NumSamples() int {
+	return len(o.samples)
+}
+
+// mergeSamples merges two slices sorted by timestamp, if both have a sample
+// for the same timestamp the one from a is kept.
+func mergeSamples(a, b []Sample) []Sample {
+	merged := make([]Sample, 0, len(a)+len(b))
+
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0].timestamp < b[0].timestamp:
+			merged = append(merged, a[0])
+			a = a[1:]
+		case a[0].timestamp > b[0].timestamp:
+			merged = append(merged, b[0])
+			b = b[1:]
+		default:
+			merged = append(merged, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
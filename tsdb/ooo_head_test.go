@@ -0,0 +1,51 @@
+package tsdb
+
+import "testing"
+
+func Test_ooo_insert(t *testing.T) {
+	chunk := oooChunk{}
+
+	for _, ts := range []int64{30, 10, 20, 50, 40} {
+		if !chunk.Insert(ts, float64(ts)) {
+			t.Errorf("Sample with timestamp %d wasn't inserted", ts)
+		}
+	}
+
+	if chunk.Insert(20, 21) {
+		t.Errorf("Sample with duplicate timestamp and different value was inserted")
+	}
+
+	if !chunk.Insert(20, 20) {
+		t.Errorf("Sample with duplicate timestamp and the same value should be accepted")
+	}
+
+	if chunk.NumSamples() != 5 {
+		t.Fatalf("Expected 5 samples, got %d", chunk.NumSamples())
+	}
+
+	for i, s := range chunk.samples {
+		if s.timestamp != int64((i+1)*10) {
+			t.Errorf("Samples not sorted: expected timestamp %d, got %d", (i+1)*10, s.timestamp)
+		}
+	}
+}
+
+func Test_ooo_mergeSamples(t *testing.T) {
+	inOrder := []Sample{{timestamp: 10, value: 1}, {timestamp: 30, value: 3}, {timestamp: 50, value: 5}}
+	ooo := []Sample{{timestamp: 20, value: 2}, {timestamp: 30, value: 30}, {timestamp: 40, value: 4}}
+
+	merged := mergeSamples(inOrder, ooo)
+	expected := []Sample{
+		{timestamp: 10, value: 1}, {timestamp: 20, value: 2}, {timestamp: 30, value: 3}, {timestamp: 40, value: 4}, {timestamp: 50, value: 5},
+	}
+
+	if len(merged) != len(expected) {
+		t.Fatalf("Expected %d samples, got %d", len(expected), len(merged))
+	}
+
+	for i := range expected {
+		if merged[i] != expected[i] {
+			t.Errorf("Sample %d: expected %v, got %v", i, expected[i], merged[i])
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package tsdb
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+// memPostings is the inverted index of the head, it maps every label name and
+// value pair to the refs of the series having it. Refs only ever grow, so
+// appending keeps the lists sorted.
+type memPostings struct {
+	m map[string]map[string][]uint64
+}
+
+func newMemPostings() *memPostings {
+	return &memPostings{m: make(map[string]map[string][]uint64)}
+}
+
+// add clones the names and values it hasn't seen yet, they'd keep the labels
+// of the whole series in memory otherwise.
+func (p *memPostings) add(ref uint64, l labels.Labels) {
+	l.Range(func(label labels.Label) {
+		values, ok := p.m[label.Name]
+		if !ok {
+			values = make(map[string][]uint64)
+			p.m[strings.Clone(label.Name)] = values
+		}
+
+		refs, ok := values[label.Value]
+		if !ok {
+			values[strings.Clone(label.Value)] = []uint64{ref}
+			return
+		}
+		values[label.Value] = append(refs, ref)
+	})
+}
+
+func (p *memPostings) get(name, value string) []uint64 {
+	return p.m[name][value]
+}
+
+// delete removes the refs from all the lists, dropping the lists and names
+// left empty.
+func (p *memPostings) delete(deleted map[uint64]struct{}) {
+	if len(deleted) == 0 {
+		return
+	}
+
+	for name, values := range p.m {
+		for value, refs := range values {
+			refs = slices.DeleteFunc(refs, func(ref uint64) bool {
+				_, ok := deleted[ref]
+				return ok
+			})
+
+			if len(refs) == 0 {
+				delete(values, value)
+			} else {
+				values[value] = refs
+			}
+		}
+
+		if len(values) == 0 {
+			delete(p.m, name)
+		}
+	}
+}
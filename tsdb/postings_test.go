@@ -0,0 +1,38 @@
+package tsdb
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/pomyslowynick/scratcheus/labels"
+)
+
+func Test_postings_addDelete(t *testing.T) {
+	p := newMemPostings()
+
+	p.add(1, labels.FromStrings("__name__", "up", "job", "node"))
+	p.add(2, labels.FromStrings("__name__", "up", "job", "prometheus"))
+	p.add(3, labels.FromStrings("__name__", "up", "job", "node", "zone", "a"))
+
+	if refs := p.get("__name__", "up"); !slices.Equal(refs, []uint64{1, 2, 3}) {
+		t.Errorf("Expected refs 1, 2, 3 for up, got %v", refs)
+	}
+
+	if refs := p.get("job", "node"); !slices.Equal(refs, []uint64{1, 3}) {
+		t.Errorf("Expected refs 1, 3 for job node, got %v", refs)
+	}
+
+	p.delete(map[uint64]struct{}{2: {}, 3: {}})
+
+	if refs := p.get("__name__", "up"); !slices.Equal(refs, []uint64{1}) {
+		t.Errorf("Expected ref 1 for up after delete, got %v", refs)
+	}
+
+	if _, ok := p.m["job"]["prometheus"]; ok {
+		t.Errorf("Empty postings list wasn't dropped")
+	}
+
+	if _, ok := p.m["zone"]; ok {
+		t.Errorf("Label name without values wasn't dropped")
+	}
+}
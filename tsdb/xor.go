@@ -25,110 +25,207 @@ package tsdb
 
 import (
 	"encoding/binary"
+	"fmt"
 	"math"
 	"math/bits"
+
+	"github.com/pomyslowynick/scratcheus/value"
 )
 
+func init() {
+	RegisterEncoding(EncXOR,
+		func() Chunk { return NewXORChunk() },
+		func(b []byte) (Chunk, error) { return &XORChunk{b: bstream{stream: b}}, nil },
+	)
+}
+
+// XORChunk holds float samples encoded as in the Gorilla paper, timestamps as
+// deltas of deltas and values XORed with the previous value.
+type XORChunk struct {
+	b bstream
+}
+
+func NewXORChunk() *XORChunk {
+	return &XORChunk{b: bstream{stream: newChunkStream(EncXOR)}}
+}
+
+func (c *XORChunk) Bytes() []byte {
+	return c.b.bytes()
+}
+
+func (c *XORChunk) Encoding() Encoding {
+	return EncXOR
+}
+
+func (c *XORChunk) NumSamples() int {
+	return int(chunkNumSamples(c.b.stream))
+}
+
+func (c *XORChunk) Compact() {
+	c.b.compact()
+}
+
+func (c *XORChunk) Iterator() Iterator {
+	return NewXorReader(c.b.stream)
+}
+
+// Appender reads through the whole chunk to restore the state the previous
+// appender had after the last sample.
+func (c *XORChunk) Appender() (Appender, error) {
+	it := NewXorReader(c.b.stream)
+	for it.Next() != ValNone {
+	}
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+
+	// Chunk loaded from bytes doesn't know how much of its last byte is used
+	if it.br.countBit == 0 {
+		c.b.count = 0
+	} else {
+		c.b.stream = c.b.stream[:it.br.countByte+1]
+		c.b.count = 8 - it.br.countBit
+	}
+
+	return &xorAppender{
+		b:              &c.b,
+		t:              it.timestamp,
+		v:              it.value,
+		ts_delta:       it.ts_delta,
+		leading_zeros:  it.leadingZeros,
+		trailing_zeros: it.trailingZeros,
+	}, nil
+}
+
 type xorAppender struct {
-	b              bstream
-	t              uint64
+	b              *bstream
+	t              int64
 	v              float64
 	leading_zeros  int
 	trailing_zeros int
-	ts_delta       uint64
+	ts_delta       int64
 }
 
 func (x *xorAppender) Compact() {
-	if l := len(x.b.stream); cap(x.b.stream) > l+32 {
-		buf := make([]byte, l)
-		copy(buf, x.b.stream)
-		x.b.stream = buf
-	}
+	x.b.compact()
 }
 
-func (x *xorAppender) Append(t uint64, v float64) {
-	num := binary.BigEndian.Uint16(x.b.stream)
+func (x *xorAppender) Append(t int64, v float64) {
+	num := chunkNumSamples(x.b.stream)
 
 	switch num {
 	case 0:
-		x.b.writeBits(t, 64)
+		x.b.writeVarint(t)
 		x.b.writeBits(math.Float64bits(v), 64)
 	case 1:
 		ts_delta := t - x.t
-		x.b.writeBits(ts_delta, 64)
+		x.b.writeVarint(ts_delta)
 		x.ts_delta = ts_delta
 
 		x.writeVDelta(v)
 	default:
 		ts_delta := t - x.t
-		dod := int64(ts_delta - x.ts_delta)
+		writeDod(x.b, ts_delta-x.ts_delta)
 		x.ts_delta = ts_delta
-		switch {
-		case dod == 0:
-			x.b.writeBit(zero)
-		case bitsRange(dod, 7):
-			x.b.writeBits(0b10, 2)
-			x.b.writeBits(uint64(dod), 7)
-		case bitsRange(dod, 9):
-			x.b.writeBits(0b110, 3)
-			x.b.writeBits(uint64(dod), 9)
-		case bitsRange(dod, 12):
-			x.b.writeBits(0b1110, 4)
-			x.b.writeBits(uint64(dod), 12)
-		default:
-			x.b.writeBits(0b1111, 4)
-			x.b.writeBits(uint64(dod), 32)
-		}
+
 		x.writeVDelta(v)
 	}
 
-	num += 1
-	x.b.stream[0] = byte(num >> 8)
-	x.b.stream[1] = byte(num)
+	updateChunkHeader(x.b.stream, t)
 
 	x.t = t
 	x.v = v
 }
 
+func (x *xorAppender) AppendHistogram(int64, *Histogram) {
+	panic("appending a histogram to an XOR chunk")
+}
+
 func (x *xorAppender) writeVDelta(v float64) {
-	delta := math.Float64bits(v) ^ math.Float64bits(x.v)
+	xorWrite(x.b, v, x.v, &x.leading_zeros, &x.trailing_zeros)
+}
+
+// writeDod writes a timestamp delta of delta into the smallest bucket it
+// fits in, the bucket is marked by the number of leading ones.
+func writeDod(b *bstream, dod int64) {
+	switch {
+	case dod == 0:
+		b.writeBit(zero)
+	case bitsRange(dod, 7):
+		b.writeBits(0b10, 2)
+		b.writeBits(uint64(dod), 7)
+	case bitsRange(dod, 9):
+		b.writeBits(0b110, 3)
+		b.writeBits(uint64(dod), 9)
+	case bitsRange(dod, 12):
+		b.writeBits(0b1110, 4)
+		b.writeBits(uint64(dod), 12)
+	default:
+		b.writeBits(0b1111, 4)
+		b.writeBits(uint64(dod), 64)
+	}
+}
+
+// xorWrite writes v XORed with the previous value. The leading and trailing
+// zeros of the last written window are kept between calls, so the window can
+// be reused when the next value fits into it.
+func xorWrite(b *bstream, v, previous float64, leading, trailing *int) {
+	delta := math.Float64bits(v) ^ math.Float64bits(previous)
 	if delta == 0 {
-		x.b.writeBit(zero)
+		b.writeBit(zero)
 		return
 	}
 
-	x.b.writeBit(one)
+	b.writeBit(one)
 
 	leading_zeros := bits.LeadingZeros64(delta)
 	trailing_zeros := bits.TrailingZeros64(delta)
 
-	if leading_zeros == x.leading_zeros && trailing_zeros == x.trailing_zeros {
-		x.b.writeBit(zero)
-		x.b.writeBits(delta, 64-(leading_zeros+trailing_zeros))
+	// Leading zeros count is written on 5 bits, so it can't go over 31
+	if leading_zeros >= 32 {
+		leading_zeros = 31
+	}
+
+	// Reuse the previous window if the meaningful bits fit into it
+	if *leading != unsetLeadingZeros && leading_zeros >= *leading && trailing_zeros >= *trailing {
+		b.writeBit(zero)
+		b.writeBits(delta>>*trailing, 64-(*leading+*trailing))
 		return
 	}
 
-	x.b.writeBit(one)
-	x.b.writeBits(uint64(leading_zeros), 5)
-	x.b.writeBits(uint64(64-(leading_zeros+trailing_zeros)), 6)
-	x.b.writeBits(delta>>trailing_zeros, 64-(leading_zeros+trailing_zeros))
+	// 64 significant bits don't fit into 6 bits, they're written as 0 and the
+	// reader turns it back into 64
+	sigbits := 64 - (leading_zeros + trailing_zeros)
+	b.writeBit(one)
+	b.writeBits(uint64(leading_zeros), 5)
+	b.writeBits(uint64(sigbits), 6)
+	b.writeBits(delta>>trailing_zeros, sigbits)
 
-	x.leading_zeros = leading_zeros
-	x.trailing_zeros = trailing_zeros
+	*leading = leading_zeros
+	*trailing = trailing_zeros
 }
 
 func (x *xorAppender) Series() []byte {
 	return x.b.stream
 }
 func (x *xorAppender) SamplesNum() int {
-	return int((int16(x.b.stream[0]) << 8) + int16(x.b.stream[1]))
+	return int(chunkNumSamples(x.b.stream))
 }
 
+// unsetLeadingZeros marks that no value delta has been written yet, so there's
+// no window of meaningful bits to reuse
+const unsetLeadingZeros = 0xff
+
+// xorReader is the Iterator of XORChunk, it validates the samples against the
+// chunk header as it goes.
 type xorReader struct {
-	stream bstream
+	br      bstreamReader
+	header  chunkHeader
+	numRead int
+	err     error
 
-	timestamp     uint64
-	ts_delta      uint64
+	timestamp     int64
+	ts_delta      int64
 	value         float64
 	leadingZeros  int
 	trailingZeros int
@@ -136,92 +233,162 @@ type xorReader struct {
 
 type Sample struct {
 	value     float64
-	timestamp uint64
+	histogram *Histogram
+	timestamp int64
 }
 
-type Series struct {
-	samples []Sample
+func (s Sample) T() int64 {
+	return s.timestamp
 }
 
-func NewXorReader(s bstream) xorReader {
-	return xorReader{stream: s}
+func (s Sample) F() float64 {
+	return s.value
 }
 
-// Refactor this function, turn it into smaller functions
-func (x *xorReader) readSeries() Series {
-	var samples []Sample
+// H is nil for float samples.
+func (s Sample) H() *Histogram {
+	return s.histogram
+}
 
-	si := NewIterator(x.stream)
+// isStale reports whether the sample is a stale marker, for histograms the
+// marker is in the sum.
+func (s Sample) isStale() bool {
+	if s.histogram != nil {
+		return value.IsStaleNaN(s.histogram.Sum)
+	}
+	return value.IsStaleNaN(s.value)
+}
 
-	samplesNum := int((int16(si.nextByte()) << 8) + int16(si.nextByte()))
+type Series struct {
+	samples []Sample
+}
 
-	//  I don't really like this switch statement, but it seems clearer than if statements + returns
-	switch {
-	case samplesNum == 0:
-		// theoretically impossible, any series should should have this value set
-		return Series{}
-	case samplesNum == 1:
-		samples = append(samples, x.readFirstSample(&si))
-		return Series{samples: samples}
-	case samplesNum == 2:
-		samples = append(samples, x.readFirstSample(&si), x.readSecondSample(&si))
-		return Series{samples: samples}
-	case samplesNum > 2:
-		samples = append(samples, x.readFirstSample(&si), x.readSecondSample(&si))
+func NewXorReader(b []byte) *xorReader {
+	x := &xorReader{
+		br:           newBReader(bstream{stream: b}),
+		leadingZeros: unsetLeadingZeros,
 	}
 
-	for i := 2; i != samplesNum; i++ {
-		samples = append(samples, x.readSamples(&si))
+	header, err := readChunkHeader(b)
+	switch {
+	case err != nil:
+		x.err = err
+	case header.encoding != EncXOR:
+		x.err = fmt.Errorf("%w: unexpected encoding %s", ErrInvalidChunk, header.encoding)
 	}
 
-	return Series{samples: samples}
+	x.header = header
+	x.br.countByte = chunkHeaderSize
+
+	return x
 }
 
-func readUnencoded(si *Iterator) uint64 {
-	var tempValue uint64
+func (x *xorReader) Next() ValueType {
+	if x.err != nil || x.numRead == int(x.header.numSamples) {
+		return ValNone
+	}
+
+	switch x.numRead {
+	case 0:
+		x.readFirstSample(&x.br)
+	case 1:
+		x.readSecondSample(&x.br)
+	default:
+		x.readSamples(&x.br)
+	}
 
-	bytes := si.nextBytes(8)
-	for i, byt := range bytes {
-		tempValue += uint64(byt) << ((7 - i) * 8)
+	if x.br.Err() != nil {
+		x.err = fmt.Errorf("%w: reading sample %d of %d: %w", ErrInvalidChunk, x.numRead+1, x.header.numSamples, x.br.Err())
+		return ValNone
 	}
+	x.numRead++
 
-	return tempValue
+	if (x.numRead == 1 && x.timestamp != x.header.minTime) || (x.numRead == int(x.header.numSamples) && x.timestamp != x.header.maxTime) {
+		x.err = fmt.Errorf("%w: samples don't match the header time range", ErrInvalidChunk)
+		return ValNone
+	}
+
+	return ValFloat
 }
 
-func (x *xorReader) readFirstSample(si *Iterator) Sample {
+func (x *xorReader) At() (int64, float64) {
+	return x.timestamp, x.value
+}
 
-	x.timestamp = readUnencoded(si)
+func (x *xorReader) AtHistogram() (int64, *Histogram) {
+	panic("reading a histogram from an XOR chunk")
+}
 
-	tempValue := readUnencoded(si)
+func (x *xorReader) Err() error {
+	return x.err
+}
 
-	x.leadingZeros = bits.LeadingZeros64(tempValue)
-	x.trailingZeros = bits.TrailingZeros64(tempValue)
+func (x *xorReader) readSeries() (Series, error) {
+	samples := make([]Sample, 0, x.header.numSamples)
 
-	x.value = math.Float64frombits(tempValue)
+	for x.Next() != ValNone {
+		t, v := x.At()
+		samples = append(samples, Sample{timestamp: t, value: v})
+	}
 
-	return Sample{
-		timestamp: x.timestamp,
-		value:     x.value,
+	if x.Err() != nil {
+		return Series{}, x.Err()
 	}
+
+	return Series{samples: samples}, nil
+}
+
+func readUnencoded(si *bstreamReader) uint64 {
+	return bitsSliceToInt(si.nextBits(64))
+}
+
+func readVarint(si *bstreamReader) int64 {
+	v, err := binary.ReadVarint(si)
+	if err != nil && si.err == nil {
+		si.err = err
+	}
+
+	return v
+}
+
+func readUvarint(si *bstreamReader) uint64 {
+	v, err := binary.ReadUvarint(si)
+	if err != nil && si.err == nil {
+		si.err = err
+	}
+
+	return v
+}
+
+func (x *xorReader) readFirstSample(si *bstreamReader) {
+
+	x.timestamp = readVarint(si)
+
+	x.value = math.Float64frombits(readUnencoded(si))
 }
 
-func (x *xorReader) readSecondSample(si *Iterator) Sample {
+func (x *xorReader) readSecondSample(si *bstreamReader) {
 
 	// Second tuple is always the first timestamp delta and xored value
-	x.ts_delta = readUnencoded(si)
+	x.ts_delta = readVarint(si)
 	x.timestamp = x.timestamp + x.ts_delta
 
 	x.value = x.readXorEncodedValue(si)
+}
 
-	return Sample{
-		timestamp: x.timestamp,
-		value:     x.value,
-	}
+func (x *xorReader) readSamples(si *bstreamReader) {
+	tsDod := readDod(si)
+
+	x.timestamp = x.timestamp + x.ts_delta + tsDod
+	x.ts_delta = x.ts_delta + tsDod
+
+	// Read rest of the values
+	x.value = x.readXorEncodedValue(si)
 }
 
-func (x *xorReader) readSamples(si *Iterator) Sample {
+func readDod(si *bstreamReader) int64 {
 	//   Timestamps after first delta are deltas of deltas with variable encoding length
-	var tsDod uint64
+	var tsDod int64
 	tsDodFirstBit := si.nextBit()
 
 	// not sure if we can simplify this function, will look up source
@@ -233,22 +400,21 @@ func (x *xorReader) readSamples(si *Iterator) Sample {
 		switch tsDodSecondBit {
 		case zero:
 			tempDod := si.nextBits(7)
-			tsDod = bitsSliceToInt(tempDod)
+			tsDod = signExtend(bitsSliceToInt(tempDod), 7)
 		case one:
 			tsDodThirdBit := si.nextBit()
 			switch tsDodThirdBit {
 			case zero:
 				tempDod := si.nextBits(9)
-				tsDod = bitsSliceToInt(tempDod)
+				tsDod = signExtend(bitsSliceToInt(tempDod), 9)
 			case one:
 				tsDodFourthBit := si.nextBit()
 				switch tsDodFourthBit {
 				case zero:
 					tempDod := si.nextBits(12)
-					tsDod = bitsSliceToInt(tempDod)
+					tsDod = signExtend(bitsSliceToInt(tempDod), 12)
 				case one:
-					tempDod := si.nextBits(32)
-					tsDod = bitsSliceToInt(tempDod)
+					tsDod = int64(bitsSliceToInt(si.nextBits(64)))
 
 				}
 			}
@@ -256,19 +422,14 @@ func (x *xorReader) readSamples(si *Iterator) Sample {
 
 	}
 
-	x.timestamp = x.timestamp + x.ts_delta + tsDod
-	x.ts_delta = x.ts_delta + tsDod
-
-	// Read rest of the values
-	x.value = x.readXorEncodedValue(si)
+	return tsDod
+}
 
-	return Sample{
-		timestamp: x.timestamp,
-		value:     x.value,
-	}
+func (x *xorReader) readXorEncodedValue(si *bstreamReader) float64 {
+	return xorRead(si, x.value, &x.leadingZeros, &x.trailingZeros)
 }
 
-func (x *xorReader) readXorEncodedValue(si *Iterator) float64 {
+func xorRead(si *bstreamReader, previous float64, leading, trailing *int) float64 {
 
 	isDeltaZero := !bool(si.nextBit())
 
@@ -278,34 +439,50 @@ func (x *xorReader) readXorEncodedValue(si *Iterator) float64 {
 		case controlBit:
 			leadingZeros := bitsSliceToInt(si.nextBits(5))
 			valueLen := bitsSliceToInt(si.nextBits(6))
+			if valueLen == 0 {
+				valueLen = 64
+			}
+			if leadingZeros+valueLen > 64 {
+				si.err = fmt.Errorf("%d leading zeros and %d significant bits", leadingZeros, valueLen)
+				return previous
+			}
 			xoredValue := bitsSliceToInt(si.nextBits(int(valueLen)))
 			trailingZeros := 64 - (leadingZeros + valueLen)
-			decodedValue := math.Float64frombits(math.Float64bits(x.value) ^ (xoredValue << trailingZeros))
-			x.leadingZeros = int(leadingZeros)
-			x.trailingZeros = int(trailingZeros)
+			decodedValue := math.Float64frombits(math.Float64bits(previous) ^ (xoredValue << trailingZeros))
+			*leading = int(leadingZeros)
+			*trailing = int(trailingZeros)
 
 			return decodedValue
 
 		case !controlBit:
-			sigBits := 64 - x.leadingZeros - x.trailingZeros
-			xoredValue := si.nextBits(sigBits)
-
-			xoredShiftedValue := bitsSliceToInt(xoredValue)
-			xoredAsFloat := math.Float64frombits(xoredShiftedValue)
+			if *leading == unsetLeadingZeros {
+				si.err = fmt.Errorf("value window reused before it was set")
+				return previous
+			}
+			sigBits := 64 - *leading - *trailing
+			xoredValue := bitsSliceToInt(si.nextBits(sigBits))
 
-			return xoredAsFloat
+			return math.Float64frombits(math.Float64bits(previous) ^ (xoredValue << *trailing))
 		}
 
 	}
 
 	// If delta is zero then we return last value
-	return x.value
+	return previous
 }
 
 func bitsRange(v int64, nbits int) bool {
 	return 1<<(nbits-1) >= v && -((1<<(nbits-1))-1) <= v
 }
 
+// signExtend turns nbits long two's complement value back into an int64
+func signExtend(v uint64, nbits int) int64 {
+	if v > 1<<(nbits-1) {
+		return int64(v) - 1<<nbits
+	}
+	return int64(v)
+}
+
 func bitsSliceToInt(bits []bit) uint64 {
 	var bitsAsInt uint64
 
@@ -318,6 +495,7 @@ func bitsSliceToInt(bits []bit) uint64 {
 	return bitsAsInt
 }
 
-func NewAppender() xorAppender {
-	return xorAppender{b: bstream{stream: make([]byte, 2)}}
+func NewAppender() *xorAppender {
+	c := NewXORChunk()
+	return &xorAppender{b: &c.b, leading_zeros: unsetLeadingZeros}
 }
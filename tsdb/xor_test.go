@@ -1,22 +1,29 @@
 package tsdb
 
 import (
+	"errors"
+	"math"
 	"slices"
 	"testing"
 	"time"
+
+	"github.com/pomyslowynick/scratcheus/value"
 )
 
 func Test_xor_append(t *testing.T) {
-	appender := xorAppender{
-		b: bstream{stream: make([]byte, 2)},
-	}
+	appender := NewAppender()
 
 	// 27th of April 2025, 12:10:10, 10ns, UTC
-	// 1745755810
+	// 1745755810000
 	date := time.Date(2025, time.April, 27, 12, 10, 10, 10, time.UTC)
-	timestamp := uint64(date.Unix())
+	timestamp := date.UnixMilli()
 	value := 2.75231
-	encodedSample := []byte{0, 1, 0, 0, 0, 0, 104, 14, 30, 162, 64, 6, 4, 187, 26, 243, 161, 77}
+	encodedSample := []byte{
+		// Header: encoding, number of samples, min and max time
+		1, 0, 0, 0, 1, 0, 0, 1, 150, 119, 39, 168, 208, 0, 0, 1, 150, 119, 39, 168, 208,
+		// Varint timestamp and the value
+		160, 163, 189, 242, 206, 101, 64, 6, 4, 187, 26, 243, 161, 77,
+	}
 
 	appender.Append(timestamp, value)
 
@@ -46,14 +53,12 @@ func Test_xor_append(t *testing.T) {
 }
 
 func Test_xor_read(t *testing.T) {
-	appender := xorAppender{
-		b: bstream{stream: make([]byte, 2)},
-	}
+	appender := NewAppender()
 
 	// 27th of April 2025, 12:10:10, 10ns, UTC
-	// 1745755810
+	// 1745755810000
 	date := time.Date(2025, time.April, 27, 12, 10, 10, 10, time.UTC)
-	timestamp := uint64(date.Unix())
+	timestamp := date.UnixMilli()
 	value := 2.75231
 
 	appender.Append(timestamp, value)
@@ -66,8 +71,11 @@ func Test_xor_read(t *testing.T) {
 
 	appender.Append(timestamp+60, value+2)
 
-	reader := NewXorReader(appender.b)
-	retrievedSeries := reader.readSeries()
+	reader := NewXorReader(appender.Series())
+	retrievedSeries, err := reader.readSeries()
+	if err != nil {
+		t.Fatalf("Failed to read the series: %v", err)
+	}
 
 	for i, v := range retrievedSeries.samples {
 		if v.value != value+float64(i) {
@@ -76,20 +84,153 @@ func Test_xor_read(t *testing.T) {
 	}
 
 	for i, ts := range retrievedSeries.samples {
-		if ts.timestamp != timestamp+uint64(i*30) {
-			t.Errorf("Timestamp %d not equal to expected value of %d", ts.timestamp, timestamp+uint64(i*30))
+		if ts.timestamp != timestamp+int64(i*30) {
+			t.Errorf("Timestamp %d not equal to expected value of %d", ts.timestamp, timestamp+int64(i*30))
 		}
 	}
 }
-func Test_xor_compact(t *testing.T) {
-	appender := xorAppender{
-		b: bstream{stream: make([]byte, 2)},
+func Test_xor_roundTrip(t *testing.T) {
+	appender := NewAppender()
+
+	// Negative timestamps, sub-second deltas and shrinking deltas
+	timestamps := []int64{-1500, -1250, -1000, 0, 15, 16, 1017, 1018, 5000, 5001}
+	values := []float64{0, -1.5, 1e300, math.NaN(), 3.14159, 3.14159, -0.000001, math.Inf(1), 42, 1 << 53}
+
+	for i := range timestamps {
+		appender.Append(timestamps[i], values[i])
+	}
+
+	reader := NewXorReader(appender.Series())
+	series, err := reader.readSeries()
+	if err != nil {
+		t.Fatalf("Failed to read the series: %v", err)
+	}
+	samples := series.samples
+
+	if len(samples) != len(timestamps) {
+		t.Fatalf("Expected %d samples, got %d", len(timestamps), len(samples))
+	}
+
+	for i, s := range samples {
+		if s.timestamp != timestamps[i] {
+			t.Errorf("Timestamp %d not equal to expected value of %d", s.timestamp, timestamps[i])
+		}
+
+		if math.Float64bits(s.value) != math.Float64bits(values[i]) {
+			t.Errorf("Value %v not equal to expected value of %v", s.value, values[i])
+		}
+	}
+}
+
+func Test_xor_staleNaN(t *testing.T) {
+	appender := NewAppender()
+
+	values := []float64{1, math.Float64frombits(value.StaleNaN), math.NaN(), math.Float64frombits(value.StaleNaN), 2}
+	for i, v := range values {
+		appender.Append(int64(i)*15000, v)
+	}
+
+	series, err := NewXorReader(appender.Series()).readSeries()
+	if err != nil {
+		t.Fatalf("Failed to read the series: %v", err)
+	}
+
+	for i, s := range series.samples {
+		if math.Float64bits(s.value) != math.Float64bits(values[i]) {
+			t.Errorf("Sample %d: expected bits %x, got %x", i, math.Float64bits(values[i]), math.Float64bits(s.value))
+		}
+
+		if s.isStale() != value.IsStaleNaN(values[i]) {
+			t.Errorf("Sample %d: stale marker not kept apart from NaN", i)
+		}
+	}
+}
+
+func Test_xor_manySamples(t *testing.T) {
+	appender := NewAppender()
+
+	for i := range 70000 {
+		appender.Append(int64(i)*15000, float64(i))
+	}
+
+	if appender.SamplesNum() != 70000 {
+		t.Fatalf("Expected 70000 samples in the header, got %d", appender.SamplesNum())
+	}
+
+	reader := NewXorReader(appender.Series())
+	series, err := reader.readSeries()
+	if err != nil {
+		t.Fatalf("Failed to read the series: %v", err)
+	}
+
+	if len(series.samples) != 70000 {
+		t.Errorf("Expected 70000 samples, got %d", len(series.samples))
+	}
+}
+
+func Test_xor_longGap(t *testing.T) {
+	appender := NewAppender()
+
+	// Delta of delta which doesn't fit into 32 bits
+	timestamps := []int64{0, 15000, 15000 + 1<<40, 30000 + 1<<40, 30001 + 1<<40}
+
+	for i, ts := range timestamps {
+		appender.Append(ts, float64(i))
 	}
 
+	reader := NewXorReader(appender.Series())
+	series, err := reader.readSeries()
+	if err != nil {
+		t.Fatalf("Failed to read the series: %v", err)
+	}
+
+	for i, s := range series.samples {
+		if s.timestamp != timestamps[i] {
+			t.Errorf("Timestamp %d not equal to expected value of %d", s.timestamp, timestamps[i])
+		}
+	}
+}
+
+func Test_xor_readCorrupt(t *testing.T) {
+	appender := NewAppender()
+	for i := range 10 {
+		appender.Append(int64(i)*15000, float64(i)*1.5)
+	}
+	stream := appender.Series()
+
+	wrongEncoding := slices.Clone(stream)
+	wrongEncoding[0] = 0
+
+	tooManySamples := slices.Clone(stream)
+	tooManySamples[chunkNumSamplesOffset+3] = 200
+
+	badMaxTime := slices.Clone(stream)
+	badMaxTime[chunkMaxTimeOffset+7]++
+
+	corruptChunks := map[string][]byte{
+		"empty":            {},
+		"header only":      stream[:chunkHeaderSize-1],
+		"truncated":        stream[:len(stream)-3],
+		"wrong encoding":   wrongEncoding,
+		"too many samples": tooManySamples,
+		"bad max time":     badMaxTime,
+	}
+
+	for name, chunk := range corruptChunks {
+		reader := NewXorReader(chunk)
+		if _, err := reader.readSeries(); !errors.Is(err, ErrInvalidChunk) {
+			t.Errorf("%s: expected ErrInvalidChunk, got: %v", name, err)
+		}
+	}
+}
+
+func Test_xor_compact(t *testing.T) {
+	appender := NewAppender()
+
 	// 27th of April 2025, 12:10:10, 10ns, UTC
-	// 1745755810
+	// 1745755810000
 	date := time.Date(2025, time.April, 27, 12, 10, 10, 10, time.UTC)
-	timestamp := uint64(date.Unix())
+	timestamp := date.UnixMilli()
 	value := 2.75231
 
 	appender.Append(timestamp, value)
@@ -0,0 +1,18 @@
+package value
+
+import "math"
+
+const (
+	// NormalNaN is the NaN returned by math.NaN().
+	NormalNaN uint64 = 0x7ff8000000000001
+
+	// StaleNaN is a signaling NaN, it marks that a series stopped being
+	// exposed. It's a distinct bit pattern, so it can't be confused with a
+	// NaN exposed by a target.
+	StaleNaN uint64 = 0x7ff0000000000002
+)
+
+// IsStaleNaN returns true if v is a stale marker, a plain NaN isn't one.
+func IsStaleNaN(v float64) bool {
+	return math.Float64bits(v) == StaleNaN
+}
@@ -0,0 +1,22 @@
+package value
+
+import (
+	"math"
+	"testing"
+)
+
+func Test_value_isStaleNaN(t *testing.T) {
+	if !IsStaleNaN(math.Float64frombits(StaleNaN)) {
+		t.Errorf("StaleNaN wasn't recognised as stale")
+	}
+
+	if math.Float64bits(math.NaN()) != NormalNaN {
+		t.Errorf("NormalNaN doesn't match math.NaN()")
+	}
+
+	for _, v := range []float64{math.NaN(), 0, math.Inf(1), 1.5} {
+		if IsStaleNaN(v) {
+			t.Errorf("%v shouldn't be a stale marker", v)
+		}
+	}
+}
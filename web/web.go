@@ -0,0 +1,87 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Handler serves the HTTP API. For now it's the lifecycle endpoints.
+type Handler struct {
+	listenAddress string
+	mux           *http.ServeMux
+	reloadCh      chan chan error
+}
+
+func New(listenAddress string) *Handler {
+	h := &Handler{
+		listenAddress: listenAddress,
+		mux:           http.NewServeMux(),
+		reloadCh:      make(chan chan error),
+	}
+
+	h.mux.HandleFunc("GET /-/healthy", h.healthy)
+	h.mux.HandleFunc("POST /-/reload", h.reload)
+	h.mux.HandleFunc("PUT /-/reload", h.reload)
+
+	return h
+}
+
+// Reload is where the reload requests come from. The requester waits for the
+// result on the channel it sends.
+func (h *Handler) Reload() <-chan chan error {
+	return h.reloadCh
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Run serves until the context is done.
+func (h *Handler) Run(ctx context.Context) error {
+	server := &http.Server{
+		Addr:    h.listenAddress,
+		Handler: h,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			return err
+		}
+		if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+}
+
+func (h *Handler) healthy(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "Scratcheus is Healthy.")
+}
+
+func (h *Handler) reload(w http.ResponseWriter, r *http.Request) {
+	rc := make(chan error)
+
+	select {
+	case h.reloadCh <- rc:
+	case <-r.Context().Done():
+		return
+	}
+
+	if err := <-rc; err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+	}
+}
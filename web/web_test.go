@@ -0,0 +1,63 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_handler_reload(t *testing.T) {
+	h := New("")
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	results := []error{nil, errors.New("bad config")}
+	go func() {
+		for _, err := range results {
+			rc := <-h.Reload()
+			rc <- err
+		}
+	}()
+
+	resp, err := http.Post(server.URL+"/-/reload", "", nil)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(server.URL+"/-/reload", "", nil)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for a failed reload, got %d", resp.StatusCode)
+	}
+}
+
+func Test_handler_reloadMethod(t *testing.T) {
+	h := New("")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", rec.Code)
+	}
+}
+
+func Test_handler_healthy(t *testing.T) {
+	h := New("")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/healthy", nil))
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Healthy") {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+}